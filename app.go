@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"hunddb/lsm"
+	"hunddb/lsm/block_manager"
 	"hunddb/lsm/sstable"
+	"hunddb/lsm/wal"
 	model "hunddb/model/record"
 	"hunddb/probabilistic/count_min_sketch"
 	"hunddb/probabilistic/hyperloglog"
@@ -33,14 +35,29 @@ type App struct {
 }
 
 // NewApp creates a new App application struct and loads the LSM instance
-func NewApp() *App {
-	lsmInstance := lsm.LoadLSM()
+func NewApp() (*App, error) {
+	// Move files still sealed with a retired key to the active one before anything reads them,
+	// so old keys can be dropped from the config after a restart
+	_, err := block_manager.GetBlockManager().RewriteFiles(
+		"*.db",
+		filepath.Join(wal.LOGS_PATH, "*.log"),
+		token_bucket.FILEPATH,
+		filepath.Join("probabilistic", "*.db"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt files: %w", err)
+	}
+
+	lsmInstance, err := lsm.LoadLSM()
+	if err != nil {
+		return nil, err
+	}
 	tokenBucketInstance := token_bucket.NewTokenBucket()
 
 	return &App{
 		lsm:         lsmInstance,
 		tokenBucket: tokenBucketInstance,
-	}
+	}, nil
 }
 
 // startup is called when the app starts up
@@ -252,11 +269,110 @@ func (a *App) GetSSTableStats() map[string]interface{} {
 		}
 	}
 
+	// Properties of every table, keyed by its index; tables written before properties have none
+	tables := make(map[string]interface{}, totalSSTables)
+	totalRecords, totalTombstones := uint64(0), uint64(0)
+	for level, indexes := range levels {
+		for _, index := range indexes {
+			table := map[string]interface{}{"level": level}
+			properties, err := sstable.GetProperties(index)
+			if err != nil {
+				table["error"] = err.Error()
+			} else if properties != nil {
+				table["properties"] = map[string]interface{}{
+					"recordCount":      properties.RecordCount,
+					"tombstoneCount":   properties.TombstoneCount,
+					"tombstoneRatio":   properties.TombstoneRatio(),
+					"rawKeyBytes":      properties.RawKeyBytes,
+					"rawValueBytes":    properties.RawValueBytes,
+					"minTimestamp":     properties.MinTimestamp,
+					"maxTimestamp":     properties.MaxTimestamp,
+					"creationReason":   properties.CreationReason.String(),
+					"sourceLevel":      properties.SourceLevel,
+					"inputTables":      properties.InputTables,
+					"formatVersion":    properties.FormatVersion,
+					"keyDictionary":    properties.KeyDictionary,
+					"blockCompression": properties.BlockCompression,
+					"filterPolicy":     properties.FilterPolicy,
+				}
+				totalRecords += properties.RecordCount
+				totalTombstones += properties.TombstoneCount
+			}
+			tables[fmt.Sprint(index)] = table
+		}
+	}
+
 	return map[string]interface{}{
 		"totalLevels":       len(levels),
 		"totalSSTables":     totalSSTables,
 		"maxTablesPerLevel": maxTablesPerLevel,
 		"levelDetails":      levels,
+		"totalRecords":      totalRecords,
+		"totalTombstones":   totalTombstones,
+		"tables":            tables,
+	}
+}
+
+// GetMemtableStats returns the memtables in memory and their flushes
+func (a *App) GetMemtableStats() map[string]interface{} {
+	stats := a.lsm.MemtableStats()
+
+	return map[string]interface{}{
+		"mutableEntries":   stats.MutableEntries,
+		"mutableBytes":     stats.MutableBytes,
+		"immutableCount":   stats.ImmutableCount,
+		"immutableBytes":   stats.ImmutableBytes,
+		"maxImmutable":     stats.MaxImmutable,
+		"flushesCompleted": stats.FlushesCompleted,
+		"flushRetries":     stats.FlushRetries,
+		"flushesFailed":    stats.FlushesFailed,
+	}
+}
+
+// Flush writes the memtables out as level 0 SSTables; with wait it returns once they are committed and persisted
+func (a *App) Flush(wait bool) error {
+	return a.lsm.Flush(wait)
+}
+
+// CompactRange merges every SSTable holding keys in [start, end] into the bottom level, empty bounds leave the range open
+func (a *App) CompactRange(start string, end string) error {
+	return a.lsm.CompactRange(start, end)
+}
+
+// IngestExternalFile links an SSTable built offline by sstable.Writer into the tree
+func (a *App) IngestExternalFile(path string) error {
+	return a.lsm.IngestExternalFile(path)
+}
+
+// GetBackgroundError returns the flush error that stopped writes, or an empty string while writes are accepted
+func (a *App) GetBackgroundError() string {
+	if err := a.lsm.BackgroundError(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// ResumeWrites clears the background error and retries the failed flushes
+func (a *App) ResumeWrites() {
+	a.lsm.Resume()
+}
+
+// GetWriteStallStats returns whether writes are currently throttled, why, and how often they were
+func (a *App) GetWriteStallStats() map[string]interface{} {
+	stats := a.lsm.WriteStallStats()
+
+	return map[string]interface{}{
+		"condition":              stats.Condition,
+		"cause":                  stats.Cause,
+		"level0Tables":           stats.Level0Tables,
+		"pendingFlushBytes":      stats.PendingFlushBytes,
+		"pendingCompactionBytes": stats.PendingCompactionBytes,
+		"delayedWrites":          stats.DelayedWrites,
+		"delayTimeMs":            stats.DelayTime.Milliseconds(),
+		"stoppedWrites":          stats.StoppedWrites,
+		"stopTimeMs":             stats.StopTime.Milliseconds(),
+		"stopsByCause":           stats.StopsByCause,
+		"stalledWriters":         stats.StalledWriters,
 	}
 }
 
@@ -80,6 +80,11 @@ const configSchema = yup.object().shape({
       .min(1, "Minimum capacity is 1")
       .max(10000, "Maximum capacity is 10000")
       .required("Read path capacity is required"),
+    table_cache_capacity: yup
+      .number()
+      .min(0, "Minimum capacity is 0")
+      .max(10000, "Maximum capacity is 10000")
+      .required("Table cache capacity is required"),
   }),
   wal: yup.object().shape({
     log_size: yup
@@ -100,6 +105,29 @@ const configSchema = yup.object().shape({
       .min(1, "Minimum step index is 1")
       .max(1000, "Maximum step index is 1000")
       .required("Sparse step index is required"),
+    format_version: yup
+      .number()
+      .oneOf([1, 2], "Unknown format version")
+      .required("Format version is required"),
+    data_block_size: yup
+      .number()
+      .min(64, "Minimum data block size is 64")
+      .required("Data block size is required"),
+    block_restart_interval: yup
+      .number()
+      .min(1, "Minimum restart interval is 1")
+      .required("Block restart interval is required"),
+    mmap_reads: yup
+      .boolean()
+      .required("Mmap reads setting is required"),
+    index_partition_size: yup
+      .number()
+      .test(
+        "partition-size",
+        "Index partition size must be 0 or at least 64",
+        (value) => value === 0 || value >= 64
+      )
+      .required("Index partition size is required"),
   }),
   memtable: yup.object().shape({
     capacity: yup
@@ -116,6 +144,30 @@ const configSchema = yup.object().shape({
       .number()
       .oneOf([0.01, 0.05, 0.1, 0.2], "Invalid false positive rate")
       .required("False positive rate is required"),
+    policy: yup
+      .string()
+      .oneOf(["bloom", "blocked_bloom", "xor"], "Invalid filter policy")
+      .required("Filter policy is required"),
+    bottom_level_policy: yup
+      .string()
+      .oneOf(["bloom", "blocked_bloom", "xor"], "Invalid filter policy")
+      .required("Bottom level filter policy is required"),
+    bottom_level_false_positive_rate: yup
+      .number()
+      .oneOf([0.0001, 0.001, 0.01], "Invalid false positive rate")
+      .required("Bottom level false positive rate is required"),
+    prefix_extractor: yup
+      .string()
+      .oneOf(["fixed", "delimiter", "none"], "Invalid prefix extractor")
+      .required("Prefix extractor is required"),
+    prefix_length: yup
+      .number()
+      .min(1, "Minimum prefix length is 1")
+      .required("Prefix length is required"),
+    prefix_delimiter: yup
+      .string()
+      .length(1, "Prefix delimiter must be a single character")
+      .required("Prefix delimiter is required"),
   }),
   block_manager: yup.object().shape({
     block_size: yup
@@ -162,6 +214,11 @@ const memtableTypeOptions = [
   { value: "hashmap", label: "HashMap" },
 ];
 
+const formatVersionOptions = [
+  { value: 1, label: "1 - Record per index entry" },
+  { value: 2, label: "2 - Prefix-compressed data blocks" },
+];
+
 const booleanOptions = [
   { value: true, label: "Enabled" },
   { value: false, label: "Disabled" },
@@ -181,6 +238,24 @@ const falsePositiveRateOptions = [
   { value: 0.2, label: "20% (0.2) - Memory efficient" },
 ];
 
+const filterPolicyOptions = [
+  { value: "blocked_bloom", label: "Blocked Bloom - One cache line per lookup" },
+  { value: "xor", label: "Xor - Smallest for low rates" },
+  { value: "bloom", label: "Bloom - Classic" },
+];
+
+const prefixExtractorOptions = [
+  { value: "fixed", label: "Fixed - The first length bytes" },
+  { value: "delimiter", label: "Delimiter - Up to the delimiter" },
+  { value: "none", label: "None - Point lookups only" },
+];
+
+const bottomLevelFalsePositiveRateOptions = [
+  { value: 0.0001, label: "0.01% (0.0001) - Highest precision" },
+  { value: 0.001, label: "0.1% (0.001) - High precision" },
+  { value: 0.01, label: "1% (0.01) - Same as upper levels" },
+];
+
 export const Config = () => {
   const [loading, setLoading] = useState(true);
   const [saving, setSaving] = useState(false);
@@ -528,6 +603,18 @@ export const Config = () => {
               min={1}
               disabled={isConfigLocked}
             />
+            <ConfigInput
+              label="Table Cache Capacity"
+              name="cache.table_cache_capacity"
+              type="number"
+              register={register}
+              setValue={setValue}
+              watch={watch}
+              error={errors.cache?.table_cache_capacity}
+              description="SSTables whose config, Bloom filter and key bounds stay in memory (0 disables)"
+              min={0}
+              disabled={isConfigLocked}
+            />
           </ConfigSection>
 
           {/* WAL Configuration */}
@@ -588,7 +675,60 @@ export const Config = () => {
                 description="Sparse index step size"
                 min={1}
                 disabled={isConfigLocked}
-                className="md:col-span-2"
+              />
+              <ConfigSelect
+                label="Format Version"
+                name="sstable.format_version"
+                options={formatVersionOptions}
+                setValue={setValue}
+                watch={watch}
+                error={errors.sstable?.format_version}
+                disabled={isConfigLocked}
+              />
+              <ConfigInput
+                label="Data Block Size"
+                name="sstable.data_block_size"
+                type="number"
+                register={register}
+                setValue={setValue}
+                watch={watch}
+                error={errors.sstable?.data_block_size}
+                description="Bytes of records per data block (format 2)"
+                min={64}
+                disabled={isConfigLocked}
+              />
+              <ConfigInput
+                label="Block Restart Interval"
+                name="sstable.block_restart_interval"
+                type="number"
+                register={register}
+                setValue={setValue}
+                watch={watch}
+                error={errors.sstable?.block_restart_interval}
+                description="Every Nth key of a data block is stored whole (format 2)"
+                min={1}
+                disabled={isConfigLocked}
+              />
+              <ConfigSelect
+                label="Mmap Reads"
+                name="sstable.mmap_reads"
+                options={booleanOptions}
+                setValue={setValue}
+                watch={watch}
+                error={errors.sstable?.mmap_reads}
+                disabled={isConfigLocked}
+              />
+              <ConfigInput
+                label="Index Partition Size"
+                name="sstable.index_partition_size"
+                type="number"
+                register={register}
+                setValue={setValue}
+                watch={watch}
+                error={errors.sstable?.index_partition_size}
+                description="Bytes of block index per partition in bottom level tables, 0 keeps it whole"
+                min={0}
+                disabled={isConfigLocked}
               />
             </div>
           </ConfigSection>
@@ -642,6 +782,70 @@ export const Config = () => {
               description="Choose the balance between precision and performance"
               disabled={isConfigLocked}
             />
+            <div className="grid grid-cols-1 md:grid-cols-2 gap-6 mt-6">
+              <ConfigSelect
+                label="Filter Policy"
+                name="bloom_filter.policy"
+                options={filterPolicyOptions}
+                setValue={setValue}
+                watch={watch}
+                error={errors.bloom_filter?.policy}
+                description="Filter of tables in the upper levels"
+                disabled={isConfigLocked}
+              />
+              <ConfigSelect
+                label="Bottom Level Filter Policy"
+                name="bloom_filter.bottom_level_policy"
+                options={filterPolicyOptions}
+                setValue={setValue}
+                watch={watch}
+                error={errors.bloom_filter?.bottom_level_policy}
+                description="Filter of tables in the bottom level"
+                disabled={isConfigLocked}
+              />
+              <ConfigSelect
+                label="Bottom Level False Positive Rate"
+                name="bloom_filter.bottom_level_false_positive_rate"
+                options={bottomLevelFalsePositiveRateOptions}
+                setValue={setValue}
+                watch={watch}
+                error={errors.bloom_filter?.bottom_level_false_positive_rate}
+                description="Most data lives in the bottom level, a lower rate pays off there"
+                disabled={isConfigLocked}
+              />
+              <ConfigSelect
+                label="Prefix Extractor"
+                name="bloom_filter.prefix_extractor"
+                options={prefixExtractorOptions}
+                setValue={setValue}
+                watch={watch}
+                error={errors.bloom_filter?.prefix_extractor}
+                description="Key prefixes the filters hold to skip tables in prefix scans"
+                disabled={isConfigLocked}
+              />
+              <ConfigInput
+                label="Prefix Length"
+                name="bloom_filter.prefix_length"
+                type="number"
+                register={register}
+                setValue={setValue}
+                watch={watch}
+                error={errors.bloom_filter?.prefix_length}
+                description="Prefix length of the fixed extractor"
+                min={1}
+                disabled={isConfigLocked}
+              />
+              <ConfigInput
+                label="Prefix Delimiter"
+                name="bloom_filter.prefix_delimiter"
+                register={register}
+                setValue={setValue}
+                watch={watch}
+                error={errors.bloom_filter?.prefix_delimiter}
+                description="Prefixes of the delimiter extractor end with it, like / or :"
+                disabled={isConfigLocked}
+              />
+            </div>
           </ConfigSection>
 
           {/* Block Manager Configuration */}
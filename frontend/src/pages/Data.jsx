@@ -1,5 +1,5 @@
 import React, { useEffect, useState } from "react";
-import { GetSSTableLevels, GetSSTableStats, CheckSSTableIntegrity } from "@wails/main/App.js";
+import { GetSSTableLevels, GetSSTableStats, CheckSSTableIntegrity, GetBackgroundError, ResumeWrites, Flush, CompactRange, IngestExternalFile } from "@wails/main/App.js";
 
 // Background decorations matching Home page
 const BgDecorations = () => (
@@ -27,6 +27,12 @@ export const Data = () => {
   const [sstableStats, setSstableStats] = useState({});
   const [isLoading, setIsLoading] = useState(true);
   const [error, setError] = useState(null);
+  const [backgroundError, setBackgroundError] = useState("");
+  const [rangeStart, setRangeStart] = useState("");
+  const [rangeEnd, setRangeEnd] = useState("");
+  const [ingestPath, setIngestPath] = useState("");
+  const [maintenanceRunning, setMaintenanceRunning] = useState(false);
+  const [maintenanceMessage, setMaintenanceMessage] = useState(null);
   const [showIntegrityModal, setShowIntegrityModal] = useState(false);
   const [selectedSSTable, setSelectedSSTable] = useState(null);
   const [integrityResults, setIntegrityResults] = useState([]);
@@ -45,9 +51,10 @@ export const Data = () => {
       setIsLoading(true);
       
       // Fetch both levels and stats from the real backend
-      const [levels, stats] = await Promise.all([
+      const [levels, stats, bgError] = await Promise.all([
         GetSSTableLevels(),
-        GetSSTableStats()
+        GetSSTableStats(),
+        GetBackgroundError()
       ]);
       
       // Filter out empty levels for display (levels might be null arrays)
@@ -55,6 +62,7 @@ export const Data = () => {
       
       setSstableLevels(nonEmptyLevels);
       setSstableStats(stats);
+      setBackgroundError(bgError || "");
       setError(null);
     } catch (err) {
       console.error("Failed to fetch SSTable levels:", err);
@@ -64,6 +72,43 @@ export const Data = () => {
     }
   };
 
+  const handleResumeWrites = async () => {
+    try {
+      await ResumeWrites();
+    } catch (err) {
+      console.error("Failed to resume writes:", err);
+    }
+    fetchSSTableLevels();
+  };
+
+  // Runs a manual Flush, CompactRange or ingestion, then reloads the levels to show its outcome
+  const runMaintenance = async (operation, successMessage) => {
+    setMaintenanceRunning(true);
+    try {
+      await operation();
+      setMaintenanceMessage({ ok: true, text: successMessage });
+    } catch (err) {
+      console.error("Maintenance operation failed:", err);
+      setMaintenanceMessage({ ok: false, text: String(err) });
+    } finally {
+      setMaintenanceRunning(false);
+    }
+    fetchSSTableLevels();
+  };
+
+  const handleFlush = () => runMaintenance(() => Flush(true), "Memtables flushed to level 0");
+
+  const handleCompactRange = () =>
+    runMaintenance(
+      () => CompactRange(rangeStart, rangeEnd),
+      rangeStart || rangeEnd
+        ? `Compacted [${rangeStart || "…"}, ${rangeEnd || "…"}] to the bottom level`
+        : "Compacted every SSTable to the bottom level"
+    );
+
+  const handleIngest = () =>
+    runMaintenance(() => IngestExternalFile(ingestPath), `Ingested ${ingestPath}`);
+
   const getTotalSSTables = () => {
     return sstableStats.totalSSTables || sstableLevels.reduce((sum, level) => sum + level.length, 0);
   };
@@ -150,6 +195,20 @@ export const Data = () => {
         <div className="grid lg:grid-cols-3 gap-8 !mt-0 sm:!mt-3">
           {/* Main Content */}
           <div className="lg:col-span-2 space-y-6">
+            {/* Background Error Banner */}
+            {!isLoading && backgroundError && (
+              <div className="bg-red-100 rounded-xl p-6 border-4 border-red-400 shadow-[6px_6px_0px_0px_rgba(220,38,38,1)]">
+                <p className="text-xl font-bold text-red-700">⚠️ Writes are stopped</p>
+                <p className="text-red-700 mt-1 break-words">{backgroundError}</p>
+                <button
+                  onClick={handleResumeWrites}
+                  className="mt-4 px-6 py-3 bg-sloth-brown text-sloth-yellow font-bold rounded-lg border-4 border-sloth-brown-dark shadow-[4px_4px_0px_0px_rgba(0,0,0,1)] hover:shadow-[6px_6px_0px_0px_rgba(0,0,0,1)] active:shadow-none active:translate-x-[4px] active:translate-y-[4px] transition-all duration-200"
+                >
+                  🔄 Resume Writes
+                </button>
+              </div>
+            )}
+
             {/* Stats Panel */}
             {!isLoading && !error && (
               <div className="bg-sloth-yellow rounded-xl p-6 border-4 border-sloth-brown shadow-[6px_6px_0px_0px_rgba(107,94,74,1)] relative overflow-hidden">
@@ -293,6 +352,62 @@ export const Data = () => {
               </button>
             </div>
 
+            {/* Maintenance Panel */}
+            <div className="bg-sloth-yellow rounded-xl p-6 border-4 border-sloth-brown shadow-[6px_6px_0px_0px_rgba(107,94,74,1)] space-y-4">
+              <h3 className="text-xl font-bold text-sloth-brown-dark">🧹 Maintenance</h3>
+              <button
+                onClick={handleFlush}
+                disabled={maintenanceRunning}
+                className="w-full px-6 py-3 bg-sloth-brown text-sloth-yellow font-bold rounded-lg border-4 border-sloth-brown-dark shadow-[4px_4px_0px_0px_rgba(0,0,0,1)] hover:shadow-[6px_6px_0px_0px_rgba(0,0,0,1)] active:shadow-none active:translate-x-[4px] active:translate-y-[4px] transition-all duration-200 disabled:opacity-50 disabled:cursor-not-allowed"
+              >
+                Flush Memtables
+              </button>
+              <div className="space-y-2">
+                <input
+                  type="text"
+                  value={rangeStart}
+                  onChange={(e) => setRangeStart(e.target.value)}
+                  placeholder="Range start (empty = first key)"
+                  className="w-full px-3 py-2 rounded-lg border-3 border-sloth-brown bg-sloth-yellow-lite text-sloth-brown-dark"
+                />
+                <input
+                  type="text"
+                  value={rangeEnd}
+                  onChange={(e) => setRangeEnd(e.target.value)}
+                  placeholder="Range end (empty = last key)"
+                  className="w-full px-3 py-2 rounded-lg border-3 border-sloth-brown bg-sloth-yellow-lite text-sloth-brown-dark"
+                />
+                <button
+                  onClick={handleCompactRange}
+                  disabled={maintenanceRunning}
+                  className="w-full px-6 py-3 bg-sloth-brown text-sloth-yellow font-bold rounded-lg border-4 border-sloth-brown-dark shadow-[4px_4px_0px_0px_rgba(0,0,0,1)] hover:shadow-[6px_6px_0px_0px_rgba(0,0,0,1)] active:shadow-none active:translate-x-[4px] active:translate-y-[4px] transition-all duration-200 disabled:opacity-50 disabled:cursor-not-allowed"
+                >
+                  {maintenanceRunning ? "Working..." : "Compact Range"}
+                </button>
+              </div>
+              <div className="space-y-2">
+                <input
+                  type="text"
+                  value={ingestPath}
+                  onChange={(e) => setIngestPath(e.target.value)}
+                  placeholder="Path of an SSTable built offline"
+                  className="w-full px-3 py-2 rounded-lg border-3 border-sloth-brown bg-sloth-yellow-lite text-sloth-brown-dark"
+                />
+                <button
+                  onClick={handleIngest}
+                  disabled={maintenanceRunning || !ingestPath}
+                  className="w-full px-6 py-3 bg-sloth-brown text-sloth-yellow font-bold rounded-lg border-4 border-sloth-brown-dark shadow-[4px_4px_0px_0px_rgba(0,0,0,1)] hover:shadow-[6px_6px_0px_0px_rgba(0,0,0,1)] active:shadow-none active:translate-x-[4px] active:translate-y-[4px] transition-all duration-200 disabled:opacity-50 disabled:cursor-not-allowed"
+                >
+                  {maintenanceRunning ? "Working..." : "Ingest SSTable"}
+                </button>
+              </div>
+              {maintenanceMessage && (
+                <p className={`text-sm font-bold break-words ${maintenanceMessage.ok ? "text-green-700" : "text-red-700"}`}>
+                  {maintenanceMessage.text}
+                </p>
+              )}
+            </div>
+
             {/* Info Panel */}
             <div className="bg-sloth-yellow rounded-xl p-6 border-4 border-sloth-brown shadow-[6px_6px_0px_0px_rgba(107,94,74,1)]">
               <h3 className="text-xl font-bold text-sloth-brown-dark mb-4 flex items-center gap-2">
@@ -427,6 +542,23 @@ export const Data = () => {
                   <p className="text-sm text-sloth-brown">
                     Level {selectedSSTable.level}
                   </p>
+                  {sstableStats.tables?.[selectedSSTable.index]?.properties && (() => {
+                    const properties = sstableStats.tables[selectedSSTable.index].properties;
+                    return (
+                      <div className="text-left text-xs text-sloth-brown-dark mt-3 space-y-1">
+                        <p>📦 {properties.recordCount} records, {properties.tombstoneCount} tombstones ({(properties.tombstoneRatio * 100).toFixed(1)}%)</p>
+                        <p>📏 {properties.rawKeyBytes} key bytes, {properties.rawValueBytes} value bytes</p>
+                        <p>🕒 Timestamps {properties.minTimestamp} – {properties.maxTimestamp}</p>
+                        <p>
+                          🛠️ Written by {properties.creationReason}
+                          {properties.creationReason === "compaction" &&
+                            ` of level ${properties.sourceLevel} (tables ${(properties.inputTables || []).join(", ")})`}
+                        </p>
+                        <p>🗜️ Format {properties.formatVersion}, {properties.blockCompression} blocks{properties.keyDictionary ? ", dictionary keys" : ""}</p>
+                        {properties.filterPolicy && <p>🔎 {properties.filterPolicy} filter</p>}
+                      </div>
+                    );
+                  })()}
                 </div>
               )}
               
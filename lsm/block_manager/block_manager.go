@@ -2,13 +2,16 @@ package block_manager
 
 import (
 	"errors"
+	"fmt"
 	lru_cache "hunddb/lsm/lru_cache"
 	block_location "hunddb/model/block_location"
 	"hunddb/utils/config"
 	crc_util "hunddb/utils/crc"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -35,6 +38,15 @@ type BlockManager struct {
 	blockSize   uint16 // in bytes
 	blockCache  *lru_cache.LRUCache[block_location.BlockLocation, []byte]
 	fileMutexes sync.Map
+	encryption  atomic.Pointer[encryptionState] // nil when encryption at rest is disabled
+}
+
+// encryptionState is the keyring in use, replaced as a whole by SetKeyring.
+type encryptionState struct {
+	keyring *Keyring // nil when encryption at rest is disabled
+	// Set when encryption is enabled but the configured keys are invalid. Every read and write fails
+	// with it, so blocks are never written in plaintext when encryption was asked for
+	err error
 }
 
 // GetBlockManager returns the singleton instance
@@ -46,10 +58,102 @@ func GetBlockManager() *BlockManager {
 			blockSize:  uint16(cfg.BlockManager.BlockSize),
 			blockCache: lru_cache.NewLRUCache[block_location.BlockLocation, []byte](uint32(cfg.BlockManager.CacheSize)),
 		}
+		if cfg.Encryption.Enabled {
+			keyring, err := NewKeyringFromHex(cfg.Encryption.Keys, cfg.Encryption.ActiveKeyID)
+			if err != nil {
+				err = fmt.Errorf("invalid encryption configuration: %w", err)
+			}
+			instance.encryption.Store(&encryptionState{keyring: keyring, err: err})
+		}
 	})
 	return instance
 }
 
+/*
+SetKeyring replaces the keyring used to encrypt blocks, nil disables encryption.
+Encrypted and plaintext blocks have different sizes on disk, so this must be set before
+any data is written - switching an existing database between the two is not supported.
+Rotating keys is done by passing a keyring with a new active key that still holds the old ones.
+The keyring replaces the configured one, an invalid encryption configuration included.
+Safe to call while blocks are read and written, each operation uses the keyring it started with.
+*/
+func (bm *BlockManager) SetKeyring(keyring *Keyring) {
+	bm.encryption.Store(&encryptionState{keyring: keyring})
+	bm.ClearCache()
+}
+
+// ConfigError returns why the configured encryption keys couldn't be used, nil if they are valid or encryption is disabled.
+func (bm *BlockManager) ConfigError() error {
+	_, err := bm.keyring()
+	return err
+}
+
+// keyring returns the keyring blocks are encrypted with, nil when encryption is disabled,
+// or the error of an invalid encryption configuration.
+func (bm *BlockManager) keyring() (*Keyring, error) {
+	state := bm.encryption.Load()
+	if state == nil {
+		return nil, nil
+	}
+	return state.keyring, state.err
+}
+
+// ClearCache drops every cached block, e.g. after files were removed or replaced behind the block manager's back.
+func (bm *BlockManager) ClearCache() {
+	bm.blockCache.Clear()
+}
+
+// physicalBlockSize returns the size a block takes on disk, including the encryption overhead.
+func (bm *BlockManager) physicalBlockSize(keyring *Keyring) int64 {
+	if keyring != nil {
+		return int64(bm.blockSize) + ENCRYPTION_OVERHEAD
+	}
+	return int64(bm.blockSize)
+}
+
+// headerSize returns the size of the header in front of the first block, see fileHeader.
+func (bm *BlockManager) headerSize(keyring *Keyring) int64 {
+	if keyring != nil {
+		return FILE_HEADER_SIZE
+	}
+	return 0
+}
+
+// blockOffset returns the offset a block starts at on disk.
+func (bm *BlockManager) blockOffset(keyring *Keyring, blockIndex uint64) int64 {
+	return bm.headerSize(keyring) + int64(blockIndex)*bm.physicalBlockSize(keyring)
+}
+
+/*
+fileHeader returns the header of an encrypted file. A file without a header holds no written blocks yet,
+with create set it gets a new header naming the active key, otherwise nil is returned.
+*/
+func (bm *BlockManager) fileHeader(file *os.File, keyring *Keyring, create bool) (*fileHeader, error) {
+	data := make([]byte, FILE_HEADER_SIZE)
+	n, err := file.ReadAt(data, 0)
+	if n == FILE_HEADER_SIZE {
+		return deserializeFileHeader(data), nil
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, fmt.Errorf("file header of %s is truncated", file.Name())
+	}
+	if !create {
+		return nil, nil
+	}
+
+	header, err := keyring.newFileHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.WriteAt(header.serialize(), 0); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
 // getFileMutex retrieves or creates a RWMutex for a given file path.
 func (bm *BlockManager) getFileMutex(filePath string) *sync.RWMutex {
 	if mutex, exists := bm.fileMutexes.Load(filePath); exists {
@@ -90,7 +194,7 @@ func (bm *BlockManager) ReadBlock(location block_location.BlockLocation) ([]byte
 
 	block, err := bm.readBlockFromDisk(location)
 	if err != nil {
-		return nil, errors.New("block not read successfully")
+		return nil, fmt.Errorf("block not read successfully: %w", err)
 	}
 
 	bm.blockCache.Put(location, block)
@@ -106,13 +210,195 @@ func (bm *BlockManager) WriteBlock(location block_location.BlockLocation, data [
 
 	err := bm.writeBlockToDisk(location, data)
 	if err != nil {
-		return errors.New("block not written successfully")
+		return fmt.Errorf("block not written successfully: %w", err)
 	}
 	bm.blockCache.Put(location, data)
 
 	return nil
 }
 
+// ReadBlockUncached reads a block straight from disk, bypassing the cache and leaving it untouched.
+// Meant for one-off scans (e.g. WAL recovery at startup) that should not evict hot blocks.
+func (bm *BlockManager) ReadBlockUncached(location block_location.BlockLocation) ([]byte, error) {
+	mutex := bm.getFileMutex(location.FilePath)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return bm.readBlockFromDisk(location)
+}
+
+// BlockCount returns the number of blocks the file holds, a partially written last block included.
+func (bm *BlockManager) BlockCount(filePath string) (uint64, error) {
+	keyring, err := bm.keyring()
+	if err != nil {
+		return 0, err
+	}
+	mutex := bm.getFileMutex(filePath)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	physicalSize := bm.physicalBlockSize(keyring)
+	blocksSize := max(info.Size()-bm.headerSize(keyring), 0)
+	return uint64((blocksSize + physicalSize - 1) / physicalSize), nil
+}
+
+// PreallocateFile creates the file with blockCount unwritten (zeroed) blocks, so that
+// writing them later never has to grow the file. Zeros are written explicitly,
+// truncating would only create a sparse file.
+func (bm *BlockManager) PreallocateFile(filePath string, blockCount uint64) error {
+	keyring, err := bm.keyring()
+	if err != nil {
+		return err
+	}
+	mutex := bm.getFileMutex(filePath)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if keyring != nil {
+		if _, err := bm.fileHeader(file, keyring, true); err != nil {
+			return err
+		}
+	}
+	if _, err := file.Seek(bm.headerSize(keyring), 0); err != nil {
+		return err
+	}
+	zeroBlock := make([]byte, bm.physicalBlockSize(keyring))
+	for i := uint64(0); i < blockCount; i++ {
+		if _, err := file.Write(zeroBlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+RewriteFile re-encrypts the file with the active key if it is sealed with another one, so the old key can be dropped.
+The file is rewritten into a copy that replaces it once complete, a crash midway leaves the original untouched.
+Returns the number of written blocks that were re-encrypted.
+*/
+func (bm *BlockManager) RewriteFile(filePath string) (uint64, error) {
+	keyring, err := bm.keyring()
+	if err != nil || keyring == nil {
+		return 0, err
+	}
+
+	mutex := bm.getFileMutex(filePath)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header, err := bm.fileHeader(file, keyring, false)
+	if err != nil || header == nil || header.keyID == keyring.ActiveKeyID() {
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	rewrittenHeader := &fileHeader{fileID: header.fileID, keyID: keyring.ActiveKeyID()}
+	data := rewrittenHeader.serialize()
+	rewritten := uint64(0)
+	physical := make([]byte, bm.physicalBlockSize(keyring))
+	for blockIndex := uint64(0); bm.blockOffset(keyring, blockIndex) < info.Size(); blockIndex++ {
+		clear(physical)
+		if _, err := file.ReadAt(physical, bm.blockOffset(keyring, blockIndex)); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if isUnwritten(physical) {
+			data = append(data, physical...)
+			continue
+		}
+		plain, err := keyring.open(physical, header, blockIndex, int(bm.blockSize))
+		if err != nil {
+			return 0, fmt.Errorf("block %d of %s: %w", blockIndex, filePath, err)
+		}
+		sealed, err := keyring.seal(plain, rewrittenHeader, blockIndex)
+		if err != nil {
+			return 0, err
+		}
+		data = append(data, sealed...)
+		rewritten++
+	}
+
+	tmpPath := filePath + ".rewrite"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return rewritten, nil
+}
+
+/*
+RewriteFiles calls RewriteFile for every file matching one of the glob patterns, e.g. at startup after a key rotation.
+Files without an encrypted file header, or whose header names a key not in the keyring, are left alone.
+Returns the number of files that were re-encrypted.
+*/
+func (bm *BlockManager) RewriteFiles(patterns ...string) (int, error) {
+	keyring, err := bm.keyring()
+	if err != nil || keyring == nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, path := range paths {
+			if !bm.sealedWithKnownKey(path, keyring) {
+				continue
+			}
+			blocks, err := bm.RewriteFile(path)
+			if err != nil {
+				return rewritten, fmt.Errorf("failed to re-encrypt %s: %w", path, err)
+			}
+			if blocks > 0 {
+				rewritten++
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+// sealedWithKnownKey reports whether the file is a regular file whose header names a key of the keyring.
+func (bm *BlockManager) sealedWithKnownKey(filePath string, keyring *Keyring) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	header, err := bm.fileHeader(file, keyring, false)
+	if err != nil || header == nil {
+		return false
+	}
+	_, err = keyring.cipher(header)
+	return err == nil
+}
+
 // GetBlockSize returns the current block size
 func (bm *BlockManager) GetBlockSize() uint16 {
 	return bm.blockSize
@@ -120,35 +406,68 @@ func (bm *BlockManager) GetBlockSize() uint16 {
 
 // Private helper method for ReadBlock
 func (bm *BlockManager) readBlockFromDisk(location block_location.BlockLocation) ([]byte, error) {
+	keyring, err := bm.keyring()
+	if err != nil {
+		return nil, err
+	}
 	file, err := os.Open(location.FilePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	offset := int64(location.BlockIndex) * int64(bm.blockSize)
+	offset := bm.blockOffset(keyring, location.BlockIndex)
 	_, err = file.Seek(offset, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	data := make([]byte, int(bm.blockSize))
+	data := make([]byte, bm.physicalBlockSize(keyring))
 	_, err = file.Read(data)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	if keyring != nil {
+		header, err := bm.fileHeader(file, keyring, false)
+		if err != nil {
+			return nil, err
+		}
+		if header == nil {
+			return make([]byte, bm.blockSize), nil // Nothing was written to the file yet
+		}
+		return keyring.open(data, header, location.BlockIndex, int(bm.blockSize))
+	}
 	return data, nil
 }
 
 // Private helper method for WriteBlock
 func (bm *BlockManager) writeBlockToDisk(location block_location.BlockLocation, data []byte) error {
+	keyring, err := bm.keyring()
+	if err != nil {
+		return err
+	}
 	file, err := os.OpenFile(location.FilePath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	offset := int64(location.BlockIndex) * int64(bm.blockSize)
+	if keyring != nil {
+		// Encrypted blocks always span a whole block so they can be read back at fixed offsets
+		if len(data) < int(bm.blockSize) {
+			data = append(data, make([]byte, int(bm.blockSize)-len(data))...)
+		}
+		header, err := bm.fileHeader(file, keyring, true)
+		if err != nil {
+			return err
+		}
+		data, err = keyring.seal(data, header, location.BlockIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	offset := bm.blockOffset(keyring, location.BlockIndex)
 	_, err = file.Seek(offset, 0)
 	if err != nil {
 		return err
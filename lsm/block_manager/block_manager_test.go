@@ -156,6 +156,30 @@ func TestBlockManager_MultipleBlocksInFile(t *testing.T) {
 	}
 }
 
+func TestBlockManager_BlockCount(t *testing.T) {
+	resetBlockManager()
+	bm := GetBlockManager()
+
+	tmpFile, cleanup := createTestFile(t, nil)
+	defer cleanup()
+
+	if count, err := bm.BlockCount(tmpFile); err != nil || count != 0 {
+		t.Fatalf("BlockCount of an empty file = %d, %v, want 0", count, err)
+	}
+	block := make([]byte, bm.GetBlockSize())
+	for _, index := range []uint64{0, 2} {
+		if err := bm.WriteBlock(block_location.BlockLocation{FilePath: tmpFile, BlockIndex: index}, block); err != nil {
+			t.Fatalf("Failed to write block %d: %v", index, err)
+		}
+	}
+	if count, err := bm.BlockCount(tmpFile); err != nil || count != 3 {
+		t.Errorf("BlockCount = %d, %v, want 3", count, err)
+	}
+	if _, err := bm.BlockCount(tmpFile + ".missing"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
 func TestBlockManager_CacheIntegration(t *testing.T) {
 	resetBlockManager()
 	bm := GetBlockManager()
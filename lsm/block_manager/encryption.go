@@ -0,0 +1,202 @@
+package block_manager
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+/*
+Encrypted file format on disk:
+
+	+--------------+------------+---------+---------+-----+
+	| FileID (12B) | KeyID (4B) | Block 0 | Block 1 | ... |
+	+--------------+------------+---------+---------+-----+
+
+	FileID = Random ID written when the file is created. It stays with the file when it is renamed
+	         (e.g. recycled WAL segments), so it identifies the file rather than its path
+	KeyID = ID of the key every block of the file is sealed with
+
+Encrypted block format on disk:
+
+	+-------------+------------------------------+-----------+
+	| Nonce (12B) | Ciphertext (BLOCK_SIZE)      | Tag (16B) |
+	+-------------+------------------------------+-----------+
+
+	Nonce = Random AES-GCM nonce, unique per write
+	Ciphertext = The logical block (including its CRC), encrypted with AES-GCM
+	Tag = AES-GCM authentication tag, also covering the file ID and block index
+
+A block of zeros was never written (e.g. preallocated) and reads as a zeroed block.
+Writes to an existing file keep using the key in its header, so a file is only ever sealed with one key.
+After a rotation new files get the new active key, and RewriteFile moves existing files over.
+*/
+
+const (
+	FILE_ID_SIZE     = 12
+	KEY_ID_SIZE      = 4
+	FILE_HEADER_SIZE = FILE_ID_SIZE + KEY_ID_SIZE
+	NONCE_SIZE       = 12
+	TAG_SIZE         = 16
+
+	// ENCRYPTION_OVERHEAD is the number of bytes an encrypted block takes on disk on top of BLOCK_SIZE
+	ENCRYPTION_OVERHEAD = NONCE_SIZE + TAG_SIZE
+)
+
+var (
+	ErrUnknownKeyID   = errors.New("block encrypted with an unknown key")
+	ErrBlockTampered  = errors.New("block failed authentication")
+	ErrInvalidKeySize = errors.New("encryption key must be 16, 24 or 32 bytes long")
+)
+
+// Keyring holds the AES-GCM ciphers for every known key ID and the ID used for new writes.
+type Keyring struct {
+	activeKeyID uint32
+	ciphers     map[uint32]cipher.AEAD
+}
+
+// NewKeyring builds a keyring from raw keys. Key ID 0 is reserved.
+func NewKeyring(keys map[uint32][]byte, activeKeyID uint32) (*Keyring, error) {
+	if activeKeyID == 0 {
+		return nil, errors.New("key ID 0 is reserved")
+	}
+	if _, exists := keys[activeKeyID]; !exists {
+		return nil, fmt.Errorf("active key ID %d has no key", activeKeyID)
+	}
+
+	keyring := &Keyring{
+		activeKeyID: activeKeyID,
+		ciphers:     make(map[uint32]cipher.AEAD, len(keys)),
+	}
+	for keyID, key := range keys {
+		if keyID == 0 {
+			return nil, errors.New("key ID 0 is reserved")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidKeySize
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.ciphers[keyID] = gcm
+	}
+	return keyring, nil
+}
+
+// NewKeyringFromHex builds a keyring from hex-encoded keys keyed by decimal key IDs, as stored in the config.
+func NewKeyringFromHex(hexKeys map[string]string, activeKeyID uint32) (*Keyring, error) {
+	keys := make(map[uint32][]byte, len(hexKeys))
+	for id, hexKey := range hexKeys {
+		keyID, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key ID %q: %w", id, err)
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for ID %d: %w", keyID, err)
+		}
+		keys[uint32(keyID)] = key
+	}
+	return NewKeyring(keys, activeKeyID)
+}
+
+// ActiveKeyID returns the ID of the key used for new writes.
+func (k *Keyring) ActiveKeyID() uint32 {
+	return k.activeKeyID
+}
+
+// fileHeader is the header of an encrypted file.
+type fileHeader struct {
+	fileID []byte
+	keyID  uint32
+}
+
+// newFileHeader returns the header of a new encrypted file, sealed with the active key.
+func (k *Keyring) newFileHeader() (*fileHeader, error) {
+	fileID := make([]byte, FILE_ID_SIZE)
+	if _, err := rand.Read(fileID); err != nil {
+		return nil, fmt.Errorf("failed to generate file ID: %w", err)
+	}
+	return &fileHeader{fileID: fileID, keyID: k.activeKeyID}, nil
+}
+
+// serialize encodes the header as it is stored at the start of the file.
+func (header *fileHeader) serialize() []byte {
+	data := make([]byte, FILE_HEADER_SIZE)
+	copy(data, header.fileID)
+	binary.LittleEndian.PutUint32(data[FILE_ID_SIZE:], header.keyID)
+	return data
+}
+
+// deserializeFileHeader decodes a header read from the start of a file.
+func deserializeFileHeader(data []byte) *fileHeader {
+	return &fileHeader{
+		fileID: bytes.Clone(data[:FILE_ID_SIZE]),
+		keyID:  binary.LittleEndian.Uint32(data[FILE_ID_SIZE:FILE_HEADER_SIZE]),
+	}
+}
+
+// cipher returns the cipher for the key the file is sealed with.
+func (k *Keyring) cipher(header *fileHeader) (cipher.AEAD, error) {
+	gcm, exists := k.ciphers[header.keyID]
+	if !exists {
+		return nil, ErrUnknownKeyID
+	}
+	return gcm, nil
+}
+
+// seal encrypts a logical block with the key of its file, binding it to the file and its block index.
+func (k *Keyring) seal(plain []byte, header *fileHeader, blockIndex uint64) ([]byte, error) {
+	gcm, err := k.cipher(header)
+	if err != nil {
+		return nil, err
+	}
+	physical := make([]byte, NONCE_SIZE, len(plain)+ENCRYPTION_OVERHEAD)
+	if _, err := rand.Read(physical); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(physical, physical, plain, blockAAD(header.fileID, blockIndex)), nil
+}
+
+// open decrypts a physical block. A block of zeros was never written and yields a zeroed block.
+func (k *Keyring) open(physical []byte, header *fileHeader, blockIndex uint64, blockSize int) ([]byte, error) {
+	if isUnwritten(physical) {
+		return make([]byte, blockSize), nil
+	}
+	gcm, err := k.cipher(header)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, physical[:NONCE_SIZE], physical[NONCE_SIZE:], blockAAD(header.fileID, blockIndex))
+	if err != nil {
+		return nil, ErrBlockTampered
+	}
+	return plain, nil
+}
+
+// isUnwritten reports whether a physical block is all zeros, as preallocated blocks are.
+func isUnwritten(physical []byte) bool {
+	for _, b := range physical {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// blockAAD is the additional authenticated data for a block - its file ID and index, so blocks cannot be
+// swapped around or copied between files. The file path is deliberately left out, since WAL segments are renamed when recycled.
+func blockAAD(fileID []byte, blockIndex uint64) []byte {
+	aad := make([]byte, FILE_ID_SIZE+8)
+	copy(aad, fileID)
+	binary.LittleEndian.PutUint64(aad[FILE_ID_SIZE:], blockIndex)
+	return aad
+}
@@ -0,0 +1,133 @@
+package block_manager
+
+import (
+	"errors"
+	"fmt"
+	crc_util "hunddb/utils/crc"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// ErrMmapUnsupported is returned by OpenMappedFile when files can't be memory mapped, readers fall back to ReadFromDisk.
+var ErrMmapUnsupported = errors.New("memory mapped reads are not supported")
+
+/*
+MappedFile is a read-only memory mapping of a file that is never written again, such as a finished SSTable.
+
+Reads are served straight from the mapping, without the file mutex or the block cache of the BlockManager.
+The CRC of a block is checked the first time it is touched, later reads trust it.
+
+The mapping is released once the MappedFile is no longer referenced. Read always copies out of it,
+as the GC doesn't see references into the mapping and records keep slices of the data they were read from.
+*/
+type MappedFile struct {
+	data      []byte
+	blockSize uint64
+	verified  []atomic.Bool // Blocks whose CRC was checked
+}
+
+/*
+OpenMappedFile maps the whole file at filePath into memory.
+
+Returns ErrMmapUnsupported on platforms without mmap and when blocks are encrypted, as the plaintext then only
+exists after the BlockManager opened them.
+*/
+func (bm *BlockManager) OpenMappedFile(filePath string) (*MappedFile, error) {
+	keyring, err := bm.keyring()
+	if err != nil {
+		return nil, err
+	}
+	if keyring != nil {
+		return nil, ErrMmapUnsupported
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // The mapping stays valid after the descriptor is closed
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("can't map empty file %s", filePath)
+	}
+	data, err := mmapFile(file, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := uint64(bm.blockSize)
+	mapped := &MappedFile{
+		data:      data,
+		blockSize: blockSize,
+		verified:  make([]atomic.Bool, (uint64(len(data))+blockSize-1)/blockSize),
+	}
+	runtime.SetFinalizer(mapped, (*MappedFile).Close)
+	return mapped, nil
+}
+
+// Close releases the mapping. Only needed to release it before the MappedFile is garbage collected.
+func (mapped *MappedFile) Close() error {
+	if mapped.data == nil {
+		return nil
+	}
+	data := mapped.data
+	mapped.data = nil
+	runtime.SetFinalizer(mapped, nil)
+	return munmapFile(data)
+}
+
+// Size returns the size of the mapped file.
+func (mapped *MappedFile) Size() uint64 {
+	return uint64(len(mapped.data))
+}
+
+// block returns the block at blockIndex, checking its CRC on first touch.
+func (mapped *MappedFile) block(blockIndex uint64) ([]byte, error) {
+	start := blockIndex * mapped.blockSize
+	if start >= uint64(len(mapped.data)) {
+		return nil, fmt.Errorf("block %d is past the end of the mapped file", blockIndex)
+	}
+	end := min(start+mapped.blockSize, uint64(len(mapped.data)))
+	block := mapped.data[start:end:end]
+	if end-start < mapped.blockSize {
+		// A partially written last block reads as zero padded, as it does through the BlockManager
+		block = append(make([]byte, 0, mapped.blockSize), block...)
+		block = block[:mapped.blockSize]
+	}
+
+	if !mapped.verified[blockIndex].Load() {
+		if err := crc_util.CheckBlockIntegrity(block); err != nil {
+			return nil, fmt.Errorf("block %d: %w", blockIndex, err)
+		}
+		mapped.verified[blockIndex].Store(true)
+	}
+	return block, nil
+}
+
+/*
+Read is ReadFromDisk for the mapped file: it returns size bytes from startOffset on, leaving out the CRCs.
+
+The data is copied out of the mapping, so it stays valid after the mapping is released.
+*/
+func (mapped *MappedFile) Read(startOffset uint64, size uint64) ([]byte, error) {
+	blockIndex := startOffset / mapped.blockSize
+	blockOffset := max(startOffset%mapped.blockSize, CRC_SIZE)
+
+	data := make([]byte, 0, size)
+	for remaining := size; remaining > 0; blockIndex++ {
+		block, err := mapped.block(blockIndex)
+		if err != nil {
+			return nil, err
+		}
+		bytesToRead := min(remaining, mapped.blockSize-blockOffset)
+		data = append(data, block[blockOffset:blockOffset+bytesToRead]...)
+		remaining -= bytesToRead
+		blockOffset = CRC_SIZE
+	}
+	return data, nil
+}
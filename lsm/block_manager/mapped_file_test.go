@@ -0,0 +1,138 @@
+package block_manager
+
+import (
+	"bytes"
+	"errors"
+	crc_util "hunddb/utils/crc"
+	"os"
+	"testing"
+)
+
+// openTestMapping writes data with CRCs added to a temp file and maps it, skipping the test where mmap is unsupported.
+func openTestMapping(t *testing.T, bm *BlockManager, data []byte) (string, *MappedFile) {
+	tmpFile, cleanup := createTestFile(t, nil)
+	t.Cleanup(cleanup)
+	if err := bm.WriteToDisk(crc_util.AddCRCsToData(data), tmpFile, 0); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	mapped, err := bm.OpenMappedFile(tmpFile)
+	if errors.Is(err, ErrMmapUnsupported) {
+		t.Skip("mmap is not supported on this platform")
+	}
+	if err != nil {
+		t.Fatalf("Failed to map file: %v", err)
+	}
+	t.Cleanup(func() { mapped.Close() })
+	return tmpFile, mapped
+}
+
+func TestMappedFile_ReadMatchesReadFromDisk(t *testing.T) {
+	resetBlockManager()
+	bm := GetBlockManager()
+	payload := uint64(bm.GetBlockSize()) - CRC_SIZE
+
+	data := make([]byte, 3*payload)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	tmpFile, mapped := openTestMapping(t, bm, data)
+
+	if mapped.Size() != 3*uint64(bm.GetBlockSize()) {
+		t.Errorf("Expected a mapping of 3 blocks, got %d bytes", mapped.Size())
+	}
+
+	reads := []struct{ offset, size uint64 }{
+		{CRC_SIZE, 10},                          // Start of the first block
+		{0, payload},                            // A whole block, the offset moved past the CRC
+		{uint64(bm.GetBlockSize()) - 5, 20},     // Across a block boundary
+		{CRC_SIZE + 1, 2*payload + payload - 2}, // Across all three blocks
+	}
+	for _, read := range reads {
+		expected, _, err := bm.ReadFromDisk(tmpFile, read.offset, read.size)
+		if err != nil {
+			t.Fatalf("ReadFromDisk(%d, %d) failed: %v", read.offset, read.size, err)
+		}
+		got, err := mapped.Read(read.offset, read.size)
+		if err != nil {
+			t.Fatalf("Read(%d, %d) failed: %v", read.offset, read.size, err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("Read(%d, %d) doesn't match ReadFromDisk", read.offset, read.size)
+		}
+	}
+
+	if _, err := mapped.Read(3*uint64(bm.GetBlockSize())+CRC_SIZE, 1); err == nil {
+		t.Error("Expected a read past the end of the file to fail")
+	}
+}
+
+func TestMappedFile_ChecksCRCOnFirstTouch(t *testing.T) {
+	resetBlockManager()
+	bm := GetBlockManager()
+	blockSize := int64(bm.GetBlockSize())
+
+	tmpFile, mapped := openTestMapping(t, bm, make([]byte, 2*(uint64(blockSize)-CRC_SIZE)))
+	if _, err := mapped.Read(CRC_SIZE, 10); err != nil {
+		t.Fatalf("Read of the first block failed: %v", err)
+	}
+
+	// The mapping is shared with the file, both blocks change under it
+	file, err := os.OpenFile(tmpFile, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{100, blockSize + 100} {
+		if _, err := file.WriteAt([]byte{0xff}, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	if _, err := mapped.Read(uint64(blockSize)+CRC_SIZE, 10); err == nil {
+		t.Error("Expected the corrupted second block to fail its CRC check")
+	}
+	if _, err := mapped.Read(CRC_SIZE, 10); err != nil {
+		t.Errorf("Expected the first block not to be checked again, got %v", err)
+	}
+}
+
+func TestMappedFile_UnsupportedWithEncryption(t *testing.T) {
+	resetBlockManager()
+	bm := GetBlockManager()
+	defer bm.SetKeyring(nil)
+
+	tmpFile, cleanup := createTestFile(t, make([]byte, bm.GetBlockSize()))
+	defer cleanup()
+
+	keyring, err := NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}, 1)
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	bm.SetKeyring(keyring)
+	if _, err := bm.OpenMappedFile(tmpFile); !errors.Is(err, ErrMmapUnsupported) {
+		t.Errorf("Expected encrypted files not to be mapped, got %v", err)
+	}
+}
+
+// TestMappedFile_ReadOutlivesMapping verifies that read data is copied, so it stays valid once the mapping is released.
+func TestMappedFile_ReadOutlivesMapping(t *testing.T) {
+	resetBlockManager()
+	bm := GetBlockManager()
+	data := bytes.Repeat([]byte("mapped"), 100)
+	_, mapped := openTestMapping(t, bm, data)
+
+	got, err := mapped.Read(CRC_SIZE, 50)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if &got[0] == &mapped.data[CRC_SIZE] {
+		t.Fatal("Expected a read within a block to be copied out of the mapping")
+	}
+	if err := mapped.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if !bytes.Equal(got, data[:50]) {
+		t.Error("Expected the read data to stay valid after the mapping was released")
+	}
+}
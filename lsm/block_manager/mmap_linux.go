@@ -0,0 +1,17 @@
+//go:build linux
+
+package block_manager
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of the file read-only, shared with the page cache.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
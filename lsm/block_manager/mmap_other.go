@@ -0,0 +1,14 @@
+//go:build !linux
+
+package block_manager
+
+import "os"
+
+// mmapFile is only implemented on Linux, elsewhere SSTables are read through the BlockManager.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
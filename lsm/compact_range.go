@@ -0,0 +1,131 @@
+package lsm
+
+import (
+	"fmt"
+	"hunddb/lsm/sstable"
+)
+
+// rangeTable is an SSTable considered by CompactRange with its key boundaries
+type rangeTable struct {
+	index    uint64
+	level    int
+	minKey   string
+	maxKey   string
+	selected bool
+}
+
+/*
+CompactRange flushes the memtables, then merges every SSTable holding keys in [start, end] into a single
+table in the bottom level. An empty start or end leaves that side of the range open, so CompactRange("", "")
+compacts the whole tree.
+
+Tables overlapping the keys of a selected table are selected too, until no table left behind shares keys
+with the merged one; otherwise an older version left in a higher level would shadow the newer one moved down.
+All levels are reserved while the merge runs, so no other compaction or flush commit interleaves with it.
+*/
+func (lsm *LSM) CompactRange(start string, end string) error {
+	if start != "" && end != "" && start > end {
+		return fmt.Errorf("invalid compaction range: start %q is after end %q", start, end)
+	}
+	if err := lsm.Flush(true); err != nil {
+		return fmt.Errorf("failed to compact range: %w", err)
+	}
+
+	// Reserve every level in order, the same order compactions take them in
+	for lvl := range lsm.levelLocks {
+		lsm.levelLocks[lvl].Lock()
+	}
+	defer func() {
+		for lvl := len(lsm.levelLocks) - 1; lvl >= 0; lvl-- {
+			lsm.levelLocks[lvl].Unlock()
+		}
+	}()
+
+	// Newest first, as sstable.Compact expects: lower levels are newer, and within a level later tables are
+	tables := make([]*rangeTable, 0)
+	lsm.mu.RLock()
+	for lvl, level := range lsm.levels {
+		for i := len(level) - 1; i >= 0; i-- {
+			tables = append(tables, &rangeTable{index: level[i], level: lvl})
+		}
+	}
+	bottom := len(lsm.levels) - 1
+	lsm.mu.RUnlock()
+
+	for _, table := range tables {
+		minKey, maxKey, err := sstable.GetSSBoundaries(int(table.index))
+		if err != nil {
+			return fmt.Errorf("failed to compact range: %w", err)
+		}
+		table.minKey, table.maxKey = minKey, maxKey
+	}
+
+	compactionList := selectRangeTables(tables, start, end)
+	if len(compactionList) == 0 {
+		return nil
+	}
+	// A single table already in the bottom level has nothing to be merged with
+	if len(compactionList) == 1 {
+		for _, table := range tables {
+			if table.selected && table.level == bottom {
+				return nil
+			}
+		}
+	}
+
+	// The shallowest level a selected table comes from is recorded as the source level
+	sourceLevel := bottom
+	for _, table := range tables {
+		if table.selected && table.level < sourceLevel {
+			sourceLevel = table.level
+		}
+	}
+
+	newIndex := int(lsm.GetNextSSTableIndexWithIncrement())
+	if err := sstable.Compact(compactionList, newIndex, sourceLevel, bottom); err != nil {
+		return fmt.Errorf("failed to compact range: %w", err)
+	}
+
+	lsm.mu.Lock()
+	for _, table := range tables {
+		if table.selected {
+			lsm.levels[table.level] = removeFirstOccurrence(lsm.levels[table.level], table.index)
+		}
+	}
+	lsm.levels[bottom] = append(lsm.levels[bottom], uint64(newIndex))
+	lsm.compactionCommittedUnsafe(compactionList)
+	lsm.mu.Unlock()
+
+	return lsm.PersistLSM()
+}
+
+// selectRangeTables marks the tables overlapping [start, end], widening the range to the selected tables
+// until it stops growing, and returns their indexes in the order of tables.
+func selectRangeTables(tables []*rangeTable, start string, end string) []int {
+	// "" sorts before every key, so an open start needs no special case; an open end does
+	low, high, openEnd := start, end, end == ""
+	for grown := true; grown; {
+		grown = false
+		for _, table := range tables {
+			if table.selected || table.maxKey < low || (!openEnd && table.minKey > high) {
+				continue
+			}
+			table.selected = true
+			grown = true
+			if table.minKey < low {
+				low = table.minKey
+			}
+			if !openEnd && table.maxKey > high {
+				high = table.maxKey
+			}
+		}
+	}
+
+	selected := make([]int, 0)
+	for _, table := range tables {
+		if table.selected {
+			selected = append(selected, int(table.index))
+		}
+	}
+	return selected
+}
@@ -1,36 +1,31 @@
 package lsm
 
 import (
-	"fmt"
-	memtable "hunddb/lsm/memtable"
 	"sync"
+	"time"
 )
 
-// flushJob represents a single memtable flush task with a pre-assigned SSTable index
+// flushJob represents a single immutable memtable waiting to be written out
 type flushJob struct {
-	pos   int                // position in batch (0 = oldest)
-	index int                // assigned SSTable index
-	mt    *memtable.MemTable // memtable to flush
-	resCh chan<- flushResult // channel to send the result
-}
-
-type flushResult struct {
-	pos   int
-	index int
-	err   error
+	lsm *LSM
+	imm *immutableMemtable
 }
 
 // FlushPool is a simple worker pool used to concurrently flush memtables
 type FlushPool struct {
-	jobs chan flushJob
-	wg   sync.WaitGroup
+	// Jobs are kept in a slice rather than a channel so that submitting never blocks:
+	// writers submit with lsm.mu held, while workers take lsm.mu to commit their results.
+	mu     sync.Mutex
+	cond   *sync.Cond
+	jobs   []flushJob
+	closed bool
+	wg     sync.WaitGroup
 }
 
 // NewFlushPool creates a pool with the given worker count and starts workers immediately
 func NewFlushPool(workerCount int) *FlushPool {
-	p := &FlushPool{
-		jobs: make(chan flushJob),
-	}
+	p := &FlushPool{}
+	p.cond = sync.NewCond(&p.mu)
 	p.start(workerCount)
 	return p
 }
@@ -40,79 +35,67 @@ func (p *FlushPool) start(workerCount int) {
 		p.wg.Add(1)
 		go func() {
 			defer p.wg.Done()
-			for job := range p.jobs {
-				// Perform the flush
-				err := job.mt.Flush(job.index)
-				job.resCh <- flushResult{pos: job.pos, index: job.index, err: err}
+			for {
+				job, ok := p.next()
+				if !ok {
+					return
+				}
+				// Perform the flush, the LSM commits it to level 0 in queue order
+				err := job.lsm.flushWithRetries(job.imm)
+				job.lsm.commitFlush(job.imm, err)
 			}
 		}()
 	}
 }
 
-// Stop gracefully stops the pool; should be called on shutdown if needed
-func (p *FlushPool) Stop() {
-	close(p.jobs)
-	p.wg.Wait()
+// next blocks until a job is available, returns false once the pool is stopped and drained
+func (p *FlushPool) next() (flushJob, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.jobs) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.jobs) == 0 {
+		return flushJob{}, false
+	}
+	job := p.jobs[0]
+	p.jobs[0] = flushJob{}
+	p.jobs = p.jobs[1:]
+	return job, true
 }
 
-// submitBatch submits a batch of flush jobs and commits results to level 0 in-order (oldest to newest)
-func (p *FlushPool) submitBatch(lsm *LSM, memtables []*memtable.MemTable, indexes []int, lowWaterMarks []uint64) {
-	n := len(memtables)
-	resCh := make(chan flushResult, n)
-
-	// Coordinator to ensure in-order commit (oldest->newest)
-	go func() {
-		defer close(resCh)
-	}()
-
-	// Collector and committer
-	go func() {
-		pending := make(map[int]flushResult, n)
-		next := 0
-		committed := 0
-		for committed < n {
-			r := <-resCh
-			pending[r.pos] = r
-			for {
-				rr, ok := pending[next]
-				if !ok {
-					break
-				}
-				// Only append to levels when the specific position is done (ensures ordering)
-				if rr.err == nil {
-					// Commit to level 0 under its compaction lock to avoid race with compaction
-					lsm.levelLocks[0].Lock()
-					lsm.mu.Lock()
-					lsm.levels[0] = append(lsm.levels[0], uint64(rr.index))
-
-					// After successful flush, use the memtable's low water mark to clean up WAL segments
-					// The low water mark for this memtable position tells us which WAL segments can be deleted
-					if rr.pos < len(lowWaterMarks) {
-						lowWaterMark := lowWaterMarks[rr.pos]
-						if lowWaterMark > 0 {
-							// Clean up WAL segments below this low water mark
-							if err := lsm.wal.DeleteOldLogs(lowWaterMark); err != nil {
-								// Log error but don't fail the flush
-								fmt.Printf("Warning: Failed to delete old WAL logs below watermark %d: %v\n", lowWaterMark, err)
-							}
-						}
-					}
+// submit queues the flush of an immutable memtable; it never blocks
+func (p *FlushPool) submit(lsm *LSM, imm *immutableMemtable) {
+	p.mu.Lock()
+	p.jobs = append(p.jobs, flushJob{lsm: lsm, imm: imm})
+	p.mu.Unlock()
+	p.cond.Signal()
+}
 
-					lsm.mu.Unlock()
-					lsm.levelLocks[0].Unlock()
+// Stop gracefully stops the pool once the queued jobs are done; should be called on shutdown if needed
+func (p *FlushPool) Stop() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	p.wg.Wait()
+}
 
-					// After successful append, consider compactions
-					lsm.maybeStartCompactions()
-				}
-				delete(pending, next)
-				next++
-				committed++
-			}
-		}
-	}()
+// flushWithRetries writes an immutable memtable out as an SSTable, retrying up to FLUSH_MAX_RETRIES times
+// with exponential backoff. A memtable only releases its memory once a flush succeeds, so retrying is safe.
+// Writes admitted before the memtable was queued may still be inserting into it, the flush waits for them first.
+func (lsm *LSM) flushWithRetries(imm *immutableMemtable) error {
+	imm.writers.wg.Wait()
+	err := imm.mt.Flush(imm.index)
+	backoff := FLUSH_RETRY_BACKOFF
+	for attempt := uint64(0); err != nil && attempt < FLUSH_MAX_RETRIES; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
 
-	// Enqueue jobs in order (oldest first)
-	for i := 0; i < n; i++ {
-		p.jobs <- flushJob{pos: i, index: indexes[i], mt: memtables[i], resCh: resCh}
+		lsm.mu.Lock()
+		lsm.memtableStats.FlushRetries++
+		lsm.mu.Unlock()
+		err = imm.mt.Flush(imm.index)
 	}
+	return err
 }
@@ -0,0 +1,100 @@
+package lsm
+
+import (
+	"fmt"
+	"hunddb/lsm/sstable"
+	"io"
+	"os"
+)
+
+/*
+IngestExternalFile links an SSTable built by sstable.Writer into the tree, skipping the WAL and the memtables.
+The file at path is hard linked (or copied, across file systems) under a newly assigned index, so it can be
+removed afterwards.
+
+The ingested records are newer than everything in the tree. The memtables are flushed first, so no earlier write
+left in them shadows the file, and the table goes to the deepest level where neither that level nor any level
+above holds a table sharing keys with it; with an overlapping table in level 0 it becomes the newest level 0 table.
+*/
+func (lsm *LSM) IngestExternalFile(path string) error {
+	if err := lsm.Flush(true); err != nil {
+		return fmt.Errorf("failed to ingest %s: %w", path, err)
+	}
+
+	// Reserve every level in order, no compaction or flush commit may move tables while the level is picked
+	for lvl := range lsm.levelLocks {
+		lsm.levelLocks[lvl].Lock()
+	}
+	unlockLevels := func() {
+		for lvl := len(lsm.levelLocks) - 1; lvl >= 0; lvl-- {
+			lsm.levelLocks[lvl].Unlock()
+		}
+	}
+
+	index := lsm.GetNextSSTableIndexWithIncrement()
+	tablePath := fmt.Sprintf(sstable.FILE_NAME_FORMAT, index)
+	if err := linkOrCopyFile(path, tablePath); err != nil {
+		unlockLevels()
+		return fmt.Errorf("failed to ingest %s: %w", path, err)
+	}
+	if _, _, err := sstable.ValidateExternalFile(int(index)); err != nil {
+		os.Remove(tablePath)
+		unlockLevels()
+		return fmt.Errorf("failed to ingest %s: %w", path, err)
+	}
+
+	lsm.mu.RLock()
+	levels := make([][]uint64, len(lsm.levels))
+	for lvl := range lsm.levels {
+		levels[lvl] = append([]uint64(nil), lsm.levels[lvl]...)
+	}
+	lsm.mu.RUnlock()
+	target := 0
+	for lvl := range levels {
+		if overlapsAny(index, levels[lvl]) {
+			break
+		}
+		target = lvl
+	}
+
+	lsm.mu.Lock()
+	lsm.levels[target] = append(lsm.levels[target], index)
+	lsm.refreshPendingCompactionBytesUnsafe()
+	lsm.mu.Unlock()
+
+	err := lsm.PersistLSM()
+	unlockLevels()
+	if err != nil {
+		return fmt.Errorf("failed to ingest %s: %w", path, err)
+	}
+	lsm.maybeStartCompactions()
+	return nil
+}
+
+// linkOrCopyFile makes the file at source available at target, as a hard link when both are on the same file system.
+func linkOrCopyFile(source string, target string) error {
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	return out.Close()
+}
@@ -15,9 +15,9 @@ var (
 
 
 // LRUCache is a generic Least Recently Used cache implementation (Used for read path cache and for block manager)
-// K is the key type (string for records, disk location for blocks)
+// K is the key type (string for records, disk location for blocks, SSTable index for open tables)
 // V is the value type (any value for records, block data for disk blocks)
-type LRUCache[K string | block_location.BlockLocation, V any] struct {
+type LRUCache[K string | int | block_location.BlockLocation, V any] struct {
 	capacity uint32
 	size     uint32
 
@@ -38,7 +38,7 @@ type listItem[K comparable, V any] struct {
 }
 
 // NewLRUCache creates a new LRU cache with the specified capacity
-func NewLRUCache[K string | block_location.BlockLocation, V any](capacity uint32) *LRUCache[K, V] {
+func NewLRUCache[K string | int | block_location.BlockLocation, V any](capacity uint32) *LRUCache[K, V] {
 	return &LRUCache[K, V]{
 		capacity:   capacity,
 		size:       0,
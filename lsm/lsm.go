@@ -2,6 +2,7 @@ package lsm
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hunddb/lsm/block_manager"
 	cache "hunddb/lsm/cache"
@@ -13,17 +14,33 @@ import (
 	crc_util "hunddb/utils/crc"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Global configuration variables loaded from config in init()
 var (
-	MAX_LEVELS           uint64
-	MAX_TABLES_PER_LEVEL uint64
-	MAX_MEMTABLES        uint64
-	COMPACTION_TYPE      string
-	LSM_PATH             string
-	CRC_SIZE             uint64
+	MAX_LEVELS               uint64
+	MAX_TABLES_PER_LEVEL     uint64
+	MAX_MEMTABLES            uint64
+	COMPACTION_TYPE          string
+	LSM_PATH                 string
+	CRC_SIZE                 uint64
+	SUBSCRIPTION_BUFFER_SIZE uint64
+	WRITE_BUFFER_SIZE        uint64 // Memory budget across all memtables, 0 disables it
+
+	// Write stall thresholds, 0 disables a threshold (see WriteStallStats)
+	LEVEL0_SLOWDOWN_WRITES_TRIGGER    uint64
+	LEVEL0_STOP_WRITES_TRIGGER        uint64
+	PENDING_FLUSH_SLOWDOWN_BYTES      uint64
+	PENDING_FLUSH_STOP_BYTES          uint64
+	PENDING_COMPACTION_SLOWDOWN_BYTES uint64
+	PENDING_COMPACTION_STOP_BYTES     uint64
+	WRITE_SLOWDOWN_DELAY              time.Duration
+
+	FLUSH_WORKERS       uint64
+	FLUSH_MAX_RETRIES   uint64        // Retries of a failed flush before it becomes a background error
+	FLUSH_RETRY_BACKOFF time.Duration // Wait before the first retry, doubled after every attempt
 )
 
 const LWM_PATH = "lwm.db"
@@ -37,6 +54,18 @@ func init() {
 	COMPACTION_TYPE = cfg.LSM.CompactionType
 	LSM_PATH = cfg.LSM.LSMPath
 	CRC_SIZE = cfg.CRC.Size
+	SUBSCRIPTION_BUFFER_SIZE = cfg.LSM.SubscriptionBufferSize
+	WRITE_BUFFER_SIZE = cfg.LSM.WriteBufferSize
+	LEVEL0_SLOWDOWN_WRITES_TRIGGER = cfg.LSM.Level0SlowdownWritesTrigger
+	LEVEL0_STOP_WRITES_TRIGGER = cfg.LSM.Level0StopWritesTrigger
+	PENDING_FLUSH_SLOWDOWN_BYTES = cfg.LSM.PendingFlushSlowdownBytes
+	PENDING_FLUSH_STOP_BYTES = cfg.LSM.PendingFlushStopBytes
+	PENDING_COMPACTION_SLOWDOWN_BYTES = cfg.LSM.PendingCompactionSlowdownBytes
+	PENDING_COMPACTION_STOP_BYTES = cfg.LSM.PendingCompactionStopBytes
+	WRITE_SLOWDOWN_DELAY = time.Duration(cfg.LSM.WriteSlowdownDelayMicros) * time.Microsecond
+	FLUSH_WORKERS = cfg.LSM.FlushWorkers
+	FLUSH_MAX_RETRIES = cfg.LSM.FlushMaxRetries
+	FLUSH_RETRY_BACKOFF = time.Duration(cfg.LSM.FlushRetryBackoffMillis) * time.Millisecond
 }
 
 /*
@@ -44,9 +73,18 @@ LSM represents a Log-Structured Merge Tree
 */
 type LSM struct {
 	// Each level holds the indexes of its SSTables
-	levels       [][]uint64
-	memtables    []*memtable.MemTable
-	lowWaterMark []uint64 // low water mark per memtable for log truncation
+	levels [][]uint64
+	// memtable receives all writes; once full it joins immutables to be flushed, both protected by mu
+	memtable   *memtable.MemTable
+	immutables []*immutableMemtable // oldest first
+	// activeMemtable holds the same memtable for Get, which reads it without taking mu
+	activeMemtable atomic.Pointer[memtable.MemTable]
+	// memtableWriters tracks the writes still inserting into memtable after releasing mu, protected by mu
+	memtableWriters *memtableWriters
+	// writesInFlight counts those writes across all memtables, Get only fills the cache while there are none
+	writesInFlight atomic.Int64
+	// lowWaterMark is the WAL log index of the latest logged write into memtable, used for log truncation
+	lowWaterMark uint64
 	wal          *wal.WAL
 	cache        *cache.ReadPathCache
 
@@ -62,9 +100,33 @@ type LSM struct {
 
 	// flushPool is the worker pool used for concurrent memtable flushes (lazy-initialized)
 	flushPool *FlushPool
+	// backgroundWork is signalled on mu whenever a flush or compaction commits, waking stalled writers
+	backgroundWork *sync.Cond
+	// background counts the flushes and compactions in flight
+	background sync.WaitGroup
+	// backgroundErr is set when a flush fails for good and fails writes until Resume, protected by mu
+	backgroundErr error
+	// memtableStats and stallStats hold the flush and write stall counters, protected by mu
+	memtableStats MemtableStats
+	stallStats    WriteStallStats
+	// pendingCompactionBytes is the compaction debt estimated whenever the levels change, protected by mu
+	pendingCompactionBytes int64
+	// tableSizes caches the on-disk size of SSTables for that estimate, protected by mu
+	tableSizes map[uint64]int64
 
 	// levelLocks ensures only one compaction operates on a given level at a time
 	levelLocks []sync.Mutex
+
+	// subscribers receive every committed write (see Subscribe), protected by mu
+	subscribers map[*Subscription]struct{}
+	// lastSequence is the commit timestamp of the latest write, protected by mu
+	lastSequence uint64
+	// walReplays counts the subscriptions replaying the WAL, which defer retiring its segments
+	// up to deferredLowWaterMark until they finish, protected by mu
+	walReplays           int
+	deferredLowWaterMark uint64
+	// unpublished holds the writes into a lock-free memtable in commit order, until they can be published, protected by mu
+	unpublished []*pendingPublication
 }
 
 /*
@@ -133,6 +195,20 @@ func loadLowWaterMarks() ([]uint64, error) {
 	return lowWaterMarks, nil
 }
 
+// lowWaterMarksUnsafe returns the low water marks of the memtables in memory, oldest first,
+// padded or truncated to MAX_MEMTABLES entries; must be called with lsm.mu held.
+func (lsm *LSM) lowWaterMarksUnsafe() []uint64 {
+	lowWaterMarks := make([]uint64, 0, MAX_MEMTABLES)
+	for _, imm := range lsm.immutables {
+		lowWaterMarks = append(lowWaterMarks, imm.lowWaterMark)
+	}
+	lowWaterMarks = append(lowWaterMarks, lsm.lowWaterMark)
+	for uint64(len(lowWaterMarks)) < MAX_MEMTABLES {
+		lowWaterMarks = append(lowWaterMarks, 0)
+	}
+	return lowWaterMarks[:MAX_MEMTABLES]
+}
+
 func saveLowWaterMarks(lowWaterMarks []uint64) error {
 	data := make([]byte, MAX_MEMTABLES*8)
 	for i := uint64(0); i < MAX_MEMTABLES; i++ {
@@ -146,8 +222,8 @@ func saveLowWaterMarks(lowWaterMarks []uint64) error {
 PersistLSM persists the LSM parts that need to be persisted (the levels and their SSTable indexes).
 */
 func (lsm *LSM) PersistLSM() error {
-	// Get the serialized data
-	data := lsm.serialize()
+	// Get the serialized data, split into CRC-prefixed blocks as LoadLSM expects
+	data := crc_util.AddCRCsToData(lsm.serialize())
 
 	blockManager := block_manager.GetBlockManager()
 
@@ -156,7 +232,10 @@ func (lsm *LSM) PersistLSM() error {
 		return err
 	}
 	// Also persist low water marks
-	err = saveLowWaterMarks(lsm.lowWaterMark)
+	lsm.mu.RLock()
+	lowWaterMarks := lsm.lowWaterMarksUnsafe()
+	lsm.mu.RUnlock()
+	err = saveLowWaterMarks(lowWaterMarks)
 	if err != nil {
 		return err
 	}
@@ -228,65 +307,86 @@ func (lsm *LSM) deserialize(data []byte) error {
 
 /*
 LoadLSM loads the LSM from disk, or creates a new one if it doesn't exist.
-Always returns an LSM instance. If previous data couldn't be loaded, the DataLost flag will be set to true.
+If previous data couldn't be loaded, the DataLost flag will be set to true.
+An error is only returned when the configuration can't be used, e.g. an unknown memtable type or invalid encryption keys.
 */
-func LoadLSM() *LSM {
+func LoadLSM() (*LSM, error) {
+	if err := block_manager.GetBlockManager().ConfigError(); err != nil {
+		return nil, err
+	}
+	// The memtable type is resolved before anything is opened, since names registered
+	// with memtable.Register are only known once every init function has run
+	mt, err := memtable.NewMemtable()
+	if err != nil {
+		return nil, err
+	}
+
 	dataLost := false
 	wal, err := wal.BuildWAL()
 	if err != nil {
 		dataLost = true
 	}
 	lsm := &LSM{
-		levels:       make([][]uint64, MAX_LEVELS),
-		memtables:    make([]*memtable.MemTable, 0, MAX_MEMTABLES),
-		lowWaterMark: make([]uint64, MAX_MEMTABLES),
-		wal:          wal,
-		cache:        cache.NewReadPathCache(),
-		DataLost:     dataLost, // Initially assume no data loss
-		flushPool:    nil,
-		levelLocks:   make([]sync.Mutex, int(MAX_LEVELS)),
+		levels:      make([][]uint64, MAX_LEVELS),
+		wal:         wal,
+		cache:       cache.NewReadPathCache(),
+		DataLost:    dataLost, // Initially assume no data loss
+		flushPool:   nil,
+		levelLocks:  make([]sync.Mutex, int(MAX_LEVELS)),
+		subscribers: make(map[*Subscription]struct{}),
+		tableSizes:  make(map[uint64]int64),
 	}
-
-	blockManager := block_manager.GetBlockManager()
+	lsm.backgroundWork = sync.NewCond(&lsm.mu)
+	lsm.stallStats.StopsByCause = make(map[string]uint64)
+	lsm.setMemtableUnsafe(mt)
 
 	// Check if the file exists using os.Stat
 	_, err = os.Stat(LSM_PATH)
 	if os.IsNotExist(err) {
 		// File doesn't exist - this is a fresh start (not data loss)
-		firstMemtable, _ := memtable.NewMemtable()
-		lsm.memtables = append(lsm.memtables, firstMemtable)
 		// Initialize next SSTable index on fresh start
 		lsm.mu.Lock()
 		lsm.NextSSTableIndex = lsm.getNextSSTableIndexUnsafe()
 		lsm.mu.Unlock()
-		return lsm
+		return lsm, nil
 	}
 
-	err = wal.RecoverMemtables(lsm.memtables)
+	// The persisted low water marks are only checked for readability, the memtables are rebuilt from the WAL
+	_, err = loadLowWaterMarks()
 	if err != nil {
-		// WAL recovery failed - consider it data loss
 		lsm.DataLost = true
-		return lsm
 	}
 
-	// Try to load low water marks
-	lsm.lowWaterMark, err = loadLowWaterMarks()
+	// File exists, so any errors from here on are considered data corruption
+	err = lsm.loadLevels()
 	if err != nil {
 		lsm.DataLost = true
 	}
 
-	// File exists, so any errors from here on are considered data corruption
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	lsm.NextSSTableIndex = lsm.getNextSSTableIndexUnsafe()
+	lsm.refreshPendingCompactionBytesUnsafe()
+
+	// The WAL is replayed once the levels are known, since memtables that fill up during
+	// recovery are queued for flushing and need SSTable indexes past the existing ones
+	err = lsm.recoverMemtablesUnsafe()
+	if err != nil {
+		// WAL recovery failed - consider it data loss
+		lsm.DataLost = true
+	}
+	return lsm, nil
+}
+
+// loadLevels reads the persisted level layout from LSM_PATH.
+func (lsm *LSM) loadLevels() error {
+	blockManager := block_manager.GetBlockManager()
 
 	// Try to read the levels size
 	levelsSizeBytes, _, err := blockManager.ReadFromDisk(LSM_PATH, 0, 8)
 	if err != nil {
 		// File exists but can't read size header - corruption
-		lsm.mu.Lock()
-		lsm.DataLost = true
-		// Initialize with current state
-		lsm.NextSSTableIndex = lsm.getNextSSTableIndexUnsafe()
-		lsm.mu.Unlock()
-		return lsm
+		return err
 	}
 
 	levelsSize := binary.LittleEndian.Uint64(levelsSizeBytes)
@@ -295,37 +395,50 @@ func LoadLSM() *LSM {
 	data, _, err := blockManager.ReadFromDisk(LSM_PATH, 8+CRC_SIZE, uint64(levelsSize))
 	if err != nil {
 		// File exists but can't read data - corruption
-		lsm.mu.Lock()
-		lsm.DataLost = true
-		// Initialize with current state
-		lsm.NextSSTableIndex = lsm.getNextSSTableIndexUnsafe()
-		lsm.mu.Unlock()
-		return lsm
+		return err
 	}
 
-	// Try to deserialize the data
-	err = lsm.deserialize(data)
-	if err != nil {
-		// File exists but data format is invalid - corruption
-		lsm.mu.Lock()
-		lsm.DataLost = true
-		// Initialize with current state
-		lsm.NextSSTableIndex = lsm.getNextSSTableIndexUnsafe()
-		lsm.mu.Unlock()
-		return lsm
+	// Try to deserialize the data, an invalid format is corruption as well
+	return lsm.deserialize(data)
+}
+
+/*
+recoverMemtablesUnsafe replays the WAL into memtables. Memtables that fill up are queued for flushing
+as during normal writes and the last one stays mutable. Must be called with lsm.mu held.
+*/
+func (lsm *LSM) recoverMemtablesUnsafe() error {
+	if lsm.wal == nil {
+		return fmt.Errorf("WAL is not available")
+	}
+	if lsm.memtable == nil {
+		fresh, err := memtable.NewMemtable()
+		if err != nil {
+			return err
+		}
+		lsm.setMemtableUnsafe(fresh)
 	}
 
-	// Successfully loaded previous data
-	lsm.mu.Lock()
-	lsm.NextSSTableIndex = lsm.getNextSSTableIndexUnsafe()
-	lsm.mu.Unlock()
-	return lsm
+	var rotateErr error
+	err := lsm.wal.ReplayRecords(func(record *model.Record) {
+		if rotateErr != nil {
+			return
+		}
+		if lsm.memtable.IsFull() {
+			rotateErr = lsm.rotateMemtableUnsafe()
+			if rotateErr != nil {
+				return
+			}
+		}
+		lsm.memtable.Put(record)
+	})
+	if err != nil {
+		return err
+	}
+	return rotateErr
 }
 
-// initFlushPoolOnce lazily initializes the flush worker pool
+// initFlushPoolOnce lazily initializes the flush worker pool; must be called with lsm.mu held
 func (lsm *LSM) initFlushPoolOnce(workers int) {
-	lsm.mu.Lock()
-	defer lsm.mu.Unlock()
 	if lsm.flushPool == nil {
 		lsm.flushPool = NewFlushPool(workers)
 	}
@@ -341,12 +454,24 @@ func (lsm *LSM) IsDataLost() bool {
 	return lsm.DataLost
 }
 
-// Get retrieves a record from the LSM by checking the memtables, cache, and SSTables in order.
+/*
+Get retrieves a record from the LSM by checking the memtables, cache, and SSTables in order.
+The memtable receiving writes is checked first without taking lsm.mu, so reads of recent writes never wait for writers.
+*/
 func (lsm *LSM) Get(key string) (*model.Record, error, bool) {
+	if mt := lsm.activeMemtable.Load(); mt != nil {
+		if record := mt.Get(key); record != nil {
+			return record, nil, false
+		}
+	}
+
 	lsm.mu.RLock()
 	defer lsm.mu.RUnlock()
 
 	errorEncountered := false
+	// No write can be admitted while mu is held. Without writes still inserting, a key missing
+	// from the memtables has its latest version in the SSTables, which is then safe to cache
+	cacheable := lsm.writesInFlight.Load() == 0
 
 	// 1. Check memtables first
 	if record := lsm.checkMemtables(key); record != nil {
@@ -366,7 +491,9 @@ func (lsm *LSM) Get(key string) (*model.Record, error, bool) {
 		err = errorEncounteredInCheck
 	}
 	if record != nil {
-		lsm.cache.Put(key, record)
+		if cacheable {
+			lsm.cache.Put(key, record)
+		}
 		return record, nil, false
 	}
 
@@ -374,11 +501,10 @@ func (lsm *LSM) Get(key string) (*model.Record, error, bool) {
 }
 
 /*
-checkMemtables checks the memtables in reverse order (newest to oldest) for the given key.
+checkMemtables checks the mutable memtable, then the immutable ones from newest to oldest, for the given key.
 */
 func (lsm *LSM) checkMemtables(key string) *model.Record {
-	for i := len(lsm.memtables) - 1; i >= 0; i-- {
-		mt := lsm.memtables[i]
+	for _, mt := range lsm.memtablesUnsafe() {
 		if record := mt.Get(key); record != nil {
 			return record
 		}
@@ -388,6 +514,7 @@ func (lsm *LSM) checkMemtables(key string) *model.Record {
 
 /*
 checkSSTables checks the SSTables in reverse order (newest to oldest) for the given key.
+The newest version found is returned, a tombstone included, so older versions in deeper levels stay hidden.
 */
 func (lsm *LSM) checkSSTables(key string) (*model.Record, error, bool) {
 	errorEncountered := false
@@ -396,7 +523,7 @@ func (lsm *LSM) checkSSTables(key string) (*model.Record, error, bool) {
 		levelIndexes := lsm.levels[i]
 		for index := len(levelIndexes) - 1; index >= 0; index-- {
 			tableIndex := levelIndexes[index]
-			record, err := sstable.Get(key, int(tableIndex))
+			record, err := sstable.GetEntry(key, int(tableIndex))
 			if err != nil {
 				errorEncountered = true
 				errorEncounteredInCheck = err
@@ -409,57 +536,118 @@ func (lsm *LSM) checkSSTables(key string) (*model.Record, error, bool) {
 	return nil, errorEncounteredInCheck, errorEncountered
 }
 
+/*
+WriteOptions controls how a single Put or Delete is applied.
+*/
+type WriteOptions struct {
+	// DisableWAL skips the write-ahead log for the write. Such writes are only durable
+	// once their memtable reaches an SSTable (see Flush) and are lost on a crash before that.
+	// Meant for bulk imports that can be redone from their source.
+	DisableWAL bool
+}
+
+// Put stores the value for the key using the default write options.
 func (lsm *LSM) Put(key string, value []byte) error {
-	lsm.mu.Lock()
-	defer lsm.mu.Unlock()
+	return lsm.PutWithOptions(key, value, WriteOptions{})
+}
 
-	record := model.NewRecord(key, value, uint64(time.Now().UnixNano()), false)
+// PutWithOptions stores the value for the key, applying the given write options.
+func (lsm *LSM) PutWithOptions(key string, value []byte, opts WriteOptions) error {
+	_, err := lsm.write(key, value, false, opts)
+	return err
+}
 
-	logIndex, err := lsm.wal.WriteRecord(record)
-	if err != nil {
-		return err
-	}
-	// Update low water mark for the current memtable
-	lsm.lowWaterMark[len(lsm.memtables)-1] = logIndex
+// Delete removes the key using the default write options.
+func (lsm *LSM) Delete(key string) (bool, error) {
+	return lsm.DeleteWithOptions(key, WriteOptions{})
+}
 
-	err = lsm.memtables[len(lsm.memtables)-1].Put(record)
-	if err != nil {
-		return err
+// DeleteWithOptions removes the key, applying the given write options.
+func (lsm *LSM) DeleteWithOptions(key string, opts WriteOptions) (bool, error) {
+	return lsm.write(key, nil, true, opts)
+}
+
+/*
+write applies a Put or a Delete (tombstone). lsm.mu is held to make room for the write, assign its sequence,
+append it to the WAL and publish it, which fixes its commit order. Lock-free memtables are written after
+releasing lsm.mu, so concurrent writers only take turns on the WAL; they keep the record with the newest
+sequence when writes of one key land out of order. Other memtables lock on every write anyway and are
+written under lsm.mu. For deletes, returns whether the key existed in the memtable.
+*/
+func (lsm *LSM) write(key string, value []byte, tombstone bool, opts WriteOptions) (bool, error) {
+	if key == "" {
+		// Rejected up front, since a write is logged to the WAL before a lock-free memtable would reject it
+		return false, errors.New("key cannot be empty")
 	}
 
-	err = lsm.checkIfToFlush(key)
+	lsm.mu.Lock()
+	err := lsm.makeRoomForWriteUnsafe()
 	if err != nil {
-		return err
+		lsm.mu.Unlock()
+		return false, err
 	}
 
-	lsm.cache.Invalidate(key)
+	record := model.NewRecord(key, value, lsm.nextSequenceUnsafe(uint64(time.Now().UnixNano())), tombstone)
 
-	return nil
-}
+	if !opts.DisableWAL {
+		logIndex, err := lsm.wal.WriteRecord(record)
+		if err != nil {
+			lsm.mu.Unlock()
+			return false, err
+		}
+		// Update low water mark for the current memtable
+		lsm.lowWaterMark = logIndex
+	}
 
-func (lsm *LSM) Delete(key string) (bool, error) {
-	lsm.mu.Lock()
-	defer lsm.mu.Unlock()
+	mt := lsm.memtable
+	if !mt.Concurrent() {
+		defer lsm.mu.Unlock()
+		keyExists, err := applyToMemtable(mt, record)
+		if err != nil {
+			return false, err
+		}
+		lsm.publishUnsafe(record)
+		err = lsm.checkIfToFlush()
+		if err != nil {
+			return keyExists, err
+		}
+		lsm.cache.Invalidate(key)
+		return keyExists, nil
+	}
+
+	// Admitted writes count against the memtable's capacity, so a rotation here queues
+	// it only once it would be full, and its flush waits until the write is inserted
+	writers := lsm.memtableWriters
+	writers.add()
+	lsm.writesInFlight.Add(1)
+	publication := &pendingPublication{record: record}
+	lsm.unpublished = append(lsm.unpublished, publication)
+	flushErr := lsm.checkIfToFlush()
+	lsm.mu.Unlock()
 
-	record := model.NewRecord(key, nil, uint64(time.Now().UnixNano()), true)
+	keyExists, err := applyToMemtable(mt, record)
+	// Invalidated before the write stops counting as in flight, see Get
+	lsm.cache.Invalidate(key)
+	lsm.writesInFlight.Add(-1)
+	writers.done()
 
-	logIndex, err := lsm.wal.WriteRecord(record)
+	// Published only once visible to Get, after every earlier write
+	lsm.mu.Lock()
+	publication.inserted, publication.failed = true, err != nil
+	lsm.publishInsertedUnsafe()
+	lsm.mu.Unlock()
 	if err != nil {
 		return false, err
 	}
-	// Update low water mark for the current memtable
-	lsm.lowWaterMark[len(lsm.memtables)-1] = logIndex
-
-	keyExists := lsm.memtables[len(lsm.memtables)-1].Delete(record)
+	return keyExists, flushErr
+}
 
-	err = lsm.checkIfToFlush(key)
-	if err != nil {
-		return keyExists, err
+// applyToMemtable puts or deletes the record in the memtable, depending on its tombstone.
+func applyToMemtable(mt *memtable.MemTable, record *model.Record) (bool, error) {
+	if record.Tombstone {
+		return mt.Delete(record), nil
 	}
-
-	lsm.cache.Invalidate(key)
-
-	return keyExists, nil
+	return false, mt.Put(record)
 }
 
 /*
@@ -522,8 +710,7 @@ func (lsm *LSM) RangeScan(rangeStart string, rangeEnd string, pageSize int, page
 
 	// Check memtables first (newest to oldest)
 	// We use a large page size initially to collect all relevant keys
-	for i := len(lsm.memtables) - 1; i >= 0; i-- {
-		mt := lsm.memtables[i]
+	for _, mt := range lsm.memtablesUnsafe() {
 		mt.ScanForRange(rangeStart, rangeEnd, &tombstonedKeys, &bestKeys, 10000, 0) // Large page size to get all keys
 	}
 
@@ -559,8 +746,7 @@ checkMemtablesForRangeIterate checks the memtables in reverse order (newest to o
 */
 func (lsm *LSM) checkMemtablesForRangeIterate(rangeStart string, rangeEnd string, key string, tombstonedKeys *[]string) *model.Record {
 	var smallestRecord *model.Record = nil
-	for i := len(lsm.memtables) - 1; i >= 0; i-- {
-		mt := lsm.memtables[i]
+	for _, mt := range lsm.memtablesUnsafe() {
 		if record := mt.GetNextForRange(rangeStart, rangeEnd, key, tombstonedKeys); record != nil {
 			if smallestRecord == nil || record.Key < smallestRecord.Key {
 				smallestRecord = record
@@ -597,8 +783,7 @@ checkMemtables checks the memtables in reverse order (newest to oldest) for the
 */
 func (lsm *LSM) checkMemtablesForPrefixIterate(prefix string, key string, tomstonedKeys *[]string) *model.Record {
 	var smallestRecord *model.Record = nil
-	for i := len(lsm.memtables) - 1; i >= 0; i-- {
-		mt := lsm.memtables[i]
+	for _, mt := range lsm.memtablesUnsafe() {
 		if record := mt.GetNextForPrefix(prefix, key, tomstonedKeys); record != nil {
 			if smallestRecord == nil || record.Key < smallestRecord.Key {
 				smallestRecord = record
@@ -646,8 +831,7 @@ func (lsm *LSM) PrefixScan(prefix string, pageSize int, pageNumber int) ([]strin
 
 	// Check memtables first (newest to oldest)
 	// We use a large page size initially to collect all relevant keys
-	for i := len(lsm.memtables) - 1; i >= 0; i-- {
-		mt := lsm.memtables[i]
+	for _, mt := range lsm.memtablesUnsafe() {
 		mt.ScanForPrefix(prefix, &tombstonedKeys, &bestKeys, 10000, 0) // Large page size to get all keys
 	}
 
@@ -729,48 +913,74 @@ func (lsm *LSM) GetNextSSTableIndexWithIncrement() uint64 {
 	return current
 }
 
-func (lsm *LSM) checkIfToFlush(key string) error {
-	n := lsm.memtables[len(lsm.memtables)-1]
-	if uint64(len(lsm.memtables)) == MAX_MEMTABLES && n.IsFull() {
-		// Prepare batch: copy current memtables in order (oldest->newest)
-		batch := make([]*memtable.MemTable, len(lsm.memtables))
-		copy(batch, lsm.memtables)
-
-		// Copy low water marks for the memtables being flushed
-		lowWaterMarks := make([]uint64, len(batch))
-		copy(lowWaterMarks, lsm.lowWaterMark[:len(batch)])
-
-		// Assign indices for each memtable using the monotonic counter
-		indexes := make([]int, len(batch))
-		for i := 0; i < len(batch); i++ {
-			indexes[i] = int(lsm.GetNextSSTableIndexWithIncrement())
-		}
+// writeBufferUsageUnsafe returns the approximate bytes held by all memtables, including the ones
+// waiting to be flushed; must be called with lsm.mu held.
+func (lsm *LSM) writeBufferUsageUnsafe() int64 {
+	usage := int64(0)
+	for _, mt := range lsm.memtablesUnsafe() {
+		usage += mt.MemoryUsage()
+	}
+	return usage
+}
 
-		// Reset memtables with a fresh empty one so writers can continue immediately
-		fresh, _ := memtable.NewMemtable()
-		lsm.memtables = []*memtable.MemTable{fresh}
+// WriteBufferUsage returns the approximate number of bytes currently held by the memtables.
+func (lsm *LSM) WriteBufferUsage() int64 {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	return lsm.writeBufferUsageUnsafe()
+}
 
-		// Reset low water marks - keep the array but initialize first element to 0 for the fresh memtable
-		for i := range lsm.lowWaterMark {
-			lsm.lowWaterMark[i] = 0
+/*
+Flush forces every memtable holding data to be written out as a level 0 SSTable. With wait it also waits
+for the flushes to commit and persists the level layout, so writes made with DisableWAL are durable once
+it returns; without wait it only queues the flushes. It fails if a flush fails for good, see BackgroundError.
+*/
+func (lsm *LSM) Flush(wait bool) error {
+	lsm.mu.Lock()
+	if lsm.backgroundErr != nil {
+		err := lsm.backgroundErr
+		lsm.mu.Unlock()
+		return fmt.Errorf("failed to flush memtables: %w", err)
+	}
+	if lsm.memtable != nil && lsm.memtable.TotalEntries() > 0 {
+		if err := lsm.rotateMemtableUnsafe(); err != nil {
+			lsm.mu.Unlock()
+			return fmt.Errorf("failed to flush memtables: %w", err)
 		}
+	}
+	if !wait || len(lsm.immutables) == 0 {
+		lsm.mu.Unlock()
+		return nil
+	}
 
-		// Ensure flush pool exists (lazy init) with 4 workers
-		lsm.initFlushPoolOnce(4)
-
-		// Submit batch to pool (concurrently flushed, but committed oldest->newest)
-		lsm.flushPool.submitBatch(lsm, batch, indexes, lowWaterMarks)
+	// Memtables commit in queue order, so the newest one committing means all of them did
+	last := lsm.immutables[len(lsm.immutables)-1]
+	for !last.committed && lsm.backgroundErr == nil {
+		lsm.backgroundWork.Wait()
 	}
-	return nil
+	err := lsm.backgroundErr
+	lsm.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to flush memtables: %w", err)
+	}
+	return lsm.PersistLSM()
 }
 
 // maybeStartCompactions checks compaction triggers after a flush; left empty for now
 func (lsm *LSM) maybeStartCompactions() {
 	switch COMPACTION_TYPE {
 	case "size":
-		go lsm.sizeTieredCompaction()
+		lsm.background.Add(1)
+		go func() {
+			defer lsm.background.Done()
+			lsm.sizeTieredCompaction()
+		}()
 	case "level", "leveled":
-		go lsm.leveledCompaction()
+		lsm.background.Add(1)
+		go func() {
+			defer lsm.background.Done()
+			lsm.leveledCompaction()
+		}()
 	default:
 		// unsupported type: do nothing
 	}
@@ -823,19 +1033,19 @@ func (lsm *LSM) sizeTieredCompaction() {
 			// Assign new SSTable index
 			newIndex := int(lsm.GetNextSSTableIndexWithIncrement())
 
-			// Perform compaction (heavy IO), keep the level lock held to serialize same-level compactions
-			if err := sstable.Compact(group, newIndex); err != nil {
-				// If compaction fails, release and stop attempting this level for now
-				lsm.levelLocks[lvl].Unlock()
-				return
-			}
-
 			// Determine target level (next level if exists, else same level)
 			target := lvl
 			if lvl < maxLevels-1 {
 				target = lvl + 1
 			}
 
+			// Perform compaction (heavy IO), keep the level lock held to serialize same-level compactions
+			if err := sstable.Compact(group, newIndex, lvl, target); err != nil {
+				// If compaction fails, release and stop attempting this level for now
+				lsm.levelLocks[lvl].Unlock()
+				return
+			}
+
 			// Lock target level (if different) to avoid concurrent mutations there
 			if target != lvl {
 				lsm.levelLocks[target].Lock()
@@ -853,6 +1063,7 @@ func (lsm *LSM) sizeTieredCompaction() {
 			lsm.levels[lvl] = cur
 			// Append new index to target level
 			lsm.levels[target] = append(lsm.levels[target], uint64(newIndex))
+			lsm.compactionCommittedUnsafe(group)
 			lsm.mu.Unlock()
 
 			if target != lvl {
@@ -895,15 +1106,14 @@ func (lsm *LSM) leveledCompaction() {
 			// Lock target level as well to avoid races with its compactions
 			lsm.levelLocks[target].Lock()
 
-			// Snapshot candidate from source (oldest first)
+			// Snapshot the source level (oldest first) and pick the candidate from it
 			var srcIdx uint64
 			lsm.mu.RLock()
-			if len(lsm.levels[lvl]) > 0 {
-				srcIdx = lsm.levels[lvl][0]
-			} else {
-				srcIdx = 0
-			}
+			source := append([]uint64(nil), lsm.levels[lvl]...)
 			lsm.mu.RUnlock()
+			if len(source) > 0 {
+				srcIdx = pickCompactionCandidate(source)
+			}
 
 			if srcIdx == 0 && count == 0 {
 				// nothing to do
@@ -965,7 +1175,7 @@ func (lsm *LSM) leveledCompaction() {
 			newIndex := int(lsm.GetNextSSTableIndexWithIncrement())
 
 			// Perform compaction with both levels reserved
-			if err := sstable.Compact(compactionList, newIndex); err != nil {
+			if err := sstable.Compact(compactionList, newIndex, lvl, target); err != nil {
 				lsm.levelLocks[target].Unlock()
 				lsm.levelLocks[lvl].Unlock()
 				return
@@ -983,6 +1193,7 @@ func (lsm *LSM) leveledCompaction() {
 
 			// Append new compacted table to target level
 			lsm.levels[target] = append(lsm.levels[target], uint64(newIndex))
+			lsm.compactionCommittedUnsafe(compactionList)
 			lsm.mu.Unlock()
 
 			// Release locks and iterate again while over capacity
@@ -1002,8 +1213,51 @@ func removeFirstOccurrence(s []uint64, val uint64) []uint64 {
 	return s
 }
 
+/*
+pickCompactionCandidate returns the table of the level, given oldest first, that leveled compaction moves down next.
+Tables with the largest share of tombstones go first, since their deletions reach the older versions below soonest, but only if
+no older table of the level shares keys with them; otherwise the older version left behind would shadow the newer one.
+Falls back to the oldest table, also for tables written before properties existed.
+*/
+func pickCompactionCandidate(level []uint64) uint64 {
+	best, bestRatio := 0, 0.0
+	for position, index := range level {
+		properties, err := sstable.GetProperties(int(index))
+		if err != nil {
+			continue
+		}
+		ratio := properties.TombstoneRatio()
+		if ratio <= bestRatio || overlapsAny(index, level[:position]) {
+			continue
+		}
+		best, bestRatio = position, ratio
+	}
+	return level[best]
+}
+
+// overlapsAny reports whether the key range of the table intersects one of the others, unreadable bounds count as overlapping.
+func overlapsAny(index uint64, others []uint64) bool {
+	if len(others) == 0 {
+		return false
+	}
+	minKey, maxKey, err := sstable.GetSSBoundaries(int(index))
+	if err != nil {
+		return true
+	}
+	for _, other := range others {
+		otherMin, otherMax, err := sstable.GetSSBoundaries(int(other))
+		if err != nil || !(maxKey < otherMin || otherMax < minKey) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetLevels returns a copy of the current SSTable levels structure
 func (lsm *LSM) GetLevels() [][]int {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
 	// Create a deep copy to prevent external modification
 	levelsCopy := make([][]int, len(lsm.levels))
 	for i, level := range lsm.levels {
@@ -0,0 +1,1284 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hunddb/lsm/block_manager"
+	memtable "hunddb/lsm/memtable"
+	"hunddb/lsm/memtable/concurrent_skip_list"
+	memtable_interface "hunddb/lsm/memtable/memtable_interface"
+	"hunddb/lsm/sstable"
+	"hunddb/lsm/wal"
+	model "hunddb/model/record"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test helper functions
+
+func setupTestLSM(t *testing.T) *LSM {
+	tmpDir, err := os.MkdirTemp("", "lsm_test_")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+
+	// Change to test directory so the LSM, WAL and SSTables are created in it
+	oldDir, _ := os.Getwd()
+	os.Chdir(tmpDir)
+
+	t.Cleanup(func() {
+		os.Chdir(oldDir)
+		os.RemoveAll(tmpDir)
+	})
+
+	// Cached blocks and tables are keyed by relative path or index and would leak between test directories
+	block_manager.GetBlockManager().ClearCache()
+	sstable.ClearTableCache()
+
+	lsm, err := LoadLSM()
+	if err != nil {
+		t.Fatalf("Failed to load LSM: %v", err)
+	}
+	// Background flushes and compactions must not outlive the test directory (cleanups run last in, first out)
+	t.Cleanup(lsm.background.Wait)
+	return lsm
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("value_%d_%s", i, bytes.Repeat([]byte("x"), 500)))
+}
+
+// Test Cases
+
+// TestLSM_PutWithoutWAL verifies that writes with DisableWAL skip the WAL but stay readable
+func TestLSM_PutWithoutWAL(t *testing.T) {
+	lsm := setupTestLSM(t)
+
+	// Enough data to fill several WAL blocks if it were logged
+	for i := 0; i < 50; i++ {
+		err := lsm.PutWithOptions(fmt.Sprintf("bulk_%03d", i), testValue(i), WriteOptions{DisableWAL: true})
+		if err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+	}
+
+	if _, err := os.Stat("hunddb/lsm/wal/logs/wal_1.log"); !os.IsNotExist(err) {
+		t.Errorf("Expected no WAL segment to be written for WAL-less puts")
+	}
+
+	record, err, _ := lsm.Get("bulk_007")
+	if err != nil || record == nil {
+		t.Fatalf("Expected to read back bulk_007, got record=%v err=%v", record, err)
+	}
+	if !bytes.Equal(record.Value, testValue(7)) {
+		t.Errorf("Value mismatch for bulk_007")
+	}
+
+	existed, err := lsm.DeleteWithOptions("bulk_007", WriteOptions{DisableWAL: true})
+	if err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if !existed {
+		t.Errorf("Expected bulk_007 to exist before deletion")
+	}
+	if record, _, _ := lsm.Get("bulk_007"); record != nil {
+		t.Errorf("Expected bulk_007 to be deleted")
+	}
+}
+
+// TestLSM_FlushPersistsMemtables verifies that Flush moves memtable data to level 0 and survives a reload
+func TestLSM_FlushPersistsMemtables(t *testing.T) {
+	lsm := setupTestLSM(t)
+
+	for i := 0; i < 20; i++ {
+		err := lsm.PutWithOptions(fmt.Sprintf("key_%03d", i), testValue(i), WriteOptions{DisableWAL: true})
+		if err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+	}
+
+	err := lsm.Flush(true)
+	if err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	levels := lsm.GetLevels()
+	if len(levels[0]) != 1 {
+		t.Fatalf("Expected 1 table in level 0 after flush, got %d", len(levels[0]))
+	}
+	if stats := lsm.MemtableStats(); stats.MutableEntries != 0 || stats.ImmutableCount != 0 {
+		t.Errorf("Expected no buffered memtable data after flush, got %+v", stats)
+	}
+
+	// Flushing again with nothing buffered is a no-op
+	err = lsm.Flush(true)
+	if err != nil {
+		t.Fatalf("Second flush failed: %v", err)
+	}
+	if len(lsm.GetLevels()[0]) != 1 {
+		t.Errorf("Expected an empty flush not to create tables")
+	}
+
+	// The data must be readable from a freshly loaded LSM
+	reloaded, err := LoadLSM()
+	if err != nil {
+		t.Fatalf("Failed to reload LSM: %v", err)
+	}
+	if reloaded.IsDataLost() {
+		t.Fatalf("Reloaded LSM reports data loss")
+	}
+	for i := 0; i < 20; i++ {
+		record, err, _ := reloaded.Get(fmt.Sprintf("key_%03d", i))
+		if err != nil || record == nil {
+			t.Fatalf("Expected key_%03d after reload, got record=%v err=%v", i, record, err)
+		}
+		if !bytes.Equal(record.Value, testValue(i)) {
+			t.Errorf("Value mismatch for key_%03d after reload", i)
+		}
+	}
+}
+
+// collectEvents reads count events from the subscription, failing the test if they do not arrive in time
+func collectEvents(t *testing.T, sub *Subscription, count int) []ChangeEvent {
+	t.Helper()
+	events := make([]ChangeEvent, 0, count)
+	for len(events) < count {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				t.Fatalf("Subscription ended after %d of %d events (err=%v)", len(events), count, sub.Err())
+			}
+			events = append(events, event)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for events, got %d of %d", len(events), count)
+		}
+	}
+	return events
+}
+
+// TestLSM_SubscribeLiveChanges verifies that subscribers receive matching puts and deletes in commit order
+func TestLSM_SubscribeLiveChanges(t *testing.T) {
+	lsm := setupTestLSM(t)
+
+	sub, err := lsm.Subscribe("user:", 0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	lsm.Put("user:1", []byte("alice"))
+	lsm.Put("order:1", []byte("ignored"))
+	lsm.Put("user:2", []byte("bob"))
+	lsm.Delete("user:1")
+
+	events := collectEvents(t, sub, 3)
+	expected := []struct {
+		key       string
+		value     string
+		tombstone bool
+	}{
+		{"user:1", "alice", false},
+		{"user:2", "bob", false},
+		{"user:1", "", true},
+	}
+	for i, event := range events {
+		if event.Key != expected[i].key || string(event.Value) != expected[i].value || event.Tombstone != expected[i].tombstone {
+			t.Errorf("Event %d: expected %+v, got key=%s value=%q tombstone=%v", i, expected[i], event.Key, event.Value, event.Tombstone)
+		}
+		if i > 0 && event.Sequence <= events[i-1].Sequence {
+			t.Errorf("Expected strictly increasing sequences, got %d after %d", event.Sequence, events[i-1].Sequence)
+		}
+	}
+
+	sub.Close()
+	select {
+	case _, ok := <-sub.Events:
+		if ok {
+			t.Errorf("Expected no further events after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected Events to be closed after Close")
+	}
+}
+
+// TestLSM_SubscribeReplaysFromWAL verifies that a subscription can resume from a sequence still in the WAL
+func TestLSM_SubscribeReplaysFromWAL(t *testing.T) {
+	lsm := setupTestLSM(t)
+
+	first, err := lsm.Subscribe("", 0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		lsm.Put(fmt.Sprintf("key_%d", i), testValue(i))
+	}
+	seen := collectEvents(t, first, 5)
+	first.Close()
+
+	// Resume from the third change - it and everything after it is replayed, then live changes follow
+	resumed, err := lsm.Subscribe("", seen[2].Sequence)
+	if err != nil {
+		t.Fatalf("Failed to resume subscription: %v", err)
+	}
+	defer resumed.Close()
+	lsm.Put("key_5", testValue(5))
+
+	events := collectEvents(t, resumed, 4)
+	for i, event := range events {
+		expectedKey := fmt.Sprintf("key_%d", i+2)
+		if event.Key != expectedKey {
+			t.Errorf("Event %d: expected %s, got %s", i, expectedKey, event.Key)
+		}
+		if !bytes.Equal(event.Value, testValue(i+2)) {
+			t.Errorf("Event %d: value mismatch", i)
+		}
+	}
+	if events[0].Sequence != seen[2].Sequence {
+		t.Errorf("Expected replay to start at sequence %d, got %d", seen[2].Sequence, events[0].Sequence)
+	}
+}
+
+// TestLSM_SubscribeTruncated verifies that resuming from changes already retired from the WAL fails instead of skipping them
+func TestLSM_SubscribeTruncated(t *testing.T) {
+	oldLogSize := wal.LOG_SIZE
+	wal.LOG_SIZE = 1 // A segment per block, so flushes retire segments quickly
+	defer func() { wal.LOG_SIZE = oldLogSize }()
+	useMemtableCapacity(t, 10)
+	lsm := setupTestLSM(t)
+
+	first, err := lsm.Subscribe("", 0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	value := bytes.Repeat([]byte("v"), 1024)
+	for i := 0; i < 30; i++ {
+		if err := lsm.Put(fmt.Sprintf("key_%02d", i), value); err != nil {
+			t.Fatalf("Failed to put record: %v", err)
+		}
+	}
+	seen := collectEvents(t, first, 30)
+	first.Close()
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	if _, err := lsm.Subscribe("", seen[0].Sequence); !errors.Is(err, ErrSequenceTruncated) {
+		t.Fatalf("Expected ErrSequenceTruncated for a retired sequence, got %v", err)
+	}
+
+	// The latest change is still in the WAL segment being written to
+	resumed, err := lsm.Subscribe("", seen[29].Sequence)
+	if err != nil {
+		t.Fatalf("Failed to resume from a retained sequence: %v", err)
+	}
+	defer resumed.Close()
+	if events := collectEvents(t, resumed, 1); events[0].Key != "key_29" {
+		t.Errorf("Expected the replay to start at key_29, got %s", events[0].Key)
+	}
+}
+
+// TestLSM_SubscribeReplayWhileWriting verifies that writes committed while a subscription replays the WAL
+// are delivered once each, after the replayed ones
+func TestLSM_SubscribeReplayWhileWriting(t *testing.T) {
+	lsm := setupTestLSM(t)
+	oldBufferSize := SUBSCRIPTION_BUFFER_SIZE
+	SUBSCRIPTION_BUFFER_SIZE = 1000
+	defer func() { SUBSCRIPTION_BUFFER_SIZE = oldBufferSize }()
+
+	first, err := lsm.Subscribe("", 0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		lsm.Put(fmt.Sprintf("before_%03d", i), testValue(i))
+	}
+	fromSeq := collectEvents(t, first, 1)[0].Sequence
+	first.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			lsm.Put(fmt.Sprintf("during_%03d", i), testValue(i))
+		}
+	}()
+	sub, err := lsm.Subscribe("", fromSeq)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+	<-done
+
+	events := collectEvents(t, sub, 400)
+	keys := make(map[string]bool)
+	for i, event := range events {
+		if i > 0 && event.Sequence <= events[i-1].Sequence {
+			t.Fatalf("Expected strictly increasing sequences, got %d after %d", event.Sequence, events[i-1].Sequence)
+		}
+		if keys[event.Key] {
+			t.Fatalf("Expected %s to be delivered once", event.Key)
+		}
+		keys[event.Key] = true
+	}
+	select {
+	case event := <-sub.Events:
+		t.Errorf("Expected no further events, got %s", event.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestLSM_SubscriptionLagged verifies that a subscriber that stops reading is dropped instead of blocking writes
+func TestLSM_SubscriptionLagged(t *testing.T) {
+	lsm := setupTestLSM(t)
+	oldBufferSize := SUBSCRIPTION_BUFFER_SIZE
+	SUBSCRIPTION_BUFFER_SIZE = 2
+	defer func() { SUBSCRIPTION_BUFFER_SIZE = oldBufferSize }()
+
+	sub, err := lsm.Subscribe("", 0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(fmt.Sprintf("key_%d", i), testValue(i)); err != nil {
+			t.Fatalf("Put blocked or failed on a lagging subscriber: %v", err)
+		}
+	}
+
+	// The buffered changes are still delivered before the subscription ends
+	received := 0
+	for range sub.Events {
+		received++
+	}
+	if received == 0 || received >= 10 {
+		t.Errorf("Expected only the buffered changes to be delivered, got %d", received)
+	}
+	if !errors.Is(sub.Err(), ErrSubscriptionLagged) {
+		t.Errorf("Expected ErrSubscriptionLagged, got %v", sub.Err())
+	}
+}
+
+// TestLSM_MemtableByteBudget verifies that large values fill memtables by size rather than key count
+func TestLSM_MemtableByteBudget(t *testing.T) {
+	lsm := setupTestLSM(t)
+	oldMaxSize, oldWriteBuffer := memtable.MAX_SIZE_BYTES, WRITE_BUFFER_SIZE
+	memtable.MAX_SIZE_BYTES = 64 * 1024
+	WRITE_BUFFER_SIZE = 0
+	defer func() { memtable.MAX_SIZE_BYTES, WRITE_BUFFER_SIZE = oldMaxSize, oldWriteBuffer }()
+
+	bigValue := bytes.Repeat([]byte("v"), 20*1024)
+	for i := 0; i < 4; i++ {
+		if err := lsm.PutWithOptions(fmt.Sprintf("big_%d", i), bigValue, WriteOptions{DisableWAL: true}); err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+		if i == 2 {
+			if usage := lsm.WriteBufferUsage(); usage < 3*20*1024 {
+				t.Errorf("Expected write buffer usage of at least %d bytes, got %d", 3*20*1024, usage)
+			}
+		}
+	}
+
+	// 4 values of 20KB exceed the 64KB budget, so the memtable must have been queued for flushing
+	stats := lsm.MemtableStats()
+	if stats.ImmutableCount+int(stats.FlushesCompleted) != 1 || stats.MutableEntries != 0 {
+		t.Errorf("Expected the byte budget to switch to a fresh memtable, got %+v", stats)
+	}
+}
+
+// TestLSM_UnknownMemtableType verifies that a memtable type no implementation registered fails loading
+func TestLSM_UnknownMemtableType(t *testing.T) {
+	setupTestLSM(t)
+	oldType := memtable.MEMTABLE_TYPE
+	memtable.MEMTABLE_TYPE = "no_such_memtable"
+	defer func() { memtable.MEMTABLE_TYPE = oldType }()
+
+	lsm, err := LoadLSM()
+	if err == nil {
+		t.Fatalf("Expected an unknown memtable type to fail loading")
+	}
+	if lsm != nil {
+		t.Errorf("Expected no LSM alongside the error")
+	}
+	if !strings.Contains(err.Error(), "unknown memtable type") {
+		t.Errorf("Expected an unknown memtable type error, got %v", err)
+	}
+}
+
+// TestLSM_WriteBufferLimit verifies that reaching the global write buffer budget flushes the memtables early
+func TestLSM_WriteBufferLimit(t *testing.T) {
+	lsm := setupTestLSM(t)
+	oldMaxSize, oldWriteBuffer := memtable.MAX_SIZE_BYTES, WRITE_BUFFER_SIZE
+	memtable.MAX_SIZE_BYTES = 0
+	WRITE_BUFFER_SIZE = 100 * 1024
+	defer func() { memtable.MAX_SIZE_BYTES, WRITE_BUFFER_SIZE = oldMaxSize, oldWriteBuffer }()
+
+	bigValue := bytes.Repeat([]byte("v"), 20*1024)
+	for i := 0; i < 6; i++ {
+		if err := lsm.PutWithOptions(fmt.Sprintf("big_%d", i), bigValue, WriteOptions{DisableWAL: true}); err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+	}
+	if usage := lsm.WriteBufferUsage(); usage >= int64(WRITE_BUFFER_SIZE) {
+		t.Errorf("Expected the write buffer to be flushed, still holding %d bytes", usage)
+	}
+
+	// The early flush runs in the background - wait for its table to reach level 0
+	deadline := time.Now().Add(5 * time.Second)
+	for len(lsm.GetLevels()[0]) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected an SSTable in level 0 after the write buffer filled up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 6; i++ {
+		record, err, _ := lsm.Get(fmt.Sprintf("big_%d", i))
+		if err != nil || record == nil || !bytes.Equal(record.Value, bigValue) {
+			t.Errorf("Expected big_%d to be readable after the early flush (err=%v)", i, err)
+		}
+	}
+}
+
+// useMemtableCapacity sets the memtable key capacity for the duration of the test
+func useMemtableCapacity(t *testing.T, capacity uint64) {
+	oldCapacity, oldMaxSize := memtable.CAPACITY, memtable.MAX_SIZE_BYTES
+	memtable.CAPACITY, memtable.MAX_SIZE_BYTES = capacity, 0
+	t.Cleanup(func() { memtable.CAPACITY, memtable.MAX_SIZE_BYTES = oldCapacity, oldMaxSize })
+}
+
+// useMemtableType sets the memtable implementation for the duration of the test
+func useMemtableType(t *testing.T, memtableType memtable.MemtableType) {
+	oldType := memtable.MEMTABLE_TYPE
+	memtable.MEMTABLE_TYPE = memtableType
+	t.Cleanup(func() { memtable.MEMTABLE_TYPE = oldType })
+}
+
+// waitForFlushes waits until no memtable is left in the flush queue
+func waitForFlushes(t *testing.T, lsm *LSM) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for lsm.MemtableStats().ImmutableCount > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for queued memtables to be flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestLSM_ImmutableMemtablesStallWrites verifies that queued memtables stay readable and that
+// writes stall only once the flush queue is full
+func TestLSM_ImmutableMemtablesStallWrites(t *testing.T) {
+	useMemtableCapacity(t, 2)
+	lsm := setupTestLSM(t)
+	oldMaxMemtables := MAX_MEMTABLES
+	MAX_MEMTABLES = 4
+	defer func() { MAX_MEMTABLES = oldMaxMemtables }()
+
+	// A pool without workers keeps every full memtable in the queue until workers are started
+	lsm.mu.Lock()
+	lsm.flushPool = NewFlushPool(0)
+	lsm.mu.Unlock()
+
+	// 3 full memtables fill the queue, the last 2 writes go to the mutable memtable
+	for i := 0; i < 8; i++ {
+		if err := lsm.Put(fmt.Sprintf("key_%d", i), testValue(i)); err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+	}
+	stats := lsm.MemtableStats()
+	if stats.ImmutableCount != 3 || stats.MutableEntries != 2 || lsm.WriteStallStats().StoppedWrites != 0 {
+		t.Fatalf("Expected 3 queued memtables and no stalls, got %+v", stats)
+	}
+	for i := 0; i < 8; i++ {
+		record, err, _ := lsm.Get(fmt.Sprintf("key_%d", i))
+		if err != nil || record == nil || !bytes.Equal(record.Value, testValue(i)) {
+			t.Fatalf("Expected key_%d to be readable while its memtable waits for a flush (err=%v)", i, err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- lsm.Put("key_8", testValue(8)) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the write to stall on a full flush queue, it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if stallStats := lsm.WriteStallStats(); stallStats.StalledWriters != 1 || stallStats.Condition != WriteConditionStopped || stallStats.Cause != StallCauseMemtables {
+		t.Errorf("Expected 1 writer stopped by the memtables, got %+v", stallStats)
+	}
+
+	lsm.flushPool.start(1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Stalled write failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the stalled write to resume once a flush committed")
+	}
+
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	stallStats := lsm.WriteStallStats()
+	if stallStats.StoppedWrites != 1 || stallStats.StopsByCause[StallCauseMemtables] != 1 || stallStats.StopTime <= 0 || stallStats.StalledWriters != 0 {
+		t.Errorf("Expected one recorded stall, got %+v", stallStats)
+	}
+	stats = lsm.MemtableStats()
+	if stats.FlushesCompleted != 5 || stats.FlushesFailed != 0 {
+		t.Errorf("Expected 5 memtables committed to level 0 one by one, got %+v", stats)
+	}
+	for i := 0; i < 9; i++ {
+		record, err, _ := lsm.Get(fmt.Sprintf("key_%d", i))
+		if err != nil || record == nil || !bytes.Equal(record.Value, testValue(i)) {
+			t.Errorf("Expected key_%d to be readable after the flushes (err=%v)", i, err)
+		}
+	}
+}
+
+// TestLSM_ReloadRecoversMemtables verifies that unflushed writes are recovered from the WAL
+// when the LSM is reloaded over existing files, including memtables that fill up during recovery
+func TestLSM_ReloadRecoversMemtables(t *testing.T) {
+	useMemtableCapacity(t, 3)
+	lsm := setupTestLSM(t)
+
+	for i := 0; i < 2; i++ {
+		if err := lsm.Put(fmt.Sprintf("flushed_%d", i), testValue(i)); err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := lsm.Put(fmt.Sprintf("key_%d", i), testValue(i)); err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+	}
+	waitForFlushes(t, lsm)
+	if err := lsm.PersistLSM(); err != nil {
+		t.Fatalf("PersistLSM failed: %v", err)
+	}
+	if err := lsm.wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	reloaded, err := LoadLSM()
+	if err != nil {
+		t.Fatalf("Failed to reload LSM: %v", err)
+	}
+	t.Cleanup(reloaded.background.Wait)
+	if reloaded.IsDataLost() {
+		t.Fatalf("Reloaded LSM reports data loss")
+	}
+	if err := reloaded.Put("after_reload", []byte("ok")); err != nil {
+		t.Fatalf("Put after reload failed: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		record, err, _ := reloaded.Get(fmt.Sprintf("key_%d", i))
+		if err != nil || record == nil || !bytes.Equal(record.Value, testValue(i)) {
+			t.Errorf("Expected key_%d after reload (err=%v)", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if record, _, _ := reloaded.Get(fmt.Sprintf("flushed_%d", i)); record == nil {
+			t.Errorf("Expected flushed_%d after reload", i)
+		}
+	}
+	if record, _, _ := reloaded.Get("after_reload"); record == nil || string(record.Value) != "ok" {
+		t.Errorf("Expected the write after reload to be readable")
+	}
+}
+
+// useWriteStallTriggers sets the level 0 write stall triggers and compaction for the duration of the test
+func useWriteStallTriggers(t *testing.T, lsm *LSM, slowdown uint64, stop uint64, delay time.Duration, compactionType string) {
+	lsm.background.Wait()
+	oldSlowdown, oldStop, oldDelay := LEVEL0_SLOWDOWN_WRITES_TRIGGER, LEVEL0_STOP_WRITES_TRIGGER, WRITE_SLOWDOWN_DELAY
+	oldCompaction, oldMaxPer := COMPACTION_TYPE, MAX_TABLES_PER_LEVEL
+	LEVEL0_SLOWDOWN_WRITES_TRIGGER, LEVEL0_STOP_WRITES_TRIGGER, WRITE_SLOWDOWN_DELAY = slowdown, stop, delay
+	COMPACTION_TYPE, MAX_TABLES_PER_LEVEL = compactionType, 2
+	t.Cleanup(func() {
+		LEVEL0_SLOWDOWN_WRITES_TRIGGER, LEVEL0_STOP_WRITES_TRIGGER, WRITE_SLOWDOWN_DELAY = oldSlowdown, oldStop, oldDelay
+		lsm.background.Wait()
+		COMPACTION_TYPE, MAX_TABLES_PER_LEVEL = oldCompaction, oldMaxPer
+	})
+}
+
+// flushTables writes count level 0 SSTables with one key each
+func flushTables(t *testing.T, lsm *LSM, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := lsm.Put(fmt.Sprintf("table_%d", i), testValue(i)); err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+		if err := lsm.Flush(true); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+}
+
+// TestLSM_Level0SlowdownDelaysWrites verifies that writes are delayed once level 0 reaches the slowdown trigger
+func TestLSM_Level0SlowdownDelaysWrites(t *testing.T) {
+	lsm := setupTestLSM(t)
+	useWriteStallTriggers(t, lsm, 1, 0, 50*time.Millisecond, "")
+
+	if err := lsm.Put("before", []byte("fast")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if stats := lsm.WriteStallStats(); stats.Condition != WriteConditionNormal || stats.DelayedWrites != 0 {
+		t.Fatalf("Expected no throttling with an empty level 0, got %+v", stats)
+	}
+
+	flushTables(t, lsm, 1)
+	if stats := lsm.WriteStallStats(); stats.Condition != WriteConditionDelayed || stats.Cause != StallCauseLevel0 {
+		t.Errorf("Expected writes to be delayed by level 0, got %+v", stats)
+	}
+
+	start := time.Now()
+	if err := lsm.Put("after", []byte("slow")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the write to be delayed by at least 50ms, took %v", elapsed)
+	}
+	stats := lsm.WriteStallStats()
+	if stats.DelayedWrites != 1 || stats.DelayTime != 50*time.Millisecond || stats.StoppedWrites != 0 {
+		t.Errorf("Expected 1 delayed write, got %+v", stats)
+	}
+}
+
+// TestLSM_Level0StopBlocksWrites verifies that writes wait while level 0 is at the stop trigger
+// and resume once compaction brings it back down
+func TestLSM_Level0StopBlocksWrites(t *testing.T) {
+	lsm := setupTestLSM(t)
+	useWriteStallTriggers(t, lsm, 0, 3, 0, "")
+
+	flushTables(t, lsm, 3)
+	stats := lsm.WriteStallStats()
+	if stats.Condition != WriteConditionStopped || stats.Cause != StallCauseLevel0 || stats.Level0Tables != 3 {
+		t.Fatalf("Expected writes to be stopped by level 0, got %+v", stats)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- lsm.Put("blocked", []byte("value")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the write to wait for compaction, it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if stats := lsm.WriteStallStats(); stats.StalledWriters != 1 {
+		t.Errorf("Expected 1 stalled writer, got %+v", stats)
+	}
+	record, err, _ := lsm.Get("table_0")
+	if err != nil || record == nil {
+		t.Errorf("Expected reads to proceed while writes are stopped (err=%v)", err)
+	}
+
+	// Size-tiered compaction merges the 2 oldest tables into level 1, leaving 2 in level 0
+	lsm.background.Wait()
+	COMPACTION_TYPE = "size"
+	lsm.maybeStartCompactions()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Stopped write failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the write to resume after compaction")
+	}
+
+	stats = lsm.WriteStallStats()
+	if stats.StoppedWrites != 1 || stats.StopsByCause[StallCauseLevel0] != 1 || stats.StopTime <= 0 || stats.Condition != WriteConditionNormal {
+		t.Errorf("Expected one recorded level 0 stop, got %+v", stats)
+	}
+	if record, _, _ := lsm.Get("blocked"); record == nil {
+		t.Errorf("Expected the resumed write to be readable")
+	}
+}
+
+// TestLSM_PendingCompactionBytes verifies the compaction debt estimate and its stop threshold
+func TestLSM_PendingCompactionBytes(t *testing.T) {
+	lsm := setupTestLSM(t)
+	useWriteStallTriggers(t, lsm, 0, 0, 0, "leveled")
+	oldStop := PENDING_COMPACTION_STOP_BYTES
+	PENDING_COMPACTION_STOP_BYTES = 1
+	defer func() { PENDING_COMPACTION_STOP_BYTES = oldStop }()
+
+	flushTables(t, lsm, 2)
+	if stats := lsm.WriteStallStats(); stats.PendingCompactionBytes != 0 {
+		t.Errorf("Expected no compaction debt within the level capacity, got %+v", stats)
+	}
+
+	// Add a third table directly, leveled compaction would otherwise start on its flush
+	lsm.mu.Lock()
+	lsm.levels[0] = append(lsm.levels[0], lsm.levels[0][0])
+	lsm.refreshPendingCompactionBytesUnsafe()
+	lsm.mu.Unlock()
+	stats := lsm.WriteStallStats()
+	if stats.PendingCompactionBytes <= 0 || stats.Condition != WriteConditionStopped || stats.Cause != StallCausePendingCompaction {
+		t.Errorf("Expected writes to be stopped on the compaction debt of an overfull level 0, got %+v", stats)
+	}
+
+	lsm.mu.Lock()
+	lsm.levels[0] = lsm.levels[0][:2]
+	lsm.compactionCommittedUnsafe(nil)
+	lsm.mu.Unlock()
+	if stats := lsm.WriteStallStats(); stats.PendingCompactionBytes != 0 || stats.Condition != WriteConditionNormal {
+		t.Errorf("Expected the debt to clear once the level is within capacity, got %+v", stats)
+	}
+}
+
+// TestLSM_FailedFlushStopsWrites verifies that a flush failing past its retries keeps the memtable readable,
+// fails writes and Flush with the background error, and that Resume retries the flush and accepts writes again
+func TestLSM_FailedFlushStopsWrites(t *testing.T) {
+	useMemtableCapacity(t, 2)
+	lsm := setupTestLSM(t)
+	oldRetries, oldBackoff := FLUSH_MAX_RETRIES, FLUSH_RETRY_BACKOFF
+	FLUSH_MAX_RETRIES, FLUSH_RETRY_BACKOFF = 2, time.Millisecond
+	t.Cleanup(func() {
+		lsm.background.Wait()
+		FLUSH_MAX_RETRIES, FLUSH_RETRY_BACKOFF = oldRetries, oldBackoff
+	})
+
+	// A directory in place of the SSTable file makes every attempt to write it fail
+	blocked := fmt.Sprintf("sstable_%d.db", lsm.NextSSTableIndex)
+	if err := os.Mkdir(blocked, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", blocked, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := lsm.Put(fmt.Sprintf("key_%d", i), testValue(i)); err != nil {
+			t.Fatalf("Failed to put record %d: %v", i, err)
+		}
+	}
+	if err := lsm.Flush(true); err == nil {
+		t.Fatalf("Expected Flush to report the failed flush")
+	}
+	if lsm.BackgroundError() == nil {
+		t.Fatalf("Expected a background error after the flush ran out of retries")
+	}
+	if err := lsm.Put("key_2", testValue(2)); !errors.Is(err, ErrWritesStopped) {
+		t.Fatalf("Expected writes to fail with ErrWritesStopped, got %v", err)
+	}
+	stats := lsm.MemtableStats()
+	if stats.FlushRetries != 2 || stats.FlushesFailed != 1 || stats.ImmutableCount != 1 {
+		t.Errorf("Expected 2 retries, 1 failed flush and its memtable still queued, got %+v", stats)
+	}
+	for i := 0; i < 2; i++ {
+		record, err, _ := lsm.Get(fmt.Sprintf("key_%d", i))
+		if err != nil || record == nil || !bytes.Equal(record.Value, testValue(i)) {
+			t.Errorf("Expected key_%d to stay readable after the failed flush (err=%v)", i, err)
+		}
+	}
+
+	if err := os.Remove(blocked); err != nil {
+		t.Fatalf("Failed to remove %s: %v", blocked, err)
+	}
+	lsm.Resume()
+	if err := lsm.Put("key_2", testValue(2)); err != nil {
+		t.Fatalf("Expected writes to be accepted after Resume, got %v", err)
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Flush failed after Resume: %v", err)
+	}
+	if lsm.BackgroundError() != nil || lsm.MemtableStats().FlushesCompleted != 2 {
+		t.Errorf("Expected both memtables committed once resumed, got %+v", lsm.MemtableStats())
+	}
+	for i := 0; i < 3; i++ {
+		record, err, _ := lsm.Get(fmt.Sprintf("key_%d", i))
+		if err != nil || record == nil || !bytes.Equal(record.Value, testValue(i)) {
+			t.Errorf("Expected key_%d to be readable after the flushes (err=%v)", i, err)
+		}
+	}
+}
+
+// useNoCompaction turns automatic compactions off for the duration of the test
+func useNoCompaction(t *testing.T, lsm *LSM) {
+	lsm.background.Wait()
+	oldCompaction := COMPACTION_TYPE
+	COMPACTION_TYPE = ""
+	t.Cleanup(func() {
+		lsm.background.Wait()
+		COMPACTION_TYPE = oldCompaction
+	})
+}
+
+// expectValue fails the test unless the key holds the value, or is deleted when value is nil
+func expectValue(t *testing.T, lsm *LSM, key string, value []byte) {
+	t.Helper()
+	record, err, _ := lsm.Get(key)
+	if value == nil {
+		// A deleted key reads as its tombstone, or as not found once compaction dropped it
+		if record != nil && !record.Tombstone {
+			t.Errorf("Expected %s to be deleted, got %q", key, record.Value)
+		}
+		return
+	}
+	if err != nil || record == nil || record.Tombstone || !bytes.Equal(record.Value, value) {
+		t.Errorf("Expected %s to hold %q, got %+v (err=%v)", key, value, record, err)
+	}
+}
+
+// TestLSM_FlushWithoutWait verifies that Flush(false) queues the memtable and returns before it is committed
+func TestLSM_FlushWithoutWait(t *testing.T) {
+	lsm := setupTestLSM(t)
+
+	if err := lsm.Put("key", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := lsm.Flush(false); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if stats := lsm.MemtableStats(); stats.MutableEntries != 0 {
+		t.Errorf("Expected the memtable to be queued for its flush, got %+v", stats)
+	}
+	waitForFlushes(t, lsm)
+	if levels := lsm.GetLevels(); len(levels[0]) != 1 {
+		t.Errorf("Expected 1 level 0 SSTable, got %v", levels)
+	}
+	expectValue(t, lsm, "key", []byte("value"))
+}
+
+// TestLSM_CompactRange verifies that CompactRange moves the tables holding a key range, and the tables
+// sharing keys with them, to the bottom level without resurrecting older versions
+func TestLSM_CompactRange(t *testing.T) {
+	lsm := setupTestLSM(t)
+	useNoCompaction(t, lsm)
+	bottom := int(MAX_LEVELS) - 1
+
+	put := func(key string, value string) {
+		t.Helper()
+		if err := lsm.Put(key, []byte(value)); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	flush := func() {
+		t.Helper()
+		if err := lsm.Flush(true); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	put("a_1", "old")
+	put("a_2", "old")
+	flush()
+	put("b_1", "only")
+	flush()
+	put("a_1", "new")
+	if _, err := lsm.Delete("a_2"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	flush()
+	levels := lsm.GetLevels()
+	if len(levels[0]) != 3 {
+		t.Fatalf("Expected 3 level 0 SSTables, got %v", levels)
+	}
+	bTable := levels[0][1]
+
+	// Only a_1 is asked for, but both tables holding a_* keys have to move down together
+	if err := lsm.CompactRange("a_1", "a_1"); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	levels = lsm.GetLevels()
+	if len(levels[0]) != 1 || levels[0][0] != bTable || len(levels[bottom]) != 1 {
+		t.Fatalf("Expected the b_* table left in level 0 and one bottom level table, got %v", levels)
+	}
+	expectValue(t, lsm, "a_1", []byte("new"))
+	expectValue(t, lsm, "a_2", nil)
+	expectValue(t, lsm, "b_1", []byte("only"))
+
+	// Nothing holds keys in the range
+	if err := lsm.CompactRange("z", "zz"); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	if after := lsm.GetLevels(); len(after[0]) != 1 || len(after[bottom]) != 1 {
+		t.Errorf("Expected an empty range to leave the levels alone, got %v", after)
+	}
+
+	// An open range compacts everything, the memtable included
+	put("c_1", "memtable")
+	if err := lsm.CompactRange("", ""); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	levels = lsm.GetLevels()
+	for lvl := 0; lvl < bottom; lvl++ {
+		if len(levels[lvl]) != 0 {
+			t.Fatalf("Expected every table in the bottom level, got %v", levels)
+		}
+	}
+	if len(levels[bottom]) != 1 {
+		t.Fatalf("Expected a single bottom level table, got %v", levels)
+	}
+	expectValue(t, lsm, "a_1", []byte("new"))
+	expectValue(t, lsm, "a_2", nil)
+	expectValue(t, lsm, "b_1", []byte("only"))
+	expectValue(t, lsm, "c_1", []byte("memtable"))
+
+	if err := lsm.CompactRange("b", "a"); err == nil {
+		t.Errorf("Expected an error for a range whose start is after its end")
+	}
+}
+
+// TestLSM_CompactionPicksTombstoneHeavyTables verifies that leveled compaction moves the table with the most
+// tombstones down first, unless an older table of the level shares keys with it
+func TestLSM_CompactionPicksTombstoneHeavyTables(t *testing.T) {
+	lsm := setupTestLSM(t)
+	useNoCompaction(t, lsm)
+
+	// Writes five keys of the prefix as a level 0 table, the first deleted of them as tombstones
+	writeTable := func(prefix string, deleted int) {
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("%s_%d", prefix, i)
+			var err error
+			if i < deleted {
+				_, err = lsm.Delete(key)
+			} else {
+				err = lsm.Put(key, testValue(i))
+			}
+			if err != nil {
+				t.Fatalf("Failed to write %s: %v", key, err)
+			}
+		}
+		if err := lsm.Flush(true); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	writeTable("b", 0) // Oldest, no tombstones
+	writeTable("a", 2) // Overlaps nothing older
+	level0 := func() []uint64 {
+		lsm.mu.RLock()
+		defer lsm.mu.RUnlock()
+		return append([]uint64(nil), lsm.levels[0]...)
+	}
+
+	tables := level0()
+	if picked := pickCompactionCandidate(tables); picked != tables[1] {
+		t.Errorf("Expected the table with tombstones %d to be picked, got %d", tables[1], picked)
+	}
+
+	// Deleting every key of the oldest table must not move those tombstones below it
+	writeTable("b", 5)
+	tables = level0()
+	if picked := pickCompactionCandidate(tables); picked != tables[1] {
+		t.Errorf("Expected table %d while the overlapping table %d waits, got %d", tables[1], tables[2], picked)
+	}
+
+	properties, err := sstable.GetProperties(int(tables[2]))
+	if err != nil || properties == nil {
+		t.Fatalf("Expected properties for table %d, got %v %v", tables[2], properties, err)
+	}
+	if properties.CreationReason != sstable.CREATION_REASON_FLUSH || properties.RecordCount != 5 || properties.TombstoneCount != 5 {
+		t.Errorf("Unexpected flush properties %+v", properties)
+	}
+
+	if err := lsm.CompactRange("", ""); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+	levels := lsm.GetLevels()
+	bottom := levels[len(levels)-1]
+	properties, err = sstable.GetProperties(bottom[0])
+	if err != nil || properties == nil {
+		t.Fatalf("Expected properties for the compacted table, got %v %v", properties, err)
+	}
+	if properties.CreationReason != sstable.CREATION_REASON_COMPACTION || properties.SourceLevel != 0 || len(properties.InputTables) != 3 {
+		t.Errorf("Unexpected compaction properties %+v", properties)
+	}
+}
+
+// TestLSM_TombstonesShadowDeeperLevels verifies that a deleted key stays deleted while an older version
+// of it sits in a deeper level, also after leveled compaction moved the tombstone down
+func TestLSM_TombstonesShadowDeeperLevels(t *testing.T) {
+	lsm := setupTestLSM(t)
+	useNoCompaction(t, lsm)
+	oldMaxPer := MAX_TABLES_PER_LEVEL
+	MAX_TABLES_PER_LEVEL = 1
+	t.Cleanup(func() { MAX_TABLES_PER_LEVEL = oldMaxPer })
+
+	// Reads cache what they find, so each key is only read once its tables are where the check wants them
+	for _, key := range []string{"flushed", "compacted"} {
+		if err := lsm.Put(key, []byte("old")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.CompactRange("", ""); err != nil {
+		t.Fatalf("CompactRange failed: %v", err)
+	}
+
+	for _, key := range []string{"flushed", "compacted"} {
+		if _, err := lsm.Delete(key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	expectValue(t, lsm, "flushed", nil)
+
+	// The tombstone-only table is moved to level 1 first, far above the old versions
+	if err := lsm.Put("other", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	lsm.leveledCompaction()
+	if levels := lsm.GetLevels(); len(levels[0]) != 1 || len(levels[1]) != 1 {
+		t.Fatalf("Expected a table in each of level 0 and 1, got %v", levels)
+	}
+	expectValue(t, lsm, "compacted", nil)
+	expectValue(t, lsm, "other", []byte("value"))
+}
+
+// writeExternalFile builds an SSTable with sstable.Writer outside of the LSM directory
+func writeExternalFile(t *testing.T, name string, kv ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	writer, err := sstable.NewWriter(path)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	for i := 0; i < len(kv); i += 2 {
+		if err := writer.Put(kv[i], []byte(kv[i+1])); err != nil {
+			t.Fatalf("Writer.Put failed: %v", err)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Writer.Finish failed: %v", err)
+	}
+	return path
+}
+
+// TestLSM_IngestExternalFile verifies that ingested tables land in the deepest level they overlap nothing in,
+// and shadow older versions of their keys
+func TestLSM_IngestExternalFile(t *testing.T) {
+	lsm := setupTestLSM(t)
+	useNoCompaction(t, lsm)
+	bottom := len(lsm.GetLevels()) - 1
+
+	for _, key := range []string{"a_1", "a_2", "a_3"} {
+		if err := lsm.Put(key, []byte("old")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Nothing shares keys with it, so it goes straight to the bottom level
+	path := writeExternalFile(t, "z.sst", "z_1", "bulk", "z_2", "bulk")
+	if err := lsm.IngestExternalFile(path); err != nil {
+		t.Fatalf("IngestExternalFile failed: %v", err)
+	}
+	os.Remove(path) // The table was linked, the original is not needed anymore
+	levels := lsm.GetLevels()
+	if len(levels[0]) != 1 || len(levels[bottom]) != 1 {
+		t.Fatalf("Expected the table in the bottom level, got %v", levels)
+	}
+	expectValue(t, lsm, "z_2", []byte("bulk"))
+
+	// Overlapping level 0, it becomes the newest level 0 table
+	if err := lsm.IngestExternalFile(writeExternalFile(t, "a.sst", "a_2", "new", "a_9", "new")); err != nil {
+		t.Fatalf("IngestExternalFile failed: %v", err)
+	}
+	levels = lsm.GetLevels()
+	if len(levels[0]) != 2 {
+		t.Fatalf("Expected the table in level 0, got %v", levels)
+	}
+	expectValue(t, lsm, "a_1", []byte("old"))
+	expectValue(t, lsm, "a_2", []byte("new"))
+
+	// An unflushed write is older than the ingested file
+	if err := lsm.Put("m_1", []byte("memtable")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := lsm.IngestExternalFile(writeExternalFile(t, "m.sst", "m_1", "ingested")); err != nil {
+		t.Fatalf("IngestExternalFile failed: %v", err)
+	}
+	expectValue(t, lsm, "m_1", []byte("ingested"))
+
+	// A file that is not an SSTable is refused and leaves nothing behind
+	before := lsm.GetLevels()
+	garbage := filepath.Join(t.TempDir(), "garbage.sst")
+	if err := os.WriteFile(garbage, []byte("not an sstable"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next := lsm.GetNextSSTableIndex()
+	if err := lsm.IngestExternalFile(garbage); err == nil {
+		t.Fatal("Expected a file that is not an SSTable to be refused")
+	}
+	if after := lsm.GetLevels(); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Expected a refused file to leave the levels alone, got %v", after)
+	}
+	if _, err := os.Stat(fmt.Sprintf(sstable.FILE_NAME_FORMAT, next)); !os.IsNotExist(err) {
+		t.Errorf("Expected the refused file to be removed, got %v", err)
+	}
+}
+
+// overlapProbe is the concurrent skip list with every Put held until another Put is in progress
+type overlapProbe struct {
+	*concurrent_skip_list.ConcurrentSkipList
+}
+
+var (
+	registerOverlapProbe sync.Once
+	probeInside          atomic.Int32
+	probeOverlapped      atomic.Bool
+	probeGaveUp          atomic.Bool // Set once a Put waited in vain, so serialized writes don't wait again
+)
+
+func (probe overlapProbe) Put(record *model.Record) error {
+	if probeInside.Add(1) > 1 {
+		probeOverlapped.Store(true)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !probeOverlapped.Load() && !probeGaveUp.Load() {
+		if time.Now().After(deadline) {
+			probeGaveUp.Store(true)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	probeInside.Add(-1)
+	return probe.ConcurrentSkipList.Put(record)
+}
+
+// useOverlapProbe makes the LSMs set up by the test use the overlap probe as memtable
+func useOverlapProbe(t *testing.T) {
+	registerOverlapProbe.Do(func() {
+		memtable.Register("overlap_probe", func(capacity int) memtable_interface.MemtableInterface {
+			return overlapProbe{concurrent_skip_list.New(16, capacity)}
+		})
+	})
+	probeOverlapped.Store(false)
+	probeGaveUp.Store(false)
+	useMemtableType(t, "overlap_probe")
+}
+
+// TestLSM_ConcurrentWritersOverlap verifies that writers into a lock-free memtable insert at the same time
+func TestLSM_ConcurrentWritersOverlap(t *testing.T) {
+	useOverlapProbe(t)
+	useMemtableCapacity(t, 1000)
+	lsm := setupTestLSM(t)
+
+	const writers, keysPerWriter = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				if err := lsm.Put(fmt.Sprintf("w%d_%03d", w, i), []byte("v")); err != nil {
+					t.Errorf("Failed to put record: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Writes serialized by lsm.mu would never have two inserts in progress at once
+	if !probeOverlapped.Load() {
+		t.Fatalf("Expected concurrent writers to insert into the memtable at the same time")
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			if record, err, _ := lsm.Get(fmt.Sprintf("w%d_%03d", w, i)); err != nil || record == nil {
+				t.Fatalf("Expected w%d_%03d to be readable (err=%v)", w, i, err)
+			}
+		}
+	}
+}
+
+// TestLSM_ConcurrentWritesPublishedOnceVisible verifies that writes into a lock-free memtable are only published
+// once Get sees them, still in commit order
+func TestLSM_ConcurrentWritesPublishedOnceVisible(t *testing.T) {
+	useOverlapProbe(t)
+	useMemtableCapacity(t, 1000)
+	lsm := setupTestLSM(t)
+
+	const writers, keysPerWriter = 4, 25
+	sub, err := lsm.Subscribe("", 0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				lsm.Put(fmt.Sprintf("w%d_%03d", w, i), []byte("v"))
+			}
+		}(w)
+	}
+
+	// The probe holds inserts back until another one is in progress, so an event published before its insert
+	// would arrive while Get still misses the key
+	var previous uint64
+	for received := 0; received < writers*keysPerWriter; received++ {
+		event := collectEvents(t, sub, 1)[0]
+		if record, err, _ := lsm.Get(event.Key); err != nil || record == nil {
+			t.Fatalf("Expected %s to be visible once its event was delivered (err=%v)", event.Key, err)
+		}
+		if event.Sequence <= previous {
+			t.Fatalf("Expected strictly increasing sequences, got %d after %d", event.Sequence, previous)
+		}
+		previous = event.Sequence
+	}
+	wg.Wait()
+}
+
+// TestLSM_ConcurrentWritersAcrossFlushes verifies that writes inserting after releasing the lock reach the
+// SSTables of memtables rotated meanwhile, and that the newest write of a key wins
+func TestLSM_ConcurrentWritersAcrossFlushes(t *testing.T) {
+	useMemtableType(t, memtable.ConcurrentSkipList)
+	useMemtableCapacity(t, 20)
+	lsm := setupTestLSM(t)
+
+	const writers, keysPerWriter = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				if err := lsm.Put(fmt.Sprintf("w%d_%03d", w, i), []byte(fmt.Sprintf("v%d_%d", w, i))); err != nil {
+					t.Errorf("Failed to put record: %v", err)
+					return
+				}
+				if err := lsm.Put("shared", []byte(fmt.Sprintf("v%d_%d", w, i))); err != nil {
+					t.Errorf("Failed to put shared record: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := lsm.Put("shared", []byte("final")); err != nil {
+		t.Fatalf("Failed to put the final shared record: %v", err)
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if stats := lsm.MemtableStats(); stats.FlushesCompleted < writers*keysPerWriter/20 {
+		t.Errorf("Expected the small memtables to be flushed many times, got %d flushes", stats.FlushesCompleted)
+	}
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			record, err, _ := lsm.Get(fmt.Sprintf("w%d_%03d", w, i))
+			if err != nil || record == nil || string(record.Value) != fmt.Sprintf("v%d_%d", w, i) {
+				t.Fatalf("Expected w%d_%03d to be readable after the flushes (record=%v, err=%v)", w, i, record, err)
+			}
+		}
+	}
+	if record, err, _ := lsm.Get("shared"); err != nil || record == nil || string(record.Value) != "final" {
+		t.Errorf("Expected the newest shared record, got %v (err=%v)", record, err)
+	}
+}
@@ -0,0 +1,145 @@
+package arena
+
+import (
+	model "hunddb/model/record"
+	"unsafe"
+)
+
+// RECORDS_PER_CHUNK is the number of records allocated together in one chunk.
+const RECORDS_PER_CHUNK = 512
+
+/*
+Arena copies memtable records into a few large allocations instead of one heap object per
+record, key and value. Keys and values are packed into byte slabs, which hold no pointers and
+are never scanned by the garbage collector, and Record structs are carved from fixed-size chunks.
+A memtable with N records then keeps O(N / slab size) objects alive instead of 3N.
+
+Memory is never reused: a record handed out stays valid for as long as anything references it,
+so callers may keep records returned by Get after the memtable is flushed. Release drops the
+arena's own references, and the slabs are reclaimed wholesale once the memtable is gone.
+Overwritten records are not reclaimed until then either.
+
+An Arena is not safe for concurrent use.
+*/
+type Arena struct {
+	slabSize  int
+	slab      []byte               // Current byte slab, allocations are appended until it is full
+	records   Chunks[model.Record] // Record structs
+	allocated int64                // Bytes copied into the arena (keys, values and records)
+	reserved  int64                // Bytes of all slabs and chunks allocated so far
+}
+
+/*
+Chunks hands out values of T carved from chunks of RECORDS_PER_CHUNK elements, so a structure
+built from many small nodes allocates once per chunk instead of once per node.
+Like Arena it never reuses memory and is not safe for concurrent use. The zero value is ready to use.
+*/
+type Chunks[T any] struct {
+	chunk []T // Current chunk, never grown past its capacity so handed out pointers stay valid
+}
+
+// New returns a pointer to a zeroed T.
+func (c *Chunks[T]) New() *T {
+	if len(c.chunk) == cap(c.chunk) {
+		c.chunk = make([]T, 0, RECORDS_PER_CHUNK)
+	}
+	c.chunk = c.chunk[:len(c.chunk)+1]
+	return &c.chunk[len(c.chunk)-1]
+}
+
+// NewSlice returns a zeroed slice of n elements whose capacity is capped at n.
+// Slices longer than a quarter chunk get their own allocation.
+func (c *Chunks[T]) NewSlice(n int) []T {
+	if n > RECORDS_PER_CHUNK/4 {
+		return make([]T, n)
+	}
+	if len(c.chunk)+n > cap(c.chunk) {
+		c.chunk = make([]T, 0, RECORDS_PER_CHUNK)
+	}
+	start := len(c.chunk)
+	c.chunk = c.chunk[:start+n]
+	return c.chunk[start : start+n : start+n]
+}
+
+// Release drops the reference to the current chunk. Values handed out stay valid.
+func (c *Chunks[T]) Release() {
+	c.chunk = nil
+}
+
+// New creates an arena that allocates byte slabs of slabSize bytes.
+func New(slabSize int) *Arena {
+	if slabSize <= 0 {
+		slabSize = 1 << 20
+	}
+	return &Arena{slabSize: slabSize}
+}
+
+// alloc returns n bytes of arena memory.
+// Allocations larger than a quarter slab get their own slice, so they don't waste the rest of a slab.
+func (a *Arena) alloc(n int) []byte {
+	a.allocated += int64(n)
+	if n > a.slabSize/4 {
+		a.reserved += int64(n)
+		return make([]byte, n)
+	}
+	if len(a.slab)+n > cap(a.slab) {
+		a.slab = make([]byte, 0, a.slabSize)
+		a.reserved += int64(a.slabSize)
+	}
+	start := len(a.slab)
+	a.slab = a.slab[:start+n]
+	// Capping the capacity keeps appends by the caller from overwriting the next allocation
+	return a.slab[start : start+n : start+n]
+}
+
+// CopyBytes returns a copy of b in arena memory. nil stays nil.
+func (a *Arena) CopyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	buf := a.alloc(len(b))
+	copy(buf, b)
+	return buf
+}
+
+// CopyString returns a copy of s in arena memory.
+func (a *Arena) CopyString(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	buf := a.alloc(len(s))
+	copy(buf, s)
+	// The bytes are never modified after this point, which is what unsafe.String requires
+	return unsafe.String(unsafe.SliceData(buf), len(buf))
+}
+
+// CopyRecord returns a copy of record whose struct, key and value all live in the arena.
+func (a *Arena) CopyRecord(record *model.Record) *model.Record {
+	if len(a.records.chunk) == cap(a.records.chunk) {
+		a.reserved += RECORDS_PER_CHUNK * int64(unsafe.Sizeof(model.Record{}))
+	}
+	a.allocated += int64(unsafe.Sizeof(model.Record{}))
+	copied := a.records.New()
+	*copied = model.Record{
+		Key:       a.CopyString(record.Key),
+		Value:     a.CopyBytes(record.Value),
+		Timestamp: record.Timestamp,
+		Tombstone: record.Tombstone,
+	}
+	return copied
+}
+
+// Release drops the arena's references to its slabs. Records handed out stay valid.
+// Allocating after Release starts new slabs.
+func (a *Arena) Release() {
+	a.slab = nil
+	a.records.Release()
+	a.allocated = 0
+	a.reserved = 0
+}
+
+// Allocated returns the number of bytes copied into the arena since it was created or released.
+func (a *Arena) Allocated() int64 { return a.allocated }
+
+// Reserved returns the number of bytes of slabs and chunks allocated since the arena was created or released.
+func (a *Arena) Reserved() int64 { return a.reserved }
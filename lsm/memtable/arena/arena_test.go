@@ -0,0 +1,96 @@
+package arena
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+
+	model "hunddb/model/record"
+)
+
+// TestArena_CopyRecord verifies that copies are independent of the caller's record
+func TestArena_CopyRecord(t *testing.T) {
+	a := New(1024)
+	key := []byte("user/1")
+	original := model.NewRecord(string(key), []byte("value"), 42, false)
+
+	copied := a.CopyRecord(original)
+	original.Value[0] = 'X'
+	original.Key = "changed"
+
+	if copied.Key != "user/1" || string(copied.Value) != "value" || copied.Timestamp != 42 || copied.Tombstone {
+		t.Fatalf("Copy changed with the original: %+v", copied)
+	}
+	if copied == original {
+		t.Fatalf("Expected a distinct record")
+	}
+
+	tomb := a.CopyRecord(model.NewRecord("gone", nil, 43, true))
+	if tomb.Value != nil || !tomb.Tombstone {
+		t.Errorf("Expected a nil-valued tombstone, got %+v", tomb)
+	}
+}
+
+// TestArena_AllocationsDoNotOverlap verifies that appending to a returned slice cannot clobber the next allocation
+func TestArena_AllocationsDoNotOverlap(t *testing.T) {
+	a := New(64)
+	first := a.CopyBytes([]byte("aaaa"))
+	second := a.CopyBytes([]byte("bbbb"))
+
+	first = append(first, 'X')
+	if string(second) != "bbbb" {
+		t.Fatalf("Append to an earlier allocation overwrote a later one: %q", second)
+	}
+	if string(first) != "aaaaX" {
+		t.Errorf("Unexpected appended slice %q", first)
+	}
+}
+
+// TestArena_SlabsAndLargeValues verifies slab reuse, slab rollover and dedicated large allocations
+func TestArena_SlabsAndLargeValues(t *testing.T) {
+	a := New(100)
+	for i := 0; i < 10; i++ {
+		a.CopyString("0123456789")
+	}
+	if a.Allocated() != 100 || a.Reserved() != 100 {
+		t.Fatalf("Expected one full slab, got allocated=%d reserved=%d", a.Allocated(), a.Reserved())
+	}
+
+	a.CopyString("x")
+	if a.Reserved() != 200 {
+		t.Errorf("Expected a second slab, got reserved=%d", a.Reserved())
+	}
+
+	large := bytes.Repeat([]byte("L"), 60)
+	got := a.CopyBytes(large)
+	if !bytes.Equal(got, large) || a.Reserved() != 260 {
+		t.Errorf("Expected a dedicated allocation for a large value, got reserved=%d", a.Reserved())
+	}
+}
+
+// TestArena_ReleaseKeepsRecordsValid verifies that records handed out survive Release and a GC
+func TestArena_ReleaseKeepsRecordsValid(t *testing.T) {
+	a := New(256)
+	var records []*model.Record
+	for i := 0; i < 2*RECORDS_PER_CHUNK; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		records = append(records, a.CopyRecord(model.NewRecord(key, []byte(key), uint64(i), false)))
+	}
+	a.Release()
+	if a.Allocated() != 0 || a.Reserved() != 0 {
+		t.Errorf("Expected counters to reset on Release")
+	}
+	runtime.GC()
+
+	// New allocations must not reuse memory still referenced by old records
+	for i := 0; i < 100; i++ {
+		a.CopyRecord(model.NewRecord("overwrite", []byte("overwrite"), 0, false))
+	}
+	for i, record := range records {
+		key := fmt.Sprintf("key%05d", i)
+		if record.Key != key || string(record.Value) != key || record.Timestamp != uint64(i) {
+			t.Fatalf("Record %d corrupted after Release: %+v", i, record)
+		}
+	}
+}
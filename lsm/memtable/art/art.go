@@ -0,0 +1,618 @@
+package art
+
+import (
+	"errors"
+	memtable "hunddb/lsm/memtable/memtable_interface"
+	sstable "hunddb/lsm/sstable"
+	model "hunddb/model/record"
+	"math"
+)
+
+// Compile-time assertion that ART implements the Memtable interface.
+var _ memtable.MemtableInterface = (*ART)(nil)
+
+// nodeKind is the adaptive size class of an inner node.
+type nodeKind uint8
+
+const (
+	node4   nodeKind = iota // up to 4 children, sorted edge bytes
+	node16                  // up to 16 children, sorted edge bytes
+	node48                  // up to 48 children, 256-entry index into the child slots
+	node256                 // one child slot per possible edge byte
+)
+
+// NODE_OVERHEAD approximates the bytes of a node struct besides its edge and child arrays.
+const NODE_OVERHEAD = 80
+
+/*
+node is a single ART node. Path compression stores the bytes shared by every key below
+the parent edge in prefix, so long common prefixes like "tenant/123/user/" cost one node.
+A key that ends exactly at a node is kept in rec - since a key sorts before all of its
+extensions, rec is visited before the children during ordered walks.
+Nodes without children keep nil edge arrays and allocate them on the first child.
+*/
+type node struct {
+	prefix   string
+	rec      *model.Record
+	kind     nodeKind
+	count    int     // number of children
+	keys     []byte  // node4/node16: sorted edge bytes; node48: edge byte -> child slot + 1
+	children []*node // node4/node16/node48: child slots; node256: indexed by edge byte
+}
+
+// ART is an adaptive radix tree storing records by key.
+// It implements Memtable semantics with logical deletion (tombstones); nodes are never removed.
+type ART struct {
+	root *node
+
+	// Capacity and counters (distinct keys)
+	capacity    int   // max distinct keys (active + tombstoned)
+	totalCount  int   // current distinct keys
+	activeCount int   // current non-tombstoned keys
+	memoryUsage int64 // approximate bytes held by records and nodes
+}
+
+// NewART creates an ART memtable with an explicit capacity (distinct keys).
+func NewART(capacity int) *ART {
+	if capacity <= 0 {
+		capacity = math.MaxInt
+	}
+	return &ART{capacity: capacity}
+}
+
+// ===== Node helpers =====
+
+// nodeMemoryUsage approximates the bytes of a node: the struct and its edge and child arrays.
+func nodeMemoryUsage(n *node) int64 {
+	return NODE_OVERHEAD + int64(cap(n.keys)) + 8*int64(cap(n.children))
+}
+
+// findChild returns the child under edge byte c, or nil.
+func (n *node) findChild(c byte) *node {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.count; i++ {
+			if n.keys[i] == c {
+				return n.children[i]
+			}
+			if n.keys[i] > c {
+				return nil
+			}
+		}
+	case node48:
+		if slot := n.keys[c]; slot != 0 {
+			return n.children[slot-1]
+		}
+	case node256:
+		return n.children[c]
+	}
+	return nil
+}
+
+// addChild links child under edge byte c, growing the node to the next size class when it is full.
+// Nodes grow in place, so parents never need to be rewired.
+func (n *node) addChild(c byte, child *node) {
+	switch n.kind {
+	case node4, node16:
+		if n.children == nil {
+			n.keys = make([]byte, 0, 4)
+			n.children = make([]*node, 0, 4)
+		}
+		if n.count == cap(n.children) {
+			n.grow()
+			n.addChild(c, child)
+			return
+		}
+		pos := 0
+		for pos < n.count && n.keys[pos] < c {
+			pos++
+		}
+		n.keys = append(n.keys, 0)
+		n.children = append(n.children, nil)
+		copy(n.keys[pos+1:], n.keys[pos:])
+		copy(n.children[pos+1:], n.children[pos:])
+		n.keys[pos] = c
+		n.children[pos] = child
+	case node48:
+		if n.count == len(n.children) {
+			n.grow()
+			n.addChild(c, child)
+			return
+		}
+		// Children are never removed, so the next free slot is always count
+		n.children[n.count] = child
+		n.keys[c] = byte(n.count + 1)
+	case node256:
+		n.children[c] = child
+	}
+	n.count++
+}
+
+// grow moves the node to the next size class.
+func (n *node) grow() {
+	switch n.kind {
+	case node4:
+		keys := make([]byte, n.count, 16)
+		children := make([]*node, n.count, 16)
+		copy(keys, n.keys)
+		copy(children, n.children)
+		n.keys, n.children, n.kind = keys, children, node16
+	case node16:
+		keys := make([]byte, 256)
+		children := make([]*node, 48)
+		for i := 0; i < n.count; i++ {
+			keys[n.keys[i]] = byte(i + 1)
+			children[i] = n.children[i]
+		}
+		n.keys, n.children, n.kind = keys, children, node48
+	case node48:
+		children := make([]*node, 256)
+		for c := 0; c < 256; c++ {
+			if slot := n.keys[c]; slot != 0 {
+				children[c] = n.children[slot-1]
+			}
+		}
+		n.keys, n.children, n.kind = nil, children, node256
+	}
+}
+
+// forEachChild calls fn for every child with edge byte >= from, in edge order, until fn returns false.
+func (n *node) forEachChild(from byte, fn func(c byte, child *node) bool) bool {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.count; i++ {
+			if n.keys[i] >= from && !fn(n.keys[i], n.children[i]) {
+				return false
+			}
+		}
+	case node48:
+		for c := int(from); c < 256; c++ {
+			if slot := n.keys[c]; slot != 0 && !fn(byte(c), n.children[slot-1]) {
+				return false
+			}
+		}
+	case node256:
+		for c := int(from); c < 256; c++ {
+			if n.children[c] != nil && !fn(byte(c), n.children[c]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// commonPrefixLength returns the number of leading bytes a and b share.
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// ===== Tree operations =====
+
+// search returns the node holding key, or nil.
+func (t *ART) search(key string) *node {
+	n := t.root
+	depth := 0
+	for n != nil {
+		rest := key[depth:]
+		if len(rest) < len(n.prefix) || rest[:len(n.prefix)] != n.prefix {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.rec == nil {
+				return nil
+			}
+			return n
+		}
+		n = n.findChild(key[depth])
+		depth++
+	}
+	return nil
+}
+
+// insert adds a record for a key that is not yet in the tree.
+func (t *ART) insert(record *model.Record) {
+	t.memoryUsage += memtable.RecordMemoryUsage(record)
+	key := record.Key
+	ref := &t.root
+	depth := 0
+	for {
+		n := *ref
+		if n == nil {
+			*ref = t.newLeaf(key[depth:], record)
+			return
+		}
+
+		common := commonPrefixLength(n.prefix, key[depth:])
+		if common < len(n.prefix) {
+			// The key diverges inside the compressed path: split it with a new parent
+			parent := &node{prefix: n.prefix[:common]}
+			edge := n.prefix[common]
+			n.prefix = n.prefix[common+1:]
+			parent.addChild(edge, n)
+			if depth+common == len(key) {
+				parent.rec = record
+			} else {
+				parent.addChild(key[depth+common], t.newLeaf(key[depth+common+1:], record))
+			}
+			t.memoryUsage += nodeMemoryUsage(parent)
+			*ref = parent
+			return
+		}
+
+		depth += len(n.prefix)
+		if depth == len(key) {
+			n.rec = record
+			return
+		}
+
+		child := n.findChild(key[depth])
+		if child == nil {
+			before := nodeMemoryUsage(n)
+			n.addChild(key[depth], t.newLeaf(key[depth+1:], record))
+			t.memoryUsage += nodeMemoryUsage(n) - before
+			return
+		}
+		ref = n.childRef(key[depth])
+		depth++
+	}
+}
+
+// childRef returns the slot holding the child under edge byte c; the child must exist.
+func (n *node) childRef(c byte) **node {
+	switch n.kind {
+	case node4, node16:
+		for i := 0; i < n.count; i++ {
+			if n.keys[i] == c {
+				return &n.children[i]
+			}
+		}
+	case node48:
+		return &n.children[n.keys[c]-1]
+	case node256:
+		return &n.children[c]
+	}
+	return nil
+}
+
+// newLeaf creates a childless node holding record, with the remaining key bytes as its prefix.
+func (t *ART) newLeaf(prefix string, record *model.Record) *node {
+	leaf := &node{prefix: prefix, rec: record}
+	t.memoryUsage += nodeMemoryUsage(leaf)
+	return leaf
+}
+
+/*
+ascend visits, in key order, every record under n whose key is >= start, until fn returns false.
+depth is the number of key bytes consumed above n. While bounded, the walk follows the path of
+start and skips subtrees that sort entirely before it - so seeking costs O(len(start)) and each
+visited record costs amortized O(1), instead of scanning every key.
+*/
+func ascend(n *node, depth int, start string, bounded bool, fn func(*model.Record) bool) bool {
+	if bounded {
+		rest := start[depth:]
+		m := min(len(n.prefix), len(rest))
+		switch {
+		case n.prefix[:m] < rest[:m]:
+			return true // every key below sorts before start
+		case n.prefix[:m] > rest[:m] || len(rest) <= len(n.prefix):
+			bounded = false // every key below sorts at or after start
+		default:
+			depth += len(n.prefix)
+		}
+	}
+
+	if !bounded {
+		if n.rec != nil && !fn(n.rec) {
+			return false
+		}
+		return n.forEachChild(0, func(_ byte, child *node) bool {
+			return ascend(child, 0, "", false, fn)
+		})
+	}
+
+	// start continues past this node, so the record here (a proper prefix of start) sorts before it
+	edge := start[depth]
+	return n.forEachChild(edge, func(c byte, child *node) bool {
+		return ascend(child, depth+1, start, c == edge, fn)
+	})
+}
+
+// ascendFrom walks the whole tree starting at the first key >= start.
+func (t *ART) ascendFrom(start string, fn func(*model.Record) bool) {
+	if t.root == nil {
+		return
+	}
+	ascend(t.root, 0, start, true, fn)
+}
+
+// successor returns the smallest string that sorts after key.
+func successor(key string) string {
+	return key + "\x00"
+}
+
+// ===== Memtable interface =====
+
+var ErrCapacityExceeded = errors.New("memtable capacity exceeded")
+
+// Put inserts or updates a record for its key.
+// NEW key: if IsFull() -> error; else insert and update counters.
+// EXISTING key: replace record and adjust activeCount on tombstone transitions.
+func (t *ART) Put(record *model.Record) error {
+	if record == nil || record.Key == "" {
+		return errors.New("invalid record: record and key cannot be nil/empty")
+	}
+	existing := t.search(record.Key)
+
+	if existing == nil {
+		if t.IsFull() {
+			return ErrCapacityExceeded
+		}
+		t.insert(record)
+		t.totalCount++
+		if !record.Tombstone {
+			t.activeCount++
+		}
+		return nil
+	}
+
+	prevDel := existing.rec.Tombstone
+	newDel := record.Tombstone
+	t.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(existing.rec)
+	existing.rec = record
+	if prevDel && !newDel {
+		t.activeCount++
+	} else if !prevDel && newDel {
+		t.activeCount--
+	}
+	return nil
+}
+
+// Delete marks the key as tombstoned using the provided record.
+// Returns true if the key existed before this call; false otherwise.
+// For a non-existing key, we insert a tombstone if capacity allows (returning false).
+func (t *ART) Delete(record *model.Record) bool {
+	if record == nil || record.Key == "" {
+		return false
+	}
+	record.Tombstone = true
+
+	existing := t.search(record.Key)
+	if existing == nil {
+		if t.IsFull() {
+			return false
+		}
+		t.insert(record)
+		t.totalCount++
+		return false
+	}
+
+	if !existing.rec.Tombstone {
+		t.activeCount--
+	}
+	t.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(existing.rec)
+	existing.rec = record
+	return true
+}
+
+// Get returns the latest non-tombstoned record by key, or nil if absent/tombstoned.
+func (t *ART) Get(key string) *model.Record {
+	n := t.search(key)
+	if n == nil || n.rec.IsDeleted() {
+		return nil
+	}
+	return n.rec
+}
+
+// GetNextForPrefix returns the next record in lexicographical order after the given key,
+// constrained to the given prefix, or nil if none exists.
+// tombstonedKeys is used to track keys that have been tombstoned in more recent structures.
+func (t *ART) GetNextForPrefix(prefix string, key string, tombstonedKeys *[]string) *model.Record {
+	start := max(prefix, successor(key))
+	var result *model.Record
+	t.ascendFrom(start, func(rec *model.Record) bool {
+		if len(rec.Key) < len(prefix) || rec.Key[:len(prefix)] != prefix {
+			return false // left the prefix subtree
+		}
+		result = nextVisible(rec, tombstonedKeys)
+		return result == nil
+	})
+	return result
+}
+
+// GetNextForRange returns the next record in lexicographical order after the given key,
+// constrained to the given range [rangeStart, rangeEnd] (inclusive), or nil if none exists.
+// tombstonedKeys is used to track keys that have been tombstoned in more recent structures.
+func (t *ART) GetNextForRange(rangeStart string, rangeEnd string, key string, tombstonedKeys *[]string) *model.Record {
+	start := max(rangeStart, successor(key))
+	var result *model.Record
+	t.ascendFrom(start, func(rec *model.Record) bool {
+		if rec.Key > rangeEnd {
+			return false
+		}
+		result = nextVisible(rec, tombstonedKeys)
+		return result == nil
+	})
+	return result
+}
+
+// nextVisible returns rec if it is live and not tombstoned in more recent structures.
+// Local tombstones are added to tombstonedKeys.
+func nextVisible(rec *model.Record, tombstonedKeys *[]string) *model.Record {
+	if rec.IsDeleted() {
+		addToTombstoned(rec.Key, tombstonedKeys)
+		return nil
+	}
+	if isKeyTombstoned(rec.Key, tombstonedKeys) {
+		return nil
+	}
+	return rec
+}
+
+// ScanForPrefix scans records with the given prefix and adds keys to bestKeys.
+// Only the subtree under the prefix is walked.
+func (t *ART) ScanForPrefix(
+	prefix string,
+	tombstonedKeys *[]string,
+	bestKeys *[]string,
+	pageSize int,
+	pageNumber int,
+) {
+	tombstonedSet, bestKeysSet := buildScanSets(tombstonedKeys, bestKeys)
+	t.ascendFrom(prefix, func(rec *model.Record) bool {
+		if len(rec.Key) < len(prefix) || rec.Key[:len(prefix)] != prefix {
+			return false
+		}
+		processRecordForScan(rec, tombstonedSet, bestKeysSet, tombstonedKeys, bestKeys)
+		return true
+	})
+}
+
+// ScanForRange scans records within the given range and adds keys to bestKeys.
+// Only keys are added for memory efficiency - use Get() to retrieve full records.
+func (t *ART) ScanForRange(
+	rangeStart string,
+	rangeEnd string,
+	tombstonedKeys *[]string,
+	bestKeys *[]string,
+	pageSize int,
+	pageNumber int,
+) {
+	tombstonedSet, bestKeysSet := buildScanSets(tombstonedKeys, bestKeys)
+	t.ascendFrom(rangeStart, func(rec *model.Record) bool {
+		if rec.Key > rangeEnd {
+			return false
+		}
+		processRecordForScan(rec, tombstonedSet, bestKeysSet, tombstonedKeys, bestKeys)
+		return true
+	})
+}
+
+// buildScanSets creates sets of the tombstoned and already found keys for O(1) lookup.
+func buildScanSets(tombstonedKeys *[]string, bestKeys *[]string) (map[string]bool, map[string]bool) {
+	tombstonedSet := make(map[string]bool)
+	if tombstonedKeys != nil {
+		for _, key := range *tombstonedKeys {
+			tombstonedSet[key] = true
+		}
+	}
+	bestKeysSet := make(map[string]bool)
+	if bestKeys != nil {
+		for _, key := range *bestKeys {
+			bestKeysSet[key] = true
+		}
+	}
+	return tombstonedSet, bestKeysSet
+}
+
+// processRecordForScan processes a single record during the scan operation
+func processRecordForScan(
+	record *model.Record,
+	tombstonedSet map[string]bool,
+	bestKeysSet map[string]bool,
+	tombstonedKeys *[]string,
+	bestKeys *[]string,
+) {
+	// Skip if already tombstoned in newer structures or found in newer memtables
+	if tombstonedSet[record.Key] || bestKeysSet[record.Key] {
+		return
+	}
+
+	if record.IsDeleted() {
+		if tombstonedKeys != nil {
+			*tombstonedKeys = append(*tombstonedKeys, record.Key)
+			tombstonedSet[record.Key] = true
+		}
+		return
+	}
+
+	if bestKeys != nil {
+		*bestKeys = insertKeySorted(*bestKeys, record.Key)
+		bestKeysSet[record.Key] = true
+	}
+}
+
+// insertKeySorted inserts a key in sorted order into the slice
+func insertKeySorted(keys []string, newKey string) []string {
+	left, right := 0, len(keys)
+	for left < right {
+		mid := (left + right) / 2
+		if keys[mid] < newKey {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	keys = append(keys, "")
+	copy(keys[left+1:], keys[left:])
+	keys[left] = newKey
+	return keys
+}
+
+// isKeyTombstoned checks if a key is in the tombstoned keys slice
+func isKeyTombstoned(key string, tombstonedKeys *[]string) bool {
+	if tombstonedKeys == nil {
+		return false
+	}
+	for _, tombKey := range *tombstonedKeys {
+		if tombKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// addToTombstoned adds a key to the tombstoned keys slice if it's not already there
+func addToTombstoned(key string, tombstonedKeys *[]string) {
+	if tombstonedKeys == nil {
+		return
+	}
+	for _, tombKey := range *tombstonedKeys {
+		if tombKey == key {
+			return
+		}
+	}
+	*tombstonedKeys = append(*tombstonedKeys, key)
+}
+
+func (t *ART) Size() int         { return t.activeCount }
+func (t *ART) Capacity() int     { return t.capacity }
+func (t *ART) TotalEntries() int { return t.totalCount }
+func (t *ART) IsFull() bool      { return t.totalCount >= t.capacity }
+
+// MemoryUsage returns the approximate number of bytes held by the stored records and nodes.
+func (t *ART) MemoryUsage() int64 { return t.memoryUsage }
+
+// RetrieveSortedRecords returns all records (including tombstones) in sorted key order.
+// This is used for flushing the memtable to an SSTable.
+func (t *ART) RetrieveSortedRecords() []model.Record {
+	records := make([]model.Record, 0, t.totalCount)
+	t.ascendFrom("", func(rec *model.Record) bool {
+		recordCopy := model.Record{
+			Key:       rec.Key,
+			Value:     make([]byte, len(rec.Value)),
+			Timestamp: rec.Timestamp,
+			Tombstone: rec.Tombstone,
+		}
+		copy(recordCopy.Value, rec.Value)
+		records = append(records, recordCopy)
+		return true
+	})
+	return records
+}
+
+// Flush persists the memtable contents to disk (SSTable).
+func (t *ART) Flush(index int) error {
+	sortedRecords := t.RetrieveSortedRecords()
+
+	err := sstable.PersistMemtable(sortedRecords, index)
+	if err != nil {
+		return errors.New("failed to flush ART memtable: " + err.Error())
+	}
+
+	return nil
+}
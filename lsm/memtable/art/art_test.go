@@ -0,0 +1,301 @@
+package art
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"hunddb/lsm/memtable/conformance"
+	mi "hunddb/lsm/memtable/memtable_interface"
+	"hunddb/lsm/memtable/skip_list"
+	model "hunddb/model/record"
+)
+
+// helper to create records with current timestamp
+func rec(key string, val []byte, tomb bool) *model.Record {
+	return model.NewRecord(key, val, uint64(time.Now().UnixNano()), tomb)
+}
+
+// TestART_PutGetDelete verifies the basic memtable semantics and counters
+func TestART_PutGetDelete(t *testing.T) {
+	tree := NewART(10)
+
+	for _, key := range []string{"tenant/1/user/b", "tenant/1/user/a", "tenant/2"} {
+		if err := tree.Put(rec(key, []byte("v_"+key), false)); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	if got := tree.Get("tenant/1/user/a"); got == nil || string(got.Value) != "v_tenant/1/user/a" {
+		t.Fatalf("Unexpected record %v", got)
+	}
+	for _, missing := range []string{"tenant/1", "tenant/1/user/", "tenant/1/user/c", "tenant/22", "x"} {
+		if tree.Get(missing) != nil {
+			t.Errorf("Expected nil for missing key %q", missing)
+		}
+	}
+
+	tree.Put(rec("tenant/2", []byte("updated"), false))
+	if got := tree.Get("tenant/2"); string(got.Value) != "updated" {
+		t.Errorf("Expected updated value, got %s", got.Value)
+	}
+	if tree.TotalEntries() != 3 || tree.Size() != 3 {
+		t.Errorf("Expected Total=3 Size=3, got Total=%d Size=%d", tree.TotalEntries(), tree.Size())
+	}
+
+	if !tree.Delete(rec("tenant/1/user/b", nil, false)) {
+		t.Errorf("Expected Delete of an existing key to return true")
+	}
+	if tree.Get("tenant/1/user/b") != nil {
+		t.Errorf("Expected deleted key to be hidden")
+	}
+	if tree.Delete(rec("tenant/3", nil, false)) {
+		t.Errorf("Expected Delete of an unseen key to return false")
+	}
+	if tree.TotalEntries() != 4 || tree.Size() != 2 {
+		t.Errorf("Expected Total=4 Size=2, got Total=%d Size=%d", tree.TotalEntries(), tree.Size())
+	}
+
+	tree.Put(rec("tenant/1/user/b", []byte("back"), false))
+	if tree.Get("tenant/1/user/b") == nil || tree.Size() != 3 {
+		t.Errorf("Expected resurrected key to be visible with Size=3, got Size=%d", tree.Size())
+	}
+}
+
+// TestART_KeysThatArePrefixesOfOthers verifies keys ending inside compressed paths and at inner nodes
+func TestART_KeysThatArePrefixesOfOthers(t *testing.T) {
+	tree := NewART(100)
+	keys := []string{"abcdef", "abc", "ab", "abcdefgh", "abd", "a"}
+	for _, key := range keys {
+		tree.Put(rec(key, []byte(key), false))
+	}
+	for _, key := range keys {
+		if got := tree.Get(key); got == nil || got.Key != key {
+			t.Errorf("Get(%q) = %v", key, got)
+		}
+	}
+	if tree.Get("abcd") != nil || tree.Get("abcdefg") != nil {
+		t.Errorf("Expected keys inside a compressed path to be absent")
+	}
+
+	sort.Strings(keys)
+	records := tree.RetrieveSortedRecords()
+	if len(records) != len(keys) {
+		t.Fatalf("Expected %d records, got %d", len(keys), len(records))
+	}
+	for i, record := range records {
+		if record.Key != keys[i] {
+			t.Errorf("Record %d: expected %q, got %q", i, keys[i], record.Key)
+		}
+	}
+}
+
+// TestART_NodeGrowth verifies that nodes grow through every size class without losing children
+func TestART_NodeGrowth(t *testing.T) {
+	tree := NewART(0)
+	for c := 255; c >= 0; c-- {
+		key := "p" + string([]byte{byte(c)})
+		tree.Put(rec(key, []byte{byte(c)}, false))
+
+		// The first key is a single leaf, the second one splits it under the shared prefix "p"
+		if c < 255 && tree.root.findChild(byte(c)) == nil {
+			t.Fatalf("Child %d missing right after insert", c)
+		}
+	}
+	if tree.root.kind != node256 {
+		t.Errorf("Expected the root to grow to node256, got kind %d", tree.root.kind)
+	}
+	for c := 0; c < 256; c++ {
+		if got := tree.Get("p" + string([]byte{byte(c)})); got == nil || got.Value[0] != byte(c) {
+			t.Fatalf("Lost key for edge byte %d", c)
+		}
+	}
+	records := tree.RetrieveSortedRecords()
+	for i := range records {
+		if records[i].Value[0] != byte(i) {
+			t.Fatalf("Record %d out of order", i)
+		}
+	}
+}
+
+// TestART_Capacity verifies that only new distinct keys are limited by capacity
+func TestART_Capacity(t *testing.T) {
+	tree := NewART(2)
+	tree.Put(rec("a", []byte("1"), false))
+	tree.Put(rec("b", []byte("2"), false))
+
+	if !tree.IsFull() {
+		t.Fatalf("Expected tree to be full")
+	}
+	if err := tree.Put(rec("c", []byte("3"), false)); !errors.Is(err, ErrCapacityExceeded) {
+		t.Errorf("Expected ErrCapacityExceeded, got %v", err)
+	}
+	if err := tree.Put(rec("a", []byte("updated"), false)); err != nil {
+		t.Errorf("Expected update of an existing key to succeed when full, got %v", err)
+	}
+	if tree.Delete(rec("d", nil, true)) || tree.TotalEntries() != 2 {
+		t.Errorf("Expected tombstone for a new key to be rejected when full")
+	}
+}
+
+// TestART_MatchesSkipList verifies iteration and scans against the skip list on random keys
+func TestART_MatchesSkipList(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	tree := NewART(5000)
+	list := skip_list.New(16, 5000)
+
+	alphabet := "ab/1"
+	randomKey := func() string {
+		b := make([]byte, 1+rng.Intn(8))
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+	for i := 0; i < 3000; i++ {
+		key := randomKey()
+		if rng.Intn(5) == 0 {
+			tree.Delete(rec(key, nil, true))
+			list.Delete(rec(key, nil, true))
+		} else {
+			tree.Put(rec(key, []byte(key), false))
+			list.Put(rec(key, []byte(key), false))
+		}
+	}
+	if tree.TotalEntries() != list.TotalEntries() || tree.Size() != list.Size() {
+		t.Fatalf("Counters differ: ART %d/%d, skip list %d/%d",
+			tree.TotalEntries(), tree.Size(), list.TotalEntries(), list.Size())
+	}
+
+	for i := 0; i < 200; i++ {
+		prefix, after := randomKey(), randomKey()
+		prefix = prefix[:min(len(prefix), 1+rng.Intn(3))]
+		if i%4 == 0 {
+			prefix = ""
+		}
+		var treeTomb, listTomb []string
+		got := tree.GetNextForPrefix(prefix, after, &treeTomb)
+		want := list.GetNextForPrefix(prefix, after, &listTomb)
+		if (got == nil) != (want == nil) || (got != nil && got.Key != want.Key) {
+			t.Fatalf("GetNextForPrefix(%q, %q) = %v, want %v", prefix, after, got, want)
+		}
+		if fmt.Sprint(treeTomb) != fmt.Sprint(listTomb) {
+			t.Fatalf("GetNextForPrefix(%q, %q) tombstones %v, want %v", prefix, after, treeTomb, listTomb)
+		}
+
+		start, end := randomKey(), randomKey()
+		if start > end {
+			start, end = end, start
+		}
+		treeTomb, listTomb = nil, nil
+		got = tree.GetNextForRange(start, end, after, &treeTomb)
+		want = list.GetNextForRange(start, end, after, &listTomb)
+		if (got == nil) != (want == nil) || (got != nil && got.Key != want.Key) {
+			t.Fatalf("GetNextForRange(%q, %q, %q) = %v, want %v", start, end, after, got, want)
+		}
+
+		var treeBest, listBest []string
+		treeTomb, listTomb = nil, nil
+		tree.ScanForPrefix(prefix, &treeTomb, &treeBest, 50, 0)
+		list.ScanForPrefix(prefix, &listTomb, &listBest, 50, 0)
+		if fmt.Sprint(treeBest) != fmt.Sprint(listBest) || fmt.Sprint(treeTomb) != fmt.Sprint(listTomb) {
+			t.Fatalf("ScanForPrefix(%q) mismatch", prefix)
+		}
+
+		treeBest, listBest, treeTomb, listTomb = nil, nil, nil, nil
+		tree.ScanForRange(start, end, &treeTomb, &treeBest, 50, 0)
+		list.ScanForRange(start, end, &listTomb, &listBest, 50, 0)
+		if fmt.Sprint(treeBest) != fmt.Sprint(listBest) || fmt.Sprint(treeTomb) != fmt.Sprint(listTomb) {
+			t.Fatalf("ScanForRange(%q, %q) mismatch", start, end)
+		}
+	}
+
+	treeRecords, listRecords := tree.RetrieveSortedRecords(), list.RetrieveSortedRecords()
+	if len(treeRecords) != len(listRecords) {
+		t.Fatalf("Expected %d sorted records, got %d", len(listRecords), len(treeRecords))
+	}
+	for i := range treeRecords {
+		if treeRecords[i].Key != listRecords[i].Key || treeRecords[i].Tombstone != listRecords[i].Tombstone {
+			t.Fatalf("Sorted record %d: expected %q, got %q", i, listRecords[i].Key, treeRecords[i].Key)
+		}
+	}
+}
+
+// TestART_MemoryUsage verifies that memory usage tracks inserts, updates and node growth
+func TestART_MemoryUsage(t *testing.T) {
+	tree := NewART(0)
+	if tree.MemoryUsage() != 0 {
+		t.Fatalf("Expected empty tree to use 0 bytes, got %d", tree.MemoryUsage())
+	}
+
+	tree.Put(rec("tenant/1/user/1", []byte("value"), false))
+	afterFirst := tree.MemoryUsage()
+	if afterFirst <= 0 {
+		t.Fatalf("Expected memory usage to grow after insert, got %d", afterFirst)
+	}
+
+	tree.Put(rec("tenant/1/user/1", []byte("a much longer value"), false))
+	if grown := tree.MemoryUsage() - afterFirst; grown != int64(len("a much longer value")-len("value")) {
+		t.Errorf("Expected update to grow usage by the value difference, got %d", grown)
+	}
+
+	for i := 0; i < 1000; i++ {
+		tree.Put(rec(fmt.Sprintf("tenant/1/user/%04d", i), []byte("value"), false))
+	}
+	// Recompute the node part from scratch and compare with the incrementally tracked total
+	var expected int64
+	var walk func(n *node)
+	walk = func(n *node) {
+		expected += nodeMemoryUsage(n)
+		if n.rec != nil {
+			expected += int64(len(n.rec.Key)+len(n.rec.Value)) + 64
+		}
+		n.forEachChild(0, func(_ byte, child *node) bool {
+			walk(child)
+			return true
+		})
+	}
+	walk(tree.root)
+	if tree.MemoryUsage() != expected {
+		t.Errorf("Tracked usage %d differs from the tree's actual usage %d", tree.MemoryUsage(), expected)
+	}
+}
+
+func BenchmarkART_Put(b *testing.B) {
+	tree := NewART(0)
+	for i := 0; i < b.N; i++ {
+		tree.Put(rec(fmt.Sprintf("tenant/%03d/user/%08d", i%100, i), []byte("value"), false))
+	}
+}
+
+func BenchmarkART_ScanForPrefix(b *testing.B) {
+	tree := NewART(0)
+	for i := 0; i < 100000; i++ {
+		tree.Put(rec(fmt.Sprintf("tenant/%03d/user/%08d", i%100, i), []byte("value"), false))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var best []string
+		tree.ScanForPrefix(fmt.Sprintf("tenant/%03d/", i%100), &[]string{}, &best, 50, 0)
+	}
+}
+
+func BenchmarkART_GetNextForPrefix(b *testing.B) {
+	tree := NewART(0)
+	for i := 0; i < 100000; i++ {
+		tree.Put(rec(fmt.Sprintf("tenant/%03d/user/%08d", i%100, i), []byte("value"), false))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.GetNextForPrefix(fmt.Sprintf("tenant/%03d/", i%100), "", &[]string{})
+	}
+}
+
+// TestART_Conformance runs the shared memtable conformance suite
+func TestART_Conformance(t *testing.T) {
+	conformance.Run(t, func(capacity int) mi.MemtableInterface {
+		return NewART(capacity)
+	})
+}
@@ -2,6 +2,7 @@ package btree
 
 import (
 	"fmt"
+	"hunddb/lsm/memtable/arena"
 	memtable "hunddb/lsm/memtable/memtable_interface"
 	sstable "hunddb/lsm/sstable"
 	model "hunddb/model/record"
@@ -16,6 +17,10 @@ const (
 	// DefaultOrder defines the default order (degree) of the B-tree.
 	// A B-tree of order m can have at most m-1 keys and m children per node.
 	DefaultOrder = 5
+
+	// ENTRY_OVERHEAD approximates the bytes a record costs in the tree besides the record itself:
+	// its slot in the node plus its share of the node struct and child pointers.
+	ENTRY_OVERHEAD = 32
 )
 
 // Node represents a node in the B-tree containing records and child nodes.
@@ -50,6 +55,16 @@ type BTree struct {
 
 	// capacity is the maximum number of distinct keys (active + tombstoned)
 	capacity int
+
+	// memoryUsage tracks the approximate bytes held by records and nodes
+	memoryUsage int64
+
+	// arena holds copies of the stored records, nil stores the caller's records as they are.
+	// With an arena, nodes and their record and child slices are carved from chunks as well.
+	arena        *arena.Arena
+	nodeChunks   arena.Chunks[Node]
+	recordChunks arena.Chunks[*model.Record]
+	childChunks  arena.Chunks[*Node]
 }
 
 // NewBTree creates a B-tree with an explicit capacity (distinct keys).
@@ -67,6 +82,41 @@ func NewBTree(order, capacity int) *BTree {
 	}
 }
 
+// NewBTreeWithArena creates a B-tree that copies every stored record into an arena
+// with byte slabs of slabSize, see arena.Arena.
+func NewBTreeWithArena(order, capacity, slabSize int) *BTree {
+	bt := NewBTree(order, capacity)
+	bt.arena = arena.New(slabSize)
+	return bt
+}
+
+// own returns the record to store: its arena copy when an arena is used, the record itself otherwise.
+func (bt *BTree) own(record *model.Record) *model.Record {
+	if bt.arena == nil {
+		return record
+	}
+	return bt.arena.CopyRecord(record)
+}
+
+// newNode allocates a node with the given number of record and child slots.
+// With an arena, the slices get room for a full node (order records, order+1 children), so they never grow.
+func (bt *BTree) newNode(isLeaf bool, records int, children int) *Node {
+	if bt.arena == nil {
+		node := &Node{isLeaf: isLeaf, records: make([]*model.Record, records)}
+		if children > 0 {
+			node.children = make([]*Node, children)
+		}
+		return node
+	}
+	node := bt.nodeChunks.New()
+	node.isLeaf = isLeaf
+	node.records = bt.recordChunks.NewSlice(bt.order)[:records]
+	if !isLeaf {
+		node.children = bt.childChunks.NewSlice(bt.order + 1)[:children]
+	}
+	return node
+}
+
 // Get retrieves a record from the B-tree by key.
 //
 // Parameters:
@@ -127,10 +177,9 @@ func (bt *BTree) Put(record *model.Record) error {
 		if bt.IsFull() {
 			return fmt.Errorf("memtable is full (capacity=%d)", bt.capacity)
 		}
-		bt.root = &Node{
-			isLeaf:  true,
-			records: []*model.Record{record},
-		}
+		bt.root = bt.newNode(true, 1, 0)
+		bt.root.records[0] = bt.own(record)
+		bt.memoryUsage += memtable.RecordMemoryUsage(record) + ENTRY_OVERHEAD
 		bt.totalRecords++
 		if !record.Tombstone {
 			bt.activeRecords++
@@ -149,13 +198,15 @@ func (bt *BTree) Put(record *model.Record) error {
 		} else if !wasActive && isActive {
 			bt.activeRecords++
 		}
-		existingNode.records[existingIndex] = record
+		bt.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(oldRecord)
+		existingNode.records[existingIndex] = bt.own(record)
 	} else {
 		// NEW distinct key → must respect capacity.
 		if bt.IsFull() {
 			return fmt.Errorf("memtable is full (capacity=%d)", bt.capacity)
 		}
-		bt.insertRecord(bt.root, record)
+		bt.insertRecord(bt.root, bt.own(record))
+		bt.memoryUsage += memtable.RecordMemoryUsage(record) + ENTRY_OVERHEAD
 		bt.totalRecords++
 		if !record.Tombstone {
 			bt.activeRecords++
@@ -170,6 +221,11 @@ func (bt *BTree) IsFull() bool {
 	return bt.totalRecords >= bt.capacity
 }
 
+// MemoryUsage returns the approximate number of bytes held by the stored records and nodes.
+func (bt *BTree) MemoryUsage() int64 {
+	return bt.memoryUsage
+}
+
 // Delete marks the key as tombstoned.
 // Behavior:
 //   - If key exists: replace the record with a tombstone and update stats; return true.
@@ -190,7 +246,8 @@ func (bt *BTree) Delete(record *model.Record) bool {
 				return true
 			}
 			// Replace with tombstone and adjust stats.
-			node.records[idx] = record
+			bt.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(old)
+			node.records[idx] = bt.own(record)
 			bt.activeRecords--
 			return true
 		}
@@ -281,9 +338,12 @@ func (bt *BTree) findNextPrefixMatchAfterKey(prefix string, afterKey string, nod
 		// Check each record from startIndex onwards
 		for i := startIndex; i < len(node.records); i++ {
 			record := node.records[i]
-			// If key doesn't start with prefix, we've gone too far
+			// Keys before the prefix are skipped, once past it we've gone too far
 			if len(record.Key) < len(prefix) || record.Key[:len(prefix)] != prefix {
-				return nil
+				if record.Key > prefix {
+					return nil
+				}
+				continue
 			}
 
 			// Check if this record is tombstoned locally
@@ -613,16 +673,16 @@ func (bt *BTree) splitNode(node *Node) {
 	midRecord := node.records[mid]
 
 	// Create new right node
-	rightNode := &Node{
-		parent:  node.parent,
-		isLeaf:  node.isLeaf,
-		records: make([]*model.Record, len(node.records)-mid-1),
+	childCount := 0
+	if !node.isLeaf {
+		childCount = len(node.children) - mid - 1
 	}
+	rightNode := bt.newNode(node.isLeaf, len(node.records)-mid-1, childCount)
+	rightNode.parent = node.parent
 	copy(rightNode.records, node.records[mid+1:])
 
 	// If not leaf, split children too
 	if !node.isLeaf {
-		rightNode.children = make([]*Node, len(node.children)-mid-1)
 		copy(rightNode.children, node.children[mid+1:])
 
 		// Update parent pointers
@@ -638,11 +698,9 @@ func (bt *BTree) splitNode(node *Node) {
 
 	// Handle root split
 	if node.parent == nil {
-		newRoot := &Node{
-			isLeaf:   false,
-			records:  []*model.Record{midRecord},
-			children: []*Node{node, rightNode},
-		}
+		newRoot := bt.newNode(false, 1, 2)
+		newRoot.records[0] = midRecord
+		newRoot.children[0], newRoot.children[1] = node, rightNode
 		node.parent = newRoot
 		rightNode.parent = newRoot
 		bt.root = newRoot
@@ -726,6 +784,12 @@ func (bt *BTree) Flush(index int) error {
 	if err != nil {
 		return fmt.Errorf("failed to flush B-tree memtable: %v", err)
 	}
+	if bt.arena != nil {
+		bt.arena.Release()
+		bt.nodeChunks.Release()
+		bt.recordChunks.Release()
+		bt.childChunks.Release()
+	}
 
 	return nil
 }
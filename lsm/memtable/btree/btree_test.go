@@ -3,11 +3,13 @@ package btree
 import (
 	"fmt"
 	"math"
+	"runtime"
 	"sort"
 	"strconv"
 	"testing"
 	"time"
 
+	"hunddb/lsm/memtable/conformance"
 	memtable "hunddb/lsm/memtable/memtable_interface"
 	record "hunddb/model/record"
 )
@@ -1573,3 +1575,87 @@ func BenchmarkBTree_ScanForRange(b *testing.B) {
 		btree.ScanForRange("key000000", "key005000", &tombstoned, &bestKeys, 50, 0)
 	}
 }
+
+// TestBTree_MemoryUsage verifies that memory usage follows value sizes through inserts, updates and deletes
+func TestBTree_MemoryUsage(t *testing.T) {
+	bt := NewBTree(DefaultOrder, 100)
+	if bt.MemoryUsage() != 0 {
+		t.Fatalf("Expected empty tree to use 0 bytes, got %d", bt.MemoryUsage())
+	}
+
+	for i := 0; i < 10; i++ {
+		bt.Put(createTestRecord(fmt.Sprintf("key%02d", i), "v"))
+	}
+	small := bt.MemoryUsage()
+
+	// Growing one value by 10000 bytes grows usage by exactly that much
+	bt.Put(createTestRecord("key03", "v"+string(make([]byte, 10000))))
+	if bt.MemoryUsage() != small+10000 {
+		t.Errorf("Expected usage %d after growing a value, got %d", small+10000, bt.MemoryUsage())
+	}
+
+	// Deleting drops the value but keeps the tombstone entry
+	bt.Delete(createTombstoneRecord("key03"))
+	if bt.MemoryUsage() != small-1 {
+		t.Errorf("Expected usage %d after delete, got %d", small-1, bt.MemoryUsage())
+	}
+}
+
+// TestBTree_Conformance runs the shared memtable conformance suite
+func TestBTree_Conformance(t *testing.T) {
+	conformance.Run(t, func(capacity int) memtable.MemtableInterface {
+		return NewBTree(DefaultOrder, capacity)
+	})
+}
+
+// benchmarkBTreeFill fills a fresh memtable per iteration the way the write path does, with one new
+// record per Put, then reports the live heap objects and the cost of a GC cycle that has to mark the memtable.
+func benchmarkBTreeFill(b *testing.B, newMemtable func() *BTree) {
+	const n = 100_000
+	var gcTime time.Duration
+	var liveObjects uint64
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := newMemtable()
+		for j := 0; j < n; j++ {
+			_ = m.Put(createTestRecord(fmt.Sprintf("key%09d", j), "value"))
+		}
+
+		b.StopTimer()
+		// The first cycle collects the garbage of the fill, the second one only marks the live memtable
+		runtime.GC()
+		start := time.Now()
+		runtime.GC()
+		gcTime += time.Since(start)
+		runtime.ReadMemStats(&after)
+		liveObjects += after.HeapObjects
+		runtime.KeepAlive(m)
+		b.StartTimer()
+	}
+	b.StopTimer()
+
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+	b.ReportMetric(float64(gcTime.Nanoseconds())/float64(b.N), "gc-mark-ns/op")
+	b.ReportMetric(float64(liveObjects)/float64(b.N), "live-objects")
+}
+
+func BenchmarkBTree_Fill(b *testing.B) {
+	benchmarkBTreeFill(b, func() *BTree { return NewBTree(DefaultOrder, 0) })
+}
+
+func BenchmarkBTree_FillArena(b *testing.B) {
+	benchmarkBTreeFill(b, func() *BTree { return NewBTreeWithArena(DefaultOrder, 0, 256*1024) })
+}
+
+// TestBTree_ConformanceArena runs the shared memtable conformance suite with an arena-backed tree
+func TestBTree_ConformanceArena(t *testing.T) {
+	conformance.Run(t, func(capacity int) memtable.MemtableInterface {
+		return NewBTreeWithArena(DefaultOrder, capacity, 1024)
+	})
+}
@@ -0,0 +1,481 @@
+package concurrent_skip_list
+
+import (
+	"errors"
+	memtable "hunddb/lsm/memtable/memtable_interface"
+	sstable "hunddb/lsm/sstable"
+	model "hunddb/model/record"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Compile-time assertion that ConcurrentSkipList implements the concurrent Memtable interface.
+var _ memtable.ConcurrentMemtable = (*ConcurrentSkipList)(nil)
+
+// ErrCapacityExceeded is returned when inserting a new key into a full skip list.
+var ErrCapacityExceeded = errors.New("memtable capacity exceeded")
+
+/*
+ConcurrentSkipList is a lock-free skip list memtable.
+
+  - Writers insert with compare-and-swap on the forward pointers, retrying from a fresh search
+    when another writer changed the same spot, so any number of goroutines can write at once.
+  - Readers only follow atomic pointers and never wait on writers.
+  - Nodes are never unlinked - deletes store a tombstone record, like the other memtables.
+    This keeps insertion the only structural change, which is what makes CAS sufficient.
+
+A node becomes visible once it is linked on level 0. Higher levels are linked afterwards and
+only speed up searches, so a reader may briefly take the slower path but never misses a key.
+*/
+type ConcurrentSkipList struct {
+	head          *node
+	maxHeight     int
+	currentHeight atomic.Int32
+
+	// Capacity and counters (distinct keys)
+	capacity    int
+	totalCount  atomic.Int64 // current distinct keys, reserved before a new node is linked
+	activeCount atomic.Int64 // current non-tombstoned keys
+	memoryUsage atomic.Int64 // approximate bytes held by records and nodes
+}
+
+// node holds the latest record for a key. The record is swapped atomically on updates.
+type node struct {
+	key  string
+	rec  atomic.Pointer[model.Record]
+	next []atomic.Pointer[node] // i-th pointer is for level i
+}
+
+func newNode(rec *model.Record, height int) *node {
+	n := &node{
+		key:  rec.Key,
+		next: make([]atomic.Pointer[node], height),
+	}
+	n.rec.Store(rec)
+	return n
+}
+
+// New creates a ConcurrentSkipList memtable with the given parameters.
+// maxHeight >= 1; capacity <= 0 is treated as unbounded.
+func New(maxHeight int, capacity int) *ConcurrentSkipList {
+	if maxHeight < 1 {
+		maxHeight = 1
+	}
+	if capacity <= 0 {
+		capacity = int(^uint(0) >> 1)
+	}
+	s := &ConcurrentSkipList{
+		head:      &node{next: make([]atomic.Pointer[node], maxHeight)},
+		maxHeight: maxHeight,
+		capacity:  capacity,
+	}
+	s.currentHeight.Store(1)
+	return s
+}
+
+// ===== Internal helpers =====
+
+// roll picks a random height. math/rand/v2's top-level functions are safe for concurrent use.
+func (s *ConcurrentSkipList) roll() int {
+	h := 1
+	for h < s.maxHeight && rand.Uint32()&1 == 1 {
+		h++
+	}
+	return h
+}
+
+// findPredecessors fills preds/succs with the nodes surrounding key on every level
+// and returns the node holding key, if any.
+func (s *ConcurrentSkipList) findPredecessors(key string, preds, succs []*node) *node {
+	pred := s.head
+	for level := s.maxHeight - 1; level >= 0; level-- {
+		cur := pred.next[level].Load()
+		for cur != nil && cur.key < key {
+			pred = cur
+			cur = pred.next[level].Load()
+		}
+		preds[level] = pred
+		succs[level] = cur
+	}
+	if succs[0] != nil && succs[0].key == key {
+		return succs[0]
+	}
+	return nil
+}
+
+// findGreaterOrEqual returns the first node with a key >= key, or nil.
+func (s *ConcurrentSkipList) findGreaterOrEqual(key string) *node {
+	pred := s.head
+	var cur *node
+	for level := int(s.currentHeight.Load()) - 1; level >= 0; level-- {
+		cur = pred.next[level].Load()
+		for cur != nil && cur.key < key {
+			pred = cur
+			cur = pred.next[level].Load()
+		}
+	}
+	return cur
+}
+
+// firstAfter returns the first node with a key > key, or nil.
+func (s *ConcurrentSkipList) firstAfter(key string) *node {
+	cur := s.findGreaterOrEqual(key)
+	if cur != nil && cur.key == key {
+		cur = cur.next[0].Load()
+	}
+	return cur
+}
+
+/*
+update replaces the record of an existing node and adjusts the counters. A record older than the stored one
+is dropped: concurrent writers of a key may land in any order, the one with the newest timestamp wins.
+*/
+func (s *ConcurrentSkipList) update(n *node, record *model.Record) {
+	old := n.rec.Load()
+	for {
+		if old.Timestamp > record.Timestamp {
+			return
+		}
+		if n.rec.CompareAndSwap(old, record) {
+			break
+		}
+		old = n.rec.Load()
+	}
+	s.memoryUsage.Add(memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(old))
+	if old.Tombstone && !record.Tombstone {
+		s.activeCount.Add(1)
+	} else if !old.Tombstone && record.Tombstone {
+		s.activeCount.Add(-1)
+	}
+}
+
+// upsert inserts the record or replaces the record stored for its key.
+// Returns whether the key existed before, or ErrCapacityExceeded for a new key when full.
+func (s *ConcurrentSkipList) upsert(record *model.Record) (bool, error) {
+	preds := make([]*node, s.maxHeight)
+	succs := make([]*node, s.maxHeight)
+
+	if existing := s.findPredecessors(record.Key, preds, succs); existing != nil {
+		s.update(existing, record)
+		return true, nil
+	}
+
+	// Reserve a slot for the new key up front, so concurrent inserts cannot overshoot the capacity
+	if s.totalCount.Add(1) > int64(s.capacity) {
+		s.totalCount.Add(-1)
+		return false, ErrCapacityExceeded
+	}
+
+	height := s.roll()
+	n := newNode(record, height)
+	for {
+		// Linking level 0 publishes the node
+		n.next[0].Store(succs[0])
+		if preds[0].next[0].CompareAndSwap(succs[0], n) {
+			break
+		}
+		// Someone changed the neighbourhood - search again, the key may have been inserted meanwhile
+		if existing := s.findPredecessors(record.Key, preds, succs); existing != nil {
+			s.totalCount.Add(-1)
+			s.update(existing, record)
+			return true, nil
+		}
+	}
+
+	for level := 1; level < height; level++ {
+		for {
+			n.next[level].Store(succs[level])
+			if preds[level].next[level].CompareAndSwap(succs[level], n) {
+				break
+			}
+			s.findPredecessors(record.Key, preds, succs)
+		}
+	}
+
+	// Raise the search height only after the node is fully linked
+	for {
+		current := s.currentHeight.Load()
+		if int(current) >= height || s.currentHeight.CompareAndSwap(current, int32(height)) {
+			break
+		}
+	}
+
+	if !record.Tombstone {
+		s.activeCount.Add(1)
+	}
+	s.memoryUsage.Add(memtable.RecordMemoryUsage(record) + nodeMemoryUsage(height))
+	return false, nil
+}
+
+// nodeMemoryUsage approximates the bytes of a node besides its record: the struct and its forward pointers.
+func nodeMemoryUsage(height int) int64 {
+	return 48 + 8*int64(height)
+}
+
+// ===== Memtable interface =====
+
+// Put inserts or updates a record for its key. Safe to call from any number of goroutines.
+// NEW key: if the skip list is full -> ErrCapacityExceeded.
+func (s *ConcurrentSkipList) Put(record *model.Record) error {
+	if record == nil || record.Key == "" {
+		return errors.New("invalid record: record and key cannot be nil/empty")
+	}
+	_, err := s.upsert(record)
+	return err
+}
+
+// Delete marks the key as tombstoned using the provided record.
+// Returns true if the key existed before this call; false otherwise.
+// For a non-existing key, a tombstone is inserted if capacity allows (returning false).
+func (s *ConcurrentSkipList) Delete(record *model.Record) bool {
+	if record == nil || record.Key == "" {
+		return false
+	}
+	record.Tombstone = true
+	existed, _ := s.upsert(record)
+	return existed
+}
+
+// Get returns the latest non-tombstoned record by key, or nil if absent/tombstoned.
+func (s *ConcurrentSkipList) Get(key string) *model.Record {
+	n := s.findGreaterOrEqual(key)
+	if n == nil || n.key != key {
+		return nil
+	}
+	rec := n.rec.Load()
+	if rec.IsDeleted() {
+		return nil
+	}
+	return rec
+}
+
+// GetNextForPrefix returns the next record in lexicographical order after the given key,
+// constrained to the given prefix, or nil if none exists.
+// tombstonedKeys is used to track keys that have been tombstoned in more recent structures.
+func (s *ConcurrentSkipList) GetNextForPrefix(prefix string, key string, tombstonedKeys *[]string) *model.Record {
+	start := key
+	if prefix > start {
+		start = prefix
+	}
+	var current *node
+	if start == key {
+		current = s.firstAfter(key)
+	} else {
+		current = s.findGreaterOrEqual(start)
+	}
+
+	for ; current != nil; current = current.next[0].Load() {
+		if len(current.key) < len(prefix) || current.key[:len(prefix)] != prefix {
+			// Keys are sorted, so the first non-matching key past the prefix ends the search
+			break
+		}
+		if record := s.visibleRecord(current, tombstonedKeys); record != nil {
+			return record
+		}
+	}
+	return nil
+}
+
+// GetNextForRange returns the next record in lexicographical order after the given key,
+// constrained to the given range [rangeStart, rangeEnd] (inclusive), or nil if none exists.
+// tombstonedKeys is used to track keys that have been tombstoned in more recent structures.
+func (s *ConcurrentSkipList) GetNextForRange(rangeStart string, rangeEnd string, key string, tombstonedKeys *[]string) *model.Record {
+	var current *node
+	if rangeStart > key {
+		current = s.findGreaterOrEqual(rangeStart)
+	} else {
+		current = s.firstAfter(key)
+	}
+
+	for ; current != nil && current.key <= rangeEnd; current = current.next[0].Load() {
+		if record := s.visibleRecord(current, tombstonedKeys); record != nil {
+			return record
+		}
+	}
+	return nil
+}
+
+// visibleRecord returns the node's record unless it is tombstoned here or in a more recent structure.
+// Local tombstones are added to tombstonedKeys.
+func (s *ConcurrentSkipList) visibleRecord(n *node, tombstonedKeys *[]string) *model.Record {
+	record := n.rec.Load()
+	if record.IsDeleted() {
+		addToTombstoned(n.key, tombstonedKeys)
+		return nil
+	}
+	if isKeyTombstoned(n.key, tombstonedKeys) {
+		return nil
+	}
+	return record
+}
+
+// ScanForPrefix scans records with the given prefix and adds keys to bestKeys.
+// Only keys are added for memory efficiency - use Get() to retrieve full records.
+func (s *ConcurrentSkipList) ScanForPrefix(
+	prefix string,
+	tombstonedKeys *[]string,
+	bestKeys *[]string,
+	pageSize int,
+	pageNumber int,
+) {
+	tombstonedSet, bestKeysSet := buildScanSets(tombstonedKeys, bestKeys)
+
+	for current := s.findGreaterOrEqual(prefix); current != nil; current = current.next[0].Load() {
+		if len(current.key) < len(prefix) || current.key[:len(prefix)] != prefix {
+			break
+		}
+		processRecordForScan(current.rec.Load(), tombstonedSet, bestKeysSet, tombstonedKeys, bestKeys)
+	}
+}
+
+// ScanForRange scans records within the given range and adds keys to bestKeys.
+// Only keys are added for memory efficiency - use Get() to retrieve full records.
+func (s *ConcurrentSkipList) ScanForRange(
+	rangeStart string,
+	rangeEnd string,
+	tombstonedKeys *[]string,
+	bestKeys *[]string,
+	pageSize int,
+	pageNumber int,
+) {
+	tombstonedSet, bestKeysSet := buildScanSets(tombstonedKeys, bestKeys)
+
+	for current := s.findGreaterOrEqual(rangeStart); current != nil && current.key <= rangeEnd; current = current.next[0].Load() {
+		processRecordForScan(current.rec.Load(), tombstonedSet, bestKeysSet, tombstonedKeys, bestKeys)
+	}
+}
+
+// buildScanSets creates sets of the already tombstoned and already found keys for O(1) lookup.
+func buildScanSets(tombstonedKeys *[]string, bestKeys *[]string) (map[string]bool, map[string]bool) {
+	tombstonedSet := make(map[string]bool)
+	if tombstonedKeys != nil {
+		for _, key := range *tombstonedKeys {
+			tombstonedSet[key] = true
+		}
+	}
+	bestKeysSet := make(map[string]bool)
+	if bestKeys != nil {
+		for _, key := range *bestKeys {
+			bestKeysSet[key] = true
+		}
+	}
+	return tombstonedSet, bestKeysSet
+}
+
+// processRecordForScan processes a single record during the scan operation
+func processRecordForScan(
+	record *model.Record,
+	tombstonedSet map[string]bool,
+	bestKeysSet map[string]bool,
+	tombstonedKeys *[]string,
+	bestKeys *[]string,
+) {
+	// Skip if already tombstoned in newer structures or already found in newer memtables
+	if tombstonedSet[record.Key] || bestKeysSet[record.Key] {
+		return
+	}
+
+	// If this record is a tombstone, add to tombstoned set
+	if record.IsDeleted() {
+		if tombstonedKeys != nil {
+			*tombstonedKeys = append(*tombstonedKeys, record.Key)
+			tombstonedSet[record.Key] = true
+		}
+		return
+	}
+
+	// Add to best keys (maintaining sorted order)
+	if bestKeys != nil {
+		*bestKeys = insertKeySorted(*bestKeys, record.Key)
+		bestKeysSet[record.Key] = true
+	}
+}
+
+// insertKeySorted inserts a key in sorted order into the slice
+func insertKeySorted(keys []string, newKey string) []string {
+	// Binary search for insertion point
+	left, right := 0, len(keys)
+	for left < right {
+		mid := (left + right) / 2
+		if keys[mid] < newKey {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+
+	// Insert at the found position
+	keys = append(keys, "")
+	copy(keys[left+1:], keys[left:])
+	keys[left] = newKey
+	return keys
+}
+
+// isKeyTombstoned checks if a key is in the tombstoned keys slice
+func isKeyTombstoned(key string, tombstonedKeys *[]string) bool {
+	if tombstonedKeys == nil {
+		return false
+	}
+	for _, tombKey := range *tombstonedKeys {
+		if tombKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// addToTombstoned adds a key to the tombstoned keys slice if it's not already there
+func addToTombstoned(key string, tombstonedKeys *[]string) {
+	if tombstonedKeys == nil {
+		return
+	}
+	for _, tombKey := range *tombstonedKeys {
+		if tombKey == key {
+			return
+		}
+	}
+	*tombstonedKeys = append(*tombstonedKeys, key)
+}
+
+func (s *ConcurrentSkipList) Size() int         { return int(s.activeCount.Load()) }
+func (s *ConcurrentSkipList) Capacity() int     { return s.capacity }
+func (s *ConcurrentSkipList) TotalEntries() int { return int(s.totalCount.Load()) }
+func (s *ConcurrentSkipList) IsFull() bool      { return s.totalCount.Load() >= int64(s.capacity) }
+
+// IsConcurrent reports that the skip list needs no external locking.
+func (s *ConcurrentSkipList) IsConcurrent() bool { return true }
+
+// MemoryUsage returns the approximate number of bytes held by the stored records and nodes.
+func (s *ConcurrentSkipList) MemoryUsage() int64 { return s.memoryUsage.Load() }
+
+// RetrieveSortedRecords returns all records (including tombstones) in sorted key order.
+// This is used for flushing the memtable to an SSTable. Records inserted concurrently
+// with the walk may or may not be included.
+func (s *ConcurrentSkipList) RetrieveSortedRecords() []model.Record {
+	var records []model.Record
+	for current := s.head.next[0].Load(); current != nil; current = current.next[0].Load() {
+		rec := current.rec.Load()
+		// Create a copy of the record to prevent external modification
+		recordCopy := model.Record{
+			Key:       rec.Key,
+			Value:     make([]byte, len(rec.Value)),
+			Timestamp: rec.Timestamp,
+			Tombstone: rec.Tombstone,
+		}
+		copy(recordCopy.Value, rec.Value)
+		records = append(records, recordCopy)
+	}
+	return records
+}
+
+// Flush persists the memtable contents to disk (SSTable).
+func (s *ConcurrentSkipList) Flush(index int) error {
+	sortedRecords := s.RetrieveSortedRecords()
+
+	err := sstable.PersistMemtable(sortedRecords, index)
+	if err != nil {
+		return errors.New("failed to flush ConcurrentSkipList memtable: " + err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package concurrent_skip_list
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"hunddb/lsm/memtable/conformance"
+	mi "hunddb/lsm/memtable/memtable_interface"
+	skip_list "hunddb/lsm/memtable/skip_list"
+	model "hunddb/model/record"
+)
+
+// helper to create records with current timestamp
+func rec(key string, val []byte, tomb bool) *model.Record {
+	return model.NewRecord(key, val, uint64(time.Now().UnixNano()), tomb)
+}
+
+// TestConcurrentSkipList_PutGetDelete verifies the basic single-threaded memtable semantics
+func TestConcurrentSkipList_PutGetDelete(t *testing.T) {
+	s := New(8, 10)
+
+	for _, key := range []string{"b", "a", "c"} {
+		if err := s.Put(rec(key, []byte("v_"+key), false)); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+	if got := s.Get("a"); got == nil || string(got.Value) != "v_a" {
+		t.Fatalf("Expected v_a, got %v", got)
+	}
+	if s.Get("missing") != nil {
+		t.Errorf("Expected nil for a missing key")
+	}
+
+	// Update keeps the number of distinct keys
+	s.Put(rec("a", []byte("v_a2"), false))
+	if got := s.Get("a"); string(got.Value) != "v_a2" {
+		t.Errorf("Expected updated value v_a2, got %s", got.Value)
+	}
+	if s.TotalEntries() != 3 || s.Size() != 3 {
+		t.Errorf("Expected Total=3 Size=3, got Total=%d Size=%d", s.TotalEntries(), s.Size())
+	}
+
+	if !s.Delete(rec("b", nil, false)) {
+		t.Errorf("Expected Delete of an existing key to return true")
+	}
+	if s.Get("b") != nil {
+		t.Errorf("Expected deleted key to be hidden")
+	}
+	if s.Delete(rec("z", nil, false)) {
+		t.Errorf("Expected Delete of an unseen key to return false")
+	}
+	if s.TotalEntries() != 4 || s.Size() != 2 {
+		t.Errorf("Expected Total=4 Size=2 after deletes, got Total=%d Size=%d", s.TotalEntries(), s.Size())
+	}
+
+	// Resurrecting a tombstoned key makes it active again
+	s.Put(rec("b", []byte("back"), false))
+	if s.Get("b") == nil || s.Size() != 3 {
+		t.Errorf("Expected resurrected key to be visible with Size=3, got Size=%d", s.Size())
+	}
+}
+
+// TestConcurrentSkipList_Capacity verifies that only new distinct keys are limited by capacity
+func TestConcurrentSkipList_Capacity(t *testing.T) {
+	s := New(4, 2)
+	s.Put(rec("a", []byte("1"), false))
+	s.Put(rec("b", []byte("2"), false))
+
+	if !s.IsFull() {
+		t.Fatalf("Expected skip list to be full")
+	}
+	if err := s.Put(rec("c", []byte("3"), false)); !errors.Is(err, ErrCapacityExceeded) {
+		t.Errorf("Expected ErrCapacityExceeded, got %v", err)
+	}
+	if err := s.Put(rec("a", []byte("updated"), false)); err != nil {
+		t.Errorf("Expected update of an existing key to succeed when full, got %v", err)
+	}
+	if s.TotalEntries() != 2 {
+		t.Errorf("Expected 2 entries, got %d", s.TotalEntries())
+	}
+}
+
+// TestConcurrentSkipList_MatchesSkipList verifies that iteration and scans behave like the sequential skip list
+func TestConcurrentSkipList_MatchesSkipList(t *testing.T) {
+	concurrent := New(8, 1000)
+	sequential := skip_list.New(8, 1000)
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("%s_%03d", []string{"apple", "banana", "cherry"}[i%3], i)
+		concurrent.Put(rec(key, []byte(key), false))
+		sequential.Put(rec(key, []byte(key), false))
+		if i%7 == 0 {
+			concurrent.Delete(rec(key, nil, true))
+			sequential.Delete(rec(key, nil, true))
+		}
+	}
+
+	// Prefix iteration
+	for _, prefix := range []string{"banana", "b", "zzz", ""} {
+		var concurrentTomb, sequentialTomb []string
+		ck, sk := "", ""
+		for {
+			c := concurrent.GetNextForPrefix(prefix, ck, &concurrentTomb)
+			s := sequential.GetNextForPrefix(prefix, sk, &sequentialTomb)
+			if (c == nil) != (s == nil) {
+				t.Fatalf("Prefix %q: iteration diverged after %q", prefix, ck)
+			}
+			if c == nil {
+				break
+			}
+			if c.Key != s.Key {
+				t.Fatalf("Prefix %q: expected %s, got %s", prefix, s.Key, c.Key)
+			}
+			ck, sk = c.Key, s.Key
+		}
+		if len(concurrentTomb) != len(sequentialTomb) {
+			t.Errorf("Prefix %q: expected %d tombstones, got %d", prefix, len(sequentialTomb), len(concurrentTomb))
+		}
+	}
+
+	// Range iteration
+	var concurrentTomb, sequentialTomb []string
+	ck, sk := "", ""
+	for {
+		c := concurrent.GetNextForRange("apple_050", "cherry_100", ck, &concurrentTomb)
+		s := sequential.GetNextForRange("apple_050", "cherry_100", sk, &sequentialTomb)
+		if (c == nil) != (s == nil) {
+			t.Fatalf("Range iteration diverged after %q", ck)
+		}
+		if c == nil {
+			break
+		}
+		if c.Key != s.Key {
+			t.Fatalf("Range: expected %s, got %s", s.Key, c.Key)
+		}
+		ck, sk = c.Key, s.Key
+	}
+
+	// Scans
+	var concurrentBest, sequentialBest []string
+	concurrent.ScanForPrefix("cherry", &[]string{}, &concurrentBest, 50, 0)
+	sequential.ScanForPrefix("cherry", &[]string{}, &sequentialBest, 50, 0)
+	if fmt.Sprint(concurrentBest) != fmt.Sprint(sequentialBest) {
+		t.Errorf("ScanForPrefix mismatch:\n got %v\nwant %v", concurrentBest, sequentialBest)
+	}
+	concurrentBest, sequentialBest = nil, nil
+	concurrent.ScanForRange("apple_100", "banana_150", &[]string{}, &concurrentBest, 50, 0)
+	sequential.ScanForRange("apple_100", "banana_150", &[]string{}, &sequentialBest, 50, 0)
+	if fmt.Sprint(concurrentBest) != fmt.Sprint(sequentialBest) {
+		t.Errorf("ScanForRange mismatch:\n got %v\nwant %v", concurrentBest, sequentialBest)
+	}
+
+	// Flushed order
+	concurrentRecords := concurrent.RetrieveSortedRecords()
+	sequentialRecords := sequential.RetrieveSortedRecords()
+	if len(concurrentRecords) != len(sequentialRecords) {
+		t.Fatalf("Expected %d sorted records, got %d", len(sequentialRecords), len(concurrentRecords))
+	}
+	for i := range concurrentRecords {
+		if concurrentRecords[i].Key != sequentialRecords[i].Key || concurrentRecords[i].Tombstone != sequentialRecords[i].Tombstone {
+			t.Errorf("Sorted record %d: expected %s, got %s", i, sequentialRecords[i].Key, concurrentRecords[i].Key)
+		}
+	}
+}
+
+// TestConcurrentSkipList_ConcurrentWriters verifies that parallel inserts and updates lose no keys
+func TestConcurrentSkipList_ConcurrentWriters(t *testing.T) {
+	const writers = 8
+	const keysPerWriter = 500
+	s := New(16, writers*keysPerWriter)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				// Writers overlap on half of their keys to exercise concurrent updates of the same key
+				key := fmt.Sprintf("key_%05d", (w/2)*keysPerWriter+i)
+				if err := s.Put(rec(key, []byte(key), false)); err != nil {
+					t.Errorf("Put(%s) failed: %v", key, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	expected := writers / 2 * keysPerWriter
+	if s.TotalEntries() != expected || s.Size() != expected {
+		t.Fatalf("Expected %d distinct keys, got Total=%d Size=%d", expected, s.TotalEntries(), s.Size())
+	}
+	records := s.RetrieveSortedRecords()
+	if len(records) != expected {
+		t.Fatalf("Expected %d linked nodes, got %d", expected, len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i-1].Key >= records[i].Key {
+			t.Fatalf("Records out of order: %s before %s", records[i-1].Key, records[i].Key)
+		}
+	}
+	for i := 0; i < expected; i++ {
+		if s.Get(fmt.Sprintf("key_%05d", i)) == nil {
+			t.Fatalf("Missing key_%05d", i)
+		}
+	}
+}
+
+// TestConcurrentSkipList_NewestTimestampWins verifies that writes of a key landing out of order keep the newest record
+func TestConcurrentSkipList_NewestTimestampWins(t *testing.T) {
+	s := New(8, 10)
+	s.Put(model.NewRecord("k", []byte("newer"), 20, false))
+	s.Put(model.NewRecord("k", []byte("older"), 10, false))
+	if got := s.Get("k"); got == nil || string(got.Value) != "newer" {
+		t.Errorf("Expected the newer record to stay, got %v", got)
+	}
+	if !s.Delete(model.NewRecord("k", nil, 15, true)) || s.Get("k") == nil {
+		t.Errorf("Expected an older tombstone to leave the newer record visible")
+	}
+
+	// Concurrent writers of one key, each with its own timestamp
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				timestamp := uint64(100 + i*8 + w)
+				s.Put(model.NewRecord("race", []byte(fmt.Sprint(timestamp)), timestamp, false))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if got := s.Get("race"); got == nil || got.Timestamp != 100+199*8+7 {
+		t.Errorf("Expected the record with the newest timestamp to win, got %v", got)
+	}
+	if s.Size() != 2 || s.TotalEntries() != 2 {
+		t.Errorf("Expected Total=2 Size=2, got Total=%d Size=%d", s.TotalEntries(), s.Size())
+	}
+}
+
+// TestConcurrentSkipList_CapacityUnderContention verifies that parallel inserts never exceed the capacity
+func TestConcurrentSkipList_CapacityUnderContention(t *testing.T) {
+	s := New(8, 100)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				s.Put(rec(fmt.Sprintf("w%d_%d", w, i), []byte("v"), false))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if s.TotalEntries() != 100 || len(s.RetrieveSortedRecords()) != 100 {
+		t.Errorf("Expected exactly 100 entries, got Total=%d linked=%d", s.TotalEntries(), len(s.RetrieveSortedRecords()))
+	}
+}
+
+// TestConcurrentSkipList_ReadersDuringWrites verifies that readers always see complete, ordered data while writers run
+func TestConcurrentSkipList_ReadersDuringWrites(t *testing.T) {
+	s := New(16, 0)
+	for i := 0; i < 1000; i += 2 {
+		s.Put(rec(fmt.Sprintf("key_%04d", i), []byte("even"), false))
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 1000; i += 2 {
+			s.Put(rec(fmt.Sprintf("key_%04d", i), []byte("odd"), false))
+		}
+		close(done)
+	}()
+
+	for reads := 0; ; reads++ {
+		// Keys present before the writer started must always be found
+		key := fmt.Sprintf("key_%04d", (reads*2)%1000)
+		if s.Get(key) == nil {
+			t.Fatalf("Reader lost %s while writers were running", key)
+		}
+		var best []string
+		s.ScanForPrefix("key_", &[]string{}, &best, 50, 0)
+		if len(best) < 500 {
+			t.Fatalf("Scan returned %d keys, expected at least 500", len(best))
+		}
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		default:
+		}
+	}
+}
+
+func BenchmarkConcurrentSkipList_ParallelPut(b *testing.B) {
+	s := New(16, 0)
+	var counter sync.Mutex
+	next := 0
+	b.RunParallel(func(pb *testing.PB) {
+		counter.Lock()
+		base := next
+		next += 1 << 24
+		counter.Unlock()
+		i := 0
+		for pb.Next() {
+			s.Put(rec(fmt.Sprintf("key_%010d", base+i), []byte("value"), false))
+			i++
+		}
+	})
+}
+
+func BenchmarkConcurrentSkipList_ParallelGet(b *testing.B) {
+	s := New(16, 0)
+	for i := 0; i < 10000; i++ {
+		s.Put(rec(fmt.Sprintf("key_%05d", i), []byte("value"), false))
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.Get(fmt.Sprintf("key_%05d", i%10000))
+			i++
+		}
+	})
+}
+
+// TestConcurrentSkipList_Conformance runs the shared memtable conformance suite
+func TestConcurrentSkipList_Conformance(t *testing.T) {
+	conformance.Run(t, func(capacity int) mi.MemtableInterface {
+		return New(16, capacity)
+	})
+}
@@ -0,0 +1,438 @@
+/*
+Package conformance is a test suite for memtable implementations.
+Every implementation selectable through memtable.Register is expected to pass it:
+
+	func TestMyMemtable_Conformance(t *testing.T) {
+		conformance.Run(t, func(capacity int) memtable_interface.MemtableInterface {
+			return NewMyMemtable(capacity)
+		})
+	}
+
+The suite covers the semantics the LSM relies on: capacity applies to new distinct keys only,
+deletes are logical (tombstones count towards capacity and shadow older structures),
+and iteration and scans return keys in lexicographical order while recording local tombstones.
+Flush is not exercised, since it writes SSTables to disk.
+*/
+package conformance
+
+import (
+	"fmt"
+	mi "hunddb/lsm/memtable/memtable_interface"
+	model "hunddb/model/record"
+	"testing"
+	"time"
+)
+
+// Factory creates an empty implementation holding at most capacity distinct keys (capacity is always positive).
+// memtable.Factory values can be passed as is.
+type Factory func(capacity int) mi.MemtableInterface
+
+// Run runs every conformance test against implementations created by factory.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, factory Factory)
+	}{
+		{"PutAndGet", testPutAndGet},
+		{"UpdateExisting", testUpdateExisting},
+		{"InvalidRecords", testInvalidRecords},
+		{"DeleteExisting", testDeleteExisting},
+		{"DeleteUnseenKey", testDeleteUnseenKey},
+		{"ResurrectTombstone", testResurrectTombstone},
+		{"Capacity", testCapacity},
+		{"MemoryUsage", testMemoryUsage},
+		{"GetNextForPrefix", testGetNextForPrefix},
+		{"GetNextForPrefixTombstones", testGetNextForPrefixTombstones},
+		{"GetNextForRange", testGetNextForRange},
+		{"ScanForPrefix", testScanForPrefix},
+		{"ScanForPrefixMergesNewerResults", testScanForPrefixMergesNewerResults},
+		{"ScanForRange", testScanForRange},
+		{"EmptyMemtable", testEmptyMemtable},
+		{"LargeDataset", testLargeDataset},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory)
+		})
+	}
+}
+
+// ---- helpers ----
+
+func record(key, value string) *model.Record {
+	return model.NewRecord(key, []byte(value), uint64(time.Now().UnixNano()), false)
+}
+
+func tombstone(key string) *model.Record {
+	return model.NewRecord(key, nil, uint64(time.Now().UnixNano()), true)
+}
+
+func putAll(t *testing.T, m mi.MemtableInterface, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if err := m.Put(record(key, "v_"+key)); err != nil {
+			t.Fatalf("Put(%s) failed: %v", key, err)
+		}
+	}
+}
+
+func checkCounts(t *testing.T, m mi.MemtableInterface, size, total int) {
+	t.Helper()
+	if m.Size() != size || m.TotalEntries() != total {
+		t.Fatalf("expected Size=%d TotalEntries=%d, got Size=%d TotalEntries=%d", size, total, m.Size(), m.TotalEntries())
+	}
+}
+
+func checkKeys(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%s: expected %v, got %v", what, want, got)
+	}
+}
+
+// iterate collects every key returned by repeated calls of next, starting from the empty key.
+func iterate(next func(key string) *model.Record) []string {
+	var keys []string
+	key := ""
+	for r := next(key); r != nil; r = next(key) {
+		keys = append(keys, r.Key)
+		key = r.Key
+	}
+	return keys
+}
+
+// ---- point operations ----
+
+func testPutAndGet(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "b", "a", "c")
+
+	for _, key := range []string{"a", "b", "c"} {
+		got := m.Get(key)
+		if got == nil || got.Key != key || string(got.Value) != "v_"+key {
+			t.Fatalf("Get(%s) = %v", key, got)
+		}
+	}
+	if m.Get("d") != nil {
+		t.Fatalf("expected nil for a missing key")
+	}
+	checkCounts(t, m, 3, 3)
+	if m.Capacity() != 100 {
+		t.Fatalf("expected Capacity=100, got %d", m.Capacity())
+	}
+}
+
+func testUpdateExisting(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "key")
+	if err := m.Put(record("key", "updated")); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if got := m.Get("key"); got == nil || string(got.Value) != "updated" {
+		t.Fatalf("expected the updated value, got %v", got)
+	}
+	checkCounts(t, m, 1, 1)
+}
+
+func testInvalidRecords(t *testing.T, factory Factory) {
+	m := factory(100)
+	if err := m.Put(nil); err == nil {
+		t.Fatalf("expected Put(nil) to fail")
+	}
+	if m.Delete(nil) {
+		t.Fatalf("expected Delete(nil) to return false")
+	}
+	if err := m.Put(record("", "value")); err == nil {
+		t.Fatalf("expected Put with an empty key to fail")
+	}
+	if m.Delete(tombstone("")) {
+		t.Fatalf("expected Delete with an empty key to return false")
+	}
+	checkCounts(t, m, 0, 0)
+}
+
+func testDeleteExisting(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "a", "b")
+
+	if !m.Delete(tombstone("a")) {
+		t.Fatalf("expected Delete of an existing key to return true")
+	}
+	if m.Get("a") != nil {
+		t.Fatalf("expected a deleted key to be hidden from Get")
+	}
+	checkCounts(t, m, 1, 2)
+
+	// Deleting again keeps the tombstone
+	if !m.Delete(tombstone("a")) {
+		t.Fatalf("expected Delete of a tombstoned key to return true")
+	}
+	checkCounts(t, m, 1, 2)
+
+	// Delete forces the tombstone flag even when the caller did not set it
+	if !m.Delete(record("b", "")) || m.Get("b") != nil {
+		t.Fatalf("expected Delete to tombstone b")
+	}
+	checkCounts(t, m, 0, 2)
+}
+
+func testDeleteUnseenKey(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "a")
+
+	// A blind delete stores a tombstone so the key stays shadowed in older structures
+	if m.Delete(tombstone("z")) {
+		t.Fatalf("expected Delete of an unseen key to return false")
+	}
+	checkCounts(t, m, 1, 2)
+
+	tombstoned := []string{}
+	m.ScanForPrefix("z", &tombstoned, &[]string{}, 50, 0)
+	checkKeys(t, "tombstones", tombstoned, "z")
+}
+
+func testResurrectTombstone(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "a")
+	m.Delete(tombstone("a"))
+	putAll(t, m, "a")
+
+	if m.Get("a") == nil {
+		t.Fatalf("expected a key put after its delete to be visible")
+	}
+	checkCounts(t, m, 1, 1)
+}
+
+func testCapacity(t *testing.T, factory Factory) {
+	m := factory(3)
+	putAll(t, m, "a", "b")
+	if m.IsFull() {
+		t.Fatalf("expected IsFull=false below capacity")
+	}
+	m.Delete(tombstone("c"))
+	if !m.IsFull() {
+		t.Fatalf("expected tombstones to count towards capacity")
+	}
+
+	if err := m.Put(record("d", "v")); err == nil {
+		t.Fatalf("expected Put of a new key to fail when full")
+	}
+	if m.Delete(tombstone("e")) {
+		t.Fatalf("expected Delete of a new key to return false when full")
+	}
+	checkCounts(t, m, 2, 3)
+
+	// Existing keys can always be updated and deleted
+	if err := m.Put(record("a", "updated")); err != nil {
+		t.Fatalf("expected update to succeed when full, got %v", err)
+	}
+	if err := m.Put(record("c", "revived")); err != nil {
+		t.Fatalf("expected tombstone overwrite to succeed when full, got %v", err)
+	}
+	if !m.Delete(tombstone("b")) {
+		t.Fatalf("expected Delete of an existing key to succeed when full")
+	}
+	checkCounts(t, m, 2, 3)
+	if m.Get("d") != nil || m.Get("e") != nil {
+		t.Fatalf("expected rejected keys to be absent")
+	}
+}
+
+func testMemoryUsage(t *testing.T, factory Factory) {
+	m := factory(100)
+	empty := m.MemoryUsage()
+
+	putAll(t, m, "a")
+	afterInsert := m.MemoryUsage()
+	if afterInsert <= empty {
+		t.Fatalf("expected usage to grow after an insert, got %d -> %d", empty, afterInsert)
+	}
+
+	m.Put(model.NewRecord("a", make([]byte, 10000), uint64(time.Now().UnixNano()), false))
+	grown := m.MemoryUsage()
+	if grown < afterInsert+9000 {
+		t.Fatalf("expected usage to follow a 10000 byte value, got %d -> %d", afterInsert, grown)
+	}
+
+	m.Delete(tombstone("a"))
+	if m.MemoryUsage() >= grown {
+		t.Fatalf("expected usage to shrink when a large value is replaced by a tombstone, got %d -> %d", grown, m.MemoryUsage())
+	}
+}
+
+// ---- iteration ----
+
+func testGetNextForPrefix(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "user009", "admin001", "user001", "user005", "us", "user", "usera", "userb/x", "v")
+
+	keys := iterate(func(key string) *model.Record {
+		return m.GetNextForPrefix("user", key, &[]string{})
+	})
+	checkKeys(t, "prefix user", keys, "user", "user001", "user005", "user009", "usera", "userb/x")
+
+	// The key to continue from does not need to exist or to match the prefix
+	if got := m.GetNextForPrefix("user", "user002", &[]string{}); got == nil || got.Key != "user005" {
+		t.Fatalf("expected user005 after user002, got %v", got)
+	}
+	if got := m.GetNextForPrefix("user", "aaa", &[]string{}); got == nil || got.Key != "user" {
+		t.Fatalf("expected user after aaa, got %v", got)
+	}
+	if got := m.GetNextForPrefix("user", "zzz", &[]string{}); got != nil {
+		t.Fatalf("expected nil after zzz, got %v", got)
+	}
+	if got := m.GetNextForPrefix("nobody", "", &[]string{}); got != nil {
+		t.Fatalf("expected nil for a prefix without keys, got %v", got)
+	}
+
+	all := iterate(func(key string) *model.Record {
+		return m.GetNextForPrefix("", key, &[]string{})
+	})
+	checkKeys(t, "empty prefix", all, "admin001", "us", "user", "user001", "user005", "user009", "usera", "userb/x", "v")
+}
+
+func testGetNextForPrefixTombstones(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "p1", "p2", "p3", "p4")
+	m.Delete(tombstone("p2"))
+
+	// p3 was tombstoned in a more recent structure, p2 is tombstoned locally
+	tombstoned := []string{"p3"}
+	got := m.GetNextForPrefix("p", "p1", &tombstoned)
+	if got == nil || got.Key != "p4" {
+		t.Fatalf("expected p4, got %v", got)
+	}
+	checkKeys(t, "tombstones", tombstoned, "p3", "p2")
+
+	// Reporting the same tombstone again does not duplicate it
+	m.GetNextForPrefix("p", "", &tombstoned)
+	checkKeys(t, "tombstones", tombstoned, "p3", "p2")
+}
+
+func testGetNextForRange(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "a", "b", "b1", "c", "d", "e")
+	m.Delete(tombstone("c"))
+
+	tombstoned := []string{}
+	keys := iterate(func(key string) *model.Record {
+		return m.GetNextForRange("b", "d", key, &tombstoned)
+	})
+	checkKeys(t, "range [b, d]", keys, "b", "b1", "d")
+	checkKeys(t, "tombstones", tombstoned, "c")
+
+	// Bounds do not need to exist
+	keys = iterate(func(key string) *model.Record {
+		return m.GetNextForRange("a5", "c5", key, &[]string{})
+	})
+	checkKeys(t, "range [a5, c5]", keys, "b", "b1")
+
+	if got := m.GetNextForRange("b", "d", "b1", &[]string{"d"}); got != nil {
+		t.Fatalf("expected nil when the only remaining key is tombstoned in a newer structure, got %v", got)
+	}
+	if got := m.GetNextForRange("x", "z", "", &[]string{}); got != nil {
+		t.Fatalf("expected nil for an empty range, got %v", got)
+	}
+}
+
+// ---- scans ----
+
+func testScanForPrefix(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "user3", "user1", "admin", "user2", "userz", "use")
+	m.Delete(tombstone("user2"))
+
+	tombstoned := []string{"userz"}
+	bestKeys := []string{}
+	m.ScanForPrefix("user", &tombstoned, &bestKeys, 50, 0)
+	checkKeys(t, "keys", bestKeys, "user1", "user3")
+	checkKeys(t, "tombstones", tombstoned, "userz", "user2")
+
+	// Nil result slices are allowed
+	m.ScanForPrefix("user", nil, nil, 50, 0)
+}
+
+func testScanForPrefixMergesNewerResults(t *testing.T, factory Factory) {
+	// Keys found in newer memtables are kept, and shadow this memtable's tombstones
+	m := factory(100)
+	putAll(t, m, "k2", "k4")
+	m.Delete(tombstone("k3"))
+
+	tombstoned := []string{}
+	bestKeys := []string{"k1", "k3", "k4"}
+	m.ScanForPrefix("k", &tombstoned, &bestKeys, 50, 0)
+	checkKeys(t, "keys", bestKeys, "k1", "k2", "k3", "k4")
+	checkKeys(t, "tombstones", tombstoned)
+}
+
+func testScanForRange(t *testing.T, factory Factory) {
+	m := factory(100)
+	putAll(t, m, "a", "b", "c", "d", "e", "ca")
+	m.Delete(tombstone("d"))
+
+	tombstoned := []string{}
+	bestKeys := []string{"c0"}
+	m.ScanForRange("b", "d", &tombstoned, &bestKeys, 50, 0)
+	checkKeys(t, "keys", bestKeys, "b", "c", "c0", "ca")
+	checkKeys(t, "tombstones", tombstoned, "d")
+
+	bestKeys = []string{}
+	m.ScanForRange("x", "z", &[]string{}, &bestKeys, 50, 0)
+	checkKeys(t, "empty range", bestKeys)
+}
+
+func testEmptyMemtable(t *testing.T, factory Factory) {
+	m := factory(10)
+	checkCounts(t, m, 0, 0)
+	if m.IsFull() || m.Get("a") != nil {
+		t.Fatalf("expected an empty memtable")
+	}
+	if m.GetNextForPrefix("", "", &[]string{}) != nil || m.GetNextForRange("a", "z", "", &[]string{}) != nil {
+		t.Fatalf("expected no records from an empty memtable")
+	}
+	bestKeys := []string{}
+	m.ScanForPrefix("", &[]string{}, &bestKeys, 50, 0)
+	m.ScanForRange("a", "z", &[]string{}, &bestKeys, 50, 0)
+	checkKeys(t, "keys", bestKeys)
+}
+
+func testLargeDataset(t *testing.T, factory Factory) {
+	const n = 2000
+	m := factory(n)
+	// Insert in a scrambled order so ordered reads cannot rely on insertion order
+	for i := 0; i < n; i++ {
+		j := (i * 7919) % n
+		if err := m.Put(record(fmt.Sprintf("tenant/%d/user/%05d", j%3, j), "v")); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	for i := 0; i < n; i += 10 {
+		m.Delete(tombstone(fmt.Sprintf("tenant/%d/user/%05d", i%3, i)))
+	}
+	if !m.IsFull() {
+		t.Fatalf("expected the memtable to be full")
+	}
+	checkCounts(t, m, n-n/10, n)
+
+	keys := iterate(func(key string) *model.Record {
+		return m.GetNextForPrefix("tenant/1/", key, &[]string{})
+	})
+	bestKeys := []string{}
+	m.ScanForPrefix("tenant/1/", &[]string{}, &bestKeys, 50, 0)
+	checkKeys(t, "iteration and scan", keys, bestKeys...)
+
+	expected := 0
+	for i := 0; i < n; i++ {
+		if i%3 == 1 && i%10 != 0 {
+			expected++
+		}
+	}
+	if len(keys) != expected {
+		t.Fatalf("expected %d keys under tenant/1/, got %d", expected, len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Fatalf("keys out of order: %s before %s", keys[i-1], keys[i])
+		}
+	}
+}
@@ -8,16 +8,28 @@ import (
 	model "hunddb/model/record"
 	"math"
 	"sort"
+	"sync"
 )
 
 // Compile-time assertion that HashMap implements the Memtable interface.
 var _ memtable.MemtableInterface = (*HashMap)(nil)
 
+// ENTRY_OVERHEAD approximates the bytes a map entry costs besides the record
+// (bucket slot, key header, pointer) plus the key's slot in the sorted index.
+const ENTRY_OVERHEAD = 64
+
 // HashMap is a minimal Memtable implementation backed by a Go map.
 // It stores the latest record per key, including tombstones.
+// Point operations go to the map; ordered reads use a sorted key index that is built lazily.
 type HashMap struct {
-	data     map[string]*model.Record
-	capacity int
+	data        map[string]*model.Record
+	capacity    int
+	memoryUsage int64 // approximate bytes held, see MemoryUsage
+
+	// Ordered reads run concurrently under the memtable read lock, so the lazy index has its own lock
+	indexMu     sync.Mutex
+	sortedKeys  []string // all keys in sorted order as of the last ordered read, never modified in place
+	pendingKeys []string // keys inserted since then, merged into sortedKeys by the next ordered read
 }
 
 // NewHashMap creates a new HashMap with the given capacity.
@@ -39,8 +51,9 @@ func (hm *HashMap) Put(record *model.Record) error {
 		return fmt.Errorf("invalid record: record and key cannot be nil/empty")
 	}
 
-	if _, ok := hm.data[record.Key]; ok {
+	if existing, ok := hm.data[record.Key]; ok {
 		// Update existing (allowed even when "full")
+		hm.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(existing)
 		hm.data[record.Key] = record
 		return nil
 	}
@@ -50,9 +63,56 @@ func (hm *HashMap) Put(record *model.Record) error {
 		return fmt.Errorf("memtable is full (capacity=%d)", hm.capacity)
 	}
 	hm.data[record.Key] = record
+	hm.memoryUsage += memtable.RecordMemoryUsage(record) + ENTRY_OVERHEAD
+
+	// Only new keys invalidate the sorted index, updates and tombstones keep it intact
+	hm.indexMu.Lock()
+	hm.pendingKeys = append(hm.pendingKeys, record.Key)
+	hm.indexMu.Unlock()
 	return nil
 }
 
+// sortedIndex returns every key (active and tombstoned) in sorted order.
+// Keys inserted since the previous call are sorted and merged in, which costs
+// O(n + k log k) for k new keys instead of sorting the whole map on every ordered read.
+// The returned slice is never modified afterwards, so callers may iterate it without holding indexMu.
+func (hm *HashMap) sortedIndex() []string {
+	hm.indexMu.Lock()
+	defer hm.indexMu.Unlock()
+
+	if len(hm.pendingKeys) == 0 {
+		return hm.sortedKeys
+	}
+	sort.Strings(hm.pendingKeys)
+
+	merged := make([]string, 0, len(hm.sortedKeys)+len(hm.pendingKeys))
+	i, j := 0, 0
+	for i < len(hm.sortedKeys) && j < len(hm.pendingKeys) {
+		if hm.sortedKeys[i] < hm.pendingKeys[j] {
+			merged = append(merged, hm.sortedKeys[i])
+			i++
+		} else {
+			merged = append(merged, hm.pendingKeys[j])
+			j++
+		}
+	}
+	merged = append(merged, hm.sortedKeys[i:]...)
+	merged = append(merged, hm.pendingKeys[j:]...)
+
+	hm.sortedKeys = merged
+	hm.pendingKeys = nil
+	return merged
+}
+
+// seekAfter returns the position in keys of the first key that is >= lowerBound and > afterKey.
+func seekAfter(keys []string, lowerBound string, afterKey string) int {
+	start := sort.SearchStrings(keys, lowerBound)
+	if after := sort.Search(len(keys), func(i int) bool { return keys[i] > afterKey }); after > start {
+		start = after
+	}
+	return start
+}
+
 func (hm *HashMap) Delete(record *model.Record) bool {
 	if record == nil || record.Key == "" {
 		return false
@@ -62,8 +122,7 @@ func (hm *HashMap) Delete(record *model.Record) bool {
 
 	// Existing key: update in place
 	if existing, ok := hm.data[record.Key]; ok {
-		if existing != nil && !existing.Tombstone {
-		}
+		hm.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(existing)
 		hm.data[record.Key] = record
 		return true
 	}
@@ -89,27 +148,12 @@ func (hm *HashMap) Get(key string) *model.Record {
 // tombstonedKeys is used to track keys that have been tombstoned in more recent structures.
 func (hm *HashMap) GetNextForPrefix(prefix string, key string, tombstonedKeys *[]string) *model.Record {
 
-	// Get all keys and sort them
-	keys := make([]string, 0, len(hm.data))
-	for k := range hm.data {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	// Find the first key > afterKey that matches the prefix
-	for _, k := range keys {
-		// Skip keys that are <= afterKey
-		if k <= key {
-			continue
-		}
+	keys := hm.sortedIndex()
 
-		// Skip keys that don't match the prefix
+	// Keys with the prefix are contiguous and start at the first key >= prefix
+	for _, k := range keys[seekAfter(keys, prefix, key):] {
 		if len(k) < len(prefix) || k[:len(prefix)] != prefix {
-			// If key > prefix and doesn't match prefix, we've gone too far
-			if k > prefix {
-				break
-			}
-			continue
+			break
 		}
 
 		record := hm.data[k]
@@ -140,27 +184,12 @@ func (hm *HashMap) GetNextForPrefix(prefix string, key string, tombstonedKeys *[
 // tombstonedKeys is used to track keys that have been tombstoned in more recent structures.
 func (hm *HashMap) GetNextForRange(rangeStart string, rangeEnd string, key string, tombstonedKeys *[]string) *model.Record {
 
-	// Get all keys and sort them
-	keys := make([]string, 0, len(hm.data))
-	for k := range hm.data {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
+	keys := hm.sortedIndex()
 
 	// Find the first key > afterKey that is within the range
-	for _, k := range keys {
-		// Skip keys that are <= afterKey
-		if k <= key {
-			continue
-		}
-
-		// Skip keys that don't fall within the range [rangeStart, rangeEnd)
-		if k < rangeStart || k > rangeEnd {
-			// If key >= rangeEnd, we've gone beyond the range
-			if k >= rangeEnd {
-				break
-			}
-			continue
+	for _, k := range keys[seekAfter(keys, rangeStart, key):] {
+		if k > rangeEnd {
+			break
 		}
 
 		record := hm.data[k]
@@ -215,15 +244,13 @@ func (hm *HashMap) ScanForPrefix(
 		}
 	}
 
-	// Get all keys with matching prefix and sort them
-	var matchingKeys []string
-	for key := range hm.data {
-		// Check if key matches prefix
-		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
-			matchingKeys = append(matchingKeys, key)
-		}
-	}
-	sort.Strings(matchingKeys)
+	// Keys with the prefix are contiguous in the sorted index
+	keys := hm.sortedIndex()
+	end := sort.Search(len(keys), func(i int) bool {
+		k := keys[i]
+		return k > prefix && (len(k) < len(prefix) || k[:len(prefix)] != prefix)
+	})
+	matchingKeys := keys[sort.SearchStrings(keys, prefix):end]
 
 	// Process each matching key
 	for _, key := range matchingKeys {
@@ -333,6 +360,11 @@ func (hm *HashMap) IsFull() bool {
 	return len(hm.data) >= hm.capacity
 }
 
+// MemoryUsage returns the approximate number of bytes held by the stored records and map entries.
+func (hm *HashMap) MemoryUsage() int64 {
+	return hm.memoryUsage
+}
+
 // RetrieveSortedRecords returns all records (including tombstones) in sorted key order.
 // This is used for flushing the memtable to an SSTable.
 func (hm *HashMap) RetrieveSortedRecords() []model.Record {
@@ -340,16 +372,9 @@ func (hm *HashMap) RetrieveSortedRecords() []model.Record {
 		return []model.Record{}
 	}
 
-	// Extract keys and sort them
-	keys := make([]string, 0, len(hm.data))
-	for key := range hm.data {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-
 	// Build result slice in sorted order
 	records := make([]model.Record, 0, len(hm.data))
-	for _, key := range keys {
+	for _, key := range hm.sortedIndex() {
 		rec := hm.data[key]
 		if rec != nil {
 			// Create a copy of the record to prevent external modification
@@ -410,15 +435,14 @@ func (hm *HashMap) ScanForRange(
 		}
 	}
 
-	// Get all keys within range and sort them
-	var matchingKeys []string
-	for key := range hm.data {
-		// Check if key is within range [rangeStart, rangeEnd]
-		if key >= rangeStart && key <= rangeEnd {
-			matchingKeys = append(matchingKeys, key)
-		}
+	// Keys within [rangeStart, rangeEnd] are contiguous in the sorted index
+	keys := hm.sortedIndex()
+	start := sort.SearchStrings(keys, rangeStart)
+	end := sort.Search(len(keys), func(i int) bool { return keys[i] > rangeEnd })
+	if end < start {
+		return
 	}
-	sort.Strings(matchingKeys)
+	matchingKeys := keys[start:end]
 
 	// Process each matching key
 	for _, key := range matchingKeys {
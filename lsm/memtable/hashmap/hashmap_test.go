@@ -3,9 +3,13 @@ package hashmap
 import (
 	"fmt"
 	"math"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
+	"hunddb/lsm/memtable/conformance"
+	mi "hunddb/lsm/memtable/memtable_interface"
 	model "hunddb/model/record"
 )
 
@@ -1751,3 +1755,106 @@ func BenchmarkHashMap_ScanForRange(b *testing.B) {
 		hm.ScanForRange("key000000", "key005000", &tombstoned, &bestKeys, 50, 0)
 	}
 }
+
+func TestHashMap_MemoryUsage(t *testing.T) {
+	hm := NewHashMap(100)
+	if hm.MemoryUsage() != 0 {
+		t.Fatalf("expected empty map to use 0 bytes, got %d", hm.MemoryUsage())
+	}
+
+	for i := 0; i < 10; i++ {
+		hm.Put(makeRec(fmt.Sprintf("key%02d", i), "v"))
+	}
+	small := hm.MemoryUsage()
+
+	hm.Put(rec("key03", make([]byte, 10001), false))
+	if hm.MemoryUsage() != small+10000 {
+		t.Fatalf("expected usage %d after growing a value, got %d", small+10000, hm.MemoryUsage())
+	}
+
+	hm.Delete(rec("key03", nil, true))
+	if hm.MemoryUsage() != small-1 {
+		t.Fatalf("expected usage %d after delete, got %d", small-1, hm.MemoryUsage())
+	}
+}
+
+func TestHashMap_SortedIndex_InterleavedInsertsAndReads(t *testing.T) {
+	hm := NewHashMap(0)
+	var expected []string
+
+	// Each round inserts keys on both sides of existing ones, then reads in order
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%03d", i*5+round)
+			hm.Put(makeRec(key, "v"))
+			expected = append(expected, key)
+		}
+		// Updates and tombstones of existing keys must not duplicate them in the index
+		hm.Put(makeRec(expected[0], "updated"))
+		hm.Delete(makeTomb(expected[1]))
+		sort.Strings(expected)
+
+		records := hm.RetrieveSortedRecords()
+		if len(records) != len(expected) {
+			t.Fatalf("round %d: expected %d records, got %d", round, len(expected), len(records))
+		}
+		for i, r := range records {
+			if r.Key != expected[i] {
+				t.Fatalf("round %d: record %d is %s, expected %s", round, i, r.Key, expected[i])
+			}
+		}
+	}
+
+	// Iterating with GetNextForRange visits every live key exactly once
+	var visited []string
+	tombstoned := []string{}
+	for r := hm.GetNextForRange("", "key999", "", &tombstoned); r != nil; r = hm.GetNextForRange("", "key999", r.Key, &tombstoned) {
+		visited = append(visited, r.Key)
+	}
+	if len(visited)+len(tombstoned) != len(expected) {
+		t.Fatalf("expected %d keys in total, visited %d live and %d tombstoned", len(expected), len(visited), len(tombstoned))
+	}
+}
+
+func TestHashMap_SortedIndex_ConcurrentOrderedReads(t *testing.T) {
+	hm := NewHashMap(0)
+	for i := 0; i < 1000; i++ {
+		hm.Put(makeRec(fmt.Sprintf("user%04d", i), "v"))
+	}
+
+	// Ordered reads only hold the memtable read lock, so several may build the index at once
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bestKeys := []string{}
+			hm.ScanForPrefix("user00", &[]string{}, &bestKeys, 50, 0)
+			if len(bestKeys) != 100 {
+				t.Errorf("expected 100 keys, got %d", len(bestKeys))
+			}
+			if r := hm.GetNextForPrefix("user", "user0500", &[]string{}); r == nil || r.Key != "user0501" {
+				t.Errorf("expected user0501, got %v", r)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkHashMap_GetNextForPrefix(b *testing.B) {
+	hm := NewHashMap(0)
+	for i := 0; i < 10000; i++ {
+		_ = hm.Put(makeRec(fmt.Sprintf("user%06d", i), "value"))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hm.GetNextForPrefix("user", fmt.Sprintf("user%06d", i%10000), &[]string{})
+	}
+}
+
+func TestHashMap_Conformance(t *testing.T) {
+	conformance.Run(t, func(capacity int) mi.MemtableInterface {
+		return NewHashMap(capacity)
+	})
+}
@@ -3,12 +3,16 @@ package memtable
 
 import (
 	"fmt"
+	"hunddb/lsm/memtable/art"
 	"hunddb/lsm/memtable/btree"
+	"hunddb/lsm/memtable/concurrent_skip_list"
 	"hunddb/lsm/memtable/hashmap"
 	mi "hunddb/lsm/memtable/memtable_interface"
 	"hunddb/lsm/memtable/skip_list"
 	model "hunddb/model/record"
 	"hunddb/utils/config"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -18,28 +22,100 @@ const (
 	BTree    MemtableType = "btree"
 	SkipList MemtableType = "skiplist"
 	HashMap  MemtableType = "hashmap"
+	// ConcurrentSkipList is lock-free: writers insert concurrently and readers never block
+	ConcurrentSkipList MemtableType = "concurrent_skiplist"
+	// ART is an adaptive radix tree, suited to keys with long shared prefixes
+	ART MemtableType = "art"
 )
 
 // Configuration variables loaded from config file
 var (
-	CAPACITY      uint64       
-	MEMTABLE_TYPE MemtableType 
+	CAPACITY       uint64
+	MEMTABLE_TYPE  MemtableType
+	MAX_SIZE_BYTES uint64 // Byte budget per memtable, 0 disables it
+	// Arena slab size for the btree and skiplist, 0 makes them store records as they are passed in
+	ARENA_SLAB_SIZE uint64
 )
 
-// init loads Memtable configuration from config file
+/*
+Factory creates an empty memtable implementation that holds at most capacity distinct keys.
+The returned implementation does not need to be safe for concurrent use - MemTable serializes
+access to it, unless it implements memtable_interface.ConcurrentMemtable.
+*/
+type Factory func(capacity int) mi.MemtableInterface
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[MemtableType]Factory)
+)
+
+/*
+Register makes a memtable implementation selectable by name through the memtable_type config key.
+It is meant to be called from the init function of the package providing the implementation,
+and panics if the name is empty or already registered, or if factory is nil.
+Implementations should pass the conformance suite in memtable/conformance.
+*/
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if name == "" {
+		panic("memtable: Register with empty name")
+	}
+	if factory == nil {
+		panic("memtable: Register factory is nil for " + name)
+	}
+	if _, exists := registry[MemtableType(name)]; exists {
+		panic("memtable: Register called twice for " + name)
+	}
+	registry[MemtableType(name)] = factory
+}
+
+// RegisteredTypes returns the names of all registered memtable implementations, sorted.
+func RegisteredTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// init registers the built-in implementations and loads Memtable configuration from config file
 func init() {
+	Register(string(BTree), func(capacity int) mi.MemtableInterface {
+		if ARENA_SLAB_SIZE > 0 {
+			return btree.NewBTreeWithArena(btree.DefaultOrder, capacity, int(ARENA_SLAB_SIZE))
+		}
+		return btree.NewBTree(btree.DefaultOrder, capacity)
+	})
+	Register(string(SkipList), func(capacity int) mi.MemtableInterface {
+		if ARENA_SLAB_SIZE > 0 {
+			return skip_list.NewWithArena(16, capacity, int(ARENA_SLAB_SIZE))
+		}
+		return skip_list.New(16, capacity)
+	})
+	Register(string(HashMap), func(capacity int) mi.MemtableInterface {
+		return hashmap.NewHashMap(capacity)
+	})
+	Register(string(ConcurrentSkipList), func(capacity int) mi.MemtableInterface {
+		return concurrent_skip_list.New(16, capacity)
+	})
+	Register(string(ART), func(capacity int) mi.MemtableInterface {
+		return art.NewART(capacity)
+	})
+
 	cfg := config.GetConfig()
 	CAPACITY = cfg.Memtable.Capacity
-	// Convert string to MemtableType
-	switch cfg.Memtable.MemtableType {
-	case "btree":
+	MAX_SIZE_BYTES = cfg.Memtable.MaxSizeBytes
+	ARENA_SLAB_SIZE = cfg.Memtable.ArenaSlabSize
+	// Custom implementations register after this runs, so the name is only resolved in NewMemtable
+	MEMTABLE_TYPE = MemtableType(cfg.Memtable.MemtableType)
+	if MEMTABLE_TYPE == "" {
 		MEMTABLE_TYPE = BTree
-	case "skiplist":
-		MEMTABLE_TYPE = SkipList
-	case "hashmap":
-		MEMTABLE_TYPE = HashMap
-	default:
-		MEMTABLE_TYPE = BTree 
 	}
 }
 
@@ -47,50 +123,70 @@ func init() {
 type MemTable struct {
 	impl mi.MemtableInterface
 	mu   sync.RWMutex
-	
+	// lockFree is set for implementations that are safe for concurrent use on their own, mu is skipped for them
+	lockFree bool
 }
 
 // NewMemtable returns a concrete *MemTable, not an interface
 func NewMemtable() (*MemTable, error) {
-	var impl mi.MemtableInterface
-	switch MEMTABLE_TYPE {
-	case BTree:
-		impl = btree.NewBTree(btree.DefaultOrder, int(CAPACITY))
-	case SkipList:
-		impl = skip_list.New(16, int(CAPACITY))
-	case HashMap:
-		impl = hashmap.NewHashMap(int(CAPACITY))
-	default:
-		return nil, fmt.Errorf("unknown memtable type: %s", MEMTABLE_TYPE)
+	registryMu.RLock()
+	factory, exists := registry[MEMTABLE_TYPE]
+	registryMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown memtable type: %s (registered: %s)", MEMTABLE_TYPE, strings.Join(RegisteredTypes(), ", "))
 	}
 
+	impl := factory(int(CAPACITY))
+	concurrent, isConcurrent := impl.(mi.ConcurrentMemtable)
+
 	return &MemTable{
-		impl: impl,
+		impl:     impl,
+		lockFree: isConcurrent && concurrent.IsConcurrent(),
 	}, nil
 }
 
+// lock acquires the write lock, unless the implementation is lock-free. Returns the matching unlock.
+func (mt *MemTable) lock() func() {
+	if mt.lockFree {
+		return func() {}
+	}
+	mt.mu.Lock()
+	return mt.mu.Unlock
+}
+
+// rLock acquires the read lock, unless the implementation is lock-free. Returns the matching unlock.
+func (mt *MemTable) rLock() func() {
+	if mt.lockFree {
+		return func() {}
+	}
+	mt.mu.RLock()
+	return mt.mu.RUnlock
+}
+
+// Concurrent reports whether the implementation is safe for concurrent use on its own, so callers
+// don't need to serialize writes into it.
+func (mt *MemTable) Concurrent() bool {
+	return mt.lockFree
+}
+
 // All methods implement the interface with thread safety
 func (mt *MemTable) Put(record *model.Record) error {
-	mt.mu.Lock()
-	defer mt.mu.Unlock()
+	defer mt.lock()()
 	return mt.impl.Put(record)
 }
 
 func (mt *MemTable) Delete(record *model.Record) bool {
-	mt.mu.Lock()
-	defer mt.mu.Unlock()
+	defer mt.lock()()
 	return mt.impl.Delete(record)
 }
 
 func (mt *MemTable) Get(key string) *model.Record {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	return mt.impl.Get(key)
 }
 
 func (mt *MemTable) GetNextForPrefix(prefix string, key string, tombstonedKeys *[]string) *model.Record {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	return mt.impl.GetNextForPrefix(prefix, key, tombstonedKeys)
 }
 
@@ -100,14 +196,12 @@ func (mt *MemTable) ScanForPrefix(
 	bestKeys *[]string,
 	pageSize int,
 	pageNumber int) {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	mt.impl.ScanForPrefix(prefix, tombstonedKeys, bestKeys, pageSize, pageNumber)
 }
 
 func (mt *MemTable) GetNextForRange(rangeStart string, rangeEnd string, key string, tombstonedKeys *[]string) *model.Record {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	return mt.impl.GetNextForRange(rangeStart, rangeEnd, key, tombstonedKeys)
 }
 
@@ -118,38 +212,41 @@ func (mt *MemTable) ScanForRange(
 	bestKeys *[]string,
 	pageSize int,
 	pageNumber int) {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	mt.impl.ScanForRange(rangeStart, rangeEnd, tombstonedKeys, bestKeys, pageSize, pageNumber)
 }
 
 func (mt *MemTable) Capacity() int {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	return mt.impl.Capacity()
 }
 
 func (mt *MemTable) Size() int {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	return mt.impl.Size()
 }
 
 func (mt *MemTable) TotalEntries() int {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
 	return mt.impl.TotalEntries()
 }
 
+// IsFull reports whether the memtable reached its key capacity or its byte budget (MAX_SIZE_BYTES).
 func (mt *MemTable) IsFull() bool {
-	mt.mu.RLock()
-	defer mt.mu.RUnlock()
+	defer mt.rLock()()
+	if MAX_SIZE_BYTES > 0 && mt.impl.MemoryUsage() >= int64(MAX_SIZE_BYTES) {
+		return true
+	}
 	return mt.impl.IsFull()
 }
 
+func (mt *MemTable) MemoryUsage() int64 {
+	defer mt.rLock()()
+	return mt.impl.MemoryUsage()
+}
+
 func (mt *MemTable) Flush(index int) error {
-	mt.mu.Lock()
-	defer mt.mu.Unlock()
+	defer mt.lock()()
 	return mt.impl.Flush(index)
 }
 
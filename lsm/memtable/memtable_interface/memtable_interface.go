@@ -68,6 +68,25 @@ type MemtableInterface interface {
 	// IsFull reports whether inserting a NEW distinct key would exceed capacity.
 	IsFull() bool
 
+	// MemoryUsage returns the approximate number of bytes held (keys, values and per-entry overhead).
+	MemoryUsage() int64
+
 	// Flush persists the memtable contents to disk (SSTable).
 	Flush(index int) error
 }
+
+// ConcurrentMemtable is implemented by memtables that are safe for concurrent use on their own.
+// When IsConcurrent reports true, the MemTable wrapper calls them without taking its lock.
+type ConcurrentMemtable interface {
+	MemtableInterface
+	IsConcurrent() bool
+}
+
+// RECORD_OVERHEAD approximates the bytes a stored record costs on top of its key and value
+// (the Record struct with its string and slice headers). Implementations add their own per-entry node overhead.
+const RECORD_OVERHEAD = 64
+
+// RecordMemoryUsage returns the approximate number of bytes a record occupies in memory.
+func RecordMemoryUsage(record *model.Record) int64 {
+	return int64(len(record.Key)+len(record.Value)) + RECORD_OVERHEAD
+}
@@ -0,0 +1,133 @@
+package memtable
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"hunddb/lsm/memtable/conformance"
+	"hunddb/lsm/memtable/hashmap"
+	mi "hunddb/lsm/memtable/memtable_interface"
+	model "hunddb/model/record"
+)
+
+// countingMemtable is a custom implementation as a third-party package would register it.
+type countingMemtable struct {
+	*hashmap.HashMap
+	puts int
+}
+
+func (c *countingMemtable) Put(record *model.Record) error {
+	c.puts++
+	return c.HashMap.Put(record)
+}
+
+// useMemtableType selects a memtable type for the duration of the test.
+func useMemtableType(t *testing.T, name MemtableType, capacity uint64) {
+	previousType, previousCapacity := MEMTABLE_TYPE, CAPACITY
+	MEMTABLE_TYPE, CAPACITY = name, capacity
+	t.Cleanup(func() { MEMTABLE_TYPE, CAPACITY = previousType, previousCapacity })
+}
+
+var (
+	registerCounting sync.Once // Register panics on a second call, e.g. with -count > 1
+	created          *countingMemtable
+)
+
+// TestRegister_CustomImplementation verifies that a registered implementation is selected by name
+func TestRegister_CustomImplementation(t *testing.T) {
+	registerCounting.Do(func() {
+		Register("test_counting", func(capacity int) mi.MemtableInterface {
+			created = &countingMemtable{HashMap: hashmap.NewHashMap(capacity)}
+			return created
+		})
+	})
+	created = nil
+	useMemtableType(t, "test_counting", 10)
+
+	mt, err := NewMemtable()
+	if err != nil {
+		t.Fatalf("NewMemtable failed: %v", err)
+	}
+	mt.Put(model.NewRecord("a", []byte("1"), 1, false))
+	if created == nil || created.puts != 1 {
+		t.Fatalf("Expected the custom implementation to receive the Put")
+	}
+	if mt.Capacity() != 10 || mt.Get("a") == nil {
+		t.Errorf("Expected the wrapper to delegate to the custom implementation")
+	}
+	if mt.lockFree {
+		t.Errorf("Expected a custom implementation to be locked by the wrapper")
+	}
+
+	found := false
+	for _, name := range RegisteredTypes() {
+		found = found || name == "test_counting"
+	}
+	if !found {
+		t.Errorf("Expected test_counting in %v", RegisteredTypes())
+	}
+}
+
+// TestRegister_InvalidRegistrations verifies that conflicting or incomplete registrations panic
+func TestRegister_InvalidRegistrations(t *testing.T) {
+	factory := func(capacity int) mi.MemtableInterface { return hashmap.NewHashMap(capacity) }
+	cases := map[string]func(){
+		"duplicate":   func() { Register(string(BTree), factory) },
+		"empty name":  func() { Register("", factory) },
+		"nil factory": func() { Register("test_nil", nil) },
+	}
+	for name, register := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected Register to panic")
+				}
+			}()
+			register()
+		})
+	}
+}
+
+// TestNewMemtable_UnknownType verifies that an unregistered name is reported with the known ones
+func TestNewMemtable_UnknownType(t *testing.T) {
+	useMemtableType(t, "no_such_memtable", 10)
+
+	_, err := NewMemtable()
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown memtable type")
+	}
+	if !strings.Contains(err.Error(), "no_such_memtable") || !strings.Contains(err.Error(), string(SkipList)) {
+		t.Errorf("Expected the error to name the type and the registered ones, got %v", err)
+	}
+}
+
+// TestNewMemtable_LockFreeDetection verifies that only concurrent implementations skip the wrapper lock
+func TestNewMemtable_LockFreeDetection(t *testing.T) {
+	for _, name := range []MemtableType{BTree, SkipList, HashMap, ART, ConcurrentSkipList} {
+		useMemtableType(t, name, 10)
+		mt, err := NewMemtable()
+		if err != nil {
+			t.Fatalf("NewMemtable(%s) failed: %v", name, err)
+		}
+		if mt.lockFree != (name == ConcurrentSkipList) {
+			t.Errorf("%s: expected lockFree=%v", name, name == ConcurrentSkipList)
+		}
+	}
+}
+
+// TestMemTable_Conformance runs the conformance suite through the wrapper for every built-in type
+func TestMemTable_Conformance(t *testing.T) {
+	for _, name := range []MemtableType{BTree, SkipList, HashMap, ART, ConcurrentSkipList} {
+		t.Run(string(name), func(t *testing.T) {
+			conformance.Run(t, func(capacity int) mi.MemtableInterface {
+				useMemtableType(t, name, uint64(capacity))
+				mt, err := NewMemtable()
+				if err != nil {
+					t.Fatalf("NewMemtable failed: %v", err)
+				}
+				return mt
+			})
+		})
+	}
+}
@@ -2,6 +2,7 @@ package skip_list
 
 import (
 	"errors"
+	"hunddb/lsm/memtable/arena"
 	memtable "hunddb/lsm/memtable/memtable_interface"
 	sstable "hunddb/lsm/sstable"
 	model "hunddb/model/record"
@@ -37,12 +38,22 @@ type SkipList struct {
 	head          *Node
 
 	// Capacity and counters (distinct keys)
-	capacity    int // max distinct keys (active + tombstoned)
-	totalCount  int // current distinct keys
-	activeCount int // current non-tombstoned keys
+	capacity    int   // max distinct keys (active + tombstoned)
+	totalCount  int   // current distinct keys
+	activeCount int   // current non-tombstoned keys
+	memoryUsage int64 // approximate bytes held by records and nodes
 
 	// RNG for level selection
 	rng *rand.Rand
+
+	// arena holds copies of the stored records, nil stores the caller's records as they are.
+	// With an arena, nodes and their forward pointers are carved from chunks as well.
+	arena  *arena.Arena
+	nodes  arena.Chunks[Node]
+	towers arena.Chunks[*Node]
+
+	// update is the search path buffer reused by Put and Delete
+	update []*Node
 }
 
 // New creates a SkipList memtable with the given parameters.
@@ -62,8 +73,32 @@ func New(maxHeight uint64, capacity int) *SkipList {
 	}
 }
 
+// NewWithArena creates a SkipList memtable that copies every stored record into an arena
+// with byte slabs of slabSize, see arena.Arena.
+func NewWithArena(maxHeight uint64, capacity int, slabSize int) *SkipList {
+	s := New(maxHeight, capacity)
+	s.arena = arena.New(slabSize)
+	return s
+}
+
 // ===== Internal helpers =====
 
+// own returns the record to store: its arena copy when an arena is used, the record itself otherwise.
+func (s *SkipList) own(rec *model.Record) *model.Record {
+	if s.arena == nil {
+		return rec
+	}
+	return s.arena.CopyRecord(rec)
+}
+
+// searchPath returns the reusable buffer for the update path of an insert.
+func (s *SkipList) searchPath() []*Node {
+	if s.update == nil {
+		s.update = make([]*Node, s.maxHeight)
+	}
+	return s.update
+}
+
 func (s *SkipList) roll() uint64 {
 	h := uint64(1)
 	for s.rng.Int31n(2) == 1 && h < s.maxHeight {
@@ -97,14 +132,26 @@ func (s *SkipList) insert(rec *model.Record, update []*Node) *Node {
 		}
 		s.currentHeight = height
 	}
-	n := newNode(rec, height)
+	var n *Node
+	if s.arena != nil {
+		n = s.nodes.New()
+		n.key, n.rec, n.nextNodes = rec.Key, rec, s.towers.NewSlice(int(height))
+	} else {
+		n = newNode(rec, height)
+	}
 	for i := uint64(0); i < height; i++ {
 		n.nextNodes[i] = update[i].nextNodes[i]
 		update[i].nextNodes[i] = n
 	}
+	s.memoryUsage += memtable.RecordMemoryUsage(rec) + nodeMemoryUsage(height)
 	return n
 }
 
+// nodeMemoryUsage approximates the bytes of a node besides its record: the struct and its forward pointers.
+func nodeMemoryUsage(height uint64) int64 {
+	return 48 + 8*int64(height)
+}
+
 // ===== Memtable interface =====
 
 var ErrCapacityExceeded = errors.New("memtable capacity exceeded")
@@ -114,10 +161,10 @@ var ErrCapacityExceeded = errors.New("memtable capacity exceeded")
 // EXISTING key: replace record and adjust activeCount on tombstone transitions.
 // If record.Tombstone == true, this acts as a logical delete update.
 func (s *SkipList) Put(record *model.Record) error {
-	if record == nil {
-		return errors.New("nil record")
+	if record == nil || record.Key == "" {
+		return errors.New("invalid record: record and key cannot be nil/empty")
 	}
-	update := make([]*Node, s.maxHeight)
+	update := s.searchPath()
 	existing := s.search(record.Key, update)
 
 	if existing == nil {
@@ -125,7 +172,7 @@ func (s *SkipList) Put(record *model.Record) error {
 		if s.IsFull() {
 			return ErrCapacityExceeded
 		}
-		s.insert(record, update)
+		s.insert(s.own(record), update)
 		s.totalCount++
 		if !record.Tombstone {
 			s.activeCount++
@@ -136,7 +183,8 @@ func (s *SkipList) Put(record *model.Record) error {
 	// Update existing key
 	prevDel := existing.rec.Tombstone
 	newDel := record.Tombstone
-	existing.rec = record
+	s.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(existing.rec)
+	existing.rec = s.own(record)
 	if prevDel && !newDel {
 		s.activeCount++
 	} else if !prevDel && newDel {
@@ -150,12 +198,12 @@ func (s *SkipList) Put(record *model.Record) error {
 // Returns true if the key existed before this call; false otherwise.
 // For a non-existing key, we insert a tombstone if capacity allows (returning false).
 func (s *SkipList) Delete(record *model.Record) bool {
-	if record == nil {
+	if record == nil || record.Key == "" {
 		return false
 	}
 	record.Tombstone = true
 
-	update := make([]*Node, s.maxHeight)
+	update := s.searchPath()
 	existing := s.search(record.Key, update)
 
 	if existing == nil {
@@ -163,7 +211,7 @@ func (s *SkipList) Delete(record *model.Record) bool {
 		if s.IsFull() {
 			return false
 		}
-		s.insert(record, update)
+		s.insert(s.own(record), update)
 		s.totalCount++ // tombstoned new key
 		// activeCount unchanged
 		return false
@@ -173,7 +221,8 @@ func (s *SkipList) Delete(record *model.Record) bool {
 	if existing.rec != nil && !existing.rec.Tombstone {
 		s.activeCount--
 	}
-	existing.rec = record
+	s.memoryUsage += memtable.RecordMemoryUsage(record) - memtable.RecordMemoryUsage(existing.rec)
+	existing.rec = s.own(record)
 	return true
 }
 
@@ -417,6 +466,9 @@ func (s *SkipList) Capacity() int     { return s.capacity }
 func (s *SkipList) TotalEntries() int { return s.totalCount }
 func (s *SkipList) IsFull() bool      { return s.totalCount >= s.capacity }
 
+// MemoryUsage returns the approximate number of bytes held by the stored records and nodes.
+func (s *SkipList) MemoryUsage() int64 { return s.memoryUsage }
+
 // RetrieveSortedRecords returns all records (including tombstones) in sorted key order.
 // This is used for flushing the memtable to an SSTable.
 func (s *SkipList) RetrieveSortedRecords() []model.Record {
@@ -452,6 +504,11 @@ func (s *SkipList) Flush(index int) error {
 	if err != nil {
 		return errors.New("failed to flush SkipList memtable: " + err.Error())
 	}
+	if s.arena != nil {
+		s.arena.Release()
+		s.nodes.Release()
+		s.towers.Release()
+	}
 
 	return nil
 }
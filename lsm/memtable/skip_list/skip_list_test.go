@@ -2,9 +2,12 @@ package skip_list
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
 	"time"
 
+	"hunddb/lsm/memtable/conformance"
+	mi "hunddb/lsm/memtable/memtable_interface"
 	model "hunddb/model/record"
 )
 
@@ -1847,3 +1850,85 @@ func BenchmarkSkipList_ScanForRange(b *testing.B) {
 		sl.ScanForRange("keyA", "keyM", &tombstoned, &bestKeys, 50, 0)
 	}
 }
+
+// TestSkipList_MemoryUsage verifies that memory usage follows value sizes through inserts, updates and deletes
+func TestSkipList_MemoryUsage(t *testing.T) {
+	sl := New(8, 100)
+	if sl.MemoryUsage() != 0 {
+		t.Fatalf("Expected empty list to use 0 bytes, got %d", sl.MemoryUsage())
+	}
+
+	for i := 0; i < 10; i++ {
+		sl.Put(rec(fmt.Sprintf("key%02d", i), []byte("v"), false))
+	}
+	small := sl.MemoryUsage()
+
+	sl.Put(rec("key03", make([]byte, 10001), false))
+	if sl.MemoryUsage() != small+10000 {
+		t.Errorf("Expected usage %d after growing a value, got %d", small+10000, sl.MemoryUsage())
+	}
+
+	sl.Delete(rec("key03", nil, true))
+	if sl.MemoryUsage() != small-1 {
+		t.Errorf("Expected usage %d after delete, got %d", small-1, sl.MemoryUsage())
+	}
+}
+
+// TestSkipList_Conformance runs the shared memtable conformance suite
+func TestSkipList_Conformance(t *testing.T) {
+	conformance.Run(t, func(capacity int) mi.MemtableInterface {
+		return New(16, capacity)
+	})
+}
+
+// benchmarkSkipListFill fills a fresh memtable per iteration the way the write path does, with one new
+// record per Put, then reports the live heap objects and the cost of a GC cycle that has to mark the memtable.
+func benchmarkSkipListFill(b *testing.B, newMemtable func() *SkipList) {
+	const n = 100_000
+	var gcTime time.Duration
+	var liveObjects uint64
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := newMemtable()
+		for j := 0; j < n; j++ {
+			_ = m.Put(rec(fmt.Sprintf("key%09d", j), []byte("value"), false))
+		}
+
+		b.StopTimer()
+		// The first cycle collects the garbage of the fill, the second one only marks the live memtable
+		runtime.GC()
+		start := time.Now()
+		runtime.GC()
+		gcTime += time.Since(start)
+		runtime.ReadMemStats(&after)
+		liveObjects += after.HeapObjects
+		runtime.KeepAlive(m)
+		b.StartTimer()
+	}
+	b.StopTimer()
+
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+	b.ReportMetric(float64(gcTime.Nanoseconds())/float64(b.N), "gc-mark-ns/op")
+	b.ReportMetric(float64(liveObjects)/float64(b.N), "live-objects")
+}
+
+func BenchmarkSkipList_Fill(b *testing.B) {
+	benchmarkSkipListFill(b, func() *SkipList { return New(16, 1<<30) })
+}
+
+func BenchmarkSkipList_FillArena(b *testing.B) {
+	benchmarkSkipListFill(b, func() *SkipList { return NewWithArena(16, 1<<30, 256*1024) })
+}
+
+// TestSkipList_ConformanceArena runs the shared memtable conformance suite with an arena-backed skip list
+func TestSkipList_ConformanceArena(t *testing.T) {
+	conformance.Run(t, func(capacity int) mi.MemtableInterface {
+		return NewWithArena(16, capacity, 1024)
+	})
+}
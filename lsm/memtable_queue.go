@@ -0,0 +1,279 @@
+package lsm
+
+import (
+	"fmt"
+	memtable "hunddb/lsm/memtable"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+immutableMemtable is a full memtable waiting in the flush queue. It stays readable
+until its SSTable is committed to level 0, so there is no window in which its data
+can be found in neither place.
+*/
+type immutableMemtable struct {
+	mt           *memtable.MemTable
+	index        int    // SSTable index assigned when the memtable was queued
+	lowWaterMark uint64 // WAL log index of the latest logged write into the memtable
+	writers      *memtableWriters
+	// Flush state, protected by lsm.mu
+	flushed   bool // The flush finished, the memtable waits for older ones to commit
+	failed    bool // The flush ran out of retries, the memtable stays queued until Resume
+	committed bool // The memtable left the queue, its SSTable is in level 0
+}
+
+/*
+memtableWriters tracks the writes that were admitted into a lock-free memtable under lsm.mu and insert into it
+after releasing it (see LSM.write). They count against the memtable's capacity, and its flush waits for them.
+*/
+type memtableWriters struct {
+	wg      sync.WaitGroup
+	pending atomic.Int64
+}
+
+// add registers a write; must be called with lsm.mu held, before the memtable can be queued for its flush.
+func (writers *memtableWriters) add() {
+	writers.wg.Add(1)
+	writers.pending.Add(1)
+}
+
+// done marks a registered write as inserted.
+func (writers *memtableWriters) done() {
+	writers.pending.Add(-1)
+	writers.wg.Done()
+}
+
+/*
+MemtableStats describes the memtables held in memory and their flushes.
+*/
+type MemtableStats struct {
+	MutableEntries   int    // Entries in the memtable receiving writes
+	MutableBytes     int64  // Approximate bytes held by the memtable receiving writes
+	ImmutableCount   int    // Full memtables waiting to be flushed
+	ImmutableBytes   int64  // Approximate bytes held by the memtables waiting to be flushed
+	MaxImmutable     int    // Number of queued memtables at which writes stall
+	FlushesCompleted uint64 // Memtables committed to level 0
+	FlushRetries     uint64 // Flush attempts repeated after an error
+	FlushesFailed    uint64 // Flushes that ran out of retries and stopped writes
+}
+
+// maxImmutableMemtables returns how many full memtables may wait for their flush before writes stall.
+// MAX_MEMTABLES counts the mutable memtable too, but at least one memtable can always be flushing.
+func maxImmutableMemtables() int {
+	if MAX_MEMTABLES <= 1 {
+		return 1
+	}
+	return int(MAX_MEMTABLES) - 1
+}
+
+// memtablesUnsafe returns every memtable in memory from newest to oldest; must be called with lsm.mu held.
+func (lsm *LSM) memtablesUnsafe() []*memtable.MemTable {
+	memtables := make([]*memtable.MemTable, 0, len(lsm.immutables)+1)
+	if lsm.memtable != nil {
+		memtables = append(memtables, lsm.memtable)
+	}
+	for i := len(lsm.immutables) - 1; i >= 0; i-- {
+		memtables = append(memtables, lsm.immutables[i].mt)
+	}
+	return memtables
+}
+
+// setMemtableUnsafe makes mt the memtable receiving writes; must be called with lsm.mu held.
+func (lsm *LSM) setMemtableUnsafe(mt *memtable.MemTable) {
+	lsm.memtable = mt
+	lsm.memtableWriters = &memtableWriters{}
+	lsm.activeMemtable.Store(mt)
+}
+
+// memtableFullUnsafe reports whether the mutable memtable is full, counting the writes still inserting into it
+// as new keys; must be called with lsm.mu held.
+func (lsm *LSM) memtableFullUnsafe() bool {
+	pending := int(lsm.memtableWriters.pending.Load())
+	return lsm.memtable.IsFull() || lsm.memtable.TotalEntries()+pending >= lsm.memtable.Capacity()
+}
+
+// overWriteBufferUnsafe reports whether the memtables reached the global write buffer budget; must be called with lsm.mu held.
+func (lsm *LSM) overWriteBufferUnsafe() bool {
+	return WRITE_BUFFER_SIZE > 0 && lsm.writeBufferUsageUnsafe() >= int64(WRITE_BUFFER_SIZE)
+}
+
+// shouldRotateUnsafe reports whether the mutable memtable is done taking writes; must be called with lsm.mu held.
+func (lsm *LSM) shouldRotateUnsafe() bool {
+	if lsm.memtable == nil || lsm.memtable.TotalEntries()+int(lsm.memtableWriters.pending.Load()) == 0 {
+		return false
+	}
+	return lsm.memtableFullUnsafe() || lsm.overWriteBufferUnsafe()
+}
+
+// mustStallUnsafe reports whether a write has to wait for a queued memtable to be flushed; must be called with lsm.mu held.
+func (lsm *LSM) mustStallUnsafe() bool {
+	if len(lsm.immutables) == 0 {
+		return false
+	}
+	return lsm.memtableFullUnsafe() || lsm.overWriteBufferUnsafe()
+}
+
+/*
+checkIfToFlush runs after every write, with lsm.mu held. A full memtable (by key capacity or byte budget,
+or because the global write buffer budget is reached) is queued for its flush right away if the queue has room.
+Otherwise the next write stalls in makeRoomForWriteUnsafe.
+*/
+func (lsm *LSM) checkIfToFlush() error {
+	if lsm.shouldRotateUnsafe() && len(lsm.immutables) < maxImmutableMemtables() {
+		return lsm.rotateMemtableUnsafe()
+	}
+	return nil
+}
+
+/*
+rotateMemtableUnsafe turns the mutable memtable into an immutable one, queues its flush and
+starts a fresh mutable memtable. Must be called with lsm.mu held; it never waits for the flush.
+*/
+func (lsm *LSM) rotateMemtableUnsafe() error {
+	fresh, err := memtable.NewMemtable()
+	if err != nil {
+		return err
+	}
+	lsm.queueFlushUnsafe(lsm.memtable, lsm.memtableWriters, lsm.lowWaterMark)
+	lsm.setMemtableUnsafe(fresh)
+	lsm.lowWaterMark = 0
+	return nil
+}
+
+// queueFlushUnsafe assigns an SSTable index to the memtable and hands it to the flush pool; must be called with lsm.mu held.
+func (lsm *LSM) queueFlushUnsafe(mt *memtable.MemTable, writers *memtableWriters, lowWaterMark uint64) *immutableMemtable {
+	imm := &immutableMemtable{
+		mt:           mt,
+		index:        int(lsm.NextSSTableIndex),
+		lowWaterMark: lowWaterMark,
+		writers:      writers,
+	}
+	lsm.NextSSTableIndex++
+	lsm.immutables = append(lsm.immutables, imm)
+	lsm.background.Add(1)
+
+	// Ensure flush pool exists (lazy init)
+	lsm.initFlushPoolOnce(int(FLUSH_WORKERS))
+	lsm.flushPool.submit(lsm, imm)
+	return imm
+}
+
+/*
+commitFlush records the outcome of a memtable flush, then commits the flushed memtables at the head
+of the queue to level 0, oldest first. Flushes run concurrently but a memtable never overtakes an older one.
+A memtable leaves the queue in the same critical section that adds its SSTable to level 0.
+
+A flush that failed for good keeps its memtable queued, readable and backed by the WAL,
+and sets the background error that fails writes until Resume.
+*/
+func (lsm *LSM) commitFlush(imm *immutableMemtable, err error) {
+	defer lsm.background.Done()
+
+	// Commit to level 0 under its compaction lock to avoid race with compaction
+	lsm.levelLocks[0].Lock()
+	lsm.mu.Lock()
+	if err != nil {
+		imm.failed = true
+		lsm.memtableStats.FlushesFailed++
+		if lsm.backgroundErr == nil {
+			lsm.backgroundErr = fmt.Errorf("failed to flush memtable to SSTable %d: %w", imm.index, err)
+		}
+		// Wake stalled writers and Flush callers so they report the error
+		lsm.backgroundWork.Broadcast()
+		lsm.mu.Unlock()
+		lsm.levelLocks[0].Unlock()
+		return
+	}
+	imm.flushed = true
+
+	committed := false
+	for len(lsm.immutables) > 0 && lsm.immutables[0].flushed {
+		head := lsm.immutables[0]
+		lsm.immutables[0] = nil
+		lsm.immutables = lsm.immutables[1:]
+
+		lsm.levels[0] = append(lsm.levels[0], uint64(head.index))
+		lsm.memtableStats.FlushesCompleted++
+		head.committed = true
+		committed = true
+
+		// The memtable's low water mark tells us which WAL segments are no longer needed
+		if head.lowWaterMark > 0 {
+			lsm.retireLogsUnsafe(head.lowWaterMark)
+		}
+	}
+
+	if committed {
+		lsm.refreshPendingCompactionBytesUnsafe()
+	}
+	// Wake writers stalled on a full queue or on too many level 0 tables
+	lsm.backgroundWork.Broadcast()
+	lsm.mu.Unlock()
+	lsm.levelLocks[0].Unlock()
+
+	// After successful append, consider compactions
+	if committed {
+		lsm.maybeStartCompactions()
+	}
+}
+
+// retireLogsUnsafe retires the WAL segments below lowWaterMark; must be called with lsm.mu held.
+// While a subscription replays the WAL, retiring is deferred until the replay finishes.
+func (lsm *LSM) retireLogsUnsafe(lowWaterMark uint64) {
+	if lsm.walReplays > 0 {
+		lsm.deferredLowWaterMark = max(lsm.deferredLowWaterMark, lowWaterMark)
+		return
+	}
+	if err := lsm.wal.DeleteOldLogs(lowWaterMark); err != nil {
+		// Log error but don't fail the flush
+		fmt.Printf("Warning: Failed to delete old WAL logs below watermark %d: %v\n", lowWaterMark, err)
+	}
+}
+
+// MemtableStats returns the current memtable and flush queue statistics.
+func (lsm *LSM) MemtableStats() MemtableStats {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	stats := lsm.memtableStats
+	if lsm.memtable != nil {
+		stats.MutableEntries = lsm.memtable.TotalEntries()
+		stats.MutableBytes = lsm.memtable.MemoryUsage()
+	}
+	stats.ImmutableCount = len(lsm.immutables)
+	for _, imm := range lsm.immutables {
+		stats.ImmutableBytes += imm.mt.MemoryUsage()
+	}
+	stats.MaxImmutable = maxImmutableMemtables()
+	return stats
+}
+
+// BackgroundError returns the error of the flush that stopped writes, or nil while writes are accepted.
+func (lsm *LSM) BackgroundError() error {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	return lsm.backgroundErr
+}
+
+/*
+Resume clears the background error once its cause (a full disk, missing permissions...) has been dealt with,
+and retries the flushes that failed. Writes are accepted again right away; if a flush fails again
+the background error is set again.
+*/
+func (lsm *LSM) Resume() {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	if lsm.backgroundErr == nil {
+		return
+	}
+	lsm.backgroundErr = nil
+	for _, imm := range lsm.immutables {
+		if imm.failed {
+			imm.failed = false
+			lsm.background.Add(1)
+			lsm.flushPool.submit(lsm, imm)
+		}
+	}
+	lsm.backgroundWork.Broadcast()
+}
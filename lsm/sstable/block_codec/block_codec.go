@@ -0,0 +1,124 @@
+package block_codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"hunddb/utils/registry"
+	"io"
+)
+
+// Codec compresses the data blocks of an SSTable. Implementations must be safe for concurrent use.
+type Codec interface {
+	// ID identifies the codec on disk, it must never change once tables were written with it.
+	ID() uint8
+	// Name selects the codec through the sstable.block_compression config key.
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// IDs of the built-in codecs, other codecs should pick IDs from 64 up
+const (
+	NONE_ID    uint8 = 0
+	DEFLATE_ID uint8 = 1
+	GZIP_ID    uint8 = 2
+)
+
+const (
+	None    = "none"
+	Deflate = "deflate"
+	Gzip    = "gzip"
+)
+
+var codecs = registry.New[Codec]("block_codec", "block codec")
+
+/*
+Register makes a codec selectable by name through the sstable.block_compression config key, and readable
+in any table written with it. It is meant to be called from the init function of the package providing the codec,
+and panics if the codec is nil, its name is empty, or its ID or name are already registered.
+*/
+func Register(codec Codec) {
+	codecs.Register(codec)
+}
+
+// ByID returns the codec a block was compressed with.
+func ByID(id uint8) (Codec, error) {
+	return codecs.ByID(id)
+}
+
+// ByName returns the codec selected in the config.
+func ByName(name string) (Codec, error) {
+	return codecs.ByName(name)
+}
+
+// RegisteredNames returns the names of all registered codecs, sorted.
+func RegisteredNames() []string {
+	return codecs.Names()
+}
+
+// init registers the built-in codecs
+func init() {
+	Register(noneCodec{})
+	Register(deflateCodec{})
+	Register(gzipCodec{})
+}
+
+// noneCodec stores blocks as they are.
+type noneCodec struct{}
+
+func (noneCodec) ID() uint8                              { return NONE_ID }
+func (noneCodec) Name() string                           { return None }
+func (noneCodec) Compress(data []byte) ([]byte, error)   { return data, nil }
+func (noneCodec) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+// deflateCodec compresses blocks with raw DEFLATE, the smallest output of the standard library codecs.
+type deflateCodec struct{}
+
+func (deflateCodec) ID() uint8    { return DEFLATE_ID }
+func (deflateCodec) Name() string { return Deflate }
+
+func (deflateCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return finishCompression(&buffer, writer, data)
+}
+
+func (deflateCodec) Decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// gzipCodec compresses blocks with gzip, DEFLATE with a header and a CRC32 of the uncompressed block.
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8    { return GZIP_ID }
+func (gzipCodec) Name() string { return Gzip }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	return finishCompression(&buffer, gzip.NewWriter(&buffer), data)
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func finishCompression(buffer *bytes.Buffer, writer io.WriteCloser, data []byte) ([]byte, error) {
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,68 @@
+package block_codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	block := []byte(strings.Repeat("user_0001 value of a fairly repetitive record ", 100))
+	for _, name := range []string{None, Deflate, Gzip} {
+		codec, err := ByName(name)
+		if err != nil {
+			t.Fatalf("ByName(%s): %v", name, err)
+		}
+		compressed, err := codec.Compress(block)
+		if err != nil {
+			t.Fatalf("%s compress: %v", name, err)
+		}
+		if name != None && len(compressed) >= len(block) {
+			t.Errorf("%s did not shrink a repetitive block: %d >= %d", name, len(compressed), len(block))
+		}
+
+		byID, err := ByID(codec.ID())
+		if err != nil || byID != codec {
+			t.Fatalf("ByID(%d) = %v, %v", codec.ID(), byID, err)
+		}
+		decompressed, err := byID.Decompress(compressed)
+		if err != nil {
+			t.Fatalf("%s decompress: %v", name, err)
+		}
+		if !bytes.Equal(decompressed, block) {
+			t.Errorf("%s round trip changed the block", name)
+		}
+	}
+}
+
+func TestCodecs_CorruptInput(t *testing.T) {
+	for _, name := range []string{Deflate, Gzip} {
+		codec, _ := ByName(name)
+		if _, err := codec.Decompress([]byte{0xff, 0x00, 0x13, 0x37}); err == nil {
+			t.Errorf("%s accepted garbage", name)
+		}
+	}
+}
+
+type testCodec struct{ noneCodec }
+
+func (testCodec) ID() uint8    { return 200 }
+func (testCodec) Name() string { return "test" }
+
+func TestRegister(t *testing.T) {
+	if _, err := ByName("test"); err == nil {
+		t.Fatal("expected an unknown codec to be reported")
+	}
+	Register(testCodec{})
+	t.Cleanup(func() { codecs.Unregister(testCodec{}) })
+	if codec, err := ByName("test"); err != nil || codec.ID() != 200 {
+		t.Errorf("ByName(test) = %v, %v", codec, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering an ID twice to panic")
+		}
+	}()
+	Register(testCodec{})
+}
@@ -0,0 +1,1016 @@
+package sstable
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	block_manager "hunddb/lsm/block_manager"
+	block_codec "hunddb/lsm/sstable/block_codec"
+	merkle_tree "hunddb/lsm/sstable/merkle_tree"
+	block_location "hunddb/model/block_location"
+	record "hunddb/model/record"
+	byte_util "hunddb/utils/byte_util"
+	"hunddb/utils/config"
+	crc_util "hunddb/utils/crc"
+	"sort"
+)
+
+const (
+	// FORMAT_VERSION_RECORDS stores every record on its own, with an index entry per record and a sparse summary over them
+	FORMAT_VERSION_RECORDS = 1
+	// FORMAT_VERSION_BLOCKS groups records into prefix-compressed data blocks, with an index entry per block
+	FORMAT_VERSION_BLOCKS = 2
+
+	RESTART_POINT_SIZE = 4
+)
+
+var (
+	FORMAT_VERSION         uint8  // Format new SSTables are written in
+	DATA_BLOCK_SIZE        uint64 // A data block is cut once its entries and restart points reach this size
+	BLOCK_RESTART_INTERVAL uint64 // Every n-th key of a data block is stored whole
+	BLOCK_COMPRESSION      string // Name of the codec data blocks are compressed with
+	INDEX_PARTITION_SIZE   uint64 // Bytes of block index per partition in bottom level tables, 0 keeps the index whole
+)
+
+func init() {
+	cfg := config.GetConfig()
+	if cfg != nil {
+		FORMAT_VERSION = cfg.SSTable.FormatVersion
+		DATA_BLOCK_SIZE = cfg.SSTable.DataBlockSize
+		BLOCK_RESTART_INTERVAL = cfg.SSTable.BlockRestartInterval
+		BLOCK_COMPRESSION = cfg.SSTable.BlockCompression
+		INDEX_PARTITION_SIZE = cfg.SSTable.IndexPartitionSize
+	}
+}
+
+/*
+In the block format, the Data component is a sequence of data blocks. Each entry of a block stores only
+the part of its key that differs from the previous key:
+
+	+--------------+----------------+------------------+----------------+----------------+------------+-------+
+	| Shared (var) | Unshared (var) | Value Size (var) | Timestamp (8B) | Tombstone (1B) | Key suffix | Value |
+	+--------------+----------------+------------------+----------------+----------------+------------+-------+
+
+Every BLOCK_RESTART_INTERVAL-th entry is a restart point, it shares nothing and stores its whole key.
+The entries are followed by the offsets of the restart points, so a lookup binary searches the restart keys
+and decodes at most one interval of entries:
+
+	+----------------+-----+----------------+--------------------+
+	| Restart 0 (4B) | ... | Restart n (4B) | Restart count (4B) |
+	+----------------+-----+----------------+--------------------+
+
+Each stored block ends with the ID of the codec it was compressed with. The table's codec is only tried,
+a block that doesn't shrink is stored as it is with the ID of the none codec:
+
+	+-------------------------------------------+---------------+
+	| Entries and restarts, compressed or not   | Codec ID (1B) |
+	+-------------------------------------------+---------------+
+
+The Index component holds one entry per data block, keyed by the last key of the block, and is small enough to be
+kept in memory by the table cache. The Summary component holds the first and last key and the record count.
+Keys are not swapped for global dictionary IDs, prefix compression takes care of repetitive keys.
+
+Tables with an IndexPartitionSize split the Index component into partitions of consecutive block index entries,
+and the Filter component into one filter per partition, over the keys of its data blocks. The Summary component
+then also holds the top-level index locating the partitions, which is all the table cache keeps, so a lookup
+reads the one index partition and filter partition its key falls into.
+*/
+
+// compressBlock compresses a finished data block with the codec and appends the ID of the codec it ended up stored with.
+func compressBlock(codec block_codec.Codec, payload []byte) ([]byte, error) {
+	if codec.ID() != block_codec.NONE_ID {
+		compressed, err := codec.Compress(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(payload) {
+			return append(compressed, codec.ID()), nil
+		}
+	}
+	return append(payload, block_codec.NONE_ID), nil
+}
+
+// decompressBlock reverses compressBlock, using the codec named by the trailing ID.
+func decompressBlock(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("data block is missing its codec ID")
+	}
+	id, payload := stored[len(stored)-1], stored[:len(stored)-1]
+	if id == block_codec.NONE_ID {
+		return payload, nil
+	}
+	codec, err := block_codec.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decompress(payload)
+}
+
+// blockHandle locates a data block in the Data component.
+type blockHandle struct {
+	lastKey string
+	offset  uint64 // Logical offset from the start of the component, the size prefix of separate files included
+	size    uint64
+}
+
+// indexPartition locates a partition of the block index and the filter over the keys of its data blocks.
+// Offsets are logical offsets from the start of the Index and Filter components, the size prefix of separate files left out.
+type indexPartition struct {
+	lastKey      string // Last key of the partition's last data block
+	indexOffset  uint64
+	indexSize    uint64
+	filterOffset uint64
+	filterSize   uint64
+}
+
+// dataBlockBuilder encodes records into a data block.
+type dataBlockBuilder struct {
+	buffer   []byte
+	restarts []uint32
+	counter  uint64 // Entries since the last restart point
+	lastKey  string
+}
+
+// add appends a record, records must be added in key order.
+func (builder *dataBlockBuilder) add(rec *record.Record) {
+	shared := 0
+	if builder.counter > 0 && builder.counter < BLOCK_RESTART_INTERVAL {
+		shared = sharedPrefixLength(builder.lastKey, rec.Key)
+	} else {
+		builder.restarts = append(builder.restarts, uint32(len(builder.buffer)))
+		builder.counter = 0
+	}
+
+	builder.buffer = binary.AppendUvarint(builder.buffer, uint64(shared))
+	builder.buffer = binary.AppendUvarint(builder.buffer, uint64(len(rec.Key)-shared))
+	builder.buffer = binary.AppendUvarint(builder.buffer, uint64(len(rec.Value)))
+	builder.buffer = binary.LittleEndian.AppendUint64(builder.buffer, rec.Timestamp)
+	builder.buffer = append(builder.buffer, byte_util.BoolToByte(rec.Tombstone))
+	builder.buffer = append(builder.buffer, rec.Key[shared:]...)
+	builder.buffer = append(builder.buffer, rec.Value...)
+
+	builder.lastKey = rec.Key
+	builder.counter++
+}
+
+func (builder *dataBlockBuilder) empty() bool {
+	return len(builder.buffer) == 0
+}
+
+// size returns the size the block would have if it was finished now.
+func (builder *dataBlockBuilder) size() uint64 {
+	return uint64(len(builder.buffer) + (len(builder.restarts)+1)*RESTART_POINT_SIZE)
+}
+
+// finish returns the encoded block and its last key, and resets the builder for the next block.
+func (builder *dataBlockBuilder) finish() ([]byte, string) {
+	block := builder.buffer
+	for _, restart := range builder.restarts {
+		block = binary.LittleEndian.AppendUint32(block, restart)
+	}
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(builder.restarts)))
+	lastKey := builder.lastKey
+
+	*builder = dataBlockBuilder{}
+	return block, lastKey
+}
+
+func sharedPrefixLength(a string, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// dataBlock is a decoded data block, split into its entries and restart points.
+type dataBlock struct {
+	entries  []byte
+	restarts []uint32
+}
+
+func parseDataBlock(payload []byte) (*dataBlock, error) {
+	if len(payload) < RESTART_POINT_SIZE {
+		return nil, fmt.Errorf("data block of %d bytes is too short", len(payload))
+	}
+	count := uint64(binary.LittleEndian.Uint32(payload[len(payload)-RESTART_POINT_SIZE:]))
+	restartsStart := uint64(len(payload)) - RESTART_POINT_SIZE - count*RESTART_POINT_SIZE
+	if count == 0 || restartsStart > uint64(len(payload)) {
+		return nil, fmt.Errorf("data block has an invalid restart count %d", count)
+	}
+
+	block := &dataBlock{
+		entries:  payload[:restartsStart],
+		restarts: make([]uint32, count),
+	}
+	for i := range block.restarts {
+		position := restartsStart + uint64(i)*RESTART_POINT_SIZE
+		block.restarts[i] = binary.LittleEndian.Uint32(payload[position : position+RESTART_POINT_SIZE])
+		if uint64(block.restarts[i]) >= restartsStart {
+			return nil, fmt.Errorf("data block restart point %d is out of bounds", i)
+		}
+	}
+	return block, nil
+}
+
+// decodeEntry decodes the entry at offset, previousKey being the key of the entry before it.
+// Returns the record and the offset of the next entry.
+func (block *dataBlock) decodeEntry(offset int, previousKey string) (*record.Record, int, error) {
+	data := block.entries[offset:]
+	fields := [3]uint64{} // Shared, unshared and value size
+	position := 0
+	for i := range fields {
+		value, n := binary.Uvarint(data[position:])
+		if n <= 0 {
+			return nil, 0, fmt.Errorf("corrupt data block entry at offset %d", offset)
+		}
+		fields[i] = value
+		position += n
+	}
+	shared, unshared, valueSize := fields[0], fields[1], fields[2]
+	remaining := uint64(len(data) - position)
+	if shared > uint64(len(previousKey)) || remaining < 8+1 || unshared > remaining-8-1 || valueSize > remaining-8-1-unshared {
+		return nil, 0, fmt.Errorf("corrupt data block entry at offset %d", offset)
+	}
+
+	timestamp := binary.LittleEndian.Uint64(data[position : position+8])
+	tombstone := byte_util.ByteToBool(data[position+8])
+	position += 8 + 1
+	key := previousKey[:shared] + string(data[position:position+int(unshared)])
+	position += int(unshared)
+	var value []byte
+	if valueSize > 0 {
+		value = append([]byte(nil), data[position:position+int(valueSize)]...)
+	}
+	position += int(valueSize)
+
+	return record.NewRecord(key, value, timestamp, tombstone), offset + position, nil
+}
+
+// seekRestart returns the offset of the last restart point whose key is smaller than key, or of the first one.
+func (block *dataBlock) seekRestart(key string) (int, error) {
+	low, high := 0, len(block.restarts)-1
+	for low < high {
+		mid := (low + high + 1) / 2
+		rec, _, err := block.decodeEntry(int(block.restarts[mid]), "")
+		if err != nil {
+			return 0, err
+		}
+		if rec.Key < key {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return int(block.restarts[low]), nil
+}
+
+// blockTableIterator walks the records of a block format SSTable in key order.
+type blockTableIterator struct {
+	table     *tableHandle
+	partition int           // Position of the current index partition, a whole block index is the only one
+	blocks    []blockHandle // Block index of the current partition
+	block     int           // Position of the current data block in blocks
+	data      *dataBlock
+	offset    int // Offset of the next entry in the current data block
+	current   *record.Record
+}
+
+func newBlockTableIterator(table *tableHandle) *blockTableIterator {
+	return &blockTableIterator{table: table, partition: -1, block: -1}
+}
+
+// loadPartition reads the block index of the index partition at the given position.
+func (iter *blockTableIterator) loadPartition(position int) error {
+	blocks, err := iter.table.partitionBlocks(position)
+	if err != nil {
+		return err
+	}
+	iter.partition, iter.blocks, iter.block, iter.data, iter.current = position, blocks, -1, nil, nil
+	return nil
+}
+
+// loadBlock reads and parses the data block at the given position of the current partition.
+func (iter *blockTableIterator) loadBlock(position int) error {
+	handle := iter.blocks[position]
+	stored, err := iter.table.readFromDisk(iter.table.dataPath, physicalOffset(iter.table.dataStart, handle.offset), handle.size)
+	if err != nil {
+		return fmt.Errorf("failed to read data block %d: %v", position, err)
+	}
+	payload, err := decompressBlock(stored)
+	if err != nil {
+		return fmt.Errorf("failed to decompress data block %d: %v", position, err)
+	}
+	data, err := parseDataBlock(payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse data block %d: %v", position, err)
+	}
+	iter.block, iter.data, iter.offset, iter.current = position, data, 0, nil
+	return nil
+}
+
+// next moves to the following record, into the next data block once this one runs out,
+// and into the next partition once its blocks run out. current is nil once the table runs out.
+func (iter *blockTableIterator) next() error {
+	for iter.data == nil || iter.offset >= len(iter.data.entries) {
+		if iter.block+1 >= len(iter.blocks) {
+			if iter.partition+1 >= iter.table.partitionCount() {
+				iter.current = nil
+				return nil
+			}
+			if err := iter.loadPartition(iter.partition + 1); err != nil {
+				iter.current = nil
+				return err
+			}
+			continue
+		}
+		if err := iter.loadBlock(iter.block + 1); err != nil {
+			iter.current = nil
+			return err
+		}
+	}
+
+	previousKey := ""
+	if iter.current != nil {
+		previousKey = iter.current.Key
+	}
+	rec, offset, err := iter.data.decodeEntry(iter.offset, previousKey)
+	if err != nil {
+		iter.current = nil
+		return err
+	}
+	iter.current, iter.offset = rec, offset
+	return nil
+}
+
+// seek moves to the first record whose key is greater than or equal to key.
+func (iter *blockTableIterator) seek(key string) error {
+	partition, position := iter.table.findPartition(key), 0
+	if partition < iter.table.partitionCount() {
+		if err := iter.loadPartition(partition); err != nil {
+			return err
+		}
+		blocks := iter.blocks
+		position = sort.Search(len(blocks), func(i int) bool { return blocks[i].lastKey >= key })
+	}
+	if partition == iter.table.partitionCount() || position == len(iter.blocks) {
+		iter.partition, iter.block, iter.data, iter.current = iter.table.partitionCount(), len(iter.blocks), nil, nil
+		return nil
+	}
+	if err := iter.loadBlock(position); err != nil {
+		return err
+	}
+	offset, err := iter.data.seekRestart(key)
+	if err != nil {
+		return err
+	}
+	iter.offset = offset
+
+	for {
+		if err := iter.next(); err != nil {
+			return err
+		}
+		if iter.current == nil || iter.current.Key >= key {
+			return nil
+		}
+	}
+}
+
+// records returns a recordSource reading the table from the current record on.
+func (iter *blockTableIterator) records() recordSource {
+	started := false
+	return func() (*record.Record, error) {
+		if started {
+			if err := iter.next(); err != nil {
+				return nil, err
+			}
+		}
+		started = true
+		return iter.current, nil
+	}
+}
+
+// getFromBlocks is GetEntry for block format tables.
+func (table *tableHandle) getFromBlocks(key string) (*record.Record, error) {
+	if err := table.loadBounds(); err != nil {
+		return nil, fmt.Errorf("failed to read block index: %v", err)
+	}
+	iter := newBlockTableIterator(table)
+	if err := iter.seek(key); err != nil {
+		return nil, fmt.Errorf("failed to search data block: %v", err)
+	}
+	if iter.current == nil || iter.current.Key != key {
+		return nil, nil
+	}
+	return iter.current, nil
+}
+
+// nextFromBlocks returns the first record from the first key >= start on that is within the window and not deleted.
+func (table *tableHandle) nextFromBlocks(start string, tombstonedKeys *[]string, within func(string) bool, stop func(string) bool) (*record.Record, error) {
+	records, err := table.blockRecordsFrom(start)
+	if err != nil {
+		return nil, err
+	}
+	return nextVisibleRecord(records, tombstonedKeys, within, stop)
+}
+
+// blockRecordsFrom returns the records of a block format table from the first key >= start on.
+func (table *tableHandle) blockRecordsFrom(start string) (recordSource, error) {
+	if err := table.loadBounds(); err != nil {
+		return nil, fmt.Errorf("failed to read block index: %v", err)
+	}
+	iter := newBlockTableIterator(table)
+	if err := iter.seek(start); err != nil {
+		return nil, fmt.Errorf("failed to search data block: %v", err)
+	}
+	return iter.records(), nil
+}
+
+// readBlockIndex reads the Summary and Index components of a block format table.
+func (table *tableHandle) readBlockIndex() error {
+	summary, err := table.readComponent(2, SUMMARY_FILE_NAME_FORMAT)
+	if err != nil {
+		return fmt.Errorf("failed to read summary: %v", err)
+	}
+	table.firstKey, table.lastKey, table.recordCount, table.partitions, err = decodeTableSummary(summary)
+	if err != nil {
+		return err
+	}
+	if table.partitioned() {
+		return nil // Partitions of the block index are read as lookups need them
+	}
+
+	index, err := table.readComponent(1, INDEX_FILE_NAME_FORMAT)
+	if err != nil {
+		return fmt.Errorf("failed to read block index: %v", err)
+	}
+	table.blocks, err = decodeBlockIndex(index)
+	return err
+}
+
+// readComponent reads the whole component at the given position of the component order.
+func (table *tableHandle) readComponent(position int, fileNameFormat string) ([]byte, error) {
+	if table.config.UseSeparateFiles {
+		filePath := fmt.Sprintf(fileNameFormat, table.index)
+		size, err := getComponentSize(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return table.readFromDisk(filePath, CRC_SIZE+STANDARD_FLAG_SIZE, size)
+	}
+	return table.readFromDisk(fmt.Sprintf(FILE_NAME_FORMAT, table.index), table.offsets[position]+CRC_SIZE, table.sizes[position])
+}
+
+// readComponentRange reads size bytes from the logical offset on of the component at the given position,
+// the offset leaving out the size prefix of separate files.
+func (table *tableHandle) readComponentRange(position int, fileNameFormat string, offset uint64, size uint64) ([]byte, error) {
+	if table.config.UseSeparateFiles {
+		return table.readFromDisk(fmt.Sprintf(fileNameFormat, table.index), physicalOffset(0, STANDARD_FLAG_SIZE+offset), size)
+	}
+	return table.readFromDisk(fmt.Sprintf(FILE_NAME_FORMAT, table.index), physicalOffset(table.offsets[position], offset), size)
+}
+
+/*
+The block index is serialized as:
+
+	+-------------+----------------+----------+--------------+------------+-----+
+	| Count (var) | Key Size (var) | Last Key | Offset (var) | Size (var) | ... |
+	+-------------+----------------+----------+--------------+------------+-----+
+*/
+func encodeBlockIndex(blocks []blockHandle) []byte {
+	data := binary.AppendUvarint(nil, uint64(len(blocks)))
+	for _, handle := range blocks {
+		data = binary.AppendUvarint(data, uint64(len(handle.lastKey)))
+		data = append(data, handle.lastKey...)
+		data = binary.AppendUvarint(data, handle.offset)
+		data = binary.AppendUvarint(data, handle.size)
+	}
+	return data
+}
+
+func decodeBlockIndex(data []byte) ([]blockHandle, error) {
+	reader := &varintReader{data: data}
+	count := reader.uvarint()
+	blocks := make([]blockHandle, 0, min(count, uint64(len(data))))
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		lastKey := reader.string()
+		offset := reader.uvarint()
+		size := reader.uvarint()
+		blocks = append(blocks, blockHandle{lastKey: lastKey, offset: offset, size: size})
+	}
+	if reader.err != nil {
+		return nil, fmt.Errorf("corrupt block index: %v", reader.err)
+	}
+	return blocks, nil
+}
+
+/*
+The table summary is serialized as:
+
+	+----------------+-----------+----------------+----------+--------------------+
+	| Key Size (var) | First Key | Key Size (var) | Last Key | Record Count (var) |
+	+----------------+-----------+----------------+----------+--------------------+
+
+Tables with a partitioned block index follow it with the top-level index:
+
+	+-----------------------+----------------+----------+---------------------+-------------------+----------------------+--------------------+-----+
+	| Partition Count (var) | Key Size (var) | Last Key | Index Offset (var)  | Index Size (var)  | Filter Offset (var)  | Filter Size (var)  | ... |
+	+-----------------------+----------------+----------+---------------------+-------------------+----------------------+--------------------+-----+
+*/
+func encodeTableSummary(firstKey string, lastKey string, recordCount uint64, partitions []indexPartition) []byte {
+	data := binary.AppendUvarint(nil, uint64(len(firstKey)))
+	data = append(data, firstKey...)
+	data = binary.AppendUvarint(data, uint64(len(lastKey)))
+	data = append(data, lastKey...)
+	data = binary.AppendUvarint(data, recordCount)
+	if partitions == nil {
+		return data
+	}
+	data = binary.AppendUvarint(data, uint64(len(partitions)))
+	for _, partition := range partitions {
+		data = binary.AppendUvarint(data, uint64(len(partition.lastKey)))
+		data = append(data, partition.lastKey...)
+		data = binary.AppendUvarint(data, partition.indexOffset)
+		data = binary.AppendUvarint(data, partition.indexSize)
+		data = binary.AppendUvarint(data, partition.filterOffset)
+		data = binary.AppendUvarint(data, partition.filterSize)
+	}
+	return data
+}
+
+// decodeTableSummary reverses encodeTableSummary, the partitions are nil for a whole block index.
+func decodeTableSummary(data []byte) (string, string, uint64, []indexPartition, error) {
+	reader := &varintReader{data: data}
+	firstKey := reader.string()
+	lastKey := reader.string()
+	recordCount := reader.uvarint()
+	var partitions []indexPartition
+	if reader.err == nil && len(reader.data) > 0 {
+		count := reader.uvarint()
+		partitions = make([]indexPartition, 0, min(count, uint64(len(reader.data))))
+		for i := uint64(0); i < count && reader.err == nil; i++ {
+			partitionLastKey := reader.string()
+			indexOffset, indexSize := reader.uvarint(), reader.uvarint()
+			filterOffset, filterSize := reader.uvarint(), reader.uvarint()
+			partitions = append(partitions, indexPartition{
+				lastKey:      partitionLastKey,
+				indexOffset:  indexOffset,
+				indexSize:    indexSize,
+				filterOffset: filterOffset,
+				filterSize:   filterSize,
+			})
+		}
+	}
+	if reader.err != nil {
+		return "", "", 0, nil, fmt.Errorf("corrupt table summary: %v", reader.err)
+	}
+	return firstKey, lastKey, recordCount, partitions, nil
+}
+
+// varintReader decodes varint prefixed fields, keeping the first error it runs into.
+type varintReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *varintReader) uvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(reader.data)
+	if n <= 0 {
+		reader.err = fmt.Errorf("truncated varint")
+		return 0
+	}
+	reader.data = reader.data[n:]
+	return value
+}
+
+func (reader *varintReader) varint() int64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(reader.data)
+	if n <= 0 {
+		reader.err = fmt.Errorf("truncated varint")
+		return 0
+	}
+	reader.data = reader.data[n:]
+	return value
+}
+
+func (reader *varintReader) byte() byte {
+	if reader.err != nil {
+		return 0
+	}
+	if len(reader.data) == 0 {
+		reader.err = fmt.Errorf("truncated byte")
+		return 0
+	}
+	value := reader.data[0]
+	reader.data = reader.data[1:]
+	return value
+}
+
+func (reader *varintReader) string() string {
+	size := reader.uvarint()
+	if reader.err != nil {
+		return ""
+	}
+	if size > uint64(len(reader.data)) {
+		reader.err = fmt.Errorf("truncated string of %d bytes", size)
+		return ""
+	}
+	value := string(reader.data[:size])
+	reader.data = reader.data[size:]
+	return value
+}
+
+// physicalOffset maps a logical offset within a component to its position on disk, the component starting at start.
+func physicalOffset(start uint64, logical uint64) uint64 {
+	payload := BLOCK_SIZE - CRC_SIZE
+	return start + logical/payload*BLOCK_SIZE + CRC_SIZE + logical%payload
+}
+
+/*
+componentWriter streams a component to disk block by block, adding the CRCs on the way.
+In separate files mode the component starts with its size, which is patched in once the component is finished.
+*/
+type componentWriter struct {
+	filePath    string
+	startOffset uint64 // On a block boundary
+	withPrefix  bool
+	pending     []byte // Logical bytes not written yet, less than a block's worth between writes
+	written     uint64 // Physical bytes written so far
+	logical     uint64 // Logical bytes written so far, the size prefix included
+}
+
+func newComponentWriter(filePath string, startOffset uint64, withPrefix bool) *componentWriter {
+	writer := &componentWriter{filePath: filePath, startOffset: startOffset, withPrefix: withPrefix}
+	if withPrefix {
+		writer.pending = make([]byte, STANDARD_FLAG_SIZE) // Placeholder for the size
+		writer.logical = STANDARD_FLAG_SIZE
+	}
+	return writer
+}
+
+// write appends data to the component and returns the logical offset it starts at.
+func (writer *componentWriter) write(data []byte) (uint64, error) {
+	offset := writer.logical
+	writer.pending = append(writer.pending, data...)
+	writer.logical += uint64(len(data))
+
+	// Write out every full block, keep the rest for later
+	payload := BLOCK_SIZE - CRC_SIZE
+	full := uint64(len(writer.pending)) / payload * payload
+	if full == 0 {
+		return offset, nil
+	}
+	blocks := crc_util.AddCRCsToData(writer.pending[:full])
+	if err := block_manager.GetBlockManager().WriteToDisk(blocks, writer.filePath, writer.startOffset+writer.written); err != nil {
+		return 0, err
+	}
+	writer.written += uint64(len(blocks))
+	writer.pending = writer.pending[:copy(writer.pending, writer.pending[full:])]
+	return offset, nil
+}
+
+// finish writes the last block and returns the size of the component, the size prefix left out,
+// and the offset the next component starts at.
+func (writer *componentWriter) finish() (uint64, uint64, error) {
+	blockManager := block_manager.GetBlockManager()
+	size := writer.logical
+	prefixOnDisk := writer.withPrefix && writer.written > 0
+	if writer.withPrefix {
+		size -= STANDARD_FLAG_SIZE
+		if !prefixOnDisk {
+			binary.LittleEndian.PutUint64(writer.pending[:STANDARD_FLAG_SIZE], size)
+		}
+	}
+
+	if len(writer.pending) > 0 {
+		blocks := crc_util.AddCRCsToData(writer.pending)
+		if err := blockManager.WriteToDisk(blocks, writer.filePath, writer.startOffset+writer.written); err != nil {
+			return 0, 0, err
+		}
+		writer.written += uint64(len(blocks))
+		writer.pending = writer.pending[:0]
+	}
+
+	// The first block is already on disk, patch the size into it
+	if prefixOnDisk {
+		location := block_location.BlockLocation{FilePath: writer.filePath, BlockIndex: writer.startOffset / BLOCK_SIZE}
+		cached, err := blockManager.ReadBlock(location)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read first block for patching the size prefix: %v", err)
+		}
+		first := append([]byte(nil), cached...)
+		binary.LittleEndian.PutUint64(first[CRC_SIZE:CRC_SIZE+STANDARD_FLAG_SIZE], size)
+		crc_util.AddCRCToBlockData(first)
+		if err := blockManager.WriteToDisk(first, writer.filePath, writer.startOffset); err != nil {
+			return 0, 0, fmt.Errorf("failed to patch the size prefix: %v", err)
+		}
+	}
+
+	return size, writer.startOffset + writer.written, nil
+}
+
+// writeComponent writes a whole component, returning its size and the offset the next component starts at.
+func writeComponent(data []byte, filePath string, startOffset uint64, withPrefix bool) (uint64, uint64, error) {
+	writer := newComponentWriter(filePath, startOffset, withPrefix)
+	if _, err := writer.write(data); err != nil {
+		return 0, 0, err
+	}
+	return writer.finish()
+}
+
+/*
+writeBlockTable writes an SSTable in the block format, taking its records in key order from next until it returns nil.
+The records are accounted for in properties, which are written with the footer.
+*/
+func writeBlockTable(index int, config *SSTableConfig, properties *TableProperties, next recordSource) error {
+	builder, err := newBlockTableBuilder(indexedFilePath(index), config, properties)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := next()
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			break
+		}
+		if err := builder.add(rec); err != nil {
+			return err
+		}
+	}
+	return builder.finish()
+}
+
+// indexedFilePath names the files of the table with the given index, in the working directory.
+func indexedFilePath(index int) func(string) string {
+	return func(fileNameFormat string) string {
+		return fmt.Sprintf(fileNameFormat, index)
+	}
+}
+
+/*
+blockTableBuilder writes an SSTable in the block format from records added in key order.
+
+Records are cut into data blocks as they come, so besides the block being built only the block index,
+the block hashes and the keys for the Bloom filter are held in memory.
+*/
+type blockTableBuilder struct {
+	config     *SSTableConfig
+	properties *TableProperties
+	codec      block_codec.Codec
+	filePath   func(string) string // Names a file of the table from its *_FILE_NAME_FORMAT
+
+	dataStartOffset uint64
+	data            *componentWriter
+	block           dataBlockBuilder
+	blocks          []blockHandle
+	blockHashes     [][]byte
+	keys            []string
+}
+
+// newBlockTableBuilder writes the config of the table and gets ready for its records.
+func newBlockTableBuilder(filePath func(string) string, config *SSTableConfig, properties *TableProperties) (*blockTableBuilder, error) {
+	codec, err := block_codec.ByID(config.BlockCodec)
+	if err != nil {
+		return nil, err
+	}
+	builder := &blockTableBuilder{
+		config:      config,
+		properties:  properties,
+		codec:       codec,
+		filePath:    filePath,
+		blocks:      make([]blockHandle, 0),
+		blockHashes: make([][]byte, 0),
+		keys:        make([]string, 0),
+	}
+
+	// 1. Config
+	serializedConfig, configSize, err := config.serialize()
+	if err != nil {
+		return nil, err
+	}
+	if err := block_manager.GetBlockManager().WriteToDisk(serializedConfig, filePath(FILE_NAME_FORMAT), 0); err != nil {
+		return nil, err
+	}
+
+	// 2. Data blocks follow the config, or start their own file
+	builder.dataStartOffset = configSize
+	if config.UseSeparateFiles {
+		builder.dataStartOffset = 0
+	}
+	builder.data = newComponentWriter(builder.componentPath(DATA_FILE_NAME_FORMAT), builder.dataStartOffset, config.UseSeparateFiles)
+	return builder, nil
+}
+
+// componentPath returns the file a component goes to, the base file unless components are in separate files.
+func (builder *blockTableBuilder) componentPath(fileNameFormat string) string {
+	if builder.config.UseSeparateFiles {
+		return builder.filePath(fileNameFormat)
+	}
+	return builder.filePath(FILE_NAME_FORMAT)
+}
+
+// add appends a record, records must be added in key order.
+func (builder *blockTableBuilder) add(rec *record.Record) error {
+	builder.properties.add(rec)
+	builder.block.add(rec)
+	builder.keys = append(builder.keys, rec.Key)
+	if builder.block.size() >= DATA_BLOCK_SIZE {
+		return builder.finishBlock()
+	}
+	return nil
+}
+
+// finishBlock compresses and writes out the data block being built.
+func (builder *blockTableBuilder) finishBlock() error {
+	payload, lastKey := builder.block.finish()
+	stored, err := compressBlock(builder.codec, payload)
+	if err != nil {
+		return fmt.Errorf("failed to compress data block: %v", err)
+	}
+	offset, err := builder.data.write(stored)
+	if err != nil {
+		return fmt.Errorf("failed to write data block: %v", err)
+	}
+	builder.blocks = append(builder.blocks, blockHandle{lastKey: lastKey, offset: offset, size: uint64(len(stored))})
+	hash := md5.Sum(stored)
+	builder.blockHashes = append(builder.blockHashes, hash[:])
+	return nil
+}
+
+// finish writes the last data block and the components describing the records, then closes the table with its footer.
+func (builder *blockTableBuilder) finish() error {
+	if !builder.block.empty() {
+		if err := builder.finishBlock(); err != nil {
+			return err
+		}
+	}
+	dataSize, nextOffset, err := builder.data.finish()
+	if err != nil {
+		return err
+	}
+
+	// 3. Block index
+	separate := builder.config.UseSeparateFiles
+	sizes := []uint64{dataSize}
+	offsets := []uint64{builder.dataStartOffset}
+	writeNext := func(fileNameFormat string, serialized []byte) error {
+		startOffset := nextOffset
+		if separate {
+			startOffset = 0
+		}
+		size, endOffset, err := writeComponent(serialized, builder.componentPath(fileNameFormat), startOffset, separate)
+		if err != nil {
+			return err
+		}
+		sizes = append(sizes, size)
+		offsets = append(offsets, startOffset)
+		nextOffset = endOffset
+		return nil
+	}
+	keys := builder.keys
+	var index, filter []byte
+	var partitions []indexPartition
+	if builder.config.IndexPartitionSize > 0 {
+		index, filter, partitions, err = builder.partitionIndexAndFilter()
+	} else {
+		index = encodeBlockIndex(builder.blocks)
+		filter, err = builder.serializedFilter(keys)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeNext(INDEX_FILE_NAME_FORMAT, index); err != nil {
+		return fmt.Errorf("failed to write block index: %v", err)
+	}
+
+	// 4. Summary, with the top-level index of a partitioned block index
+	var firstKey, lastKey string
+	if len(keys) > 0 {
+		firstKey, lastKey = keys[0], keys[len(keys)-1]
+	}
+	if err := writeNext(SUMMARY_FILE_NAME_FORMAT, encodeTableSummary(firstKey, lastKey, uint64(len(keys)), partitions)); err != nil {
+		return fmt.Errorf("failed to write summary: %v", err)
+	}
+
+	// 5. Filter over the keys and their prefixes, one per partition of a partitioned block index
+	if err := writeNext(FILTER_FILE_NAME_FORMAT, filter); err != nil {
+		return fmt.Errorf("failed to write filter: %v", err)
+	}
+
+	// 6. Merkle tree over the data blocks
+	blockHashes := builder.blockHashes
+	if len(blockHashes) == 0 {
+		emptyLeaf := md5.Sum([]byte{})
+		blockHashes = append(blockHashes, emptyLeaf[:])
+	}
+	merkleTree, err := merkle_tree.NewMerkleTree(blockHashes, true)
+	if err != nil {
+		return err
+	}
+	if err := writeNext(METADATA_FILE_NAME_FORMAT, merkleTree.Serialize()); err != nil {
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+
+	return builder.config.writeFooter(sizes, offsets, builder.properties, builder.filePath(FILE_NAME_FORMAT))
+}
+
+// serializedFilter builds the filter over keys and serializes it.
+func (builder *blockTableBuilder) serializedFilter(keys []string) ([]byte, error) {
+	filter, err := builder.config.buildFilter(keys)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Serialize(), nil
+}
+
+/*
+partitionIndexAndFilter cuts the block index into partitions of at least IndexPartitionSize bytes, the last one
+aside, and builds a filter over the keys of each partition's data blocks. Returns the Index and Filter components
+and the top-level index over them.
+*/
+func (builder *blockTableBuilder) partitionIndexAndFilter() ([]byte, []byte, []indexPartition, error) {
+	var index, filter []byte
+	partitions := make([]indexPartition, 0)
+	keys := builder.keys
+	firstBlock, firstKey := 0, 0
+	partitionSize := uint64(0)
+	for position, handle := range builder.blocks {
+		partitionSize += uint64(len(encodeBlockIndex([]blockHandle{handle})))
+		if partitionSize < builder.config.IndexPartitionSize && position < len(builder.blocks)-1 {
+			continue
+		}
+
+		lastKey := firstKey + sort.SearchStrings(keys[firstKey:], handle.lastKey) + 1
+		serializedFilter, err := builder.serializedFilter(keys[firstKey:lastKey])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		serializedIndex := encodeBlockIndex(builder.blocks[firstBlock : position+1])
+		partitions = append(partitions, indexPartition{
+			lastKey:      handle.lastKey,
+			indexOffset:  uint64(len(index)),
+			indexSize:    uint64(len(serializedIndex)),
+			filterOffset: uint64(len(filter)),
+			filterSize:   uint64(len(serializedFilter)),
+		})
+		index = append(index, serializedIndex...)
+		filter = append(filter, serializedFilter...)
+		firstBlock, firstKey, partitionSize = position+1, lastKey, 0
+	}
+	return index, filter, partitions, nil
+}
+
+// checkBlockTableIntegrity is CheckIntegrity for block format tables, the Merkle tree leaves are the data blocks.
+func checkBlockTableIntegrity(table *tableHandle) (bool, []block_location.BlockLocation, bool, error) {
+	corruptDataBlocks := make([]block_location.BlockLocation, 0)
+	if err := table.loadBounds(); err != nil {
+		corruptDataBlocks = append(corruptDataBlocks, block_location.BlockLocation{
+			FilePath:   table.indexPath,
+			BlockIndex: table.indexOffset / BLOCK_SIZE,
+		})
+		return false, corruptDataBlocks, true, fmt.Errorf("failed to read block index: %v", err)
+	}
+
+	blocks := table.blocks
+	for partition := 0; table.partitioned() && partition < table.partitionCount(); partition++ {
+		partitionBlocks, err := table.partitionBlocks(partition)
+		if err != nil {
+			corruptDataBlocks = append(corruptDataBlocks, block_location.BlockLocation{
+				FilePath:   table.indexPath,
+				BlockIndex: table.indexOffset / BLOCK_SIZE,
+			})
+			return false, corruptDataBlocks, true, err
+		}
+		blocks = append(blocks, partitionBlocks...)
+	}
+
+	blockManager := block_manager.GetBlockManager()
+	blockHashes := make([][]byte, 0, len(blocks))
+	hashToOffset := make(map[[md5.Size]byte]uint64)
+	for position, handle := range blocks {
+		offset := physicalOffset(table.dataStart, handle.offset)
+		payload, _, err := blockManager.ReadFromDisk(table.dataPath, offset, handle.size)
+		if err != nil {
+			corruptDataBlocks = append(corruptDataBlocks, block_location.BlockLocation{
+				FilePath:   table.dataPath,
+				BlockIndex: offset / BLOCK_SIZE,
+			})
+			if isFatalReadError(err) {
+				return false, corruptDataBlocks, true, fmt.Errorf("failed to read data block %d: %v", position, err)
+			}
+		}
+		hash := md5.Sum(payload)
+		blockHashes = append(blockHashes, hash[:])
+		hashToOffset[hash] = offset
+	}
+
+	return validateMerkleTree(table.index, table.config, table.sizes, table.offsets, table.dataPath, blockHashes, hashToOffset, corruptDataBlocks)
+}
@@ -0,0 +1,119 @@
+package filter_policy
+
+import (
+	"fmt"
+	bloom_filter "hunddb/lsm/sstable/bloom_filter"
+	"hunddb/utils/registry"
+)
+
+// Filter answers whether an item may be in an SSTable. It never reports a present item as missing.
+type Filter interface {
+	Contains(item []byte) bool
+	Serialize() []byte
+}
+
+/*
+Policy builds the filters of SSTables. SSTables never change once written, so a filter is built
+once from every item of its table. Implementations must be safe for concurrent use.
+*/
+type Policy interface {
+	// ID identifies the policy on disk, it must never change once tables were written with it.
+	ID() uint8
+	// Name selects the policy through the bloom_filter.policy config keys.
+	Name() string
+	// Build creates a filter over items with the given false positive rate, items may repeat.
+	Build(items [][]byte, falsePositiveRate float64) Filter
+	Deserialize(data []byte) (Filter, error)
+}
+
+// IDs of the built-in policies, other policies should pick IDs from 64 up
+const (
+	BLOOM_ID         uint8 = 0 // Tables written before filter policies hold a Bloom filter
+	BLOCKED_BLOOM_ID uint8 = 1
+	XOR_ID           uint8 = 2
+)
+
+const (
+	Bloom        = "bloom"
+	BlockedBloom = "blocked_bloom"
+	Xor          = "xor"
+)
+
+var policies = registry.New[Policy]("filter_policy", "filter policy")
+
+/*
+Register makes a policy selectable by name through the bloom_filter.policy config keys, and readable
+in any table written with it. It is meant to be called from the init function of the package providing the policy,
+and panics if the policy is nil, its name is empty, or its ID or name are already registered.
+*/
+func Register(policy Policy) {
+	policies.Register(policy)
+}
+
+// ByID returns the policy a table's filter was built with.
+func ByID(id uint8) (Policy, error) {
+	return policies.ByID(id)
+}
+
+// ByName returns the policy selected in the config.
+func ByName(name string) (Policy, error) {
+	return policies.ByName(name)
+}
+
+// RegisteredNames returns the names of all registered policies, sorted.
+func RegisteredNames() []string {
+	return policies.Names()
+}
+
+// init registers the built-in policies
+func init() {
+	Register(bloomPolicy{})
+	Register(blockedBloomPolicy{})
+	Register(xorPolicy{})
+}
+
+// bloomPolicy builds the classic bloom_filter.BloomFilter, with k md5-based hash functions spread over the whole bit array.
+type bloomPolicy struct{}
+
+func (bloomPolicy) ID() uint8    { return BLOOM_ID }
+func (bloomPolicy) Name() string { return Bloom }
+
+func (bloomPolicy) Build(items [][]byte, falsePositiveRate float64) Filter {
+	filter := bloom_filter.NewBloomFilter(len(items), falsePositiveRate)
+	for _, item := range items {
+		filter.Add(item)
+	}
+	return filter
+}
+
+func (bloomPolicy) Deserialize(data []byte) (Filter, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("bloom filter of %d bytes is too short", len(data))
+	}
+	return bloom_filter.Deserialize(data), nil
+}
+
+// hash64 hashes an item with FNV-1a and scrambles it with the seed, so a new seed gives independent hashes.
+func hash64(item []byte, seed uint64) uint64 {
+	hash := uint64(14695981039346656037)
+	for _, b := range item {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+	return mix64(hash + seed)
+}
+
+// mix64 is the MurmurHash3 finalizer, every input bit affects every output bit.
+func mix64(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// reduce maps a hash onto [0, n) without a division.
+func reduce(hash uint32, n uint32) uint32 {
+	return uint32((uint64(hash) * uint64(n)) >> 32)
+}
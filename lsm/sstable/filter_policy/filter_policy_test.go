@@ -0,0 +1,111 @@
+package filter_policy
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testItems(prefix string, n int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("%s%06d", prefix, i))
+	}
+	return items
+}
+
+func TestPolicies_NoFalseNegativesAfterRoundTrip(t *testing.T) {
+	items := testItems("key_", 5000)
+	items = append(items, items[:100]...) // Prefixes of neighbouring keys repeat, the policies must cope
+	for _, name := range []string{Bloom, BlockedBloom, Xor} {
+		policy, err := ByName(name)
+		if err != nil {
+			t.Fatalf("ByName(%s): %v", name, err)
+		}
+		byID, err := ByID(policy.ID())
+		if err != nil || byID != policy {
+			t.Fatalf("ByID(%d) = %v, %v", policy.ID(), byID, err)
+		}
+
+		filter, err := policy.Deserialize(policy.Build(items, 0.01).Serialize())
+		if err != nil {
+			t.Fatalf("%s deserialize: %v", name, err)
+		}
+		for _, item := range items {
+			if !filter.Contains(item) {
+				t.Fatalf("%s lost %s", name, item)
+			}
+		}
+	}
+}
+
+func TestPolicies_FalsePositiveRate(t *testing.T) {
+	items := testItems("present_", 20000)
+	absent := testItems("absent_", 100000)
+	for _, name := range []string{Bloom, BlockedBloom, Xor} {
+		policy, _ := ByName(name)
+		for _, rate := range []float64{0.01, 0.001} {
+			filter := policy.Build(items, rate)
+			falsePositives := 0
+			for _, item := range absent {
+				if filter.Contains(item) {
+					falsePositives++
+				}
+			}
+			if measured := float64(falsePositives) / float64(len(absent)); measured > 2*rate {
+				t.Errorf("%s built for %v has a false positive rate of %v", name, rate, measured)
+			}
+		}
+	}
+}
+
+func TestXor_SmallerThanBloom(t *testing.T) {
+	items := testItems("key_", 10000)
+	bloom, _ := ByName(Bloom)
+	xor, _ := ByName(Xor)
+	bloomSize := len(bloom.Build(items, 0.001).Serialize())
+	xorSize := len(xor.Build(items, 0.001).Serialize())
+	if xorSize >= bloomSize {
+		t.Errorf("expected the xor filter to be smaller than the bloom filter, got %d >= %d bytes", xorSize, bloomSize)
+	}
+}
+
+func TestPolicies_EmptyAndCorrupt(t *testing.T) {
+	for _, name := range []string{Bloom, BlockedBloom, Xor} {
+		policy, _ := ByName(name)
+		filter, err := policy.Deserialize(policy.Build(nil, 0.01).Serialize())
+		if err != nil {
+			t.Fatalf("%s deserialize of an empty filter: %v", name, err)
+		}
+		filter.Contains([]byte("anything")) // Must not panic
+
+		if _, err := policy.Deserialize([]byte{1, 2}); err == nil {
+			t.Errorf("expected %s to reject a truncated filter", name)
+		}
+	}
+
+	blocked, _ := ByName(BlockedBloom)
+	data := blocked.Build(testItems("key_", 1000), 0.01).Serialize()
+	if _, err := blocked.Deserialize(data[:len(data)-8]); err == nil {
+		t.Error("expected a blocked bloom filter missing a word to be rejected")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	if _, err := ByName("ribbon"); err == nil {
+		t.Error("expected an unknown policy name to be reported")
+	}
+	if _, err := ByID(200); err == nil {
+		t.Error("expected an unknown policy ID to be reported")
+	}
+	names := RegisteredNames()
+	if len(names) < 3 || names[0] != BlockedBloom || names[1] != Bloom || names[2] != Xor {
+		t.Errorf("RegisteredNames() = %v", names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a taken ID to panic")
+		}
+	}()
+	Register(xorPolicy{})
+}
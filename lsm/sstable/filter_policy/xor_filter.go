@@ -0,0 +1,218 @@
+package filter_policy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+const (
+	MAX_XOR_FINGERPRINT_BITS = 32
+	// XOR_ATTEMPTS_PER_SIZE is the number of seeds tried before the table grows, a seed almost never fails twice
+	XOR_ATTEMPTS_PER_SIZE = 10
+)
+
+/*
+xorFilter is an Xor filter (Graf and Lemire): every item maps to three slots, one in each third of the table,
+and the fingerprints in those slots XOR to the fingerprint of the item. It can only be built from all items
+at once, which suits SSTables, and takes about 1.23 * f bits per item for a false positive rate of 2^-f,
+less than a Bloom filter for the same rate.
+
+Fingerprints are f bits wide, f being the smallest width reaching the requested rate, packed into 64-bit words.
+Serialized as:
+
+	+-----------+-------------------+-----------------------+--------------------+
+	| Seed (8B) | Block length (4B) | Fingerprint bits (1B) | Fingerprints (...) |
+	+-----------+-------------------+-----------------------+--------------------+
+*/
+type xorFilter struct {
+	seed         uint64
+	blockLength  uint32 // Slots in each third of the table
+	bits         uint8
+	fingerprints []uint64
+}
+
+type xorPolicy struct{}
+
+func (xorPolicy) ID() uint8    { return XOR_ID }
+func (xorPolicy) Name() string { return Xor }
+
+func (xorPolicy) Build(items [][]byte, falsePositiveRate float64) Filter {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		falsePositiveRate = 0.01
+	}
+	fingerprintBits := uint8(min(max(math.Ceil(-math.Log2(falsePositiveRate)), 1), MAX_XOR_FINGERPRINT_BITS))
+
+	// Repeated items have equal hashes and would never peel, one of each is enough
+	hashes := make([]uint64, len(items))
+	seed := uint64(0x9e3779b97f4a7c15)
+	for attempt := 0; ; attempt++ {
+		hashes = hashes[:len(items)]
+		for i, item := range items {
+			hashes[i] = hash64(item, seed)
+		}
+		slices.Sort(hashes)
+		unique := slices.Compact(hashes)
+
+		// A sparser table always peels in the end
+		overhead := 1.23 + 0.05*float64(attempt/XOR_ATTEMPTS_PER_SIZE)
+		filter := newXorFilter(seed, len(unique), fingerprintBits, overhead)
+		if filter.populate(unique) {
+			return filter
+		}
+		seed = mix64(seed + uint64(attempt) + 1)
+	}
+}
+
+func (xorPolicy) Deserialize(data []byte) (Filter, error) {
+	if len(data) < 13 {
+		return nil, fmt.Errorf("xor filter of %d bytes is too short", len(data))
+	}
+	filter := &xorFilter{
+		seed:        binary.LittleEndian.Uint64(data[0:8]),
+		blockLength: binary.LittleEndian.Uint32(data[8:12]),
+		bits:        data[12],
+	}
+	if filter.bits == 0 || filter.bits > MAX_XOR_FINGERPRINT_BITS || filter.blockLength == 0 {
+		return nil, fmt.Errorf("corrupt xor filter header")
+	}
+	words := filter.wordCount()
+	if uint64(len(data)-13) < words*8 {
+		return nil, fmt.Errorf("xor filter of %d slots doesn't fit in %d bytes", 3*filter.blockLength, len(data))
+	}
+	filter.fingerprints = make([]uint64, words)
+	for i := range filter.fingerprints {
+		filter.fingerprints[i] = binary.LittleEndian.Uint64(data[13+i*8:])
+	}
+	return filter, nil
+}
+
+func newXorFilter(seed uint64, itemCount int, fingerprintBits uint8, overhead float64) *xorFilter {
+	capacity := 32 + uint32(math.Ceil(overhead*float64(itemCount)))
+	filter := &xorFilter{
+		seed:        seed,
+		blockLength: capacity / 3,
+		bits:        fingerprintBits,
+	}
+	filter.fingerprints = make([]uint64, filter.wordCount())
+	return filter
+}
+
+func (filter *xorFilter) wordCount() uint64 {
+	return (3*uint64(filter.blockLength)*uint64(filter.bits) + 63) / 64
+}
+
+// slots returns the three slots of a hash, one in each third of the table.
+func (filter *xorFilter) slots(hash uint64) [3]uint32 {
+	return [3]uint32{
+		reduce(uint32(hash), filter.blockLength),
+		reduce(uint32(bits.RotateLeft64(hash, 21)), filter.blockLength) + filter.blockLength,
+		reduce(uint32(bits.RotateLeft64(hash, 42)), filter.blockLength) + 2*filter.blockLength,
+	}
+}
+
+func (filter *xorFilter) fingerprint(hash uint64) uint64 {
+	return (hash ^ hash>>32) & (1<<filter.bits - 1)
+}
+
+func (filter *xorFilter) get(slot uint32) uint64 {
+	bit := uint64(slot) * uint64(filter.bits)
+	word, shift := bit/64, bit%64
+	value := filter.fingerprints[word] >> shift
+	if shift+uint64(filter.bits) > 64 {
+		value |= filter.fingerprints[word+1] << (64 - shift)
+	}
+	return value & (1<<filter.bits - 1)
+}
+
+// set stores a fingerprint in a slot that is still empty.
+func (filter *xorFilter) set(slot uint32, value uint64) {
+	bit := uint64(slot) * uint64(filter.bits)
+	word, shift := bit/64, bit%64
+	filter.fingerprints[word] |= value << shift
+	if shift+uint64(filter.bits) > 64 {
+		filter.fingerprints[word+1] |= value >> (64 - shift)
+	}
+}
+
+/*
+populate peels the hashes off the table: a slot only one hash maps to is that hash's to set, removing the hash
+may leave other slots with a single hash. Fingerprints are then set in reverse peeling order, each hash's slot
+being set last among its three. Returns false if the hashes don't peel completely, a new seed is needed then.
+*/
+func (filter *xorFilter) populate(hashes []uint64) bool {
+	slotCount := 3 * filter.blockLength
+	counts := make([]uint32, slotCount)
+	xors := make([]uint64, slotCount) // XOR of the hashes mapping to the slot, the hash itself once one is left
+	for _, hash := range hashes {
+		for _, slot := range filter.slots(hash) {
+			counts[slot]++
+			xors[slot] ^= hash
+		}
+	}
+
+	queue := make([]uint32, 0, slotCount)
+	for slot, count := range counts {
+		if count == 1 {
+			queue = append(queue, uint32(slot))
+		}
+	}
+	type peeled struct {
+		hash uint64
+		slot uint32
+	}
+	stack := make([]peeled, 0, len(hashes))
+	for len(queue) > 0 {
+		slot := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if counts[slot] != 1 {
+			continue
+		}
+		hash := xors[slot]
+		stack = append(stack, peeled{hash: hash, slot: slot})
+		for _, other := range filter.slots(hash) {
+			counts[other]--
+			xors[other] ^= hash
+			if counts[other] == 1 {
+				queue = append(queue, other)
+			}
+		}
+	}
+	if len(stack) != len(hashes) {
+		return false
+	}
+
+	for i := len(stack) - 1; i >= 0; i-- {
+		entry := stack[i]
+		value := filter.fingerprint(entry.hash)
+		for _, other := range filter.slots(entry.hash) {
+			if other != entry.slot {
+				value ^= filter.get(other)
+			}
+		}
+		filter.set(entry.slot, value)
+	}
+	return true
+}
+
+func (filter *xorFilter) Contains(item []byte) bool {
+	hash := hash64(item, filter.seed)
+	value := filter.fingerprint(hash)
+	for _, slot := range filter.slots(hash) {
+		value ^= filter.get(slot)
+	}
+	return value == 0
+}
+
+func (filter *xorFilter) Serialize() []byte {
+	data := make([]byte, 13, 13+len(filter.fingerprints)*8)
+	binary.LittleEndian.PutUint64(data[0:8], filter.seed)
+	binary.LittleEndian.PutUint32(data[8:12], filter.blockLength)
+	data[12] = filter.bits
+	for _, word := range filter.fingerprints {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	return data
+}
@@ -0,0 +1,174 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	block_manager "hunddb/lsm/block_manager"
+	block_location "hunddb/model/block_location"
+	crc_util "hunddb/utils/crc"
+)
+
+const (
+	// TABLE_MAGIC closes the footer of every SSTable, "HUNDDBST" read as little endian
+	TABLE_MAGIC uint64 = 0x54534244444e5548
+
+	// FOOTER_VERSION_1 is the first footer layout, tables written before it have no footer at all
+	FOOTER_VERSION_1 = 1
+	// FOOTER_VERSION_2 adds the handle of the Properties component
+	FOOTER_VERSION_2 = 2
+	FOOTER_VERSION   = FOOTER_VERSION_2
+
+	// CHECKSUM_TYPE_CRC32 is a CRC32 (IEEE) at the start of every block
+	CHECKSUM_TYPE_CRC32 = 1
+
+	COMPONENT_COUNT = 5
+
+	FOOTER_MAGIC_SIZE   = 8
+	FOOTER_VERSION_SIZE = 4
+)
+
+/*
+Every SSTable ends with a footer, the last block of sstable_{index}.db. It follows the Config block in separate file
+mode and the Metadata component in single file mode, so it is written only once the table is complete.
+
+The magic number and the footer version sit at the very end of the block, so a reader can tell a footer from
+any other block and pick the decoder before looking at the rest. Version 2 (without the CRC):
+
+	+--------------------------------+-----+--------------------+-------------------+-------------------------------+-----+--------------------+------------+
+	| Component 0 Offset, Size (16B) | ... | FormatVersion (1B) | ChecksumType (1B) | Properties Offset, Size (16B) | ... | FooterVersion (4B) | Magic (8B) |
+	+--------------------------------+-----+--------------------+-------------------+-------------------------------+-----+--------------------+------------+
+
+The component handles are in Data, Index, Summary, Filter, Metadata order. In separate file mode the offsets are 0,
+as each component starts its own file. The Properties component is always in sstable_{index}.db, right before the footer.
+Version 1 footers end with the ChecksumType, their tables have no properties.
+
+Tables written before footers keep the handles in their Config block and are still read through it.
+Compaction always writes a footer, so they get upgraded as they are merged.
+*/
+type tableFooter struct {
+	version       uint32
+	formatVersion uint8
+	checksumType  uint8
+	sizes         []uint64
+	offsets       []uint64
+
+	propertiesOffset uint64
+	propertiesSize   uint64 // 0 when the table has no properties
+}
+
+// serialize encodes the footer into a block in the current footer version.
+func (footer *tableFooter) serialize() []byte {
+	data := make([]byte, BLOCK_SIZE)
+
+	position := CRC_SIZE
+	for i := 0; i < COMPONENT_COUNT; i++ {
+		binary.LittleEndian.PutUint64(data[position:], footer.offsets[i])
+		binary.LittleEndian.PutUint64(data[position+STANDARD_FLAG_SIZE:], footer.sizes[i])
+		position += 2 * STANDARD_FLAG_SIZE
+	}
+	data[position] = footer.formatVersion
+	data[position+1] = footer.checksumType
+	binary.LittleEndian.PutUint64(data[position+2:], footer.propertiesOffset)
+	binary.LittleEndian.PutUint64(data[position+2+STANDARD_FLAG_SIZE:], footer.propertiesSize)
+
+	binary.LittleEndian.PutUint32(data[BLOCK_SIZE-FOOTER_MAGIC_SIZE-FOOTER_VERSION_SIZE:], FOOTER_VERSION)
+	binary.LittleEndian.PutUint64(data[BLOCK_SIZE-FOOTER_MAGIC_SIZE:], TABLE_MAGIC)
+
+	return crc_util.AddCRCToBlockData(data)
+}
+
+// decodeFooter decodes the fields of a version 1 or 2 footer, its CRC is already checked.
+func decodeFooter(data []byte, version uint32) (*tableFooter, error) {
+	footer := &tableFooter{
+		version: version,
+		sizes:   make([]uint64, COMPONENT_COUNT),
+		offsets: make([]uint64, COMPONENT_COUNT),
+	}
+
+	position := CRC_SIZE
+	for i := 0; i < COMPONENT_COUNT; i++ {
+		footer.offsets[i] = binary.LittleEndian.Uint64(data[position:])
+		footer.sizes[i] = binary.LittleEndian.Uint64(data[position+STANDARD_FLAG_SIZE:])
+		position += 2 * STANDARD_FLAG_SIZE
+	}
+	footer.formatVersion = data[position]
+	footer.checksumType = data[position+1]
+	if version >= FOOTER_VERSION_2 {
+		footer.propertiesOffset = binary.LittleEndian.Uint64(data[position+2:])
+		footer.propertiesSize = binary.LittleEndian.Uint64(data[position+2+STANDARD_FLAG_SIZE:])
+	}
+
+	if footer.checksumType != CHECKSUM_TYPE_CRC32 {
+		return nil, fmt.Errorf("unsupported checksum type %d", footer.checksumType)
+	}
+	if footer.formatVersion != FORMAT_VERSION_RECORDS && footer.formatVersion != FORMAT_VERSION_BLOCKS {
+		return nil, fmt.Errorf("unsupported format version %d", footer.formatVersion)
+	}
+	return footer, nil
+}
+
+/*
+readFooter reads the footer of the SSTable from the last block of its base file.
+
+Returns false without an error for tables written before footers, the caller falls back to the Config block then.
+*/
+func readFooter(index int) (*tableFooter, bool, error) {
+	blockManager := block_manager.GetBlockManager()
+	filePath := fmt.Sprintf(FILE_NAME_FORMAT, index)
+
+	blockCount, err := blockManager.BlockCount(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	if blockCount < 2 {
+		return nil, false, nil // Only the Config block, a separate file table written before footers
+	}
+
+	data, err := blockManager.ReadBlock(block_location.BlockLocation{FilePath: filePath, BlockIndex: blockCount - 1})
+	if err != nil {
+		return nil, false, err
+	}
+	if binary.LittleEndian.Uint64(data[BLOCK_SIZE-FOOTER_MAGIC_SIZE:]) != TABLE_MAGIC {
+		return nil, false, nil
+	}
+	if err := crc_util.CheckBlockIntegrity(data); err != nil {
+		return nil, true, fmt.Errorf("failed to verify footer integrity: %v", err)
+	}
+
+	version := binary.LittleEndian.Uint32(data[BLOCK_SIZE-FOOTER_MAGIC_SIZE-FOOTER_VERSION_SIZE:])
+	switch version {
+	case FOOTER_VERSION_1, FOOTER_VERSION_2:
+		footer, err := decodeFooter(data, version)
+		return footer, true, err
+	default:
+		return nil, true, fmt.Errorf("unsupported footer version %d", version)
+	}
+}
+
+/*
+writeFooter closes the SSTable with its properties and its footer, holding the sizes and offsets of the components.
+Must be called once every component is written, as both are appended after the last block of the base file at filePath.
+*/
+func (config *SSTableConfig) writeFooter(sizes []uint64, offsets []uint64, properties *TableProperties, filePath string) error {
+	blockManager := block_manager.GetBlockManager()
+
+	footer := &tableFooter{
+		version:       FOOTER_VERSION,
+		formatVersion: config.FormatVersion,
+		checksumType:  CHECKSUM_TYPE_CRC32,
+		sizes:         sizes,
+		offsets:       offsets,
+	}
+	if properties != nil {
+		var err error
+		if footer.propertiesOffset, footer.propertiesSize, err = writeProperties(properties, filePath); err != nil {
+			return err
+		}
+	}
+
+	blockCount, err := blockManager.BlockCount(filePath)
+	if err != nil {
+		return err
+	}
+	return blockManager.WriteToDisk(footer.serialize(), filePath, blockCount*BLOCK_SIZE)
+}
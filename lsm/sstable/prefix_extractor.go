@@ -0,0 +1,140 @@
+package sstable
+
+import (
+	"fmt"
+	"strings"
+
+	filter_policy "hunddb/lsm/sstable/filter_policy"
+)
+
+// PrefixExtractorKind tells which key prefixes go into a table's filter for prefix scans.
+type PrefixExtractorKind uint8
+
+const (
+	// Every prefix up to a length, what tables written before prefix extractors hold (up to 10 characters).
+	// Only inferred for those tables, new tables can't be written with it
+	PREFIX_EXTRACTOR_CAPPED PrefixExtractorKind = 0
+	// The first Length bytes, keys shorter than that have no prefix
+	PREFIX_EXTRACTOR_FIXED PrefixExtractorKind = 1
+	// Everything up to and including the first Delimiter, keys without it have no prefix
+	PREFIX_EXTRACTOR_DELIMITER PrefixExtractorKind = 2
+	// No prefixes, the filter only answers point lookups
+	PREFIX_EXTRACTOR_NONE PrefixExtractorKind = 3
+
+	// LEGACY_PREFIX_LENGTH is the length of the capped prefixes tables written before prefix extractors hold
+	LEGACY_PREFIX_LENGTH = 10
+)
+
+func (kind PrefixExtractorKind) String() string {
+	switch kind {
+	case PREFIX_EXTRACTOR_CAPPED:
+		return "capped"
+	case PREFIX_EXTRACTOR_FIXED:
+		return "fixed"
+	case PREFIX_EXTRACTOR_DELIMITER:
+		return "delimiter"
+	case PREFIX_EXTRACTOR_NONE:
+		return "none"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+PrefixExtractor picks the prefixes of the keys a table's filter holds, so that a prefix scan can skip tables
+without a key starting with the prefix. Each prefix costs the filter an item, so one prefix per key matching
+the key schema (say "user:" for "user:42:name") keeps the filter close to the size it has for point lookups alone.
+
+A scan prefix the extractor can't map to a filter prefix, one shorter than Length or without the Delimiter,
+can't skip any table.
+*/
+type PrefixExtractor struct {
+	Kind      PrefixExtractorKind
+	Length    uint64 // Capped and fixed extractors only
+	Delimiter byte   // Delimiter extractor only
+}
+
+// newPrefixExtractor creates the extractor selected in the config for new tables.
+func newPrefixExtractor(kind string, length uint64, delimiter string) (PrefixExtractor, error) {
+	switch kind {
+	case "fixed":
+		return PrefixExtractor{Kind: PREFIX_EXTRACTOR_FIXED, Length: length}, nil
+	case "delimiter":
+		if len(delimiter) != 1 {
+			return PrefixExtractor{}, fmt.Errorf("prefix delimiter %q is not a single byte", delimiter)
+		}
+		return PrefixExtractor{Kind: PREFIX_EXTRACTOR_DELIMITER, Delimiter: delimiter[0]}, nil
+	case "none":
+		return PrefixExtractor{Kind: PREFIX_EXTRACTOR_NONE}, nil
+	default:
+		return PrefixExtractor{}, fmt.Errorf("unknown prefix extractor %q", kind)
+	}
+}
+
+func (extractor PrefixExtractor) String() string {
+	switch extractor.Kind {
+	case PREFIX_EXTRACTOR_CAPPED, PREFIX_EXTRACTOR_FIXED:
+		return fmt.Sprintf("%s:%d", extractor.Kind, extractor.Length)
+	case PREFIX_EXTRACTOR_DELIMITER:
+		return fmt.Sprintf("%s:%c", extractor.Kind, extractor.Delimiter)
+	default:
+		return extractor.Kind.String()
+	}
+}
+
+// extract returns the single prefix of a key for fixed and delimiter extractors, false if the key has none.
+func (extractor PrefixExtractor) extract(key string) (string, bool) {
+	switch extractor.Kind {
+	case PREFIX_EXTRACTOR_FIXED:
+		if uint64(len(key)) < extractor.Length {
+			return "", false
+		}
+		return key[:extractor.Length], true
+	case PREFIX_EXTRACTOR_DELIMITER:
+		end := strings.IndexByte(key, extractor.Delimiter)
+		if end < 0 {
+			return "", false
+		}
+		return key[:end+1], true
+	default:
+		return "", false
+	}
+}
+
+// appendPrefixes appends the marked prefixes of key to the filter items. Keys come sorted,
+// so prefixes shared with the previous key are in already.
+func (extractor PrefixExtractor) appendPrefixes(items [][]byte, key string, previousKey string) [][]byte {
+	if extractor.Kind == PREFIX_EXTRACTOR_CAPPED {
+		maxPrefixLen := min(uint64(len(key)), extractor.Length)
+		for prefixLen := uint64(sharedPrefixLength(previousKey, key)) + 1; prefixLen <= maxPrefixLen; prefixLen++ {
+			items = append(items, []byte(prependPrefixPrefix(key[:prefixLen])))
+		}
+		return items
+	}
+	prefix, ok := extractor.extract(key)
+	if !ok {
+		return items
+	}
+	if previousPrefix, ok := extractor.extract(previousKey); ok && previousPrefix == prefix {
+		return items
+	}
+	return append(items, []byte(prependPrefixPrefix(prefix)))
+}
+
+// mayContainPrefix checks the filter for the prefixes a key starting with prefix would have put in it.
+func (extractor PrefixExtractor) mayContainPrefix(filter filter_policy.Filter, prefix string) bool {
+	if extractor.Kind == PREFIX_EXTRACTOR_CAPPED {
+		maxPrefixLen := min(uint64(len(prefix)), extractor.Length)
+		for prefixLen := uint64(1); prefixLen <= maxPrefixLen; prefixLen++ {
+			if !filter.Contains([]byte(prependPrefixPrefix(prefix[:prefixLen]))) {
+				return false
+			}
+		}
+		return true
+	}
+	filterPrefix, ok := extractor.extract(prefix)
+	if !ok {
+		return true
+	}
+	return filter.Contains([]byte(prependPrefixPrefix(filterPrefix)))
+}
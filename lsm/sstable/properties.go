@@ -0,0 +1,183 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	block_manager "hunddb/lsm/block_manager"
+	block_codec "hunddb/lsm/sstable/block_codec"
+	filter_policy "hunddb/lsm/sstable/filter_policy"
+	record "hunddb/model/record"
+	byte_util "hunddb/utils/byte_util"
+)
+
+// CreationReason tells why an SSTable was written.
+type CreationReason uint8
+
+const (
+	CREATION_REASON_FLUSH      CreationReason = 1
+	CREATION_REASON_COMPACTION CreationReason = 2
+	CREATION_REASON_INGESTION  CreationReason = 3 // Built outside of the database by a Writer
+
+	// SOURCE_LEVEL_MEMTABLE is the source level of flushed tables, their records come from memtables
+	SOURCE_LEVEL_MEMTABLE = -1
+	// SOURCE_LEVEL_EXTERNAL is the source level of tables built by a Writer
+	SOURCE_LEVEL_EXTERNAL = -2
+)
+
+func (reason CreationReason) String() string {
+	switch reason {
+	case CREATION_REASON_FLUSH:
+		return "flush"
+	case CREATION_REASON_COMPACTION:
+		return "compaction"
+	case CREATION_REASON_INGESTION:
+		return "ingestion"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+TableProperties are the statistics of an SSTable, collected while it is written and stored in its
+Properties component, just before the footer in sstable_{index}.db.
+
+Tables written before properties existed have none, GetProperties returns nil for them.
+*/
+type TableProperties struct {
+	RecordCount    uint64
+	TombstoneCount uint64
+	RawKeyBytes    uint64 // Keys and values as given, before dictionary, prefix or block compression
+	RawValueBytes  uint64
+	MinTimestamp   uint64
+	MaxTimestamp   uint64
+
+	CreationReason CreationReason
+	SourceLevel    int   // Level the input tables came from, SOURCE_LEVEL_MEMTABLE for flushes, SOURCE_LEVEL_EXTERNAL for Writer tables
+	InputTables    []int // Indexes of the compacted tables, empty for flushes
+
+	FormatVersion    uint8
+	KeyDictionary    bool   // Keys were swapped for global dictionary IDs
+	BlockCompression string // Name of the codec the data blocks were compressed with
+	FilterPolicy     string // Name of the filter policy, empty for tables written before filter policies
+}
+
+// newTableProperties starts the properties of a table about to be written with the config.
+func newTableProperties(config *SSTableConfig, reason CreationReason, sourceLevel int, inputTables []int) *TableProperties {
+	properties := &TableProperties{
+		CreationReason:   reason,
+		SourceLevel:      sourceLevel,
+		InputTables:      inputTables,
+		FormatVersion:    config.FormatVersion,
+		KeyDictionary:    config.CompressionEnabled,
+		BlockCompression: block_codec.None,
+	}
+	if codec, err := block_codec.ByID(config.BlockCodec); err == nil {
+		properties.BlockCompression = codec.Name()
+	}
+	if policy, err := filter_policy.ByID(config.FilterPolicy); err == nil {
+		properties.FilterPolicy = policy.Name()
+	}
+	return properties
+}
+
+// add accounts for a record written to the table.
+func (properties *TableProperties) add(rec *record.Record) {
+	if properties.RecordCount == 0 || rec.Timestamp < properties.MinTimestamp {
+		properties.MinTimestamp = rec.Timestamp
+	}
+	if rec.Timestamp > properties.MaxTimestamp {
+		properties.MaxTimestamp = rec.Timestamp
+	}
+	properties.RecordCount++
+	if rec.Tombstone {
+		properties.TombstoneCount++
+	}
+	properties.RawKeyBytes += uint64(len(rec.Key))
+	properties.RawValueBytes += uint64(len(rec.Value))
+}
+
+// TombstoneRatio returns the share of the records that are tombstones.
+func (properties *TableProperties) TombstoneRatio() float64 {
+	if properties == nil || properties.RecordCount == 0 {
+		return 0
+	}
+	return float64(properties.TombstoneCount) / float64(properties.RecordCount)
+}
+
+func (properties *TableProperties) serialize() []byte {
+	data := binary.AppendUvarint(nil, properties.RecordCount)
+	data = binary.AppendUvarint(data, properties.TombstoneCount)
+	data = binary.AppendUvarint(data, properties.RawKeyBytes)
+	data = binary.AppendUvarint(data, properties.RawValueBytes)
+	data = binary.AppendUvarint(data, properties.MinTimestamp)
+	data = binary.AppendUvarint(data, properties.MaxTimestamp)
+	data = append(data, byte(properties.CreationReason))
+	data = binary.AppendVarint(data, int64(properties.SourceLevel))
+	data = binary.AppendUvarint(data, uint64(len(properties.InputTables)))
+	for _, input := range properties.InputTables {
+		data = binary.AppendUvarint(data, uint64(input))
+	}
+	data = append(data, properties.FormatVersion, byte_util.BoolToByte(properties.KeyDictionary))
+	data = binary.AppendUvarint(data, uint64(len(properties.BlockCompression)))
+	data = append(data, properties.BlockCompression...)
+	data = binary.AppendUvarint(data, uint64(len(properties.FilterPolicy)))
+	return append(data, properties.FilterPolicy...)
+}
+
+func deserializeTableProperties(data []byte) (*TableProperties, error) {
+	reader := &varintReader{data: data}
+	properties := &TableProperties{
+		RecordCount:    reader.uvarint(),
+		TombstoneCount: reader.uvarint(),
+		RawKeyBytes:    reader.uvarint(),
+		RawValueBytes:  reader.uvarint(),
+		MinTimestamp:   reader.uvarint(),
+		MaxTimestamp:   reader.uvarint(),
+	}
+	properties.CreationReason = CreationReason(reader.byte())
+	properties.SourceLevel = int(reader.varint())
+	inputCount := reader.uvarint()
+	properties.InputTables = make([]int, 0, min(inputCount, uint64(len(data))))
+	for i := uint64(0); i < inputCount && reader.err == nil; i++ {
+		properties.InputTables = append(properties.InputTables, int(reader.uvarint()))
+	}
+	properties.FormatVersion = reader.byte()
+	properties.KeyDictionary = byte_util.ByteToBool(reader.byte())
+	properties.BlockCompression = reader.string()
+	if reader.err == nil && len(reader.data) > 0 {
+		properties.FilterPolicy = reader.string() // Missing in properties written before filter policies
+	}
+	if reader.err != nil {
+		return nil, fmt.Errorf("corrupt table properties: %v", reader.err)
+	}
+	return properties, nil
+}
+
+// writeProperties appends the Properties component to the base file at filePath, returning its offset and size.
+func writeProperties(properties *TableProperties, filePath string) (uint64, uint64, error) {
+	blockCount, err := block_manager.GetBlockManager().BlockCount(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset := blockCount * BLOCK_SIZE
+	size, _, err := writeComponent(properties.serialize(), filePath, offset, false)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to write properties: %v", err)
+	}
+	return offset, size, nil
+}
+
+/*
+GetProperties returns the properties of the SSTable with the given index,
+or nil if it was written before tables had properties.
+*/
+func GetProperties(index int) (*TableProperties, error) {
+	table, err := openTable(index)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.loadProperties(); err != nil {
+		return nil, err
+	}
+	return table.properties, nil
+}
@@ -6,7 +6,8 @@ import (
 	"errors"
 	"fmt"
 	block_manager "hunddb/lsm/block_manager"
-	bloom_filter "hunddb/lsm/sstable/bloom_filter"
+	block_codec "hunddb/lsm/sstable/block_codec"
+	filter_policy "hunddb/lsm/sstable/filter_policy"
 	merkle_tree "hunddb/lsm/sstable/merkle_tree"
 	block_location "hunddb/model/block_location"
 	record "hunddb/model/record"
@@ -15,6 +16,7 @@ import (
 	crc_util "hunddb/utils/crc"
 	string_util "hunddb/utils/string_util"
 	"io"
+	"math"
 	"os"
 	"strings"
 )
@@ -36,6 +38,19 @@ var (
 	BLOCK_SIZE          uint64
 	USE_SEPARATE_FILES  bool
 	SPARSE_STEP_INDEX   uint64 // Every 10th index goes into the summary
+
+	// Filters of the tables in every level but the bottom one
+	FILTER_POLICY              string
+	FILTER_FALSE_POSITIVE_RATE float64
+	// Filters of the bottom level tables, which hold most of the data, so every lookup that misses ends up probing them
+	BOTTOM_LEVEL_FILTER_POLICY              string
+	BOTTOM_LEVEL_FILTER_FALSE_POSITIVE_RATE float64
+	BOTTOM_LEVEL                            int
+
+	// Key prefixes the filters hold for prefix scans, see PrefixExtractor
+	PREFIX_EXTRACTOR string
+	PREFIX_LENGTH    uint64
+	PREFIX_DELIMITER string
 )
 
 // init loads SSTable configuration from config file
@@ -46,6 +61,14 @@ func init() {
 		BLOCK_SIZE = uint64(cfg.BlockManager.BlockSize)
 		USE_SEPARATE_FILES = cfg.SSTable.UseSeparateFiles
 		SPARSE_STEP_INDEX = cfg.SSTable.SparseStepIndex
+		FILTER_POLICY = cfg.BloomFilter.Policy
+		FILTER_FALSE_POSITIVE_RATE = cfg.BloomFilter.FalsePositiveRate
+		BOTTOM_LEVEL_FILTER_POLICY = cfg.BloomFilter.BottomLevelPolicy
+		BOTTOM_LEVEL_FILTER_FALSE_POSITIVE_RATE = cfg.BloomFilter.BottomLevelFalsePositiveRate
+		BOTTOM_LEVEL = int(cfg.LSM.MaxLevels) - 1
+		PREFIX_EXTRACTOR = cfg.BloomFilter.PrefixExtractor
+		PREFIX_LENGTH = cfg.BloomFilter.PrefixLength
+		PREFIX_DELIMITER = cfg.BloomFilter.PrefixDelimiter
 	}
 }
 
@@ -59,12 +82,20 @@ const (
 
 	CRC_SIZE = 4
 
+	// The format version follows the UseSeparateFiles, CompressionEnabled and SparseStepIndex fields
+	// and the five component (size, offset) pairs
+	CONFIG_FORMAT_VERSION_OFFSET = CRC_SIZE + 1 + 1 + 8 + 5*2*STANDARD_FLAG_SIZE
+	CONFIG_BLOCK_CODEC_OFFSET    = CONFIG_FORMAT_VERSION_OFFSET + 1
+	CONFIG_FILTER_POLICY_OFFSET  = CONFIG_BLOCK_CODEC_OFFSET + 1
+	CONFIG_FILTER_RATE_OFFSET    = CONFIG_FILTER_POLICY_OFFSET + 1
+	// The prefix extractor kind (1B), length (8B) and delimiter (1B)
+	CONFIG_PREFIX_EXTRACTOR_OFFSET     = CONFIG_FILTER_RATE_OFFSET + 8
+	CONFIG_INDEX_PARTITION_SIZE_OFFSET = CONFIG_PREFIX_EXTRACTOR_OFFSET + 10
+
 	INDEX_ENTRY_METADATA_SIZE = 24
 	INDEX_ENTRY_PART_SIZE     = 8
 
 	STANDARD_FLAG_SIZE = 8
-
-	BLOOM_FILTER_FALSE_POSITIVE_RATE = 0.01
 )
 
 // SSTable is an on-disk immutable key-value storage structure.
@@ -88,7 +119,7 @@ type SSTable struct {
 	// Summary component (speeds up index access)
 	SummaryComp *SummaryComp
 
-	// Filter component (Bloom filter to avoid unnecessary disk reads)
+	// Filter component (filter_policy.Filter to avoid unnecessary disk reads)
 	FilterComp *FilterComp
 
 	// Metadata component (Merkle tree for integrity verification)
@@ -134,8 +165,8 @@ type SSTableConfig struct {
 		| Config  |  Data  | IndexComp | ...
 		+---------+--------+-----------+------
 
-		In case of a single file storage, we will add positional and size info to Config part,
-		for each component, to allow for easier access.
+		The positional and size info of each component goes into the footer, the last block
+		of sstable_{index}.db, to allow for easier access (see tableFooter).
 
 		In case of seperate file storage, we will add a size flag at the beginning of the bytes
 		of each serialized component, to help with deserialization (avoid the padding).
@@ -152,6 +183,39 @@ type SSTableConfig struct {
 		Chosen by user.
 	*/
 	SparseStepIndex uint64
+
+	/*
+		Layout of the Data, Index and Summary components, one of the FORMAT_VERSION_* constants.
+		Tables written before format versions existed read as FORMAT_VERSION_RECORDS.
+	*/
+	FormatVersion uint8
+
+	/*
+		ID of the block_codec.Codec the data blocks are compressed with, block format only.
+		Chosen by user, through its name.
+	*/
+	BlockCodec uint8
+
+	/*
+		ID of the filter_policy.Policy the Filter component was built with, and the false positive rate it was built for.
+		Both depend on the level the table was written for. Tables written before filter policies hold
+		a Bloom filter (ID 0) built for an unknown rate (0).
+	*/
+	FilterPolicy            uint8
+	FilterFalsePositiveRate float64
+
+	/*
+		Picks the key prefixes the Filter component holds for prefix scans.
+		Chosen by user. Tables written before prefix extractors hold every prefix up to 10 characters.
+	*/
+	PrefixExtractor PrefixExtractor
+
+	/*
+		Block format only: the block index and the filter are split into partitions of about this many bytes
+		of index, located by a top-level index in the Summary component, see indexPartition.
+		0 for a whole block index and filter. Depends on the level the table was written for.
+	*/
+	IndexPartitionSize uint64
 }
 
 // DataComp handles the actual key-value data storage.
@@ -272,7 +336,7 @@ type SummaryComp struct {
 	IndexEntries []IndexEntry
 }
 
-// FilterComp utilizes a BloomFilter for the SSTable.
+// FilterComp utilizes a filter_policy.Filter for the SSTable.
 type FilterComp struct {
 
 	/*
@@ -291,9 +355,9 @@ type FilterComp struct {
 	StartOffset uint64
 
 	/*
-		BloomFilter for the SSTable to avoid searching for non-existent keys.
+		Filter for the SSTable to avoid searching for non-existent keys.
 	*/
-	BloomFilter *bloom_filter.BloomFilter
+	Filter filter_policy.Filter
 }
 
 // MetadataComp utilizes a MerkleTree for the SSTable.
@@ -331,6 +395,7 @@ type SSTableIterator struct {
 	compressionEnabled bool
 	hasNextRecord      bool
 	currentRecord      *record.Record
+	blocks             *blockTableIterator // Block format tables only, the record offsets above are unused then
 }
 
 // CompactionState tracks the state during compaction (memory-efficient)
@@ -348,39 +413,33 @@ type CompactionState struct {
 	dataPhysicalBase uint64
 	// wroteSizePrefix indicates whether we've already emitted the size prefix (separate-files mode only)
 	wroteSizePrefix bool
+	// properties collects the statistics of the records written
+	properties *TableProperties
+	// keepTombstones is set unless the new table goes to the bottom level
+	keepTombstones bool
 }
 
 // initializeIterator creates and initializes an SSTable iterator
-func initializeIterator(tableIndex int, config *SSTableConfig, sizes []uint64, offsets []uint64) (*SSTableIterator, error) {
-	var dataPath string
-	var dataOffset uint64
-
-	if config.UseSeparateFiles {
-		dataPath = fmt.Sprintf(DATA_FILE_NAME_FORMAT, tableIndex)
-		dataOffset = CRC_SIZE + STANDARD_FLAG_SIZE
-	} else {
-		dataPath = fmt.Sprintf(FILE_NAME_FORMAT, tableIndex)
-		dataOffset = offsets[0] + CRC_SIZE
-	}
-
-	// Get max record index using checkIndexBounds
-	var indexPath string
-	var indexFileOffset uint64
-	if config.UseSeparateFiles {
-		indexPath = fmt.Sprintf(INDEX_FILE_NAME_FORMAT, tableIndex)
-		indexFileOffset = CRC_SIZE + STANDARD_FLAG_SIZE
-	} else {
-		indexPath = fmt.Sprintf(FILE_NAME_FORMAT, tableIndex)
-		indexFileOffset = offsets[1] + CRC_SIZE
-	}
-
-	// Use a very high sentinel key to avoid early-out and still compute last index entry
-	// We only need indexOfLastIndexEntry from the return values here.
-	highKey := string([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
-	_, _, _, _, maxRecordIndex, err := checkIndexBounds(indexPath, indexFileOffset, highKey, config.SparseStepIndex)
-	if err != nil {
+func initializeIterator(table *tableHandle) (*SSTableIterator, error) {
+	tableIndex := table.index
+	dataPath, dataOffset := table.dataPath, table.dataOffset
+	if err := table.loadBounds(); err != nil {
 		return nil, fmt.Errorf("failed to check index bounds for table %d: %v", tableIndex, err)
 	}
+	if table.config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		blocks := newBlockTableIterator(table)
+		if err := blocks.next(); err != nil {
+			return nil, fmt.Errorf("failed to load first record for table %d: %v", tableIndex, err)
+		}
+		return &SSTableIterator{
+			index:         tableIndex,
+			filePath:      dataPath,
+			hasNextRecord: blocks.current != nil,
+			currentRecord: blocks.current,
+			blocks:        blocks,
+		}, nil
+	}
+	maxRecordIndex := table.lastIndexEntry
 
 	iterator := &SSTableIterator{
 		index:              tableIndex,
@@ -389,12 +448,12 @@ func initializeIterator(tableIndex int, config *SSTableConfig, sizes []uint64, o
 		currentOffset:      dataOffset,
 		recordIndex:        0,
 		maxRecordIndex:     maxRecordIndex,
-		compressionEnabled: config.CompressionEnabled,
+		compressionEnabled: table.config.CompressionEnabled,
 		hasNextRecord:      true,
 	}
 
 	// Load first record
-	err = iterator.loadNextRecord()
+	err := iterator.loadNextRecord()
 	if err != nil {
 		return nil, fmt.Errorf("failed to load first record for table %d: %v", tableIndex, err)
 	}
@@ -404,6 +463,13 @@ func initializeIterator(tableIndex int, config *SSTableConfig, sizes []uint64, o
 
 // loadNextRecord loads the next record from the iterator's SSTable
 func (iter *SSTableIterator) loadNextRecord() error {
+	if iter.blocks != nil {
+		err := iter.blocks.next()
+		iter.currentRecord = iter.blocks.current
+		iter.hasNextRecord = iter.currentRecord != nil
+		return err
+	}
+
 	if iter.recordIndex > iter.maxRecordIndex {
 		iter.hasNextRecord = false
 		iter.currentRecord = nil
@@ -464,12 +530,24 @@ due to increased size, so we work block by block there.
 func PersistMemtable(sortedRecords []record.Record, index int) error {
 
 	blockManager := block_manager.GetBlockManager()
+	// A retried flush rewrites the same index, drop whatever was cached for it
+	evictTables(index)
 
-	// 1. Persist SSTableConfig
-	SSTableConfig := &SSTableConfig{
-		UseSeparateFiles:   USE_SEPARATE_FILES,
-		CompressionEnabled: COMPRESSION_ENABLED,
-		SparseStepIndex:    uint64(SPARSE_STEP_INDEX),
+	// 1. Persist SSTableConfig, flushed tables go to level 0
+	SSTableConfig, err := newSSTableConfig(0)
+	if err != nil {
+		return err
+	}
+	properties := newTableProperties(SSTableConfig, CREATION_REASON_FLUSH, SOURCE_LEVEL_MEMTABLE, nil)
+	if SSTableConfig.FormatVersion == FORMAT_VERSION_BLOCKS {
+		next := 0
+		return writeBlockTable(index, SSTableConfig, properties, func() (*record.Record, error) {
+			if next == len(sortedRecords) {
+				return nil, nil
+			}
+			next++
+			return &sortedRecords[next-1], nil
+		})
 	}
 
 	serializedConfig, configSize, err := SSTableConfig.serialize()
@@ -564,29 +642,19 @@ func PersistMemtable(sortedRecords []record.Record, index int) error {
 		filterStartOffset = 0
 	}
 
-	bloomFilter := bloom_filter.NewBloomFilter(len(sortedRecords), BLOOM_FILTER_FALSE_POSITIVE_RATE)
-	for _, rec := range sortedRecords {
-		bloomFilter.Add([]byte(rec.Key))
-
-		// Add all prefixes of length 1 to 10 (or maximum key length) with a special prefix marker
-		keyLen := len(rec.Key)
-		maxPrefixLen := 10
-		if keyLen < maxPrefixLen {
-			maxPrefixLen = keyLen
-		}
-
-		for prefixLen := 1; prefixLen <= maxPrefixLen; prefixLen++ {
-			prefix := rec.Key[:prefixLen]
-			prefixWithMarker := prependPrefixPrefix(prefix)
-			bloomFilter.Add([]byte(prefixWithMarker))
-		}
+	keys := make([]string, len(sortedRecords))
+	for i, rec := range sortedRecords {
+		keys[i] = rec.Key
+	}
+	filter, err := SSTableConfig.buildFilter(keys)
+	if err != nil {
+		return err
 	}
-	bloomFilter.Add([]byte(prependPrefixPrefix("")))
 
 	filterComp := &FilterComp{
 		FilePath:    filterFilePath,
 		StartOffset: filterStartOffset,
-		BloomFilter: bloomFilter,
+		Filter:      filter,
 	}
 
 	serializedFilter, filterSize, err := filterComp.serialize()
@@ -627,22 +695,95 @@ func PersistMemtable(sortedRecords []record.Record, index int) error {
 
 	sizes := []uint64{dataSize, indexSize, summarySize, filterSize, metadataSize}
 	offsets := []uint64{dataStartOffset, indexStartOffset, summaryStartOffset, filterStartOffset, metaDataStartOffset}
-	err = SSTableConfig.addSizeDataToConfig(sizes, offsets, int(index))
+	for i := range sortedRecords {
+		properties.add(&sortedRecords[i])
+	}
+	err = SSTableConfig.writeFooter(sizes, offsets, properties, fmt.Sprintf(FILE_NAME_FORMAT, index))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newSSTableConfig creates the config of a new SSTable written for the given level from the configuration variables.
+func newSSTableConfig(level int) (*SSTableConfig, error) {
+	config := &SSTableConfig{
+		UseSeparateFiles:   USE_SEPARATE_FILES,
+		CompressionEnabled: COMPRESSION_ENABLED,
+		SparseStepIndex:    uint64(SPARSE_STEP_INDEX),
+		FormatVersion:      FORMAT_VERSION,
+	}
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		codec, err := block_codec.ByName(BLOCK_COMPRESSION)
+		if err != nil {
+			return nil, err
+		}
+		config.BlockCodec = codec.ID()
+	}
+	if err := config.useSettingsForLevel(level); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// useSettingsForLevel picks the filter policy and false positive rate of a table written for the given level,
+// the prefix extractor of its filter, and whether its block index and filter are partitioned.
+func (config *SSTableConfig) useSettingsForLevel(level int) error {
+	extractor, err := newPrefixExtractor(PREFIX_EXTRACTOR, PREFIX_LENGTH, PREFIX_DELIMITER)
+	if err != nil {
+		return err
+	}
+	config.PrefixExtractor = extractor
+
+	name, rate := FILTER_POLICY, FILTER_FALSE_POSITIVE_RATE
+	if level >= BOTTOM_LEVEL {
+		name, rate = BOTTOM_LEVEL_FILTER_POLICY, BOTTOM_LEVEL_FILTER_FALSE_POSITIVE_RATE
+	}
+	policy, err := filter_policy.ByName(name)
 	if err != nil {
 		return err
 	}
+	config.FilterPolicy, config.FilterFalsePositiveRate = policy.ID(), rate
 
+	// Only bottom level tables grow big enough for a whole block index or filter to be costly
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS && level >= BOTTOM_LEVEL {
+		config.IndexPartitionSize = INDEX_PARTITION_SIZE
+	}
 	return nil
 }
 
+/*
+buildFilter builds the Filter component of a table over its sorted keys. Besides the keys it holds
+the prefixes the table's PrefixExtractor picks, marked by prependPrefixPrefix, for prefix lookups.
+*/
+func (config *SSTableConfig) buildFilter(keys []string) (filter_policy.Filter, error) {
+	policy, err := filter_policy.ByID(config.FilterPolicy)
+	if err != nil {
+		return nil, err
+	}
+	items := make([][]byte, 0, len(keys))
+	previousKey := ""
+	for _, key := range keys {
+		items = append(items, []byte(key))
+		items = config.PrefixExtractor.appendPrefixes(items, key, previousKey)
+		previousKey = key
+	}
+	return policy.Build(items, config.FilterFalsePositiveRate), nil
+}
+
 /*
 The serialized data of the SSTableConfig takes up only 1 block.
 
 This is the pattern (without the CRC):
 
-	+-----------------------+-------------------------+----------------------+
-	| UseSeparateFiles (1B) | CompressionEnabled (1B) | SparseStepIndex (8B) |
-	+-----------------------+-------------------------+----------------------+
+	+-----------------------+-------------------------+----------------------+-----+--------------------+-----------------+
+	| UseSeparateFiles (1B) | CompressionEnabled (1B) | SparseStepIndex (8B) | ... | FormatVersion (1B) | BlockCodec (1B) |
+	+-----------------------+-------------------------+----------------------+-----+--------------------+-----------------+
+
+followed by FilterPolicy (1B), FilterFalsePositiveRate (8B, the bits of the float64) and the
+PrefixExtractor kind (1B), length (8B) and delimiter (1B), and IndexPartitionSize (8B).
+The gap held the component sizes and offsets in single file mode before tables got a footer, see tableFooter.
 */
 func (config *SSTableConfig) serialize() ([]byte, uint64, error) {
 
@@ -651,6 +792,14 @@ func (config *SSTableConfig) serialize() ([]byte, uint64, error) {
 	data[CRC_SIZE] = byte_util.BoolToByte(config.UseSeparateFiles)
 	data[CRC_SIZE+1] = byte_util.BoolToByte(config.CompressionEnabled)
 	binary.LittleEndian.PutUint64(data[CRC_SIZE+2:CRC_SIZE+10], uint64(config.SparseStepIndex))
+	data[CONFIG_FORMAT_VERSION_OFFSET] = config.FormatVersion
+	data[CONFIG_BLOCK_CODEC_OFFSET] = config.BlockCodec
+	data[CONFIG_FILTER_POLICY_OFFSET] = config.FilterPolicy
+	binary.LittleEndian.PutUint64(data[CONFIG_FILTER_RATE_OFFSET:], math.Float64bits(config.FilterFalsePositiveRate))
+	data[CONFIG_PREFIX_EXTRACTOR_OFFSET] = uint8(config.PrefixExtractor.Kind)
+	binary.LittleEndian.PutUint64(data[CONFIG_PREFIX_EXTRACTOR_OFFSET+1:], config.PrefixExtractor.Length)
+	data[CONFIG_PREFIX_EXTRACTOR_OFFSET+9] = config.PrefixExtractor.Delimiter
+	binary.LittleEndian.PutUint64(data[CONFIG_INDEX_PARTITION_SIZE_OFFSET:], config.IndexPartitionSize)
 
 	data = crc_util.AddCRCToBlockData(data)
 
@@ -856,7 +1005,7 @@ func (index *SummaryComp) serialize(summaryStartOffset uint64) ([]byte, uint64,
 
 func (filterComp *FilterComp) serialize() ([]byte, uint64, error) {
 
-	serializedFilter := filterComp.BloomFilter.Serialize()
+	serializedFilter := filterComp.Filter.Serialize()
 	if USE_SEPARATE_FILES {
 		prependSizePrefix(&serializedFilter)
 	}
@@ -930,98 +1079,51 @@ func prependPrefixPrefix(prefix string) string {
 }
 
 /*
-Used to add the size and offsets data of components to the config, to allow for easier reading.
+Get retrieves a record by its key from the SSTable, if it exists in the SSTable,
+while minimizing the number of disk accesses. Deleted keys are reported as missing.
 */
-func (config *SSTableConfig) addSizeDataToConfig(sizes []uint64, offsets []uint64, index int) error {
-
-	if config.UseSeparateFiles {
-		return nil
-	}
-
-	configBlock := make([]byte, BLOCK_SIZE)
-
-	configBlock[CRC_SIZE] = byte_util.BoolToByte(config.UseSeparateFiles)
-	configBlock[CRC_SIZE+1] = byte_util.BoolToByte(config.CompressionEnabled)
-	binary.LittleEndian.PutUint64(configBlock[CRC_SIZE+2:CRC_SIZE+10], uint64(config.SparseStepIndex))
-
-	currentOffset := uint64(CRC_SIZE + 1 + 1 + 8)
-	for i := 0; i < len(sizes); i++ {
-		binary.LittleEndian.PutUint64(configBlock[currentOffset:currentOffset+STANDARD_FLAG_SIZE], sizes[i])
-		currentOffset += STANDARD_FLAG_SIZE
-		binary.LittleEndian.PutUint64(configBlock[currentOffset:currentOffset+STANDARD_FLAG_SIZE], offsets[i])
-		currentOffset += STANDARD_FLAG_SIZE
-	}
-
-	configBlock = crc_util.AddCRCToBlockData(configBlock)
-
-	blockManager := block_manager.GetBlockManager()
-	err := blockManager.WriteToDisk(configBlock, fmt.Sprintf(FILE_NAME_FORMAT, index), 0)
-	if err != nil {
-		return err
+func Get(key string, index int) (*record.Record, error) {
+	record, err := GetEntry(key, index)
+	if err != nil || record == nil || record.IsDeleted() {
+		return nil, err
 	}
-
-	return nil
+	return record, nil
 }
 
 /*
-Get retrieves a record by its key from the SSTable, if it exists in the SSTable,
-while minimizing the number of disk accesses.
+GetEntry is Get that returns the tombstone of a deleted key instead of reporting it as missing,
+so a read going through the tables from newest to oldest can stop at the deletion.
 */
-func Get(key string, index int) (record *record.Record, err error) {
+func GetEntry(key string, index int) (record *record.Record, err error) {
 
-	// 0. Deserialize SSTable Config
-	config, sizes, offsets, err := deserializeSSTableConfig(index)
+	// 0. Open the SSTable (config, filter and index bounds come from the table cache)
+	table, err := openTable(index)
 	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize SSTable config: %v", err)
+		return nil, err
 	}
+	config := table.config
 
 	// 1. Bloom Filter Check
-	if config.UseSeparateFiles {
-		filterPath := fmt.Sprintf(FILTER_FILE_NAME_FORMAT, index)
-		filterSize, err := getComponentSize(filterPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get filter component size: %v", err)
-		}
-		filter, err := deserializeFilter(filterPath, 0, filterSize, config.UseSeparateFiles)
-		if err != nil {
-			return nil, fmt.Errorf("failed to deserialize filter: %v", err)
-		}
-		if !filter.Contains([]byte(key)) {
-			return nil, nil
-		}
-	} else {
-		filterPath := fmt.Sprintf(FILE_NAME_FORMAT, index)
-		filterOffset := offsets[3]
-		filterSize := sizes[3]
-		filter, err := deserializeFilter(filterPath, filterOffset, filterSize, config.UseSeparateFiles)
-		if err != nil {
-			return nil, fmt.Errorf("failed to deserialize filter (single file): %v", err)
-		}
-		if !filter.Contains([]byte(key)) {
-			return nil, nil
-		}
-	}
-
-	// 1.5. Data, Index and Summary preparation
-	summaryPath := fmt.Sprintf(SUMMARY_FILE_NAME_FORMAT, index)
-	summaryOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	if !config.UseSeparateFiles {
-		summaryPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-		summaryOffset = offsets[2] + CRC_SIZE
+	mayContain, err := table.mayContain(key)
+	if err != nil {
+		return nil, err
 	}
-	indexFileOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	indexPath := fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		indexFileOffset = offsets[1] + CRC_SIZE
-		indexPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
+	if !mayContain {
+		return nil, nil
 	}
-	dataPath := fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		dataPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
+
+	// Block format tables find the data block in their block index and search inside it
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		return table.getFromBlocks(key)
 	}
 
+	// 1.5. Data, Index and Summary preparation
+	summaryPath, summaryOffset := table.summaryPath, table.summaryOffset
+	indexFileOffset := table.indexOffset
+	dataPath := table.dataPath
+
 	// 2. Index Bounds Check
-	inIndexBounds, oneOfBounds, offsetOfMatchingBound, lastSummaryEntryIndex, lastIndexEntryIndex, err := checkIndexBounds(indexPath, indexFileOffset, key, config.SparseStepIndex)
+	inIndexBounds, oneOfBounds, offsetOfMatchingBound, lastSummaryEntryIndex, lastIndexEntryIndex, err := table.checkIndexBounds(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check index bounds: %v", err)
 	}
@@ -1033,9 +1135,6 @@ func Get(key string, index int) (record *record.Record, err error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to retrieve record from data component (one of bounds): %v", err)
 		}
-		if record.IsDeleted() {
-			return nil, nil
-		}
 		return record, nil
 	}
 	if !config.UseSeparateFiles {
@@ -1054,50 +1153,21 @@ func Get(key string, index int) (record *record.Record, err error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to retrieve record from data component (final): %v", err)
 		}
-		if record.IsDeleted() {
-			return nil, nil
-		}
 		return record, nil
 	}
 }
 
 // GetSSBoundaries returns the first (smallest) and last (largest) keys stored in the SSTable for the provided index.
-// It loads the SSTable config, locates the index component and reads the first and last entries directly.
+// They are read from the first and last index entries when the table is opened.
 func GetSSBoundaries(index int) (string, string, error) {
-	// 0. Deserialize SSTable Config
-	config, _, offsets, err := deserializeSSTableConfig(index)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to deserialize SSTable config: %v", err)
-	}
-
-	// 1. Prepare Index component path and offset
-	indexPath := fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)
-	indexFileOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	if !config.UseSeparateFiles {
-		indexPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-		indexFileOffset = offsets[1] + CRC_SIZE
-	}
-
-	// 2. Read first entry key (skip the 8B last-entry-offset header)
-	firstKey, _, err := readIndexMetadataEntry(indexPath, indexFileOffset+STANDARD_FLAG_SIZE)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read first index entry: %v", err)
-	}
-
-	// 3. Read last entry offset header, then the last entry key
-	blockManager := block_manager.GetBlockManager()
-	lastEntryOffsetBytes, _, err := blockManager.ReadFromDisk(indexPath, indexFileOffset, STANDARD_FLAG_SIZE)
+	table, err := openTable(index)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read last entry offset: %v", err)
+		return "", "", err
 	}
-	lastEntryOffset := binary.LittleEndian.Uint64(lastEntryOffsetBytes)
-
-	lastKey, _, err := readIndexMetadataEntry(indexPath, lastEntryOffset)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read last index entry: %v", err)
+	if err := table.loadBounds(); err != nil {
+		return "", "", err
 	}
-
-	return firstKey, lastKey, nil
+	return table.firstKey, table.lastKey, nil
 }
 
 /*
@@ -1105,67 +1175,36 @@ GetNextForPrefix retrieves the next record for a given prefix from the SSTable
 */
 func GetNextForPrefix(prefix string, key string, tombstonedKeys *[]string, index int) (record *record.Record, err error) {
 
-	// 0. Deserialize SSTable Config
-	config, sizes, offsets, err := deserializeSSTableConfig(index)
+	// 0. Open the SSTable (config, filter and index bounds come from the table cache)
+	table, err := openTable(index)
 	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize SSTable config: %v", err)
+		return nil, err
 	}
+	config := table.config
 
 	// 1. Bloom Filter Check
-	if config.UseSeparateFiles {
-		filterPath := fmt.Sprintf(FILTER_FILE_NAME_FORMAT, index)
-		filterSize, err := getComponentSize(filterPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get filter component size: %v", err)
-		}
-		filter, err := deserializeFilter(filterPath, 0, filterSize, config.UseSeparateFiles)
-		if err != nil {
-			return nil, fmt.Errorf("failed to deserialize filter: %v", err)
-		}
-		if !filter.Contains([]byte(prependPrefixPrefix(prefix))) {
-			return nil, nil
-		}
-	} else {
-		filterPath := fmt.Sprintf(FILE_NAME_FORMAT, index)
-		filterOffset := offsets[3]
-		filterSize := sizes[3]
-		filter, err := deserializeFilter(filterPath, filterOffset, filterSize, config.UseSeparateFiles)
-		if err != nil {
-			return nil, fmt.Errorf("failed to deserialize filter (single file): %v", err)
-		}
+	mayContain, err := table.mayContainPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !mayContain {
+		return nil, nil
+	}
 
-		maxPrefixLen := len(prefix)
-		if maxPrefixLen > 10 {
-			maxPrefixLen = 10
-		}
-		for prefixLen := 1; prefixLen <= maxPrefixLen; prefixLen++ {
-			checkPrefix := prefix[:prefixLen]
-			if !filter.Contains([]byte(prependPrefixPrefix(checkPrefix))) {
-				return nil, nil
-			}
-		}
+	// Block format tables start at the first key >= key, so the window has to leave key itself out
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		within := func(k string) bool { return k > key && strings.HasPrefix(k, prefix) }
+		stop := func(k string) bool { return k > prefix && !strings.HasPrefix(k, prefix) }
+		return table.nextFromBlocks(key, tombstonedKeys, within, stop)
 	}
 
 	// 1.5. Data, Index and Summary preparation
-	summaryPath := fmt.Sprintf(SUMMARY_FILE_NAME_FORMAT, index)
-	summaryOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	if !config.UseSeparateFiles {
-		summaryPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-		summaryOffset = offsets[2] + CRC_SIZE
-	}
-	indexFileOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	indexPath := fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		indexFileOffset = offsets[1] + CRC_SIZE
-		indexPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-	}
-	dataPath := fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		dataPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-	}
+	summaryPath, summaryOffset := table.summaryPath, table.summaryOffset
+	indexFileOffset := table.indexOffset
+	dataPath := table.dataPath
 
 	// 2. Index Bounds Check
-	inIndexBounds, _, _, lastSummaryEntryIndex, lastIndexEntryIndex, err := checkIndexBoundsForPrefix(indexPath, indexFileOffset, key, config.SparseStepIndex)
+	inIndexBounds, lastSummaryEntryIndex, lastIndexEntryIndex, err := table.checkIndexBoundsForPrefix(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check index bounds: %v", err)
 	}
@@ -1194,48 +1233,6 @@ func GetNextForPrefix(prefix string, key string, tombstonedKeys *[]string, index
 
 }
 
-/*
-Checks basic bounds for a range and computes last summary and index entry indexes for searching.
-Returns inBounds=false if [rangeStart, rangeEnd] doesn't overlap with [firstKey, lastKey] of the table.
-*/
-func checkIndexBoundsForRange(filepath string, offset uint64, rangeStart string, rangeEnd string, sparseStep uint64) (bool, uint64, uint64, error) {
-	// Read first entry key
-	firstEntryKey, _, err := readIndexMetadataEntry(filepath, offset+STANDARD_FLAG_SIZE)
-	if err != nil {
-		return false, 0, 0, err
-	}
-
-	// Read last entry info
-	blockManager := block_manager.GetBlockManager()
-	lastEntryOffsetBytes, _, err := blockManager.ReadFromDisk(filepath, offset, STANDARD_FLAG_SIZE)
-	if err != nil {
-		return false, 0, 0, err
-	}
-	lastEntryOffset := binary.LittleEndian.Uint64(lastEntryOffsetBytes)
-	lastEntryKey, _, err := readIndexMetadataEntry(filepath, lastEntryOffset)
-	if err != nil {
-		return false, 0, 0, err
-	}
-
-	// Quick overlap check: [rangeStart, rangeEnd] vs [firstEntryKey, lastEntryKey]
-	if rangeEnd < firstEntryKey || rangeStart > lastEntryKey {
-		return false, 0, 0, nil
-	}
-
-	// Compute last entry indexes similarly to other helpers
-	physicalOffsetFirst := offset + STANDARD_FLAG_SIZE
-	crcsFirst := (physicalOffsetFirst / BLOCK_SIZE) + 1
-	logicalOffsetFirst := physicalOffsetFirst - crcsFirst*CRC_SIZE
-	physicalOffsetLast := lastEntryOffset
-	crcsLast := (physicalOffsetLast / BLOCK_SIZE) + 1
-	logicalOffsetLast := physicalOffsetLast - crcsLast*CRC_SIZE
-
-	indexOfLastIndexEntry := (logicalOffsetLast - logicalOffsetFirst) / INDEX_ENTRY_METADATA_SIZE
-	indexOfLastSummaryEntry := indexOfLastIndexEntry / uint64(sparseStep)
-
-	return true, indexOfLastSummaryEntry, indexOfLastIndexEntry, nil
-}
-
 /*
 GetNextForRange retrieves the next record whose key is within [rangeStart, rangeEnd] (inclusive).
 No Bloom filter checks are performed (range cannot be easily represented in filter).
@@ -1248,32 +1245,26 @@ func GetNextForRange(rangeStart string, rangeEnd string, key string, tombstonedK
 		return nil, nil
 	}
 
-	// 0. Deserialize SSTable Config
-	config, _, offsets, err := deserializeSSTableConfig(index)
+	// 0. Open the SSTable (config and index bounds come from the table cache)
+	table, err := openTable(index)
 	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize SSTable config: %v", err)
+		return nil, err
 	}
+	config := table.config
 
-	// 1.5. Data, Index and Summary preparation (no Bloom filter for range)
-	summaryPath := fmt.Sprintf(SUMMARY_FILE_NAME_FORMAT, index)
-	summaryOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	if !config.UseSeparateFiles {
-		summaryPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-		summaryOffset = offsets[2] + CRC_SIZE
-	}
-	indexFileOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	indexPath := fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		indexFileOffset = offsets[1] + CRC_SIZE
-		indexPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-	}
-	dataPath := fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		dataPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		within := func(k string) bool { return k > key && k >= rangeStart && k <= rangeEnd }
+		stop := func(k string) bool { return k > rangeEnd }
+		return table.nextFromBlocks(max(key, rangeStart), tombstonedKeys, within, stop)
 	}
 
+	// 1.5. Data, Index and Summary preparation (no Bloom filter for range)
+	summaryPath, summaryOffset := table.summaryPath, table.summaryOffset
+	indexFileOffset := table.indexOffset
+	dataPath := table.dataPath
+
 	// 2. Index Bounds Check for range overlap
-	inBounds, lastSummaryEntryIndex, lastIndexEntryIndex, err := checkIndexBoundsForRange(indexPath, indexFileOffset, rangeStart, rangeEnd, config.SparseStepIndex)
+	inBounds, lastSummaryEntryIndex, lastIndexEntryIndex, err := table.checkIndexBoundsForRange(rangeStart, rangeEnd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check index bounds for range: %v", err)
 	}
@@ -1333,16 +1324,53 @@ func deserializeSSTableConfig(index int) (*SSTableConfig, []uint64, []uint64, er
 	useSeparateFiles := byte_util.ByteToBool(blockData[CRC_SIZE])
 	compressionEnabled := byte_util.ByteToBool(blockData[CRC_SIZE+1])
 	sparseStepIndex := uint64(binary.LittleEndian.Uint64(blockData[CRC_SIZE+2 : CRC_SIZE+10]))
+	formatVersion := blockData[CONFIG_FORMAT_VERSION_OFFSET]
+	if formatVersion == 0 {
+		formatVersion = FORMAT_VERSION_RECORDS // Written before format versions, the byte is still padding
+	}
 
 	config := &SSTableConfig{
 		UseSeparateFiles:   useSeparateFiles,
 		CompressionEnabled: compressionEnabled,
 		SparseStepIndex:    sparseStepIndex,
+		FormatVersion:      formatVersion,
+		BlockCodec:         blockData[CONFIG_BLOCK_CODEC_OFFSET],
+		FilterPolicy:       blockData[CONFIG_FILTER_POLICY_OFFSET],
+
+		FilterFalsePositiveRate: math.Float64frombits(binary.LittleEndian.Uint64(blockData[CONFIG_FILTER_RATE_OFFSET:])),
+		PrefixExtractor: PrefixExtractor{
+			Kind:      PrefixExtractorKind(blockData[CONFIG_PREFIX_EXTRACTOR_OFFSET]),
+			Length:    binary.LittleEndian.Uint64(blockData[CONFIG_PREFIX_EXTRACTOR_OFFSET+1:]),
+			Delimiter: blockData[CONFIG_PREFIX_EXTRACTOR_OFFSET+9],
+		},
+		IndexPartitionSize: binary.LittleEndian.Uint64(blockData[CONFIG_INDEX_PARTITION_SIZE_OFFSET:]),
+	}
+	if config.PrefixExtractor.Kind == PREFIX_EXTRACTOR_CAPPED && config.PrefixExtractor.Length == 0 {
+		config.PrefixExtractor.Length = LEGACY_PREFIX_LENGTH // Written before prefix extractors, the bytes are still padding
+	}
+
+	footer, found, err := readFooter(index)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read footer: %v", err)
+	}
+	if found {
+		config.FormatVersion = footer.formatVersion
+		if useSeparateFiles {
+			return config, nil, nil, nil
+		}
+		return config, footer.sizes, footer.offsets, nil
 	}
 
+	// Written before footers, the Config block holds the component sizes and offsets
+	if formatVersion != FORMAT_VERSION_RECORDS && formatVersion != FORMAT_VERSION_BLOCKS {
+		return nil, nil, nil, fmt.Errorf("unsupported format version %d", formatVersion)
+	}
+	if err := validateLegacyConfig(blockData, index); err != nil {
+		return nil, nil, nil, err
+	}
 	if !useSeparateFiles {
 
-		const expectedPairs = 5
+		const expectedPairs = COMPONENT_COUNT
 		sizes := make([]uint64, 0)
 		offsets := make([]uint64, 0)
 
@@ -1363,11 +1391,70 @@ func deserializeSSTableConfig(index int) (*SSTableConfig, []uint64, []uint64, er
 	return config, nil, nil, nil
 }
 
-func deserializeFilter(filepath string, offset uint64, filterSize uint64, useSeparateFiles bool) (*bloom_filter.BloomFilter, error) {
+/*
+validateLegacyConfig checks that a Config block without a footer has the layout tables were written with before footers,
+so any other file whose first block has a valid CRC isn't taken for an SSTable.
+The flags must be booleans and everything after the last field must be padding. In separate file mode the component
+handles are padding too and every component file must exist, in single file mode every component must lie within
+the file, after the Config block.
+*/
+func validateLegacyConfig(blockData []byte, index int) error {
+	filePath := fmt.Sprintf(FILE_NAME_FORMAT, index)
+	invalid := fmt.Errorf("%s is not an SSTable", filePath)
+	if blockData[CRC_SIZE] > 1 || blockData[CRC_SIZE+1] > 1 {
+		return invalid
+	}
+	for _, b := range blockData[CONFIG_INDEX_PARTITION_SIZE_OFFSET+8:] {
+		if b != 0 {
+			return invalid
+		}
+	}
+	useSeparateFiles := byte_util.ByteToBool(blockData[CRC_SIZE])
+
+	blockCount, err := block_manager.GetBlockManager().BlockCount(filePath)
+	if err != nil {
+		return err
+	}
+	fileSize := blockCount * BLOCK_SIZE
+	position := CRC_SIZE + 1 + 1 + 8
+	for i := 0; i < COMPONENT_COUNT; i++ {
+		size := binary.LittleEndian.Uint64(blockData[position:])
+		offset := binary.LittleEndian.Uint64(blockData[position+STANDARD_FLAG_SIZE:])
+		position += 2 * STANDARD_FLAG_SIZE
+
+		if useSeparateFiles {
+			if size != 0 || offset != 0 {
+				return invalid
+			}
+		} else if offset < BLOCK_SIZE || offset >= fileSize || size > fileSize-offset {
+			return invalid
+		}
+	}
+
+	if useSeparateFiles {
+		componentFileNames := []string{
+			DATA_FILE_NAME_FORMAT,
+			INDEX_FILE_NAME_FORMAT,
+			SUMMARY_FILE_NAME_FORMAT,
+			FILTER_FILE_NAME_FORMAT,
+			METADATA_FILE_NAME_FORMAT,
+		}
+		for _, format := range componentFileNames {
+			if _, err := os.Stat(fmt.Sprintf(format, index)); os.IsNotExist(err) {
+				return invalid
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deserializeFilter(filepath string, offset uint64, filterSize uint64, config *SSTableConfig) (filter_policy.Filter, error) {
 	actualOffset := offset
 	actualSize := filterSize
 
-	if useSeparateFiles {
+	if config.UseSeparateFiles {
 		actualOffset += STANDARD_FLAG_SIZE + CRC_SIZE
 	}
 
@@ -1377,114 +1464,17 @@ func deserializeFilter(filepath string, offset uint64, filterSize uint64, useSep
 		return nil, err
 	}
 
-	filter := bloom_filter.Deserialize(filterBytes)
-	return filter, nil
+	policy, err := filter_policy.ByID(config.FilterPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return policy.Deserialize(filterBytes)
 }
 
 /*
-Returns if the key is within the bounds of the Index Component.
-
-If the key is in the bounds, the function returns true along with the index (ex. 645. or 7328.) of the last entry.
-
-If the key happens to be one of the bounds, we return the offset in Data component of that bound's key.
+Read an index metadata entry from the SSTable Summary Component.
 
-If the key is not in the bounds, there is no point in searching further.
-*/
-func checkIndexBounds(filepath string, offset uint64, key string, sparseStep uint64) (bool, bool, uint64, uint64, uint64, error) {
-
-	firstEntryKey, firstEntryDataOffset, err := readIndexMetadataEntry(filepath, offset+STANDARD_FLAG_SIZE)
-
-	if err != nil {
-		return false, false, 0, 0, 0, err
-	}
-	if key < firstEntryKey {
-		return false, false, 0, 0, 0, nil
-	}
-	if key == firstEntryKey {
-		return true, true, firstEntryDataOffset, 0, 0, nil
-	}
-
-	blockManager := block_manager.GetBlockManager()
-	lastEntryOffsetBytes, _, err := blockManager.ReadFromDisk(filepath, offset, STANDARD_FLAG_SIZE)
-	if err != nil {
-		return false, false, 0, 0, 0, err
-	}
-	lastEntryOffset := binary.LittleEndian.Uint64(lastEntryOffsetBytes)
-
-	lastEntryKey, lastEntryDataOffset, err := readIndexMetadataEntry(filepath, lastEntryOffset)
-
-	if err != nil {
-		return false, false, 0, 0, 0, err
-	}
-	if lastEntryKey == key {
-		return true, true, lastEntryDataOffset, 0, 0, nil
-	}
-
-	physicalOffsetFirst := offset + STANDARD_FLAG_SIZE
-	crcsFirst := (physicalOffsetFirst / BLOCK_SIZE) + 1
-	logicalOffsetFirst := physicalOffsetFirst - crcsFirst*CRC_SIZE
-	physicalOffsetLast := lastEntryOffset
-	crcsLast := (physicalOffsetLast / BLOCK_SIZE) + 1
-	logicalOffsetLast := physicalOffsetLast - crcsLast*CRC_SIZE
-
-	indexOfLastIndexEntry := (logicalOffsetLast - logicalOffsetFirst) / INDEX_ENTRY_METADATA_SIZE
-	indexOfLastSummaryEntry := indexOfLastIndexEntry / uint64(sparseStep)
-
-	return lastEntryKey > key, false, 0, indexOfLastSummaryEntry, indexOfLastIndexEntry, nil
-}
-
-/*
-Returns if the key is within the bounds of the Index Component, (doesn't have to exactly be there due to prefix constraints).
-
-If the key is in the bounds, the function returns true along with the index (ex. 645. or 7328.) of the last entry.
-
-If the key happens to be one of the bounds, we return the offset in Data component of that bound's key.
-
-If the key is not in the bounds, there is no point in searching further.
-*/
-func checkIndexBoundsForPrefix(filepath string, offset uint64, key string, sparseStep uint64) (bool, bool, uint64, uint64, uint64, error) {
-
-	firstEntryKey, _, err := readIndexMetadataEntry(filepath, offset+STANDARD_FLAG_SIZE)
-
-	if err != nil {
-		return false, false, 0, 0, 0, err
-	}
-	if key < firstEntryKey {
-		if !strings.HasPrefix(firstEntryKey, key) {
-			return false, false, 0, 0, 0, nil
-		}
-	}
-
-	blockManager := block_manager.GetBlockManager()
-	lastEntryOffsetBytes, _, err := blockManager.ReadFromDisk(filepath, offset, STANDARD_FLAG_SIZE)
-	if err != nil {
-		return false, false, 0, 0, 0, err
-	}
-	lastEntryOffset := binary.LittleEndian.Uint64(lastEntryOffsetBytes)
-
-	lastEntryKey, _, err := readIndexMetadataEntry(filepath, lastEntryOffset)
-
-	if err != nil {
-		return false, false, 0, 0, 0, err
-	}
-
-	physicalOffsetFirst := offset + STANDARD_FLAG_SIZE
-	crcsFirst := (physicalOffsetFirst / BLOCK_SIZE) + 1
-	logicalOffsetFirst := physicalOffsetFirst - crcsFirst*CRC_SIZE
-	physicalOffsetLast := lastEntryOffset
-	crcsLast := (physicalOffsetLast / BLOCK_SIZE) + 1
-	logicalOffsetLast := physicalOffsetLast - crcsLast*CRC_SIZE
-
-	indexOfLastIndexEntry := (logicalOffsetLast - logicalOffsetFirst) / INDEX_ENTRY_METADATA_SIZE
-	indexOfLastSummaryEntry := indexOfLastIndexEntry / uint64(sparseStep)
-
-	return lastEntryKey > key, false, 0, indexOfLastSummaryEntry, indexOfLastIndexEntry, nil
-}
-
-/*
-Read an index metadata entry from the SSTable Summary Component.
-
-Takes in the filepath, and offset to the entry start, returns the key, its offset in the data, and any error encountered.
+Takes in the filepath, and offset to the entry start, returns the key, its offset in the data, and any error encountered.
 */
 func readIndexMetadataEntry(filepath string, offset uint64) (string, uint64, error) {
 	blockManager := block_manager.GetBlockManager()
@@ -1709,24 +1699,15 @@ func lowerBoundSearchIndexes(filepath string, startingKey string, offsetFirst ui
 	return bestOffset, bestOffset != 0, nil
 }
 
-/*
-Generic helper for sequential iteration with custom inclusion and stop conditions.
-within returns true if the record is within the desired window (e.g., has prefix or in range).
-stop returns true if we should stop scanning (e.g., key no longer has prefix or key > rangeEnd).
-*/
-func iterateSequentially(
-	dataPath string,
-	startOffset uint64,
-	tombstonedKeys *[]string,
-	compressionEnabled bool,
-	within func(string) bool,
-	stop func(string) bool,
-) (*record.Record, error) {
+// recordSource returns the records of an SSTable one at a time in key order, nil once they run out.
+type recordSource func() (*record.Record, error)
+
+// recordsFrom reads records of the record format sequentially, starting at the given offset in the Data component.
+func recordsFrom(dataPath string, startOffset uint64, compressionEnabled bool) recordSource {
 	blockManager := block_manager.GetBlockManager()
 	currentOffset := startOffset
 
-	// Read the data file sequentially to find the next valid record
-	for {
+	return func() (*record.Record, error) {
 		// Read record size
 		recordSizeBytes, newOffset, err := blockManager.ReadFromDisk(dataPath, currentOffset, STANDARD_FLAG_SIZE)
 		if err != nil {
@@ -1757,7 +1738,40 @@ func iterateSequentially(
 		currentOffset = newOffset
 
 		// Deserialize record
-		rec := record.DeserializeForSSTable(recordData, compressionEnabled)
+		return record.DeserializeForSSTable(recordData, compressionEnabled), nil
+	}
+}
+
+/*
+Generic helper for sequential iteration with custom inclusion and stop conditions.
+within returns true if the record is within the desired window (e.g., has prefix or in range).
+stop returns true if we should stop scanning (e.g., key no longer has prefix or key > rangeEnd).
+*/
+func iterateSequentially(
+	dataPath string,
+	startOffset uint64,
+	tombstonedKeys *[]string,
+	compressionEnabled bool,
+	within func(string) bool,
+	stop func(string) bool,
+) (*record.Record, error) {
+	return nextVisibleRecord(recordsFrom(dataPath, startOffset, compressionEnabled), tombstonedKeys, within, stop)
+}
+
+// nextVisibleRecord returns the first record from next that is within the window and not deleted,
+// adding the deleted keys it passes to tombstonedKeys.
+func nextVisibleRecord(
+	next recordSource,
+	tombstonedKeys *[]string,
+	within func(string) bool,
+	stop func(string) bool,
+) (*record.Record, error) {
+	// Read the records sequentially to find the next valid record
+	for {
+		rec, err := next()
+		if err != nil || rec == nil {
+			return nil, err
+		}
 
 		// If we are outside of the scan window, stop.
 		if stop != nil && stop(rec.Key) {
@@ -1819,68 +1833,39 @@ Parameters:
 - index: SSTable index to scan
 */
 func ScanForPrefix(prefix string, tombstonedKeys *[]string, bestKeys *[]string, pageSize int, pageNumber int, index int) error {
-	// 0. Deserialize SSTable Config
-	config, sizes, offsets, err := deserializeSSTableConfig(index)
+	// 0. Open the SSTable (config, filter and index bounds come from the table cache)
+	table, err := openTable(index)
 	if err != nil {
-		return fmt.Errorf("failed to deserialize SSTable config: %v", err)
+		return err
 	}
+	config := table.config
 
 	// 1. Bloom Filter Check
-	if config.UseSeparateFiles {
-		filterPath := fmt.Sprintf(FILTER_FILE_NAME_FORMAT, index)
-		filterSize, err := getComponentSize(filterPath)
-		if err != nil {
-			return fmt.Errorf("failed to get filter component size: %v", err)
-		}
-		filter, err := deserializeFilter(filterPath, 0, filterSize, config.UseSeparateFiles)
-		if err != nil {
-			return fmt.Errorf("failed to deserialize filter: %v", err)
-		}
-		if !filter.Contains([]byte(prependPrefixPrefix(prefix))) {
-			return nil // No records with this prefix
-		}
-	} else {
-		filterPath := fmt.Sprintf(FILE_NAME_FORMAT, index)
-		filterOffset := offsets[3]
-		filterSize := sizes[3]
-		filter, err := deserializeFilter(filterPath, filterOffset, filterSize, config.UseSeparateFiles)
-		if err != nil {
-			return fmt.Errorf("failed to deserialize filter (single file): %v", err)
-		}
+	mayContain, err := table.mayContainPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	if !mayContain {
+		return nil // No records with this prefix
+	}
 
-		// Check multiple prefix lengths up to 10 characters
-		maxPrefixLen := len(prefix)
-		if maxPrefixLen > 10 {
-			maxPrefixLen = 10
-		}
-		for prefixLen := 1; prefixLen <= maxPrefixLen; prefixLen++ {
-			checkPrefix := prefix[:prefixLen]
-			if !filter.Contains([]byte(prependPrefixPrefix(checkPrefix))) {
-				return nil
-			}
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		records, err := table.blockRecordsFrom(prefix)
+		if err != nil {
+			return err
 		}
+		inWindow := func(k string) bool { return strings.HasPrefix(k, prefix) }
+		pastWindow := func(k string) bool { return k > prefix }
+		return collectScanKeys(records, inWindow, pastWindow, tombstonedKeys, bestKeys, pageSize, pageNumber)
 	}
 
 	// 1.5. Data, Index and Summary preparation
-	summaryPath := fmt.Sprintf(SUMMARY_FILE_NAME_FORMAT, index)
-	summaryOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	if !config.UseSeparateFiles {
-		summaryPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-		summaryOffset = offsets[2] + CRC_SIZE
-	}
-	indexFileOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	indexPath := fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		indexFileOffset = offsets[1] + CRC_SIZE
-		indexPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-	}
-	dataPath := fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		dataPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-	}
+	summaryPath, summaryOffset := table.summaryPath, table.summaryOffset
+	indexFileOffset := table.indexOffset
+	dataPath := table.dataPath
 
 	// 2. Index Bounds Check
-	inIndexBounds, _, _, lastSummaryEntryIndex, lastIndexEntryIndex, err := checkIndexBoundsForPrefix(indexPath, indexFileOffset, prefix, config.SparseStepIndex)
+	inIndexBounds, lastSummaryEntryIndex, lastIndexEntryIndex, err := table.checkIndexBoundsForPrefix(prefix)
 	if err != nil {
 		return fmt.Errorf("failed to check index bounds: %v", err)
 	}
@@ -1905,12 +1890,7 @@ func ScanForPrefix(prefix string, tombstonedKeys *[]string, bestKeys *[]string,
 		startingDataOffset = offset
 	} else {
 		// If not found, start from the beginning of data
-		startingDataOffset = uint64(CRC_SIZE)
-		if config.UseSeparateFiles {
-			startingDataOffset += STANDARD_FLAG_SIZE
-		} else {
-			startingDataOffset = offsets[0] + CRC_SIZE
-		}
+		startingDataOffset = table.dataOffset
 	}
 
 	// 4. Sequential scan from the starting position
@@ -1922,9 +1902,16 @@ scanSequentiallyForPrefixRange scans records sequentially starting from the give
 looking for records with the specified prefix. It handles tombstones and maintains bestKeys with pagination.
 */
 func scanSequentiallyForPrefixRange(dataPath string, startOffset uint64, prefix string, tombstonedKeys *[]string, bestKeys *[]string, pageSize int, pageNumber int, compressionEnabled bool) error {
-	blockManager := block_manager.GetBlockManager()
-	currentOffset := startOffset
+	inWindow := func(k string) bool { return strings.HasPrefix(k, prefix) }
+	pastWindow := func(k string) bool { return k > prefix }
+	return collectScanKeys(recordsFrom(dataPath, startOffset, compressionEnabled), inWindow, pastWindow, tombstonedKeys, bestKeys, pageSize, pageNumber)
+}
 
+/*
+collectScanKeys reads records from next until they leave the scan window, either after being in it or once
+pastWindow says the window was skipped. It handles tombstones and maintains bestKeys with pagination.
+*/
+func collectScanKeys(next recordSource, inWindow func(string) bool, pastWindow func(string) bool, tombstonedKeys *[]string, bestKeys *[]string, pageSize int, pageNumber int) error {
 	// Create sets for efficient lookup
 	tombstonedSet := make(map[string]bool)
 	if tombstonedKeys != nil {
@@ -1941,45 +1928,26 @@ func scanSequentiallyForPrefixRange(dataPath string, startOffset uint64, prefix
 	}
 
 	var candidateKeys []string
-	foundPrefixRange := false
+	foundWindow := false
 
 	// Read records sequentially
 	for {
-		// Read record size
-		recordSizeBytes, newOffset, err := blockManager.ReadFromDisk(dataPath, currentOffset, STANDARD_FLAG_SIZE)
+		rec, err := next()
 		if err != nil {
-			if err == io.EOF {
-				break // No more records
-			}
 			return err
 		}
-		recordSize := binary.LittleEndian.Uint64(recordSizeBytes)
-		if recordSize == 0 {
-			break // Invalid record size indicates end
+		if rec == nil {
+			break // No more records
 		}
-		currentOffset = newOffset
 
-		// Read record data
-		recordData, newOffset, err := blockManager.ReadFromDisk(dataPath, currentOffset, recordSize)
-		if err != nil {
-			if err == io.EOF {
-				break // No more records
-			}
-			return err
-		}
-		currentOffset = newOffset
-
-		// Deserialize record
-		rec := record.DeserializeForSSTable(recordData, compressionEnabled)
-
-		// Check if we've found the prefix range
-		if strings.HasPrefix(rec.Key, prefix) {
-			foundPrefixRange = true
-		} else if foundPrefixRange {
-			// We've moved past the prefix range, stop scanning
+		// Check if we've found the window
+		if inWindow(rec.Key) {
+			foundWindow = true
+		} else if foundWindow || pastWindow(rec.Key) {
+			// We've moved past the window, stop scanning
 			break
 		} else {
-			// We haven't reached the prefix range yet, continue scanning
+			// We haven't reached the window yet, continue scanning
 			continue
 		}
 
@@ -2048,34 +2016,32 @@ func ScanForRange(rangeStart string, rangeEnd string, tombstonedKeys *[]string,
 		return nil
 	}
 
-	// 0. Deserialize SSTable Config
-	config, _, offsets, err := deserializeSSTableConfig(index)
+	// 0. Open the SSTable (config and index bounds come from the table cache)
+	table, err := openTable(index)
 	if err != nil {
-		return fmt.Errorf("failed to deserialize SSTable config: %v", err)
+		return err
 	}
+	config := table.config
 
 	// Skip Bloom filter check - ranges cannot be easily represented in filters
 
-	// 1. Data, Index and Summary preparation
-	summaryPath := fmt.Sprintf(SUMMARY_FILE_NAME_FORMAT, index)
-	summaryOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	if !config.UseSeparateFiles {
-		summaryPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-		summaryOffset = offsets[2] + CRC_SIZE
-	}
-	indexFileOffset := uint64(CRC_SIZE) + uint64(STANDARD_FLAG_SIZE)
-	indexPath := fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		indexFileOffset = offsets[1] + CRC_SIZE
-		indexPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
-	}
-	dataPath := fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)
-	if !config.UseSeparateFiles {
-		dataPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		records, err := table.blockRecordsFrom(rangeStart)
+		if err != nil {
+			return err
+		}
+		inWindow := func(k string) bool { return k >= rangeStart && k <= rangeEnd }
+		pastWindow := func(k string) bool { return k > rangeEnd }
+		return collectScanKeys(records, inWindow, pastWindow, tombstonedKeys, bestKeys, pageSize, pageNumber)
 	}
 
+	// 1. Data, Index and Summary preparation
+	summaryPath, summaryOffset := table.summaryPath, table.summaryOffset
+	indexFileOffset := table.indexOffset
+	dataPath := table.dataPath
+
 	// 2. Index Bounds Check for range overlap
-	inBounds, lastSummaryEntryIndex, lastIndexEntryIndex, err := checkIndexBoundsForRange(indexPath, indexFileOffset, rangeStart, rangeEnd, config.SparseStepIndex)
+	inBounds, lastSummaryEntryIndex, lastIndexEntryIndex, err := table.checkIndexBoundsForRange(rangeStart, rangeEnd)
 	if err != nil {
 		return fmt.Errorf("failed to check index bounds for range: %v", err)
 	}
@@ -2100,12 +2066,7 @@ func ScanForRange(rangeStart string, rangeEnd string, tombstonedKeys *[]string,
 		startingDataOffset = offset
 	} else {
 		// If not found, start from the beginning of data
-		startingDataOffset = uint64(CRC_SIZE)
-		if config.UseSeparateFiles {
-			startingDataOffset += STANDARD_FLAG_SIZE
-		} else {
-			startingDataOffset = offsets[0] + CRC_SIZE
-		}
+		startingDataOffset = table.dataOffset
 	}
 
 	// 4. Sequential scan from the starting position
@@ -2118,116 +2079,9 @@ looking for records within the specified range [rangeStart, rangeEnd] (inclusive
 It handles tombstones and maintains bestKeys with pagination.
 */
 func scanSequentiallyForRange(dataPath string, startOffset uint64, rangeStart string, rangeEnd string, tombstonedKeys *[]string, bestKeys *[]string, pageSize int, pageNumber int, compressionEnabled bool) error {
-	blockManager := block_manager.GetBlockManager()
-	currentOffset := startOffset
-
-	// Create sets for efficient lookup
-	tombstonedSet := make(map[string]bool)
-	if tombstonedKeys != nil {
-		for _, key := range *tombstonedKeys {
-			tombstonedSet[key] = true
-		}
-	}
-
-	bestKeysSet := make(map[string]bool)
-	if bestKeys != nil {
-		for _, key := range *bestKeys {
-			bestKeysSet[key] = true
-		}
-	}
-
-	var candidateKeys []string
-	foundRangeStart := false
-
-	// Read records sequentially
-	for {
-		// Read record size
-		recordSizeBytes, newOffset, err := blockManager.ReadFromDisk(dataPath, currentOffset, STANDARD_FLAG_SIZE)
-		if err != nil {
-			if err == io.EOF {
-				break // No more records
-			}
-			return err
-		}
-		recordSize := binary.LittleEndian.Uint64(recordSizeBytes)
-		if recordSize == 0 {
-			break // Invalid record size indicates end
-		}
-		currentOffset = newOffset
-
-		// Read record data
-		recordData, newOffset, err := blockManager.ReadFromDisk(dataPath, currentOffset, recordSize)
-		if err != nil {
-			if err == io.EOF {
-				break // No more records
-			}
-			return err
-		}
-		currentOffset = newOffset
-
-		// Deserialize record
-		rec := record.DeserializeForSSTable(recordData, compressionEnabled)
-
-		// Check if we've reached the range
-		if rec.Key >= rangeStart && rec.Key <= rangeEnd {
-			foundRangeStart = true
-		} else if foundRangeStart && rec.Key > rangeEnd {
-			// We've moved past the range, stop scanning
-			break
-		} else if rec.Key < rangeStart {
-			// We haven't reached the range yet, continue scanning
-			continue
-		}
-
-		// If we're not in the range, skip
-		if rec.Key < rangeStart || rec.Key > rangeEnd {
-			continue
-		}
-
-		// Skip if already tombstoned by higher levels
-		if tombstonedSet[rec.Key] {
-			continue
-		}
-
-		// Skip if already found in newer memtables
-		if bestKeysSet[rec.Key] {
-			continue
-		}
-
-		// Handle tombstones
-		if rec.IsDeleted() {
-			if tombstonedKeys != nil {
-				*tombstonedKeys = append(*tombstonedKeys, rec.Key)
-				tombstonedSet[rec.Key] = true
-			}
-			continue
-		}
-
-		// Add to candidate keys
-		candidateKeys = append(candidateKeys, rec.Key)
-		bestKeysSet[rec.Key] = true
-	}
-
-	// Handle pagination
-	startIndex := pageNumber * pageSize
-	endIndex := startIndex + pageSize
-
-	if startIndex >= len(candidateKeys) {
-		return nil // No keys for this page
-	}
-
-	if endIndex > len(candidateKeys) {
-		endIndex = len(candidateKeys)
-	}
-
-	// Add paginated keys to bestKeys in sorted order
-	if bestKeys != nil {
-		for i := startIndex; i < endIndex; i++ {
-			*bestKeys = insertKeySortedIfNotExists(*bestKeys, candidateKeys[i])
-		}
-	}
-
-	return nil
+	inWindow := func(k string) bool { return k >= rangeStart && k <= rangeEnd }
+	pastWindow := func(k string) bool { return k > rangeEnd }
+	return collectScanKeys(recordsFrom(dataPath, startOffset, compressionEnabled), inWindow, pastWindow, tombstonedKeys, bestKeys, pageSize, pageNumber)
 }
 
 // insertKeySortedIfNotExists inserts a key in sorted order into the slice if it doesn't already exist
@@ -2298,6 +2152,9 @@ func CheckIntegrity(index int) (bool, []block_location.BlockLocation, bool, erro
 		})
 		return false, corruptDataBlocks, true, fmt.Errorf("failed to deserialize SSTable config: %v", err)
 	}
+	if config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		return checkBlockTableIntegrity(newTableHandle(index, config, sizes, offsets))
+	}
 
 	// 2. Construct new Merkle tree
 	dataPath := ""
@@ -2341,7 +2198,7 @@ func CheckIntegrity(index int) (bool, []block_location.BlockLocation, bool, erro
 				FilePath:   dataPath,
 				BlockIndex: currentOffset / BLOCK_SIZE,
 			})
-			if errors.Is(err, io.EOF) || os.IsNotExist(err) || os.IsPermission(err) {
+			if isFatalReadError(err) {
 				return false, corruptDataBlocks, true, fmt.Errorf("failed to read record size: %v", err)
 			}
 		}
@@ -2355,7 +2212,7 @@ func CheckIntegrity(index int) (bool, []block_location.BlockLocation, bool, erro
 				FilePath:   dataPath,
 				BlockIndex: currentOffset / BLOCK_SIZE,
 			})
-			if errors.Is(err, io.EOF) || os.IsNotExist(err) || os.IsPermission(err) {
+			if isFatalReadError(err) {
 				return false, corruptDataBlocks, true, fmt.Errorf("failed to read record data: %v", err)
 			}
 		}
@@ -2365,6 +2222,22 @@ func CheckIntegrity(index int) (bool, []block_location.BlockLocation, bool, erro
 		i++
 	}
 
+	return validateMerkleTree(index, config, sizes, offsets, dataPath, recordHashes, hashToOffset, corruptDataBlocks)
+}
+
+// isFatalReadError reports whether a failed read means the rest of the data cannot be checked either.
+func isFatalReadError(err error) bool {
+	return errors.Is(err, io.EOF) || os.IsNotExist(err) || os.IsPermission(err)
+}
+
+/*
+validateMerkleTree builds a Merkle tree from the hashes of the data read back and compares it to the stored one.
+Mismatched leaves are reported as corrupt blocks of dataPath, through the offsets their hashes were read from.
+*/
+func validateMerkleTree(index int, config *SSTableConfig, sizes []uint64, offsets []uint64, dataPath string,
+	recordHashes [][]byte, hashToOffset map[[md5.Size]byte]uint64, corruptDataBlocks []block_location.BlockLocation) (bool, []block_location.BlockLocation, bool, error) {
+
+	blockManager := block_manager.GetBlockManager()
 	if len(recordHashes) == 0 {
 		emptyLeaf := md5.Sum([]byte{})
 		recordHashes = append(recordHashes, emptyLeaf[:])
@@ -2423,24 +2296,26 @@ func CheckIntegrity(index int) (bool, []block_location.BlockLocation, bool, erro
 Compact performs SSTable compaction by merging multiple SSTables into a single new SSTable.
 The input SSTables are specified by their indexes, sorted by age (newest first).
 The compacted SSTable will be stored at the specified newIndex.
+sourceLevel is the level the input tables come from, it is only recorded in the properties of the new table.
+targetLevel is the level the new table goes to, it decides the filter the table is built with.
+Tombstones are only dropped when the new table goes to the bottom level; anywhere above it they
+still have to shadow older versions of their keys in the deeper levels.
 */
-func Compact(sstableIndexes []int, newIndex int) error {
+func Compact(sstableIndexes []int, newIndex int, sourceLevel int, targetLevel int) error {
 	if len(sstableIndexes) == 0 {
 		return fmt.Errorf("no SSTables provided for compaction")
 	}
 
-	blockManager := block_manager.GetBlockManager()
-
 	// 1. Load configs and initialize iterators
 	iterators := make([]*SSTableIterator, 0, len(sstableIndexes))
 
 	for _, tableIndex := range sstableIndexes {
-		config, sizes, offsets, err := deserializeSSTableConfig(tableIndex)
+		table, err := openTable(tableIndex)
 		if err != nil {
-			return fmt.Errorf("failed to deserialize config for table %d: %v", tableIndex, err)
+			return fmt.Errorf("failed to open table %d: %v", tableIndex, err)
 		}
 
-		iterator, err := initializeIterator(tableIndex, config, sizes, offsets)
+		iterator, err := initializeIterator(table)
 		if err != nil {
 			return fmt.Errorf("failed to initialize iterator for table %d: %v", tableIndex, err)
 		}
@@ -2448,13 +2323,44 @@ func Compact(sstableIndexes []int, newIndex int) error {
 	}
 
 	// 2. Create new SSTable config using global variables
-	newConfig := &SSTableConfig{
-		UseSeparateFiles:   USE_SEPARATE_FILES,
-		CompressionEnabled: COMPRESSION_ENABLED,
-		SparseStepIndex:    uint64(SPARSE_STEP_INDEX),
+	evictTables(newIndex)
+	newConfig, err := newSSTableConfig(targetLevel)
+	if err != nil {
+		return err
+	}
+
+	// 3. Merge the tables, whatever their format, into a table of the configured format
+	inputTables := append([]int(nil), sstableIndexes...)
+	properties := newTableProperties(newConfig, CREATION_REASON_COMPACTION, sourceLevel, inputTables)
+	keepTombstones := targetLevel < BOTTOM_LEVEL
+	if newConfig.FormatVersion == FORMAT_VERSION_BLOCKS {
+		err = writeBlockTable(newIndex, newConfig, properties, func() (*record.Record, error) {
+			return nextCompactedRecord(iterators, keepTombstones), nil
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to write compacted table: %v", err)
+		}
+	} else {
+		err = compactToRecordFormat(iterators, newIndex, newConfig, properties, keepTombstones)
 	}
+	if err != nil {
+		return err
+	}
+
+	// 4. Clean up old SSTable files after successful compaction
+	err = cleanupOldSSTables(sstableIndexes)
+	if err != nil {
+		return fmt.Errorf("compaction succeeded but failed to clean up old files: %v", err)
+	}
+
+	return nil
+}
 
-	// 3. Persist new config
+// compactToRecordFormat streams the merged records of the iterators into a record format table.
+func compactToRecordFormat(iterators []*SSTableIterator, newIndex int, newConfig *SSTableConfig, properties *TableProperties, keepTombstones bool) error {
+	blockManager := block_manager.GetBlockManager()
+
+	// 1. Persist new config
 	serializedConfig, configSize, err := newConfig.serialize()
 	if err != nil {
 		return fmt.Errorf("failed to serialize new config: %v", err)
@@ -2464,7 +2370,7 @@ func Compact(sstableIndexes []int, newIndex int) error {
 		return fmt.Errorf("failed to write new config: %v", err)
 	}
 
-	// 4. Setup data component paths
+	// 2. Setup data component paths
 	dataStartOffset := configSize
 	dataFilePath := fmt.Sprintf(FILE_NAME_FORMAT, newIndex)
 	if USE_SEPARATE_FILES {
@@ -2472,7 +2378,7 @@ func Compact(sstableIndexes []int, newIndex int) error {
 		dataFilePath = fmt.Sprintf(DATA_FILE_NAME_FORMAT, newIndex)
 	}
 
-	// 5. Initialize compaction state (memory-efficient)
+	// 3. Initialize compaction state (memory-efficient)
 	state := &CompactionState{
 		iterators:         iterators,
 		totalNewRecords:   0,
@@ -2483,6 +2389,8 @@ func Compact(sstableIndexes []int, newIndex int) error {
 		currentDataOffset: dataStartOffset,
 		totalLogical:      0,
 		wroteSizePrefix:   false,
+		properties:        properties,
+		keepTombstones:    keepTombstones,
 	}
 
 	if USE_SEPARATE_FILES {
@@ -2492,24 +2400,18 @@ func Compact(sstableIndexes []int, newIndex int) error {
 	// Capture base physical offset for first record start (after CRC and size prefix if any)
 	state.dataPhysicalBase = state.currentDataOffset
 
-	// 6. Perform streaming compaction
+	// 4. Perform streaming compaction
 	err = performStreamingDataCompaction(state)
 	if err != nil {
 		return fmt.Errorf("failed to compact data: %v", err)
 	}
 
-	// 7. Create other components
+	// 5. Create other components
 	err = createCompactedComponentsFromState(state, newIndex, newConfig, dataStartOffset)
 	if err != nil {
 		return fmt.Errorf("failed to create compacted components: %v", err)
 	}
 
-	// 8. Clean up old SSTable files after successful compaction
-	err = cleanupOldSSTables(sstableIndexes)
-	if err != nil {
-		return fmt.Errorf("compaction succeeded but failed to clean up old files: %v", err)
-	}
-
 	return nil
 }
 
@@ -2519,34 +2421,15 @@ func performStreamingDataCompaction(state *CompactionState) error {
 
 	// Track data to accumulate before writing to disk in blocks
 	accumulatedData := []byte{}
-	tombstonedKeys := make(map[string]bool)
 
 	for {
-		// Find the iterator with the smallest current key
-		minIterator := findMinIterator(state.iterators)
-		if minIterator == nil {
+		currentRecord := nextCompactedRecord(state.iterators, state.keepTombstones)
+		if currentRecord == nil {
 			break // All iterators exhausted
 		}
 
-		currentRecord := minIterator.getCurrentRecord()
-		currentKey := currentRecord.Key
-
-		// Check if this key is tombstoned
-		if currentRecord.IsDeleted() {
-			tombstonedKeys[currentKey] = true
-			// Skip this record and all future occurrences of this key
-			skipKeyInAllIterators(state.iterators, currentKey)
-			continue
-		}
-
-		// Check if this key was already tombstoned by a newer SSTable
-		if tombstonedKeys[currentKey] {
-			// Skip this record and all future occurrences of this key
-			skipKeyInAllIterators(state.iterators, currentKey)
-			continue
-		}
-
 		// This is a valid record - serialize and stream it
+		state.properties.add(currentRecord)
 		serializedRecord := currentRecord.SerializeForSSTable(COMPRESSION_ENABLED)
 
 		// Store hash for Merkle tree (only 32 bytes per record)
@@ -2574,11 +2457,6 @@ func performStreamingDataCompaction(state *CompactionState) error {
 		state.totalLogical += recordTotalSize      // total logical bytes since data start
 		state.totalNewRecords++
 
-		// Advance the iterator we consumed from
-		_ = minIterator.advance()
-		// Skip this key in all other iterators
-		skipKeyInAllIterators(state.iterators, currentKey)
-
 		// If accumulated data is approaching a block boundary, flush to disk periodically
 		if len(accumulatedData) > 0 && (uint64(len(accumulatedData))%(BLOCK_SIZE-CRC_SIZE) < STANDARD_FLAG_SIZE) {
 			toWrite := accumulatedData
@@ -2646,6 +2524,36 @@ func performStreamingDataCompaction(state *CompactionState) error {
 	return nil
 }
 
+/*
+nextCompactedRecord returns the newest version of the smallest key left in the iterators and moves every iterator past it.
+Deleted keys are dropped together with their older versions, unless keepTombstones is set; then the tombstone
+is returned in their place. Returns nil once all iterators are exhausted.
+*/
+func nextCompactedRecord(iterators []*SSTableIterator, keepTombstones bool) *record.Record {
+	for {
+		// Find the iterator with the smallest current key
+		minIterator := findMinIterator(iterators)
+		if minIterator == nil {
+			return nil
+		}
+
+		currentRecord := minIterator.getCurrentRecord()
+		currentKey := currentRecord.Key
+
+		// Check if this key is tombstoned
+		if currentRecord.IsDeleted() && !keepTombstones {
+			// Skip this record and all future occurrences of this key
+			skipKeyInAllIterators(iterators, currentKey)
+			continue
+		}
+
+		// Advance the iterator we consumed from, then skip this key in all other iterators
+		_ = minIterator.advance()
+		skipKeyInAllIterators(iterators, currentKey)
+		return currentRecord
+	}
+}
+
 // findMinIterator finds the iterator with the smallest current key
 func findMinIterator(iterators []*SSTableIterator) *SSTableIterator {
 	var minIterator *SSTableIterator
@@ -2732,8 +2640,11 @@ func createCompactedComponentsFromState(state *CompactionState, newIndex int, co
 			filterFilePath = fmt.Sprintf(FILTER_FILE_NAME_FORMAT, newIndex)
 			filterStartOffset = 0
 		}
-		bf := bloom_filter.NewBloomFilter(1, BLOOM_FILTER_FALSE_POSITIVE_RATE)
-		filterComp := &FilterComp{FilePath: filterFilePath, StartOffset: filterStartOffset, BloomFilter: bf}
+		emptyFilter, err := config.buildFilter(nil)
+		if err != nil {
+			return err
+		}
+		filterComp := &FilterComp{FilePath: filterFilePath, StartOffset: filterStartOffset, Filter: emptyFilter}
 		filterBytes, filterSize, err := filterComp.serialize()
 		if err != nil {
 			return err
@@ -2762,15 +2673,9 @@ func createCompactedComponentsFromState(state *CompactionState, newIndex int, co
 			return err
 		}
 
-		// Update main config if single-file mode
-		if !USE_SEPARATE_FILES {
-			sizes := []uint64{0, idxSize, sumSize, filterSize, metaSize}
-			offsets := []uint64{dataStartOffset, indexStartOffset, summaryStartOffset, filterStartOffset, metaDataStartOffset}
-			if err := config.addSizeDataToConfig(sizes, offsets, newIndex); err != nil {
-				return err
-			}
-		}
-		return nil
+		sizes := []uint64{0, idxSize, sumSize, filterSize, metaSize}
+		offsets := []uint64{dataStartOffset, indexStartOffset, summaryStartOffset, filterStartOffset, metaDataStartOffset}
+		return config.writeFooter(sizes, offsets, state.properties, fmt.Sprintf(FILE_NAME_FORMAT, newIndex))
 	}
 
 	// Calculate data size (logical, without CRCs). In single-file mode this is needed for index offset.
@@ -2839,33 +2744,19 @@ func createCompactedComponentsFromState(state *CompactionState, newIndex int, co
 		filterStartOffset = 0
 	}
 
-	expected := len(state.indexEntries)
-	if expected <= 0 {
-		expected = 1
+	keys := make([]string, len(state.indexEntries))
+	for i, entry := range state.indexEntries {
+		keys[i] = entry.Key
 	}
-	bloomFilter := bloom_filter.NewBloomFilter(expected, BLOOM_FILTER_FALSE_POSITIVE_RATE)
-	for _, entry := range state.indexEntries {
-		bloomFilter.Add([]byte(entry.Key))
-
-		// Add prefixes
-		keyLen := len(entry.Key)
-		maxPrefixLen := 10
-		if keyLen < maxPrefixLen {
-			maxPrefixLen = keyLen
-		}
-
-		for prefixLen := 1; prefixLen <= maxPrefixLen; prefixLen++ {
-			prefix := entry.Key[:prefixLen]
-			prefixWithMarker := prependPrefixPrefix(prefix)
-			bloomFilter.Add([]byte(prefixWithMarker))
-		}
+	filter, err := config.buildFilter(keys)
+	if err != nil {
+		return err
 	}
-	bloomFilter.Add([]byte(prependPrefixPrefix("")))
 
 	filterComp := &FilterComp{
 		FilePath:    filterFilePath,
 		StartOffset: filterStartOffset,
-		BloomFilter: bloomFilter,
+		Filter:      filter,
 	}
 
 	serializedFilter, filterSize, err := filterComp.serialize()
@@ -2904,10 +2795,10 @@ func createCompactedComponentsFromState(state *CompactionState, newIndex int, co
 		return err
 	}
 
-	// 5. Update config with component sizes and offsets (if single file mode)
+	// 5. Close the table with a footer holding the component sizes and offsets
 	sizes := []uint64{dataSize, indexSize, summarySize, filterSize, metadataSize}
 	offsets := []uint64{dataStartOffset, indexStartOffset, summaryStartOffset, filterStartOffset, metaDataStartOffset}
-	err = config.addSizeDataToConfig(sizes, offsets, newIndex)
+	err = config.writeFooter(sizes, offsets, state.properties, fmt.Sprintf(FILE_NAME_FORMAT, newIndex))
 	if err != nil {
 		return err
 	}
@@ -2915,8 +2806,37 @@ func createCompactedComponentsFromState(state *CompactionState, newIndex int, co
 	return nil
 }
 
+// Size returns the number of bytes the SSTable occupies on disk, across all of its files.
+func Size(index int) (int64, error) {
+	// Either layout stores the config in the main file, the component files only exist when they are separate
+	info, err := os.Stat(fmt.Sprintf(FILE_NAME_FORMAT, index))
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	componentFileNames := []string{
+		DATA_FILE_NAME_FORMAT,
+		INDEX_FILE_NAME_FORMAT,
+		SUMMARY_FILE_NAME_FORMAT,
+		FILTER_FILE_NAME_FORMAT,
+		METADATA_FILE_NAME_FORMAT,
+	}
+	for _, format := range componentFileNames {
+		info, err := os.Stat(fmt.Sprintf(format, index))
+		if err == nil {
+			size += info.Size()
+		} else if !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
 // cleanupOldSSTables removes the files of old SSTables after successful compaction
 func cleanupOldSSTables(sstableIndexes []int) error {
+	// Removed tables must not be served from the table cache, even if deleting their files fails
+	evictTables(sstableIndexes...)
 	for _, index := range sstableIndexes {
 		// Get config to determine if using separate files
 		config, _, _, err := deserializeSSTableConfig(index)
@@ -2,15 +2,22 @@ package sstable
 
 import (
 	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	block_manager "hunddb/lsm/block_manager"
+	block_codec "hunddb/lsm/sstable/block_codec"
+	filter_policy "hunddb/lsm/sstable/filter_policy"
 	record "hunddb/model/record"
+	crc_util "hunddb/utils/crc"
 )
 
 // Test helper functions
@@ -1190,6 +1197,639 @@ func TestGetSSBoundaries_InvalidIndex(t *testing.T) {
 	}
 }
 
+func TestSize_BothLayouts(t *testing.T) {
+	setupTestDir(t)
+
+	originalUseSeparateFiles := USE_SEPARATE_FILES
+	defer func() { USE_SEPARATE_FILES = originalUseSeparateFiles }()
+
+	for i, separate := range []bool{true, false} {
+		USE_SEPARATE_FILES = separate
+		index := 310 + i
+		if err := PersistMemtable(createTestRecords(20), index); err != nil {
+			t.Fatalf("persist: %v", err)
+		}
+
+		expected := getFileSize(fmt.Sprintf(FILE_NAME_FORMAT, index))
+		if separate {
+			expected += getFileSize(fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)) +
+				getFileSize(fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)) +
+				getFileSize(fmt.Sprintf(SUMMARY_FILE_NAME_FORMAT, index)) +
+				getFileSize(fmt.Sprintf(FILTER_FILE_NAME_FORMAT, index)) +
+				getFileSize(fmt.Sprintf(METADATA_FILE_NAME_FORMAT, index))
+		}
+		size, err := Size(index)
+		if err != nil {
+			t.Fatalf("Size error (separate=%v): %v", separate, err)
+		}
+		if size != expected || size == 0 {
+			t.Errorf("unexpected size (separate=%v): got %d, expected %d", separate, size, expected)
+		}
+	}
+
+	if _, err := Size(999); err == nil {
+		t.Errorf("expected error for invalid index")
+	}
+}
+
+// Tests for the table cache
+
+func TestTableCache_ReusesAndEvictsHandles(t *testing.T) {
+	setupTestDir(t)
+
+	originalUseSeparateFiles := USE_SEPARATE_FILES
+	defer func() { USE_SEPARATE_FILES = originalUseSeparateFiles }()
+
+	for i, separate := range []bool{true, false} {
+		USE_SEPARATE_FILES = separate
+		index := 320 + i
+		if err := PersistMemtable(createTestRecords(20), index); err != nil {
+			t.Fatalf("persist: %v", err)
+		}
+
+		if rec, err := Get("key_005", index); err != nil || rec == nil {
+			t.Fatalf("Get error (separate=%v): %v %v", separate, rec, err)
+		}
+		first, err := openTable(index)
+		if err != nil {
+			t.Fatalf("openTable error (separate=%v): %v", separate, err)
+		}
+		second, _ := openTable(index)
+		if first != second {
+			t.Errorf("expected the cached handle to be reused (separate=%v)", separate)
+		}
+		if first.firstKey != "key_000" || first.lastKey != "key_019" {
+			t.Errorf("unexpected bounds (separate=%v): %s - %s", separate, first.firstKey, first.lastKey)
+		}
+
+		// Deleted tables must not be served from the cache
+		if err := cleanupOldSSTables([]int{index}); err != nil {
+			t.Fatalf("cleanup: %v", err)
+		}
+		if getTableCache().Contains(index) {
+			t.Errorf("expected the handle to be evicted with its files (separate=%v)", separate)
+		}
+	}
+}
+
+func TestTableCache_RewrittenIndex(t *testing.T) {
+	setupTestDir(t)
+
+	if err := PersistMemtable(createTestRecords(5), 330); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	if _, _, err := GetSSBoundaries(330); err != nil {
+		t.Fatalf("GetSSBoundaries error: %v", err)
+	}
+
+	// Writing the same index again, as a retried flush does, must not leave the old handle behind
+	replacement := []record.Record{
+		*record.NewRecord("other_1", []byte("a"), uint64(time.Now().Unix()), false),
+		*record.NewRecord("other_2", []byte("b"), uint64(time.Now().Unix()), false),
+	}
+	if err := PersistMemtable(replacement, 330); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	first, last, err := GetSSBoundaries(330)
+	if err != nil || first != "other_1" || last != "other_2" {
+		t.Errorf("expected the bounds of the rewritten table, got %s - %s (%v)", first, last, err)
+	}
+	if rec, err := Get("other_2", 330); err != nil || rec == nil || string(rec.Value) != "b" {
+		t.Errorf("expected other_2 in the rewritten table, got %v %v", rec, err)
+	}
+}
+
+// Tests for the block format
+
+// useBlockFormat writes new tables in the block format with small data blocks, so a few hundred records span many of them.
+func useBlockFormat(t *testing.T, dataBlockSize uint64, restartInterval uint64) {
+	originalFormat, originalBlockSize, originalInterval := FORMAT_VERSION, DATA_BLOCK_SIZE, BLOCK_RESTART_INTERVAL
+	t.Cleanup(func() {
+		FORMAT_VERSION, DATA_BLOCK_SIZE, BLOCK_RESTART_INTERVAL = originalFormat, originalBlockSize, originalInterval
+	})
+	FORMAT_VERSION, DATA_BLOCK_SIZE, BLOCK_RESTART_INTERVAL = FORMAT_VERSION_BLOCKS, dataBlockSize, restartInterval
+}
+
+func createPrefixedTestRecords(count int, prefix string, version string) []record.Record {
+	records := make([]record.Record, count)
+	for i := 0; i < count; i++ {
+		records[i] = *record.NewRecord(
+			fmt.Sprintf("%s%04d", prefix, i),
+			[]byte(fmt.Sprintf("%s_%04d", version, i)),
+			uint64(time.Now().Unix())+uint64(i),
+			i%7 == 3, // Some tombstones between restart points
+		)
+	}
+	return records
+}
+
+func TestBlockFormat_GetAcrossBlocksAndRestartPoints(t *testing.T) {
+	setupTestDir(t)
+	useBlockFormat(t, 256, 4)
+
+	originalUseSeparateFiles := USE_SEPARATE_FILES
+	defer func() { USE_SEPARATE_FILES = originalUseSeparateFiles }()
+
+	records := createPrefixedTestRecords(300, "user_", "v1")
+	for i, separate := range []bool{true, false} {
+		USE_SEPARATE_FILES = separate
+		index := 340 + i
+		if err := PersistMemtable(records, index); err != nil {
+			t.Fatalf("persist (separate=%v): %v", separate, err)
+		}
+
+		table, err := openTable(index)
+		if err != nil {
+			t.Fatalf("openTable (separate=%v): %v", separate, err)
+		}
+		if table.config.FormatVersion != FORMAT_VERSION_BLOCKS {
+			t.Fatalf("expected a block format table, got format %d", table.config.FormatVersion)
+		}
+		if err := table.loadBounds(); err != nil {
+			t.Fatalf("loadBounds (separate=%v): %v", separate, err)
+		}
+		if len(table.blocks) < 2 || len(table.blocks) >= len(records)/4 {
+			t.Errorf("expected a few records per data block, got %d blocks for %d records", len(table.blocks), len(records))
+		}
+		if table.firstKey != "user_0000" || table.lastKey != "user_0299" || table.recordCount != 300 {
+			t.Errorf("unexpected summary: %s - %s, %d records", table.firstKey, table.lastKey, table.recordCount)
+		}
+
+		for _, rec := range records {
+			got, err := Get(rec.Key, index)
+			if err != nil {
+				t.Fatalf("Get(%s) error (separate=%v): %v", rec.Key, separate, err)
+			}
+			if rec.Tombstone {
+				if got != nil {
+					t.Errorf("expected deleted %s to be nil, got %s", rec.Key, got.Value)
+				}
+				continue
+			}
+			if got == nil || string(got.Value) != string(rec.Value) || got.Timestamp != rec.Timestamp {
+				t.Errorf("Get(%s) = %v, want %s (separate=%v)", rec.Key, got, rec.Value, separate)
+			}
+		}
+		for _, missing := range []string{"a", "user_0010a", "user_1000", "z"} {
+			if got, err := Get(missing, index); err != nil || got != nil {
+				t.Errorf("Get(%s) = %v, %v, want nothing", missing, got, err)
+			}
+		}
+
+		valid, corruptBlocks, fatal, err := CheckIntegrity(index)
+		if !valid || fatal || err != nil || len(corruptBlocks) > 0 {
+			t.Errorf("CheckIntegrity (separate=%v) = %v, %v, %v, %v", separate, valid, corruptBlocks, fatal, err)
+		}
+	}
+}
+
+func TestBlockFormat_IndexSmallerThanRecordFormat(t *testing.T) {
+	setupTestDir(t)
+
+	originalFormat, originalUseSeparateFiles := FORMAT_VERSION, USE_SEPARATE_FILES
+	defer func() { FORMAT_VERSION, USE_SEPARATE_FILES = originalFormat, originalUseSeparateFiles }()
+	USE_SEPARATE_FILES = true
+
+	records := createPrefixedTestRecords(500, "customer_", "v1")
+	FORMAT_VERSION = FORMAT_VERSION_RECORDS
+	if err := PersistMemtable(records, 342); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	useBlockFormat(t, 4096, 16)
+	if err := PersistMemtable(records, 343); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+
+	recordIndex := getFileSize(fmt.Sprintf(INDEX_FILE_NAME_FORMAT, 342))
+	blockIndex := getFileSize(fmt.Sprintf(INDEX_FILE_NAME_FORMAT, 343))
+	if blockIndex >= recordIndex {
+		t.Errorf("expected the block index to be smaller, got %d bytes against %d", blockIndex, recordIndex)
+	}
+	recordData := getFileSize(fmt.Sprintf(DATA_FILE_NAME_FORMAT, 342))
+	blockData := getFileSize(fmt.Sprintf(DATA_FILE_NAME_FORMAT, 343))
+	if blockData > recordData {
+		t.Errorf("expected prefix compressed data to be no larger, got %d bytes against %d", blockData, recordData)
+	}
+}
+
+func TestBlockFormat_CompactionUpgradesRecordTables(t *testing.T) {
+	setupTestDir(t)
+
+	originalFormat := FORMAT_VERSION
+	defer func() { FORMAT_VERSION = originalFormat }()
+
+	// The older table is written in the record format, the newer one overwrites every other key
+	FORMAT_VERSION = FORMAT_VERSION_RECORDS
+	older := createPrefixedTestRecords(100, "item_", "old")
+	for i := range older {
+		older[i].Tombstone = false
+	}
+	if err := PersistMemtable(older, 344); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	useBlockFormat(t, 200, 3)
+	newer := make([]record.Record, 0)
+	for i := 0; i < 100; i += 2 {
+		rec := record.NewRecord(fmt.Sprintf("item_%04d", i), []byte(fmt.Sprintf("new_%04d", i)), uint64(time.Now().Unix()), i%10 == 0)
+		newer = append(newer, *rec)
+	}
+	if err := PersistMemtable(newer, 345); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+
+	if err := Compact([]int{345, 344}, 346, 0, 1); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	table, err := openTable(346)
+	if err != nil || table.config.FormatVersion != FORMAT_VERSION_BLOCKS {
+		t.Fatalf("expected the compacted table in the block format, got %v %v", table, err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("item_%04d", i)
+		got, err := Get(key, 346)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		switch {
+		case i%10 == 0:
+			if got != nil {
+				t.Errorf("expected deleted %s to be dropped, got %s", key, got.Value)
+			}
+		case i%2 == 0:
+			if got == nil || string(got.Value) != fmt.Sprintf("new_%04d", i) {
+				t.Errorf("expected the newer version of %s, got %v", key, got)
+			}
+		default:
+			if got == nil || string(got.Value) != fmt.Sprintf("old_%04d", i) {
+				t.Errorf("expected the older version of %s, got %v", key, got)
+			}
+		}
+	}
+
+	// Prefix and range reads walk the data blocks in order
+	bestKeys := make([]string, 0)
+	if err := ScanForPrefix("item_001", &[]string{}, &bestKeys, 50, 0, 346); err != nil {
+		t.Fatalf("ScanForPrefix: %v", err)
+	}
+	expected := []string{"item_0011", "item_0012", "item_0013", "item_0014", "item_0015", "item_0016", "item_0017", "item_0018", "item_0019"}
+	if strings.Join(bestKeys, ",") != strings.Join(expected, ",") {
+		t.Errorf("ScanForPrefix = %v, want %v", bestKeys, expected)
+	}
+	next, err := GetNextForRange("item_0019", "item_0030", "item_0019", &[]string{}, 346)
+	if err != nil || next == nil || next.Key != "item_0021" {
+		t.Errorf("GetNextForRange = %v, %v, want item_0021", next, err)
+	}
+	next, err = GetNextForPrefix("item_002", "item_0028", &[]string{}, 346)
+	if err != nil || next == nil || next.Key != "item_0029" {
+		t.Errorf("GetNextForPrefix = %v, %v, want item_0029", next, err)
+	}
+}
+
+func TestBlockFormat_CompressedDataBlocks(t *testing.T) {
+	setupTestDir(t)
+	useBlockFormat(t, 1024, 8)
+
+	originalCompression, originalUseSeparateFiles := BLOCK_COMPRESSION, USE_SEPARATE_FILES
+	defer func() { BLOCK_COMPRESSION, USE_SEPARATE_FILES = originalCompression, originalUseSeparateFiles }()
+	USE_SEPARATE_FILES = true
+
+	records := createPrefixedTestRecords(300, "order_", "v1")
+	for i := range records {
+		records[i].Value = []byte(strings.Repeat(fmt.Sprintf("status=shipped;item=%d;", i%5), 8))
+	}
+	for index, codec := range map[int]string{347: block_codec.None, 348: block_codec.Deflate, 349: block_codec.Gzip} {
+		BLOCK_COMPRESSION = codec
+		if err := PersistMemtable(records, index); err != nil {
+			t.Fatalf("persist with %s: %v", codec, err)
+		}
+	}
+
+	uncompressed := getFileSize(fmt.Sprintf(DATA_FILE_NAME_FORMAT, 347))
+	for _, index := range []int{348, 349} {
+		if compressed := getFileSize(fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)); compressed >= uncompressed {
+			t.Errorf("expected table %d to be compressed, got %d bytes against %d", index, compressed, uncompressed)
+		}
+		valid, corruptBlocks, fatal, err := CheckIntegrity(index)
+		if !valid || fatal || err != nil || len(corruptBlocks) > 0 {
+			t.Errorf("CheckIntegrity(%d) = %v, %v, %v, %v", index, valid, corruptBlocks, fatal, err)
+		}
+	}
+
+	// The codec is recorded per table, so tables of different codecs compact into one of the current codec
+	BLOCK_COMPRESSION = block_codec.Deflate
+	if err := Compact([]int{349, 348}, 350, 0, 1); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	table, err := openTable(350)
+	if err != nil || table.config.BlockCodec != block_codec.DEFLATE_ID {
+		t.Fatalf("expected the compacted table to use deflate, got %v %v", table, err)
+	}
+	for _, rec := range records {
+		got, err := Get(rec.Key, 350)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", rec.Key, err)
+		}
+		if rec.Tombstone {
+			if got != nil {
+				t.Errorf("expected deleted %s to be dropped, got %s", rec.Key, got.Value)
+			}
+			continue
+		}
+		if got == nil || string(got.Value) != string(rec.Value) {
+			t.Errorf("Get(%s) = %v, want %s", rec.Key, got, rec.Value)
+		}
+	}
+
+	BLOCK_COMPRESSION = "snappy"
+	if err := PersistMemtable(records, 351); err == nil {
+		t.Error("expected an unknown block compression to be reported")
+	}
+}
+
+// downgradeToLegacyLayout rewrites a table the way it was written before footers,
+// with the component handles in the Config block and no footer.
+func downgradeToLegacyLayout(t *testing.T, index int) {
+	footer, found, err := readFooter(index)
+	if err != nil || !found {
+		t.Fatalf("expected table %d to have a footer, got %v %v", index, found, err)
+	}
+	config, _, _, err := deserializeSSTableConfig(index)
+	if err != nil {
+		t.Fatalf("deserialize config: %v", err)
+	}
+	configBlock, _, _ := config.serialize()
+	if !config.UseSeparateFiles {
+		position := CRC_SIZE + 1 + 1 + 8
+		for i := 0; i < COMPONENT_COUNT; i++ {
+			binary.LittleEndian.PutUint64(configBlock[position:], footer.sizes[i])
+			binary.LittleEndian.PutUint64(configBlock[position+STANDARD_FLAG_SIZE:], footer.offsets[i])
+			position += 2 * STANDARD_FLAG_SIZE
+		}
+		configBlock = crc_util.AddCRCToBlockData(configBlock)
+	}
+
+	filePath := fmt.Sprintf(FILE_NAME_FORMAT, index)
+	if err := block_manager.GetBlockManager().WriteToDisk(configBlock, filePath, 0); err != nil {
+		t.Fatalf("rewrite config block: %v", err)
+	}
+	if err := os.Truncate(filePath, int64(getFileSize(filePath))-int64(BLOCK_SIZE)); err != nil {
+		t.Fatalf("drop footer: %v", err)
+	}
+	block_manager.GetBlockManager().ClearCache()
+	evictTables(index)
+}
+
+func TestFooter_LegacyTablesReadableAndUpgradedByCompaction(t *testing.T) {
+	setupTestDir(t)
+
+	originalFormat, originalUseSeparateFiles := FORMAT_VERSION, USE_SEPARATE_FILES
+	defer func() { FORMAT_VERSION, USE_SEPARATE_FILES = originalFormat, originalUseSeparateFiles }()
+
+	records := createPrefixedTestRecords(120, "legacy_", "v1")
+	tables := []struct {
+		index    int
+		format   uint8
+		separate bool
+	}{
+		{352, FORMAT_VERSION_RECORDS, false},
+		{353, FORMAT_VERSION_RECORDS, true},
+		{354, FORMAT_VERSION_BLOCKS, false},
+		{355, FORMAT_VERSION_BLOCKS, true},
+	}
+	for _, table := range tables {
+		FORMAT_VERSION, USE_SEPARATE_FILES = table.format, table.separate
+		if err := PersistMemtable(records, table.index); err != nil {
+			t.Fatalf("persist %d: %v", table.index, err)
+		}
+		downgradeToLegacyLayout(t, table.index)
+		if _, found, err := readFooter(table.index); found || err != nil {
+			t.Fatalf("expected table %d without a footer, got %v %v", table.index, found, err)
+		}
+
+		for _, rec := range records {
+			got, err := Get(rec.Key, table.index)
+			if err != nil {
+				t.Fatalf("Get(%s, %d): %v", rec.Key, table.index, err)
+			}
+			if !rec.Tombstone && (got == nil || string(got.Value) != string(rec.Value)) {
+				t.Errorf("Get(%s, %d) = %v, want %s", rec.Key, table.index, got, rec.Value)
+			}
+		}
+		valid, corruptBlocks, fatal, err := CheckIntegrity(table.index)
+		if !valid || fatal || err != nil || len(corruptBlocks) > 0 {
+			t.Errorf("CheckIntegrity(%d) = %v, %v, %v, %v", table.index, valid, corruptBlocks, fatal, err)
+		}
+	}
+
+	FORMAT_VERSION, USE_SEPARATE_FILES = FORMAT_VERSION_BLOCKS, false
+	if err := Compact([]int{355, 354, 353, 352}, 356, 0, 1); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	footer, found, err := readFooter(356)
+	if err != nil || !found || footer.formatVersion != FORMAT_VERSION_BLOCKS || footer.checksumType != CHECKSUM_TYPE_CRC32 {
+		t.Fatalf("expected the compacted table to have a footer, got %v %v %v", footer, found, err)
+	}
+	if got, err := Get("legacy_0011", 356); err != nil || got == nil || string(got.Value) != "v1_0011" {
+		t.Errorf("Get(legacy_0011) = %v, %v", got, err)
+	}
+}
+
+func TestFooter_RejectsForeignFilesAndUnknownVersions(t *testing.T) {
+	setupTestDir(t)
+	block_manager.GetBlockManager().ClearCache()
+
+	// Two blocks of noise, with a valid CRC on the first and a format version byte a legacy table could have,
+	// so only the layout checks can catch it
+	noise := make([]byte, 2*BLOCK_SIZE)
+	for i := range noise {
+		noise[i] = byte(i*31 + 7)
+	}
+	noise[CONFIG_FORMAT_VERSION_OFFSET] = 0
+	crc_util.AddCRCToBlockData(noise[:BLOCK_SIZE])
+	if err := os.WriteFile(fmt.Sprintf(FILE_NAME_FORMAT, 357), noise, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get("key", 357); err == nil || !strings.Contains(err.Error(), "is not an SSTable") {
+		t.Errorf("expected a file that is not an SSTable to be rejected, got %v", err)
+	}
+
+	// A block file of another kind, mostly padding like a small state file
+	foreign := make([]byte, BLOCK_SIZE)
+	copy(foreign[CRC_SIZE:], []byte{1, 0, 0, 0, 0, 0, 0, 0, 42})
+	crc_util.AddCRCToBlockData(foreign)
+	if err := os.WriteFile(fmt.Sprintf(FILE_NAME_FORMAT, 390), foreign, 0644); err != nil {
+		t.Fatal(err)
+	}
+	block_manager.GetBlockManager().ClearCache()
+	if _, err := Get("key", 390); err == nil || !strings.Contains(err.Error(), "is not an SSTable") {
+		t.Errorf("expected a foreign block file to be rejected, got %v", err)
+	}
+
+	if err := PersistMemtable(createPrefixedTestRecords(10, "key_", "v1"), 358); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	filePath := fmt.Sprintf(FILE_NAME_FORMAT, 358)
+	blockCount, _ := block_manager.GetBlockManager().BlockCount(filePath)
+	footerBlock, _, err := block_manager.GetBlockManager().ReadFromDisk(filePath, (blockCount-1)*BLOCK_SIZE, BLOCK_SIZE-CRC_SIZE)
+	if err != nil {
+		t.Fatalf("read footer: %v", err)
+	}
+	futureFooter := append(make([]byte, CRC_SIZE), footerBlock...)
+	binary.LittleEndian.PutUint32(futureFooter[BLOCK_SIZE-FOOTER_MAGIC_SIZE-FOOTER_VERSION_SIZE:], FOOTER_VERSION+1)
+	if err := block_manager.GetBlockManager().WriteToDisk(crc_util.AddCRCToBlockData(futureFooter), filePath, (blockCount-1)*BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	block_manager.GetBlockManager().ClearCache()
+	evictTables(358)
+	if _, err := Get("key_0001", 358); err == nil || !strings.Contains(err.Error(), "unsupported footer version") {
+		t.Errorf("expected an unsupported footer version error, got %v", err)
+	}
+}
+
+func TestProperties_CollectedOnFlushAndCompaction(t *testing.T) {
+	setupTestDir(t)
+
+	originalFormat, originalUseSeparateFiles := FORMAT_VERSION, USE_SEPARATE_FILES
+	defer func() { FORMAT_VERSION, USE_SEPARATE_FILES = originalFormat, originalUseSeparateFiles }()
+
+	records := createPrefixedTestRecords(70, "prop_", "v1") // Every 7th record is a tombstone
+	rawKeyBytes, rawValueBytes := uint64(0), uint64(0)
+	for _, rec := range records {
+		rawKeyBytes += uint64(len(rec.Key))
+		rawValueBytes += uint64(len(rec.Value))
+	}
+
+	for i, format := range []uint8{FORMAT_VERSION_RECORDS, FORMAT_VERSION_BLOCKS} {
+		FORMAT_VERSION, USE_SEPARATE_FILES = format, i%2 == 0
+		index := 359 + i
+		if err := PersistMemtable(records, index); err != nil {
+			t.Fatalf("persist: %v", err)
+		}
+		properties, err := GetProperties(index)
+		if err != nil || properties == nil {
+			t.Fatalf("GetProperties(%d) = %v, %v", index, properties, err)
+		}
+		if properties.RecordCount != 70 || properties.TombstoneCount != 10 ||
+			properties.RawKeyBytes != rawKeyBytes || properties.RawValueBytes != rawValueBytes {
+			t.Errorf("unexpected counts for format %d: %+v", format, properties)
+		}
+		if properties.MinTimestamp != records[0].Timestamp || properties.MaxTimestamp != records[69].Timestamp {
+			t.Errorf("unexpected timestamps for format %d: %+v", format, properties)
+		}
+		if properties.CreationReason != CREATION_REASON_FLUSH || properties.SourceLevel != SOURCE_LEVEL_MEMTABLE ||
+			len(properties.InputTables) != 0 || properties.FormatVersion != format || properties.BlockCompression != block_codec.None {
+			t.Errorf("unexpected flush details for format %d: %+v", format, properties)
+		}
+	}
+
+	if err := Compact([]int{360, 359}, 361, 2, BOTTOM_LEVEL); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	properties, err := GetProperties(361)
+	if err != nil || properties == nil {
+		t.Fatalf("GetProperties(361) = %v, %v", properties, err)
+	}
+	if properties.CreationReason != CREATION_REASON_COMPACTION || properties.SourceLevel != 2 ||
+		strings.Trim(fmt.Sprint(properties.InputTables), "[]") != "360 359" {
+		t.Errorf("unexpected compaction details: %+v", properties)
+	}
+	if properties.RecordCount != 60 || properties.TombstoneCount != 0 || properties.TombstoneRatio() != 0 {
+		t.Errorf("expected compaction to the bottom level to drop the tombstones, got %+v", properties)
+	}
+
+	// Tables written before properties have none
+	downgradeToLegacyLayout(t, 361)
+	if properties, err := GetProperties(361); err != nil || properties != nil {
+		t.Errorf("GetProperties of a legacy table = %v, %v, want nothing", properties, err)
+	}
+}
+
+func TestWriter_BuildsIngestibleTable(t *testing.T) {
+	dir := setupTestDir(t)
+	useBlockFormat(t, 512, 8)
+
+	path := filepath.Join(dir, "external.sst")
+	writer, err := NewWriter(path)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("bulk_%04d", i)
+		if i%50 == 7 {
+			err = writer.Delete(key)
+		} else {
+			err = writer.Put(key, []byte(fmt.Sprintf("value_%04d", i)))
+		}
+		if err != nil {
+			t.Fatalf("adding %s: %v", key, err)
+		}
+	}
+	if err := writer.Put("bulk_0100", []byte("late")); err == nil {
+		t.Error("expected a key out of order to be rejected")
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if err := writer.Put("bulk_9999", nil); err == nil {
+		t.Error("expected a finished writer to reject records")
+	}
+	if _, err := NewWriter(path); err == nil {
+		t.Error("expected NewWriter to refuse an existing file")
+	}
+
+	// Linked in under an index, the file is an ordinary table
+	if err := os.Link(path, fmt.Sprintf(FILE_NAME_FORMAT, 362)); err != nil {
+		t.Fatal(err)
+	}
+	minKey, maxKey, err := ValidateExternalFile(362)
+	if err != nil || minKey != "bulk_0000" || maxKey != "bulk_0199" {
+		t.Fatalf("ValidateExternalFile = %s, %s, %v", minKey, maxKey, err)
+	}
+	for _, i := range []int{0, 7, 57, 120, 199} {
+		key := fmt.Sprintf("bulk_%04d", i)
+		got, err := Get(key, 362)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		if i%50 == 7 {
+			if got != nil {
+				t.Errorf("expected deleted %s to be hidden, got %s", key, got.Value)
+			}
+		} else if got == nil || string(got.Value) != fmt.Sprintf("value_%04d", i) {
+			t.Errorf("Get(%s) = %v, want value_%04d", key, got, i)
+		}
+	}
+	valid, corruptBlocks, fatal, err := CheckIntegrity(362)
+	if !valid || fatal || err != nil || len(corruptBlocks) > 0 {
+		t.Errorf("CheckIntegrity = %v, %v, %v, %v", valid, corruptBlocks, fatal, err)
+	}
+	properties, err := GetProperties(362)
+	if err != nil || properties == nil || properties.CreationReason != CREATION_REASON_INGESTION ||
+		properties.SourceLevel != SOURCE_LEVEL_EXTERNAL || properties.RecordCount != 200 || properties.TombstoneCount != 4 {
+		t.Errorf("GetProperties = %+v, %v", properties, err)
+	}
+
+	empty, err := NewWriter(filepath.Join(dir, "empty.sst"))
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := empty.Finish(); err == nil {
+		t.Error("expected a table without records to be refused")
+	}
+
+	// Tables split over several files can't be moved in as one file
+	originalUseSeparateFiles := USE_SEPARATE_FILES
+	defer func() { USE_SEPARATE_FILES = originalUseSeparateFiles }()
+	USE_SEPARATE_FILES = true
+	if err := PersistMemtable(createPrefixedTestRecords(10, "split_", "v1"), 363); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	if _, _, err := ValidateExternalFile(363); err == nil {
+		t.Error("expected a table in separate files to be refused")
+	}
+}
+
 //  Benchmark tests for Get method
 
 func BenchmarkGet_Found(b *testing.B) {
@@ -4103,7 +4743,7 @@ func TestCompact_BasicFunctionality(t *testing.T) {
 	}
 
 	// Compact SSTables
-	err = Compact([]int{1, 2}, 3)
+	err = Compact([]int{1, 2}, 3, 0, 1)
 	if err != nil {
 		t.Fatalf("Compaction failed: %v", err)
 	}
@@ -4184,7 +4824,7 @@ func TestCompact_WithTombstones(t *testing.T) {
 	}
 
 	// Compact SSTables (2 is newer, so it comes first)
-	err = Compact([]int{2, 1}, 3)
+	err = Compact([]int{2, 1}, 3, 0, 1)
 	if err != nil {
 		t.Fatalf("Compaction failed: %v", err)
 	}
@@ -4253,7 +4893,7 @@ func TestCompact_OverlappingKeys(t *testing.T) {
 	}
 
 	// Compact SSTables (2 is newer, so it comes first)
-	err = Compact([]int{2, 1}, 3)
+	err = Compact([]int{2, 1}, 3, 0, 1)
 	if err != nil {
 		t.Fatalf("Compaction failed: %v", err)
 	}
@@ -4316,7 +4956,7 @@ func TestCompact_SingleFileMode(t *testing.T) {
 	}
 
 	// Compact SSTables
-	err = Compact([]int{1, 2}, 3)
+	err = Compact([]int{1, 2}, 3, 0, 1)
 	if err != nil {
 		t.Fatalf("Compaction failed: %v", err)
 	}
@@ -4376,7 +5016,7 @@ func BenchmarkCompact_Small(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := Compact([]int{1, 2}, 3+i); err != nil {
+		if err := Compact([]int{1, 2}, 3+i, 0, 1); err != nil {
 			b.Fatalf("Compaction failed: %v", err)
 		}
 	}
@@ -4460,7 +5100,7 @@ func TestCompact_MultiSSTables_OverlapAndTombstones(t *testing.T) {
 			}
 
 			// Compact newest-first
-			if err := Compact([]int{1, 2, 3}, 10); err != nil {
+			if err := Compact([]int{1, 2, 3}, 10, 0, 1); err != nil {
 				t.Fatalf("compact: %v", err)
 			}
 
@@ -4549,7 +5189,7 @@ func TestCompact_LargeRecords_BlockBoundaries(t *testing.T) {
 				t.Fatalf("persist 20: %v", err)
 			}
 
-			if err := Compact([]int{20, 21}, 30); err != nil {
+			if err := Compact([]int{20, 21}, 30, 0, 1); err != nil {
 				t.Fatalf("compact: %v", err)
 			}
 
@@ -4614,7 +5254,7 @@ func TestCompact_AllTombstonedResultsEmpty(t *testing.T) {
 		t.Fatalf("persist 40: %v", err)
 	}
 
-	if err := Compact([]int{40, 41}, 50); err != nil {
+	if err := Compact([]int{40, 41}, 50, 0, 1); err != nil {
 		t.Fatalf("compact: %v", err)
 	}
 
@@ -4630,3 +5270,402 @@ func TestCompact_AllTombstonedResultsEmpty(t *testing.T) {
 		t.Fatalf("integrity failed: ok=%v err=%v", ok, ierr)
 	}
 }
+
+// Test that compaction above the bottom level keeps tombstones, so they still shadow older versions below
+func TestCompact_KeepsTombstonesAboveBottomLevel(t *testing.T) {
+	setupTestDir(t)
+
+	originalFormat := FORMAT_VERSION
+	defer func() { FORMAT_VERSION = originalFormat }()
+
+	now := uint64(time.Now().Unix())
+	for i, format := range []uint8{FORMAT_VERSION_RECORDS, FORMAT_VERSION_BLOCKS} {
+		FORMAT_VERSION = format
+		older, newer, compacted := 60+3*i, 61+3*i, 62+3*i
+		if err := PersistMemtable([]record.Record{
+			*record.NewRecord("t_001", []byte("a"), now-2, false),
+			*record.NewRecord("t_002", []byte("b"), now-2, false),
+		}, older); err != nil {
+			t.Fatalf("persist %d: %v", older, err)
+		}
+		if err := PersistMemtable([]record.Record{
+			*record.NewRecord("t_001", nil, now-1, true),
+		}, newer); err != nil {
+			t.Fatalf("persist %d: %v", newer, err)
+		}
+
+		if err := Compact([]int{newer, older}, compacted, 0, 1); err != nil {
+			t.Fatalf("compact: %v", err)
+		}
+		rec, err := GetEntry("t_001", compacted)
+		if err != nil || rec == nil || !rec.IsDeleted() {
+			t.Errorf("format %d: expected the tombstone of t_001 to be kept, got %+v %v", format, rec, err)
+		}
+		if rec, err := Get("t_001", compacted); err != nil || rec != nil {
+			t.Errorf("format %d: expected Get to report t_001 as missing, got %+v %v", format, rec, err)
+		}
+		if rec, err := Get("t_002", compacted); err != nil || rec == nil || string(rec.Value) != "b" {
+			t.Errorf("format %d: expected t_002 to survive, got %+v %v", format, rec, err)
+		}
+		properties, err := GetProperties(compacted)
+		if err != nil || properties == nil || properties.RecordCount != 2 || properties.TombstoneCount != 1 {
+			t.Errorf("format %d: unexpected properties %+v %v", format, properties, err)
+		}
+	}
+}
+
+func TestBlockFormat_MmapReads(t *testing.T) {
+	setupTestDir(t)
+	useBlockFormat(t, 1024, 8)
+
+	originalMmapReads, originalUseSeparateFiles := MMAP_READS, USE_SEPARATE_FILES
+	defer func() { MMAP_READS, USE_SEPARATE_FILES = originalMmapReads, originalUseSeparateFiles }()
+	MMAP_READS = true
+
+	records := createPrefixedTestRecords(200, "mapped_", "v1")
+	for index, separate := range map[int]bool{364: false, 365: true} {
+		USE_SEPARATE_FILES = separate
+		if err := PersistMemtable(records, index); err != nil {
+			t.Fatalf("persist %d: %v", index, err)
+		}
+		for _, rec := range records {
+			got, err := Get(rec.Key, index)
+			if err != nil {
+				t.Fatalf("Get(%s, %d): %v", rec.Key, index, err)
+			}
+			if rec.Tombstone != (got == nil) || (got != nil && string(got.Value) != string(rec.Value)) {
+				t.Errorf("Get(%s, %d) = %v, want %s (deleted %v)", rec.Key, index, got, rec.Value, rec.Tombstone)
+			}
+		}
+
+		table, err := openTable(index)
+		if err != nil {
+			t.Fatalf("openTable(%d): %v", index, err)
+		}
+		mapped, ok := table.mappedFiles.Load(table.dataPath)
+		if !ok {
+			t.Fatalf("expected the data of table %d to be read through a mapping", index)
+		}
+		if isMapped := mapped.(*block_manager.MappedFile) != nil; isMapped != (runtime.GOOS == "linux") {
+			t.Errorf("expected table %d to be mapped only on linux, mapped %v on %s", index, isMapped, runtime.GOOS)
+		}
+	}
+
+	// A block is checked the first time it is read from the mapping
+	USE_SEPARATE_FILES = true
+	if err := PersistMemtable(records, 366); err != nil {
+		t.Fatalf("persist 366: %v", err)
+	}
+	file, err := os.OpenFile(fmt.Sprintf(DATA_FILE_NAME_FORMAT, 366), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(BLOCK_SIZE)+100); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	block_manager.GetBlockManager().ClearCache()
+	evictTables(366)
+
+	failed := 0
+	for _, rec := range records {
+		if _, err := Get(rec.Key, 366); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Error("expected reads of the corrupted block to fail")
+	}
+}
+
+// TestBlockFormat_MmapValuesOutliveEviction verifies that records read through a mapping stay valid
+// after their table is evicted and the mapping is released by the GC.
+func TestBlockFormat_MmapValuesOutliveEviction(t *testing.T) {
+	setupTestDir(t)
+	useBlockFormat(t, 1024, 8)
+
+	originalMmapReads := MMAP_READS
+	defer func() { MMAP_READS = originalMmapReads }()
+	MMAP_READS = true
+
+	records := createPrefixedTestRecords(50, "evicted_", "v1")
+	if err := PersistMemtable(records, 367); err != nil {
+		t.Fatalf("persist 367: %v", err)
+	}
+	read := make([]*record.Record, 0, len(records))
+	for _, rec := range records {
+		got, err := Get(rec.Key, 367)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", rec.Key, err)
+		}
+		read = append(read, got)
+	}
+
+	evictTables(367)
+	for i := 0; i < 3; i++ {
+		runtime.GC() // The finalizer of the dropped mapping runs after a GC cycle
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, rec := range records {
+		if rec.Tombstone != (read[i] == nil) || (read[i] != nil && string(read[i].Value) != string(rec.Value)) {
+			t.Errorf("Expected %s to keep its value after the table was evicted", rec.Key)
+		}
+	}
+}
+
+func TestFilterPolicy_ChosenPerLevel(t *testing.T) {
+	setupTestDir(t)
+
+	originalFormat, originalUseSeparateFiles := FORMAT_VERSION, USE_SEPARATE_FILES
+	originalPolicy, originalRate := FILTER_POLICY, FILTER_FALSE_POSITIVE_RATE
+	originalBottomPolicy, originalBottomRate, originalBottom := BOTTOM_LEVEL_FILTER_POLICY, BOTTOM_LEVEL_FILTER_FALSE_POSITIVE_RATE, BOTTOM_LEVEL
+	defer func() {
+		FORMAT_VERSION, USE_SEPARATE_FILES = originalFormat, originalUseSeparateFiles
+		FILTER_POLICY, FILTER_FALSE_POSITIVE_RATE = originalPolicy, originalRate
+		BOTTOM_LEVEL_FILTER_POLICY, BOTTOM_LEVEL_FILTER_FALSE_POSITIVE_RATE, BOTTOM_LEVEL = originalBottomPolicy, originalBottomRate, originalBottom
+	}()
+	FILTER_POLICY, FILTER_FALSE_POSITIVE_RATE = filter_policy.BlockedBloom, 0.05
+	BOTTOM_LEVEL_FILTER_POLICY, BOTTOM_LEVEL_FILTER_FALSE_POSITIVE_RATE, BOTTOM_LEVEL = filter_policy.Xor, 0.001, 3
+
+	records := createPrefixedTestRecords(100, "filtered_", "v1")
+	expectTable := func(index int, policyID uint8, rate float64) {
+		t.Helper()
+		table, err := openTable(index)
+		if err != nil {
+			t.Fatalf("openTable(%d): %v", index, err)
+		}
+		if table.config.FilterPolicy != policyID || table.config.FilterFalsePositiveRate != rate {
+			t.Errorf("table %d has filter %d at %v, want %d at %v",
+				index, table.config.FilterPolicy, table.config.FilterFalsePositiveRate, policyID, rate)
+		}
+		for _, rec := range records {
+			got, err := Get(rec.Key, index)
+			if err != nil {
+				t.Fatalf("Get(%s, %d): %v", rec.Key, index, err)
+			}
+			if !rec.Tombstone && (got == nil || string(got.Value) != string(rec.Value)) {
+				t.Errorf("Get(%s, %d) = %v, want %s", rec.Key, index, got, rec.Value)
+			}
+		}
+		tombstonedKeys, bestKeys := make([]string, 0), make([]string, 0)
+		if err := ScanForPrefix("filtered_0", &tombstonedKeys, &bestKeys, 200, 0, index); err != nil {
+			t.Fatalf("ScanForPrefix on %d: %v", index, err)
+		}
+		if len(bestKeys) == 0 {
+			t.Errorf("expected the prefix scan of table %d to find keys", index)
+		}
+	}
+
+	// Flushed tables go to level 0 and get the upper level filter, in both formats
+	for index, format := range map[int]uint8{367: FORMAT_VERSION_BLOCKS, 368: FORMAT_VERSION_RECORDS} {
+		FORMAT_VERSION = format
+		if err := PersistMemtable(records, index); err != nil {
+			t.Fatalf("persist %d: %v", index, err)
+		}
+		expectTable(index, filter_policy.BLOCKED_BLOOM_ID, 0.05)
+	}
+
+	// Compacting into the bottom level rebuilds the filter with the bottom level policy
+	for _, format := range []uint8{FORMAT_VERSION_BLOCKS, FORMAT_VERSION_RECORDS} {
+		FORMAT_VERSION = format
+		index := 369 + int(format) // 370 and 371
+		if err := PersistMemtable(records, index-10); err != nil {
+			t.Fatalf("persist %d: %v", index-10, err)
+		}
+		if err := Compact([]int{index - 10}, index, 2, BOTTOM_LEVEL); err != nil {
+			t.Fatalf("compact into %d: %v", index, err)
+		}
+		expectTable(index, filter_policy.XOR_ID, 0.001)
+		properties, err := GetProperties(index)
+		if err != nil || properties.FilterPolicy != filter_policy.Xor {
+			t.Errorf("expected the properties of %d to name the xor filter, got %v %v", index, properties, err)
+		}
+	}
+
+	FILTER_POLICY = "ribbon"
+	if err := PersistMemtable(records, 372); err == nil {
+		t.Error("expected an unknown filter policy to be reported")
+	}
+}
+
+func TestPrefixExtractor_FiltersPrefixScans(t *testing.T) {
+	setupTestDir(t)
+
+	originalFormat, originalRate := FORMAT_VERSION, FILTER_FALSE_POSITIVE_RATE
+	originalExtractor, originalLength, originalDelimiter := PREFIX_EXTRACTOR, PREFIX_LENGTH, PREFIX_DELIMITER
+	defer func() {
+		FORMAT_VERSION, FILTER_FALSE_POSITIVE_RATE = originalFormat, originalRate
+		PREFIX_EXTRACTOR, PREFIX_LENGTH, PREFIX_DELIMITER = originalExtractor, originalLength, originalDelimiter
+	}()
+	FILTER_FALSE_POSITIVE_RATE = 0.001
+
+	records := append(createPrefixedTestRecords(50, "order:", "v1"), createPrefixedTestRecords(50, "user:", "v1")...)
+	extractors := []struct {
+		name      string
+		length    uint64
+		delimiter string
+		expected  PrefixExtractor
+		// Scan prefixes the extractor maps to no filter prefix, or to one of a present key
+		undecided []string
+	}{
+		{"fixed", 5, "", PrefixExtractor{Kind: PREFIX_EXTRACTOR_FIXED, Length: 5}, []string{"", "acc", "user:0001xyz", "order:00z"}},
+		{"delimiter", 0, ":", PrefixExtractor{Kind: PREFIX_EXTRACTOR_DELIMITER, Delimiter: ':'}, []string{"", "account", "user:0001xyz", "order:00z"}},
+		{"none", 0, "", PrefixExtractor{Kind: PREFIX_EXTRACTOR_NONE}, []string{"", "account", "account:1", "user:0001xyz", "order:00z"}},
+	}
+
+	filterSizes := make(map[string]int)
+	index := 373
+	for _, format := range []uint8{FORMAT_VERSION_BLOCKS, FORMAT_VERSION_RECORDS} {
+		FORMAT_VERSION = format
+		for _, extractor := range extractors {
+			PREFIX_EXTRACTOR, PREFIX_LENGTH, PREFIX_DELIMITER = extractor.name, extractor.length, extractor.delimiter
+			if err := PersistMemtable(records, index); err != nil {
+				t.Fatalf("persist %s: %v", extractor.name, err)
+			}
+			table, err := openTable(index)
+			if err != nil {
+				t.Fatalf("openTable(%d): %v", index, err)
+			}
+			if table.config.PrefixExtractor != extractor.expected {
+				t.Errorf("table %d has prefix extractor %v, want %v", index, table.config.PrefixExtractor, extractor.expected)
+			}
+			filterSizes[extractor.name] = len(table.filter.Serialize())
+
+			for _, prefix := range []string{"user:", "order:0012", "user:0001"} {
+				tombstonedKeys, bestKeys := make([]string, 0), make([]string, 0)
+				if err := ScanForPrefix(prefix, &tombstonedKeys, &bestKeys, 100, 0, index); err != nil {
+					t.Fatalf("ScanForPrefix(%s) with %s: %v", prefix, extractor.name, err)
+				}
+				if len(bestKeys) == 0 {
+					t.Errorf("expected the scan for %s with the %s extractor to find keys", prefix, extractor.name)
+				}
+			}
+			for _, prefix := range []string{"account:1", "user:0001xyz", "order:00z"} {
+				if mayContain, err := table.mayContainPrefix(prefix); err != nil || mayContain && !slices.Contains(extractor.undecided, prefix) {
+					t.Errorf("expected the %s extractor to rule out prefix %s", extractor.name, prefix)
+				}
+			}
+			for _, prefix := range extractor.undecided {
+				if mayContain, err := table.mayContainPrefix(prefix); err != nil || !mayContain {
+					t.Errorf("expected the %s extractor to let prefix %q through", extractor.name, prefix)
+				}
+			}
+			index++
+		}
+	}
+
+	if filterSizes["none"] > filterSizes["delimiter"] {
+		t.Errorf("expected delimiter >= none filter sizes, got %v", filterSizes)
+	}
+
+	// Tables written before prefix extractors are read as capped and keep filtering prefix scans
+	legacy := PrefixExtractor{Kind: PREFIX_EXTRACTOR_CAPPED, Length: LEGACY_PREFIX_LENGTH}
+	items, previousKey := make([][]byte, 0), ""
+	for _, rec := range records {
+		items = legacy.appendPrefixes(items, rec.Key, previousKey)
+		previousKey = rec.Key
+	}
+	policy, _ := filter_policy.ByName(filter_policy.Bloom)
+	legacyFilter := policy.Build(items, FILTER_FALSE_POSITIVE_RATE)
+	for _, prefix := range []string{"user:", "order:0012", "user:0001"} {
+		if !legacy.mayContainPrefix(legacyFilter, prefix) {
+			t.Errorf("expected the legacy capped filter to let prefix %s through", prefix)
+		}
+	}
+	for _, prefix := range []string{"account:1", "user:0001xyz"} {
+		if legacy.mayContainPrefix(legacyFilter, prefix) {
+			t.Errorf("expected the legacy capped filter to rule out prefix %s", prefix)
+		}
+	}
+
+	// Capped prefixes are only inferred for legacy tables
+	for _, unknown := range []string{"suffix", "capped"} {
+		PREFIX_EXTRACTOR = unknown
+		if err := PersistMemtable(records, index); err == nil {
+			t.Errorf("expected the %s prefix extractor to be reported", unknown)
+		}
+	}
+}
+
+func TestPartitionedIndex_BottomLevelTables(t *testing.T) {
+	setupTestDir(t)
+	useBlockFormat(t, 256, 4)
+
+	originalPartitionSize, originalBottom, originalUseSeparateFiles := INDEX_PARTITION_SIZE, BOTTOM_LEVEL, USE_SEPARATE_FILES
+	defer func() {
+		INDEX_PARTITION_SIZE, BOTTOM_LEVEL, USE_SEPARATE_FILES = originalPartitionSize, originalBottom, originalUseSeparateFiles
+	}()
+	INDEX_PARTITION_SIZE, BOTTOM_LEVEL = 64, 3
+
+	records := createPrefixedTestRecords(500, "part_", "v1")
+	for _, separate := range []bool{true, false} {
+		USE_SEPARATE_FILES = separate
+		flushed, compacted := 380, 381
+		if !separate {
+			flushed, compacted = 382, 383
+		}
+
+		// Flushes go to level 0 and keep a whole block index
+		if err := PersistMemtable(records, flushed); err != nil {
+			t.Fatalf("persist %d: %v", flushed, err)
+		}
+		if table, _ := openTable(flushed); table.partitioned() {
+			t.Errorf("expected the level 0 table %d to keep a whole block index", flushed)
+		}
+		if err := Compact([]int{flushed}, compacted, 2, BOTTOM_LEVEL); err != nil {
+			t.Fatalf("compact into %d: %v", compacted, err)
+		}
+
+		table, err := openTable(compacted)
+		if err != nil {
+			t.Fatalf("openTable(%d): %v", compacted, err)
+		}
+		if err := table.loadBounds(); err != nil {
+			t.Fatalf("loadBounds(%d): %v", compacted, err)
+		}
+		if table.config.IndexPartitionSize != 64 || len(table.partitions) < 3 || table.blocks != nil || table.filter != nil {
+			t.Fatalf("expected table %d to cache only a top-level index over several partitions, got %d partitions and %d blocks",
+				compacted, len(table.partitions), len(table.blocks))
+		}
+
+		for _, rec := range records {
+			got, err := Get(rec.Key, compacted)
+			if err != nil {
+				t.Fatalf("Get(%s, %d): %v", rec.Key, compacted, err)
+			}
+			if rec.Tombstone != (got == nil) || got != nil && string(got.Value) != string(rec.Value) {
+				t.Errorf("Get(%s, %d) = %v, want %s (tombstone %v)", rec.Key, compacted, got, rec.Value, rec.Tombstone)
+			}
+		}
+		for _, key := range []string{"part_", "part_0100x", "part_9999", "zzz"} {
+			if got, err := Get(key, compacted); err != nil || got != nil {
+				t.Errorf("Get(%s, %d) = %v, %v, want nothing", key, compacted, got, err)
+			}
+		}
+
+		// Keys starting with "part_01" span several partitions, the scan walks across them
+		tombstonedKeys, bestKeys := make([]string, 0), make([]string, 0)
+		if err := ScanForPrefix("part_01", &tombstonedKeys, &bestKeys, 200, 0, compacted); err != nil {
+			t.Fatalf("ScanForPrefix on %d: %v", compacted, err)
+		}
+		expected := 0
+		for _, rec := range records {
+			if strings.HasPrefix(rec.Key, "part_01") && !rec.Tombstone {
+				expected++
+			}
+		}
+		if len(bestKeys) != expected {
+			t.Errorf("expected the scan of %d to find %d keys, got %d", compacted, expected, len(bestKeys))
+		}
+		for _, prefix := range []string{"part_9", "zzz"} {
+			if mayContain, err := table.mayContainPrefix(prefix); err != nil || mayContain {
+				t.Errorf("expected prefix %s to be ruled out by the top-level index of %d, got %v %v", prefix, compacted, mayContain, err)
+			}
+		}
+
+		if valid, corruptBlocks, fatal, err := CheckIntegrity(compacted); !valid || fatal || err != nil {
+			t.Errorf("CheckIntegrity(%d) = %v, %v, %v, %v", compacted, valid, corruptBlocks, fatal, err)
+		}
+	}
+}
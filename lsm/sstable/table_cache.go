@@ -0,0 +1,434 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	block_manager "hunddb/lsm/block_manager"
+	lru_cache "hunddb/lsm/lru_cache"
+	filter_policy "hunddb/lsm/sstable/filter_policy"
+	"hunddb/utils/config"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// TABLE_CACHE_CAPACITY is the number of SSTables whose metadata is kept parsed in memory, 0 disables the table cache
+	TABLE_CACHE_CAPACITY uint64
+	// MMAP_READS serves data blocks and block indexes from memory mappings of the table files
+	MMAP_READS bool
+)
+
+func init() {
+	cfg := config.GetConfig()
+	if cfg != nil {
+		TABLE_CACHE_CAPACITY = cfg.Cache.TableCacheCapacity
+		MMAP_READS = cfg.SSTable.MmapReads
+	}
+}
+
+/*
+tableHandle holds everything a lookup needs to know about an SSTable before touching its data:
+the parsed config, the component layout, the filter and the first and last index entries,
+or the whole block index for block format tables. Tables with a partitioned block index have only
+the top-level index over their partitions here, partitions of the block index and filter are read per lookup.
+SSTables never change once written, so a handle stays valid until its table is deleted or rewritten.
+With MMAP_READS, it also holds the mappings of the table files, released once the handle is dropped
+and no read through it is in flight anymore.
+
+The index bounds are read on first use, since a table left empty by compaction has none and is
+only ever turned away by its filter.
+*/
+type tableHandle struct {
+	index   int
+	config  *SSTableConfig
+	sizes   []uint64 // Component sizes, single file mode only
+	offsets []uint64 // Component offsets, single file mode only
+	filter  filter_policy.Filter
+
+	dataPath      string
+	dataStart     uint64 // Offset of the Data component
+	dataOffset    uint64 // Offset of the first record
+	indexPath     string
+	indexOffset   uint64 // Offset of the index component header (the last entry offset)
+	summaryPath   string
+	summaryOffset uint64
+
+	boundsMu         sync.Mutex
+	boundsLoaded     bool
+	firstKey         string
+	firstDataOffset  uint64
+	lastKey          string
+	lastDataOffset   uint64
+	lastIndexEntry   uint64 // Position of the last entry in the index component
+	lastSummaryEntry uint64 // Position of the last entry in the summary component
+
+	// Block format only: the block index, or the top-level index over its partitions, and the number of records
+	blocks      []blockHandle
+	partitions  []indexPartition
+	recordCount uint64
+
+	propertiesMu     sync.Mutex
+	propertiesLoaded bool
+	properties       *TableProperties // nil for tables written before properties
+
+	mappedFiles sync.Map // File path -> *block_manager.MappedFile, nil when the file couldn't be mapped
+}
+
+var (
+	tableCacheOnce sync.Once
+	tableCache     *lru_cache.LRUCache[int, *tableHandle]
+)
+
+// getTableCache returns the process wide table cache, nil when it is disabled.
+func getTableCache() *lru_cache.LRUCache[int, *tableHandle] {
+	tableCacheOnce.Do(func() {
+		if TABLE_CACHE_CAPACITY > 0 {
+			tableCache = lru_cache.NewLRUCache[int, *tableHandle](uint32(TABLE_CACHE_CAPACITY))
+		}
+	})
+	return tableCache
+}
+
+// openTable returns the handle of an SSTable, parsing its metadata from disk on a table cache miss.
+func openTable(index int) (*tableHandle, error) {
+	cache := getTableCache()
+	if cache != nil {
+		if table, err := cache.Get(index); err == nil {
+			return table, nil
+		}
+	}
+
+	table, err := loadTableHandle(index)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.Put(index, table)
+	}
+	return table, nil
+}
+
+// evictTables drops the handles of SSTables that were deleted or are about to be rewritten.
+func evictTables(indexes ...int) {
+	cache := getTableCache()
+	if cache == nil {
+		return
+	}
+	for _, index := range indexes {
+		cache.Remove(index) // Ignore error if the table was not cached
+	}
+}
+
+// ClearTableCache drops every cached SSTable handle, e.g. after SSTable files were replaced behind the LSM's back.
+func ClearTableCache() {
+	if cache := getTableCache(); cache != nil {
+		cache.Clear()
+	}
+}
+
+// loadTableHandle reads and parses the metadata of an SSTable.
+func loadTableHandle(index int) (*tableHandle, error) {
+	config, sizes, offsets, err := deserializeSSTableConfig(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize SSTable config: %v", err)
+	}
+	table := newTableHandle(index, config, sizes, offsets)
+
+	// Bloom filter, partitioned filters are read per lookup
+	if table.partitioned() {
+		return table, nil
+	}
+	if config.UseSeparateFiles {
+		filterPath := fmt.Sprintf(FILTER_FILE_NAME_FORMAT, index)
+		filterSize, err := getComponentSize(filterPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get filter component size: %v", err)
+		}
+		table.filter, err = deserializeFilter(filterPath, 0, filterSize, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize filter: %v", err)
+		}
+	} else {
+		table.filter, err = deserializeFilter(fmt.Sprintf(FILE_NAME_FORMAT, index), offsets[3], sizes[3], config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize filter (single file): %v", err)
+		}
+	}
+
+	return table, nil
+}
+
+// newTableHandle creates a handle with the component paths and offsets worked out from the config.
+func newTableHandle(index int, config *SSTableConfig, sizes []uint64, offsets []uint64) *tableHandle {
+	table := &tableHandle{
+		index:   index,
+		config:  config,
+		sizes:   sizes,
+		offsets: offsets,
+	}
+
+	if config.UseSeparateFiles {
+		table.dataPath = fmt.Sprintf(DATA_FILE_NAME_FORMAT, index)
+		table.dataOffset = CRC_SIZE + STANDARD_FLAG_SIZE
+		table.indexPath = fmt.Sprintf(INDEX_FILE_NAME_FORMAT, index)
+		table.indexOffset = CRC_SIZE + STANDARD_FLAG_SIZE
+		table.summaryPath = fmt.Sprintf(SUMMARY_FILE_NAME_FORMAT, index)
+		table.summaryOffset = CRC_SIZE + STANDARD_FLAG_SIZE
+	} else {
+		table.dataPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
+		table.dataStart = offsets[0]
+		table.dataOffset = offsets[0] + CRC_SIZE
+		table.indexPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
+		table.indexOffset = offsets[1] + CRC_SIZE
+		table.summaryPath = fmt.Sprintf(FILE_NAME_FORMAT, index)
+		table.summaryOffset = offsets[2] + CRC_SIZE
+	}
+	return table
+}
+
+// loadBounds reads the first and last index entries of the table unless they were read already.
+func (table *tableHandle) loadBounds() error {
+	table.boundsMu.Lock()
+	defer table.boundsMu.Unlock()
+	if table.boundsLoaded {
+		return nil
+	}
+	if err := table.readBounds(); err != nil {
+		return err
+	}
+	table.boundsLoaded = true
+	return nil
+}
+
+// loadProperties reads the Properties component of the table unless it was read already.
+func (table *tableHandle) loadProperties() error {
+	table.propertiesMu.Lock()
+	defer table.propertiesMu.Unlock()
+	if table.propertiesLoaded {
+		return nil
+	}
+	footer, found, err := readFooter(table.index)
+	if err != nil {
+		return fmt.Errorf("failed to read footer: %v", err)
+	}
+	if found && footer.propertiesSize > 0 {
+		data, _, err := block_manager.GetBlockManager().ReadFromDisk(
+			fmt.Sprintf(FILE_NAME_FORMAT, table.index), footer.propertiesOffset+CRC_SIZE, footer.propertiesSize)
+		if err != nil {
+			return fmt.Errorf("failed to read properties: %v", err)
+		}
+		if table.properties, err = deserializeTableProperties(data); err != nil {
+			return err
+		}
+	}
+	table.propertiesLoaded = true
+	return nil
+}
+
+/*
+readFromDisk reads size bytes of a table file from startOffset on, leaving out the CRCs.
+With MMAP_READS the file is mapped on first use and read without going through the block cache,
+falling back to the BlockManager where mapping is not supported.
+*/
+func (table *tableHandle) readFromDisk(filePath string, startOffset uint64, size uint64) ([]byte, error) {
+	if MMAP_READS {
+		if mapped := table.mappedFile(filePath); mapped != nil {
+			return mapped.Read(startOffset, size)
+		}
+	}
+	data, _, err := block_manager.GetBlockManager().ReadFromDisk(filePath, startOffset, size)
+	return data, err
+}
+
+// mappedFile returns the mapping of the table file, mapping it on first use. Returns nil if it can't be mapped.
+func (table *tableHandle) mappedFile(filePath string) *block_manager.MappedFile {
+	if mapped, ok := table.mappedFiles.Load(filePath); ok {
+		return mapped.(*block_manager.MappedFile)
+	}
+	mapped, err := block_manager.GetBlockManager().OpenMappedFile(filePath)
+	if err != nil {
+		mapped = nil // Read through the BlockManager, which reports the error if there is one
+	}
+	actual, loaded := table.mappedFiles.LoadOrStore(filePath, mapped)
+	if loaded && mapped != nil {
+		mapped.Close() // Another read mapped the file first
+	}
+	return actual.(*block_manager.MappedFile)
+}
+
+// readBounds reads the first and last index entries and the positions of the last index and summary entries.
+// Block format tables have their whole block index read instead.
+func (table *tableHandle) readBounds() error {
+	if table.config.FormatVersion == FORMAT_VERSION_BLOCKS {
+		return table.readBlockIndex()
+	}
+	var err error
+	// The first entry follows the 8B last-entry-offset header
+	table.firstKey, table.firstDataOffset, err = readIndexMetadataEntry(table.indexPath, table.indexOffset+STANDARD_FLAG_SIZE)
+	if err != nil {
+		return fmt.Errorf("failed to read first index entry: %v", err)
+	}
+	blockManager := block_manager.GetBlockManager()
+	lastEntryOffsetBytes, _, err := blockManager.ReadFromDisk(table.indexPath, table.indexOffset, STANDARD_FLAG_SIZE)
+	if err != nil {
+		return fmt.Errorf("failed to read last entry offset: %v", err)
+	}
+	lastEntryOffset := binary.LittleEndian.Uint64(lastEntryOffsetBytes)
+	table.lastKey, table.lastDataOffset, err = readIndexMetadataEntry(table.indexPath, lastEntryOffset)
+	if err != nil {
+		return fmt.Errorf("failed to read last index entry: %v", err)
+	}
+
+	// Entry positions are computed on logical offsets, leaving out the CRC of every block in between
+	physicalOffsetFirst := table.indexOffset + STANDARD_FLAG_SIZE
+	crcsFirst := (physicalOffsetFirst / BLOCK_SIZE) + 1
+	logicalOffsetFirst := physicalOffsetFirst - crcsFirst*CRC_SIZE
+	physicalOffsetLast := lastEntryOffset
+	crcsLast := (physicalOffsetLast / BLOCK_SIZE) + 1
+	logicalOffsetLast := physicalOffsetLast - crcsLast*CRC_SIZE
+
+	table.lastIndexEntry = (logicalOffsetLast - logicalOffsetFirst) / INDEX_ENTRY_METADATA_SIZE
+	table.lastSummaryEntry = table.lastIndexEntry / table.config.SparseStepIndex
+	return nil
+}
+
+/*
+checkIndexBounds reports whether the key is within the bounds of the table.
+
+If the key is one of the bounds, it also returns the offset of that bound's record in the Data component,
+otherwise the positions of the last summary and index entries to search between.
+*/
+func (table *tableHandle) checkIndexBounds(key string) (bool, bool, uint64, uint64, uint64, error) {
+	if err := table.loadBounds(); err != nil {
+		return false, false, 0, 0, 0, err
+	}
+	if key < table.firstKey {
+		return false, false, 0, 0, 0, nil
+	}
+	if key == table.firstKey {
+		return true, true, table.firstDataOffset, 0, 0, nil
+	}
+	if key == table.lastKey {
+		return true, true, table.lastDataOffset, 0, 0, nil
+	}
+	return table.lastKey > key, false, 0, table.lastSummaryEntry, table.lastIndexEntry, nil
+}
+
+// checkIndexBoundsForPrefix is checkIndexBounds for keys that only have to share a prefix with the first key.
+func (table *tableHandle) checkIndexBoundsForPrefix(key string) (bool, uint64, uint64, error) {
+	if err := table.loadBounds(); err != nil {
+		return false, 0, 0, err
+	}
+	if key < table.firstKey && !strings.HasPrefix(table.firstKey, key) {
+		return false, 0, 0, nil
+	}
+	return table.lastKey > key, table.lastSummaryEntry, table.lastIndexEntry, nil
+}
+
+// checkIndexBoundsForRange reports whether [rangeStart, rangeEnd] overlaps the keys of the table.
+func (table *tableHandle) checkIndexBoundsForRange(rangeStart string, rangeEnd string) (bool, uint64, uint64, error) {
+	if err := table.loadBounds(); err != nil {
+		return false, 0, 0, err
+	}
+	if rangeEnd < table.firstKey || rangeStart > table.lastKey {
+		return false, 0, 0, nil
+	}
+	return true, table.lastSummaryEntry, table.lastIndexEntry, nil
+}
+
+// mayContain checks the filter for a key, the filter of the partition the key falls into if it is partitioned.
+func (table *tableHandle) mayContain(key string) (bool, error) {
+	if !table.partitioned() {
+		return table.filter.Contains([]byte(key)), nil
+	}
+	if err := table.loadBounds(); err != nil {
+		return false, fmt.Errorf("failed to read top-level index: %v", err)
+	}
+	partition := table.findPartition(key)
+	if partition == table.partitionCount() {
+		return false, nil
+	}
+	filter, err := table.partitionFilter(partition)
+	if err != nil {
+		return false, err
+	}
+	return filter.Contains([]byte(key)), nil
+}
+
+/*
+mayContainPrefix checks the filter for a prefix, through the prefixes the table's PrefixExtractor put in it.
+The keys starting with prefix may span several partitions of a partitioned filter, it checks each of them
+until one may hold such a key.
+*/
+func (table *tableHandle) mayContainPrefix(prefix string) (bool, error) {
+	extractor := table.config.PrefixExtractor
+	if !table.partitioned() {
+		return extractor.mayContainPrefix(table.filter, prefix), nil
+	}
+	if err := table.loadBounds(); err != nil {
+		return false, fmt.Errorf("failed to read top-level index: %v", err)
+	}
+	for partition := table.findPartition(prefix); partition < table.partitionCount(); partition++ {
+		filter, err := table.partitionFilter(partition)
+		if err != nil {
+			return false, err
+		}
+		if extractor.mayContainPrefix(filter, prefix) {
+			return true, nil
+		}
+		if !strings.HasPrefix(table.partitions[partition].lastKey, prefix) {
+			break // Keys of the next partitions are past the prefix
+		}
+	}
+	return false, nil
+}
+
+// partitioned reports whether the block index and filter of the table are split into partitions.
+func (table *tableHandle) partitioned() bool {
+	return table.config.IndexPartitionSize > 0
+}
+
+// partitionCount returns the number of block index partitions, a whole block index counts as one.
+func (table *tableHandle) partitionCount() int {
+	if !table.partitioned() {
+		return 1
+	}
+	return len(table.partitions)
+}
+
+// findPartition returns the position of the first partition whose last key is >= key, partitionCount if none is.
+// A whole block index is always the one to search.
+func (table *tableHandle) findPartition(key string) int {
+	if !table.partitioned() {
+		return 0
+	}
+	return sort.Search(len(table.partitions), func(i int) bool { return table.partitions[i].lastKey >= key })
+}
+
+// partitionBlocks returns the block index of the partition at the given position, read from disk if it is partitioned.
+func (table *tableHandle) partitionBlocks(position int) ([]blockHandle, error) {
+	if !table.partitioned() {
+		return table.blocks, nil
+	}
+	partition := table.partitions[position]
+	data, err := table.readComponentRange(1, INDEX_FILE_NAME_FORMAT, partition.indexOffset, partition.indexSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block index partition %d: %v", position, err)
+	}
+	return decodeBlockIndex(data)
+}
+
+// partitionFilter reads the filter of the partition at the given position.
+func (table *tableHandle) partitionFilter(position int) (filter_policy.Filter, error) {
+	partition := table.partitions[position]
+	data, err := table.readComponentRange(3, FILTER_FILE_NAME_FORMAT, partition.filterOffset, partition.filterSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read filter partition %d: %v", position, err)
+	}
+	policy, err := filter_policy.ByID(table.config.FilterPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return policy.Deserialize(data)
+}
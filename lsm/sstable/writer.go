@@ -0,0 +1,123 @@
+package sstable
+
+import (
+	"fmt"
+	block_codec "hunddb/lsm/sstable/block_codec"
+	record "hunddb/model/record"
+	"os"
+	"time"
+)
+
+/*
+Writer builds an SSTable outside of a running database, from keys added in strictly increasing order,
+so a large dataset can be loaded with LSM.IngestExternalFile instead of going through Put, the WAL and the memtables.
+
+The table is written into a single file in the block format, with every component, the Merkle tree and the
+Bloom filter a flushed table has. Keys are never swapped for dictionary IDs, the global dictionary belongs
+to a database. Blocks go through the block manager, so its block size and encryption must match the ones of
+the database the file is ingested into.
+*/
+type Writer struct {
+	path     string
+	builder  *blockTableBuilder
+	lastKey  string
+	records  uint64
+	finished bool
+}
+
+// NewWriter starts a new SSTable at path, which must not exist yet.
+func NewWriter(path string) (*Writer, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("failed to create SSTable writer: %s already exists", path)
+	}
+	codec, err := block_codec.ByName(BLOCK_COMPRESSION)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSTable writer: %v", err)
+	}
+	config := &SSTableConfig{
+		UseSeparateFiles:   false,
+		CompressionEnabled: false,
+		SparseStepIndex:    uint64(SPARSE_STEP_INDEX),
+		FormatVersion:      FORMAT_VERSION_BLOCKS,
+		BlockCodec:         codec.ID(),
+	}
+	// Ingested tables go to the deepest level they don't overlap, often the bottom one
+	if err := config.useSettingsForLevel(BOTTOM_LEVEL); err != nil {
+		return nil, fmt.Errorf("failed to create SSTable writer: %v", err)
+	}
+	properties := newTableProperties(config, CREATION_REASON_INGESTION, SOURCE_LEVEL_EXTERNAL, nil)
+	builder, err := newBlockTableBuilder(func(string) string { return path }, config, properties)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSTable writer: %v", err)
+	}
+	return &Writer{path: path, builder: builder}, nil
+}
+
+// Put adds the key with its value, the key must be greater than every key added before.
+func (writer *Writer) Put(key string, value []byte) error {
+	return writer.add(key, value, false)
+}
+
+// Delete adds a tombstone for the key, hiding older versions of it once the table is ingested.
+func (writer *Writer) Delete(key string) error {
+	return writer.add(key, nil, true)
+}
+
+func (writer *Writer) add(key string, value []byte, tombstone bool) error {
+	if writer.finished {
+		return fmt.Errorf("SSTable %s is already finished", writer.path)
+	}
+	if key == "" {
+		return fmt.Errorf("keys must not be empty")
+	}
+	if writer.records > 0 && key <= writer.lastKey {
+		return fmt.Errorf("keys must be added in increasing order, %q follows %q", key, writer.lastKey)
+	}
+	rec := record.NewRecord(key, value, uint64(time.Now().UnixNano()), tombstone)
+	if err := writer.builder.add(rec); err != nil {
+		return err
+	}
+	writer.lastKey = key
+	writer.records++
+	return nil
+}
+
+// Finish writes the components describing the added records, after which the table can be ingested.
+func (writer *Writer) Finish() error {
+	if writer.finished {
+		return fmt.Errorf("SSTable %s is already finished", writer.path)
+	}
+	if writer.records == 0 {
+		return fmt.Errorf("cannot finish SSTable %s without records", writer.path)
+	}
+	writer.finished = true
+	return writer.builder.finish()
+}
+
+/*
+ValidateExternalFile checks that the SSTable with the given index, copied in from outside of the database,
+can be linked into the tree as it is, and returns its first and last key.
+*/
+func ValidateExternalFile(index int) (string, string, error) {
+	evictTables(index)
+	table, err := openTable(index)
+	if err != nil {
+		return "", "", err
+	}
+	if table.config.UseSeparateFiles {
+		return "", "", fmt.Errorf("external SSTables must be stored in a single file")
+	}
+	if table.config.CompressionEnabled {
+		return "", "", fmt.Errorf("external SSTables must not use dictionary encoded keys")
+	}
+	if _, err := block_codec.ByID(table.config.BlockCodec); err != nil {
+		return "", "", err
+	}
+	if err := table.loadBounds(); err != nil {
+		return "", "", fmt.Errorf("failed to read the bounds of the SSTable: %v", err)
+	}
+	if table.firstKey == "" {
+		return "", "", fmt.Errorf("external SSTable holds no records")
+	}
+	return table.firstKey, table.lastKey, nil
+}
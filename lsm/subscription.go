@@ -0,0 +1,224 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	model "hunddb/model/record"
+	"strings"
+	"sync"
+)
+
+// ErrSubscriptionLagged is reported when a subscriber falls more than SUBSCRIPTION_BUFFER_SIZE changes behind.
+// The subscriber can resume by subscribing again from the sequence after the last event it processed.
+var ErrSubscriptionLagged = errors.New("subscriber fell too far behind")
+
+// ErrSequenceTruncated is returned by Subscribe when changes from the requested sequence on are no longer in the WAL.
+var ErrSequenceTruncated = errors.New("changes from the requested sequence were already retired from the WAL")
+
+/*
+ChangeEvent describes a single committed Put or Delete, delivered once the write is visible to Get.
+Sequence is the commit timestamp of the write (nanoseconds), strictly increasing in commit order,
+so it can be used to resume a subscription after the last processed event.
+*/
+type ChangeEvent struct {
+	Key       string
+	Value     []byte // nil for deletes
+	Tombstone bool
+	Sequence  uint64
+}
+
+/*
+Subscription delivers the changes for a key prefix in commit order.
+Events is closed when the subscription ends, either through Close or because the subscriber lagged (see Err).
+*/
+type Subscription struct {
+	Events <-chan ChangeEvent
+
+	events    chan ChangeEvent // Outgoing events, read by the subscriber
+	live      chan ChangeEvent // Changes committed after subscribing, buffered up to SUBSCRIPTION_BUFFER_SIZE
+	done      chan struct{}    // Closed by Close to stop delivery
+	closeOnce sync.Once
+	prefix    string
+	err       error // Set under lsm.mu when the subscription is dropped
+	lsm       *LSM
+	backlog   []ChangeEvent // Changes replayed from the WAL, delivered before live ones
+	liveFrom  uint64        // First sequence delivered live, earlier ones are replayed or predate the subscription
+}
+
+// pendingPublication is a write into a lock-free memtable waiting to be published, see publishInsertedUnsafe.
+type pendingPublication struct {
+	record   *model.Record
+	inserted bool // The memtable insert finished
+	failed   bool // The insert failed, so the write is never published
+}
+
+/*
+Subscribe returns a subscription to all changes of keys starting with prefix ("" for every key).
+With fromSeq == 0 only changes committed after the call are delivered.
+Otherwise changes with Sequence >= fromSeq are replayed from the WAL first. ErrSequenceTruncated is returned
+if some of them may have been in WAL segments already retired after a flush.
+Writes made with DisableWAL cannot be replayed - only their live delivery is guaranteed.
+*/
+func (lsm *LSM) Subscribe(prefix string, fromSeq uint64) (*Subscription, error) {
+	lsm.mu.Lock()
+	sub := &Subscription{
+		events:   make(chan ChangeEvent),
+		live:     make(chan ChangeEvent, SUBSCRIPTION_BUFFER_SIZE),
+		done:     make(chan struct{}),
+		prefix:   prefix,
+		lsm:      lsm,
+		liveFrom: lsm.lastSequence + 1,
+	}
+	sub.Events = sub.events
+
+	if fromSeq == 0 {
+		lsm.subscribers[sub] = struct{}{}
+		lsm.mu.Unlock()
+		go sub.deliver()
+		return sub, nil
+	}
+	if lsm.wal == nil {
+		lsm.mu.Unlock()
+		return nil, fmt.Errorf("cannot replay changes: WAL is not available")
+	}
+
+	// Changes up to the snapshot are replayed from the WAL without holding the lock,
+	// later ones are buffered live meanwhile
+	snapshot := lsm.wal.Snapshot()
+	oldestSequence := sub.liveFrom // Sequence of the oldest change still in the WAL
+	lsm.subscribers[sub] = struct{}{}
+	lsm.walReplays++
+	lsm.mu.Unlock()
+
+	err := lsm.wal.ReplaySnapshot(snapshot, func(record *model.Record) {
+		oldestSequence = min(oldestSequence, record.Timestamp)
+		if record.Timestamp >= fromSeq && strings.HasPrefix(record.Key, prefix) {
+			sub.backlog = append(sub.backlog, changeEventFromRecord(record))
+		}
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to replay changes from WAL: %w", err)
+	} else if snapshot.Truncated() && fromSeq < oldestSequence {
+		err = ErrSequenceTruncated
+	}
+
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+	lsm.walReplays--
+	if lsm.walReplays == 0 && lsm.deferredLowWaterMark > 0 {
+		lsm.retireLogsUnsafe(lsm.deferredLowWaterMark)
+		lsm.deferredLowWaterMark = 0
+	}
+	if err != nil {
+		if _, exists := lsm.subscribers[sub]; exists {
+			lsm.removeSubscriberUnsafe(sub, nil)
+		}
+		return nil, err
+	}
+	go sub.deliver()
+
+	return sub, nil
+}
+
+// Close ends the subscription. Events is closed once delivery stops.
+func (sub *Subscription) Close() {
+	sub.lsm.mu.Lock()
+	defer sub.lsm.mu.Unlock()
+
+	if _, exists := sub.lsm.subscribers[sub]; exists {
+		sub.lsm.removeSubscriberUnsafe(sub, nil)
+	}
+	// A lagged subscription is no longer registered, but may still be delivering its buffer
+	sub.closeOnce.Do(func() { close(sub.done) })
+}
+
+// Err returns ErrSubscriptionLagged if the subscription was dropped for falling behind, nil otherwise.
+func (sub *Subscription) Err() error {
+	sub.lsm.mu.RLock()
+	defer sub.lsm.mu.RUnlock()
+	return sub.err
+}
+
+// deliver forwards the replayed backlog followed by live changes to the subscriber.
+func (sub *Subscription) deliver() {
+	defer close(sub.events)
+
+	for _, event := range sub.backlog {
+		select {
+		case sub.events <- event:
+		case <-sub.done:
+			return
+		}
+	}
+	sub.backlog = nil
+
+	for event := range sub.live {
+		if event.Sequence < sub.liveFrom {
+			continue // Committed before subscribing, but only inserted into a lock-free memtable after
+		}
+		select {
+		case sub.events <- event:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// publishUnsafe hands a committed write to every matching subscriber; must be called with lsm.mu held.
+// Subscribers never block writers - one whose buffer is full is dropped with ErrSubscriptionLagged.
+func (lsm *LSM) publishUnsafe(record *model.Record) {
+	if len(lsm.subscribers) == 0 {
+		return
+	}
+	event := changeEventFromRecord(record)
+	for sub := range lsm.subscribers {
+		if !strings.HasPrefix(event.Key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.live <- event:
+		default:
+			lsm.removeSubscriberUnsafe(sub, ErrSubscriptionLagged)
+		}
+	}
+}
+
+// publishInsertedUnsafe publishes the writes into a lock-free memtable whose inserts finished, in commit order;
+// must be called with lsm.mu held. A write is held back until every earlier one is inserted as well.
+func (lsm *LSM) publishInsertedUnsafe() {
+	for len(lsm.unpublished) > 0 && lsm.unpublished[0].inserted {
+		head := lsm.unpublished[0]
+		lsm.unpublished[0] = nil
+		lsm.unpublished = lsm.unpublished[1:]
+		if !head.failed {
+			lsm.publishUnsafe(head.record)
+		}
+	}
+}
+
+// removeSubscriberUnsafe stops live delivery to the subscriber; must be called with lsm.mu held.
+// Changes already buffered are still delivered unless the subscription is closed.
+func (lsm *LSM) removeSubscriberUnsafe(sub *Subscription, err error) {
+	delete(lsm.subscribers, sub)
+	sub.err = err
+	close(sub.live)
+}
+
+// nextSequenceUnsafe returns the commit timestamp for the next write; must be called with lsm.mu held.
+// The wall clock is used whenever it moved forward, so sequences stay meaningful across restarts.
+func (lsm *LSM) nextSequenceUnsafe(now uint64) uint64 {
+	if now <= lsm.lastSequence {
+		now = lsm.lastSequence + 1
+	}
+	lsm.lastSequence = now
+	return now
+}
+
+func changeEventFromRecord(record *model.Record) ChangeEvent {
+	return ChangeEvent{
+		Key:       record.Key,
+		Value:     record.Value,
+		Tombstone: record.Tombstone,
+		Sequence:  record.Timestamp,
+	}
+}
@@ -2,25 +2,31 @@ package wal
 
 import (
 	"bytes"
-	"encoding/binary"
+	"compress/zlib"
+	"errors"
 	"fmt"
 	bm "hunddb/lsm/block_manager"
 	memtable "hunddb/lsm/memtable"
 	block_location "hunddb/model/block_location"
 	record "hunddb/model/record"
-	byte_util "hunddb/utils/byte_util"
 	"hunddb/utils/config"
 	crc "hunddb/utils/crc"
+	"io"
 	"math"
 	"os"
 	"regexp"
 	"strconv"
 )
 
+// LOGS_PATH is the directory WAL segments are kept in
+const LOGS_PATH = "hunddb/lsm/wal/logs"
+
 // Configuration variables loaded from config file - no hardcoded defaults
 var (
-	BLOCK_SIZE uint64
-	LOG_SIZE   uint64
+	BLOCK_SIZE          uint64
+	LOG_SIZE            uint64
+	MAX_RECYCLED_LOGS   uint64
+	COMPRESSION_ENABLED bool
 )
 
 // init loads WAL configuration from config file
@@ -29,8 +35,14 @@ func init() {
 	// Always use config - no fallbacks here
 	BLOCK_SIZE = cfg.BlockManager.BlockSize
 	LOG_SIZE = cfg.WAL.LogSize
+	MAX_RECYCLED_LOGS = cfg.WAL.MaxRecycledLogs
+	COMPRESSION_ENABLED = cfg.WAL.CompressionEnabled
 }
 
+// errStaleBlock is returned when a block carries a log number different from the log it is read from.
+// This happens for blocks left over from a previous life of a recycled segment file.
+var errStaleBlock = errors.New("stale block from a recycled log segment")
+
 // WAL represents a Write-Ahead Log implementation for database persistence.
 // It manages record writing, fragmentation across blocks, and crash recovery.
 // It guarantees that all blocks will be written to durable storage, thus ensuring durability.
@@ -38,13 +50,15 @@ func init() {
 // Only happens if the program crashes, supporting graceful exit.
 // That is a balance between performance and durability that is needed.
 type WAL struct {
-	lastBlock              []byte // Current block being written to
-	offsetInBlock          uint64 // Current write position within the block
-	blocksWrittenInLastLog uint64 // Number of blocks written in last log
-	firstLogIndex          uint64 // First log segment index
-	lastLogIndex           uint64 // Last log segment index
-	logSize                uint64 // Maximum number of blocks per log file
-	logsPath               string // Path to logs directory
+	lastBlock              []byte   // Current block being written to
+	offsetInBlock          uint64   // Current write position within the block
+	blocksWrittenInLastLog uint64   // Number of blocks written in last log
+	firstLogIndex          uint64   // First log segment index
+	lastLogIndex           uint64   // Last log segment index
+	logSize                uint64   // Maximum number of blocks per log file
+	logsPath               string   // Path to logs directory
+	recycledLogs           []string // Retired segment files kept for reuse (oldest first)
+	compressPayloads       bool     // Whether record payloads are compressed before being written
 }
 
 // BuildWAL creates a new WAL instance with the specified directory path and starting log index,
@@ -57,41 +71,18 @@ func BuildWAL() (*WAL, error) {
 		firstLogIndex:          1,
 		lastLogIndex:           1,
 		logSize:                LOG_SIZE,
-		logsPath:               "hunddb/lsm/wal/logs",
+		logsPath:               LOGS_PATH,
+		compressPayloads:       COMPRESSION_ENABLED,
 	}
 	err := wal.reloadWAL()
 	if err != nil {
 		return nil, fmt.Errorf("failed to reload WAL: %w", err)
 	}
 
-	// Ensure the WAL directory exists for metadata file
-	err = os.MkdirAll("hunddb/lsm/wal", 0755)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create WAL directory for metadata: %w", err)
-	}
-
-	// If Overwrite metadata file to indicate unclean shutdown
-	// This is done because if the program crashes, we want to know that it was not a graceful exit
-	// and we need to recover the offset from the metadata file
-	// If the program exits gracefully, we will update the metadata file to indicate a clean shutdown
-	// and the offset will be restored from there on next startup
-	metadataFile, err := os.OpenFile("hunddb/lsm/wal/metadata.bin", os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open metadata file: %w", err)
-	}
-	defer metadataFile.Close()
-
-	data := make([]byte, 9)
-	data[0] = byte_util.BoolToByte(false)
-	_, err = metadataFile.Write(data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write metadata file: %w", err)
-	}
-
-	return wal, err
+	return wal, nil
 }
 
-// reloadWAL loads WAL metadata from a file to restore state after a crash or restart.
+// reloadWAL scans the existing log files to restore state after a crash or restart.
 func (wal *WAL) reloadWAL() error {
 	// Create logs directory if it doesn't exist
 	err := os.MkdirAll(wal.logsPath, 0755)
@@ -111,12 +102,18 @@ func (wal *WAL) reloadWAL() error {
 
 	// Regex for wal_{number}.log
 	re := regexp.MustCompile(`^wal_(\d+)\.log$`)
+	// Regex for recycled_{number}.log
+	recycledRe := regexp.MustCompile(`^recycled_(\d+)\.log$`)
 
 	minLogIndex := math.MaxInt32
 	maxLogIndex := -1
 
 	for _, log := range logs {
 		name := log.Name()
+		if recycledRe.MatchString(name) {
+			wal.recycledLogs = append(wal.recycledLogs, fmt.Sprintf("%s/%s", wal.logsPath, name))
+			continue
+		}
 		matches := re.FindStringSubmatch(name)
 		if matches != nil {
 			num, err := strconv.Atoi(matches[1])
@@ -139,64 +136,160 @@ func (wal *WAL) reloadWAL() error {
 	wal.firstLogIndex = uint64(minLogIndex)
 	wal.lastLogIndex = uint64(maxLogIndex)
 
-	lastFile := fmt.Sprintf("%s/wal_%d.log", wal.logsPath, maxLogIndex)
-	f, err := os.Open(lastFile)
-	if err != nil {
-		return fmt.Errorf("failed to open last WAL file: %w", err)
+	// Segments are preallocated (and possibly recycled), so the file size says nothing about
+	// how far the last log got - count the blocks that were actually written for it instead.
+	wal.blocksWrittenInLastLog = wal.countWrittenBlocks(wal.lastLogIndex)
+
+	// A completely filled last log means the next block belongs to a new segment
+	if wal.blocksWrittenInLastLog >= wal.logSize {
+		wal.lastLogIndex++
+		wal.blocksWrittenInLastLog = 0
 	}
-	defer f.Close()
 
-	info, err := f.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to stat last WAL file: %w", err)
+	// Writing always continues in a fresh block. The last block on disk was sealed by Close()
+	// and every written block must start with a header so stale blocks can be told apart.
+	// Close() writes nothing when no record is pending, so reopening doesn't use up a block.
+	wal.offsetInBlock = crc.CRC_SIZE
+
+	return nil
+}
+
+// countWrittenBlocks returns the number of leading blocks in the given log that were written for it.
+// Scanning stops at the first block that is unwritten (fails CRC) or stale (different log number).
+// The file is read directly, bypassing the block cache, since this is a one-off scan at startup.
+func (wal *WAL) countWrittenBlocks(logIndex uint64) uint64 {
+	path := wal.logPath(logIndex)
+	if _, err := os.Stat(path); err != nil {
+		return 0
 	}
-	size := info.Size()
 
-	// How many blocks are written in the last log
-	wal.blocksWrittenInLastLog = uint64(uint64(size) / BLOCK_SIZE)
+	blockManager := bm.GetBlockManager()
+	for blockIndex := uint64(0); blockIndex < wal.logSize; blockIndex++ {
+		block, err := blockManager.ReadBlockUncached(block_location.BlockLocation{FilePath: path, BlockIndex: blockIndex})
+		if err != nil || crc.CheckBlockIntegrity(block) != nil || isStaleBlock(block, logIndex) {
+			return blockIndex
+		}
+	}
+	return wal.logSize
+}
 
-	f, err = os.Open("hunddb/lsm/wal/metadata.bin")
-	if err != nil {
-		return fmt.Errorf("failed to open metadata file: %w", err)
+// isStaleBlock reports whether a CRC-valid block was not written for logIndex.
+// Empty blocks are never written, so every block of the log starts with a header carrying its
+// log number right after the CRC. A block without one is left over from before the segment's reuse.
+func isStaleBlock(block []byte, logIndex uint64) bool {
+	header := DeserializeWALHeader(block[crc.CRC_SIZE:])
+	if header == nil || header.Type == 0 {
+		return true
 	}
-	defer f.Close()
-	data := make([]byte, 9)
-	_, err = f.Read(data)
-	if err != nil {
-		return fmt.Errorf("failed to read metadata file: %w", err)
+	return header.LogNumber != logIndex
+}
+
+// logPath returns the path of the log segment with the given index.
+func (wal *WAL) logPath(logIndex uint64) string {
+	return fmt.Sprintf("%s/wal_%d.log", wal.logsPath, logIndex)
+}
+
+// allocateLog makes sure the segment file for logIndex exists and spans LOG_SIZE blocks.
+// A retired segment is reused when available (renamed and overwritten block by block),
+// otherwise a new file is created and filled with zeros up front, so that writing blocks
+// later never has to grow the file.
+func (wal *WAL) allocateLog(logIndex uint64) error {
+	path := wal.logPath(logIndex)
+	if _, err := os.Stat(path); err == nil {
+		return nil
 	}
-	madeGracefulExit := byte_util.ByteToBool(data[0])
-	if madeGracefulExit {
-		wal.offsetInBlock = binary.LittleEndian.Uint64(data[1:])
+
+	if len(wal.recycledLogs) > 0 {
+		recycled := wal.recycledLogs[0]
+		wal.recycledLogs = wal.recycledLogs[1:]
+		err := os.Rename(recycled, path)
+		if err == nil {
+			bm.GetBlockManager().RemoveFileMutex(recycled)
+			return nil
+		}
+		// Fall through to a fresh allocation if the recycled file is unusable
+		os.Remove(recycled)
 	}
 
+	if err := bm.GetBlockManager().PreallocateFile(path, wal.logSize); err != nil {
+		return fmt.Errorf("failed to preallocate log file %s: %w", path, err)
+	}
 	return nil
 }
 
 // WriteRecord writes a WAL record to the log, handling both complete and fragmented records.
+// With compression enabled, the payload is compressed before fragmentation whenever that makes it smaller.
 func (wal *WAL) WriteRecord(record *record.Record) (uint64, error) {
 	payload := record.Serialize()
+	var flags byte = 0
+	if wal.compressPayloads {
+		compressed, err := compressPayload(payload)
+		if err != nil {
+			return 0, err
+		}
+		if len(compressed) < len(payload) {
+			payload = compressed
+			flags = FLAG_COMPRESSED
+		}
+	}
 	spaceNeeded := HEADER_TOTAL_SIZE + len(payload)
 
 	// Checks if there is enough space left in the block.
 	if int(BLOCK_SIZE-wal.offsetInBlock) < spaceNeeded {
-		err := wal.flushBlock()
-		if err != nil {
-			return 0, err
+		// Seal the current block, unless nothing was written to it yet
+		if wal.offsetInBlock > crc.CRC_SIZE {
+			err := wal.flushBlock()
+			if err != nil {
+				return 0, err
+			}
+			wal.makeNewBlock()
 		}
-		wal.makeNewBlock()
 
 		// If the record is larger than a whole block, fragment it
-		if spaceNeeded > int(BLOCK_SIZE) {
-			return wal.writeFragmentedRecord(payload)
+		if spaceNeeded > int(BLOCK_SIZE-crc.CRC_SIZE) {
+			return wal.writeFragmentedRecord(payload, flags)
 		}
 	}
-	return wal.lastLogIndex, wal.writeToBlock(payload, FRAGMENT_FULL)
+	return wal.lastLogIndex, wal.writeToBlock(payload, FRAGMENT_FULL|flags)
+}
+
+// compressPayload compresses a serialized record with zlib.
+func compressPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compressor: %w", err)
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodePayload returns the serialized record for a reassembled payload, decompressing it if needed.
+func decodePayload(payload []byte, compressed bool) ([]byte, error) {
+	if !compressed {
+		return payload, nil
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %w", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %w", err)
+	}
+	return data, nil
 }
 
 // writeFragmentedRecord handles records larger than a single block by splitting them into fragments.
 // All fragments for a record are kept within the same log file.
-func (wal *WAL) writeFragmentedRecord(payload []byte) (uint64, error) {
+// flags: payload flags set on every fragment of the record.
+func (wal *WAL) writeFragmentedRecord(payload []byte, flags byte) (uint64, error) {
 	maxPayloadSize := int(BLOCK_SIZE) - HEADER_TOTAL_SIZE - crc.CRC_SIZE
 	numberOfFragments := int(math.Ceil(float64(len(payload)) / float64(maxPayloadSize)))
 
@@ -216,7 +309,7 @@ func (wal *WAL) writeFragmentedRecord(payload []byte) (uint64, error) {
 		case numberOfFragments - 1:
 			fragmentType = FRAGMENT_LAST
 		}
-		err := wal.writeToBlock(payloadFragment, fragmentType)
+		err := wal.writeToBlock(payloadFragment, fragmentType|flags)
 		if err != nil {
 			return 0, err
 		}
@@ -225,7 +318,7 @@ func (wal *WAL) writeFragmentedRecord(payload []byte) (uint64, error) {
 }
 
 // writeToBlock writes a record or record fragment to the current block.
-// fragmentType: the fragment type (FULL, FIRST, MIDDLE, LAST).
+// fragmentType: the fragment type (FULL, FIRST, MIDDLE, LAST), combined with any payload flags.
 func (wal *WAL) writeToBlock(payload []byte, fragmentType byte) error {
 	header := NewWALHeader(
 		uint64(len(payload)),
@@ -257,10 +350,18 @@ func (wal *WAL) writeToBlock(payload []byte, fragmentType byte) error {
 }
 
 // flushBlock writes the current block to storage and prepares for the next block.
+// The first block of a log allocates the whole segment file.
 func (wal *WAL) flushBlock() error {
+	if wal.blocksWrittenInLastLog == 0 {
+		err := wal.allocateLog(wal.lastLogIndex)
+		if err != nil {
+			return err
+		}
+	}
+
 	wal.lastBlock = crc.AddCRCToBlockData(wal.lastBlock)
 	err := bm.GetBlockManager().WriteBlock(block_location.BlockLocation{
-		FilePath:   fmt.Sprintf("%s/wal_%d.log", wal.logsPath, wal.lastLogIndex),
+		FilePath:   wal.logPath(wal.lastLogIndex),
 		BlockIndex: wal.blocksWrittenInLastLog,
 	}, wal.lastBlock)
 	if err != nil {
@@ -284,42 +385,45 @@ func (wal *WAL) makeNewBlock() {
 
 // Close flushes any remaining data and closes the WAL.
 // Should be called during graceful shutdown to avoid data loss.
+// Nothing is written if no record is pending.
 func (wal *WAL) Close() error {
-	err := wal.flushBlock()
-	if err != nil {
-		return fmt.Errorf("failed to flush current block: %w", err)
-	}
-
-	// Update metadata file to indicate graceful shutdown
-	metadataFile, err := os.OpenFile("hunddb/lsm/wal/metadata.bin", os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open metadata file: %w", err)
+	if wal.offsetInBlock == crc.CRC_SIZE {
+		return nil
 	}
-	defer metadataFile.Close()
-
-	data := make([]byte, 9)
-	data[0] = byte_util.BoolToByte(true) // Graceful exit flag
-	binary.LittleEndian.PutUint64(data[1:], wal.offsetInBlock)
-
-	_, err = metadataFile.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write metadata file: %w", err)
+	if err := wal.flushBlock(); err != nil {
+		return fmt.Errorf("failed to flush current block: %w", err)
 	}
+	wal.makeNewBlock()
 	return nil
 }
 
-// DeleteOldLogs deletes all log files with numbers below the given low watermark.
-// lowWatermark: the log number below which all logs should be deleted.
+// DeleteOldLogs retires all log files with numbers below the given low watermark.
+// Up to MAX_RECYCLED_LOGS retired files are kept (renamed to recycled_{number}.log) and reused
+// for future segments, the rest are deleted.
+// lowWatermark: the log number below which all logs should be retired.
 func (wal *WAL) DeleteOldLogs(lowWatermark uint64) error {
 	if lowWatermark <= 0 {
 		return nil
 	}
 	for logNum := wal.firstLogIndex; logNum < lowWatermark; logNum++ {
-		logFilePath := fmt.Sprintf("%s/wal_%d.log", wal.logsPath, logNum)
-		err := os.Remove(logFilePath)
+		logFilePath := wal.logPath(logNum)
+		var err error
+		if uint64(len(wal.recycledLogs)) < MAX_RECYCLED_LOGS {
+			recycledPath := fmt.Sprintf("%s/recycled_%d.log", wal.logsPath, logNum)
+			err = os.Rename(logFilePath, recycledPath)
+			if err == nil {
+				wal.recycledLogs = append(wal.recycledLogs, recycledPath)
+			}
+		} else {
+			err = os.Remove(logFilePath)
+		}
 		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to delete log file %s: %w", logFilePath, err)
+			return fmt.Errorf("failed to retire log file %s: %w", logFilePath, err)
 		}
+		bm.GetBlockManager().RemoveFileMutex(logFilePath)
+	}
+	if lowWatermark > wal.firstLogIndex && lowWatermark <= wal.lastLogIndex {
+		wal.firstLogIndex = lowWatermark
 	}
 
 	return nil
@@ -360,18 +464,91 @@ func (a *WAL) RecoverMemtables(memtables []*memtable.MemTable) error {
 // It handles both complete records and fragmented records across multiple blocks.
 // Updates the position as it processes records.
 func (wal *WAL) recoverMemtable(memtable *memtable.MemTable, position *WalPosition) error {
-	blockManager := bm.GetBlockManager()
 	fragmentBuffer := make([]byte, 0, BLOCK_SIZE)
+	end := WalPosition{LogIndex: wal.lastLogIndex, BlockIndex: wal.blocksWrittenInLastLog}
+	return wal.replayFrom(position, end, &fragmentBuffer, func(record *record.Record) bool {
+		memtable.Put(record)
+		return memtable.IsFull()
+	})
+}
+
+// WalSnapshot marks the records written to the WAL up to a point, see Snapshot.
+type WalSnapshot struct {
+	firstLogIndex uint64      // First log segment still on disk
+	end           WalPosition // First block not yet written to disk
+	pending       []byte      // Copy of the block being written to, its records only exist in memory
+}
+
+// Truncated reports whether older log segments were already retired, so records before the snapshot's
+// first one may be missing from it.
+func (snapshot *WalSnapshot) Truncated() bool {
+	return snapshot.firstLogIndex > 1
+}
+
+// Snapshot marks the records written so far, so they can be replayed by ReplaySnapshot while writing goes on.
+// The WAL must not be written to while taking the snapshot.
+func (wal *WAL) Snapshot() *WalSnapshot {
+	snapshot := &WalSnapshot{
+		firstLogIndex: wal.firstLogIndex,
+		end:           WalPosition{LogIndex: wal.lastLogIndex, BlockIndex: wal.blocksWrittenInLastLog},
+	}
+	if wal.offsetInBlock > crc.CRC_SIZE {
+		snapshot.pending = append([]byte(nil), wal.lastBlock[:wal.offsetInBlock]...)
+	}
+	return snapshot
+}
+
+// ReplayRecords calls apply for every record still in the WAL, in the order they were written.
+// This includes the records in the current, not yet flushed block.
+// The WAL must not be written to while replaying.
+func (wal *WAL) ReplayRecords(apply func(record *record.Record)) error {
+	return wal.ReplaySnapshot(wal.Snapshot(), apply)
+}
+
+// ReplaySnapshot calls apply for every record of the snapshot, in the order they were written.
+// Records written after the snapshot don't affect it, but the snapshot's segments must not be retired meanwhile.
+func (wal *WAL) ReplaySnapshot(snapshot *WalSnapshot, apply func(record *record.Record)) error {
+	position := &WalPosition{
+		LogIndex:   snapshot.firstLogIndex,
+		BlockIndex: 0,
+		Offset:     crc.CRC_SIZE,
+	}
+	fragmentBuffer := make([]byte, 0, BLOCK_SIZE)
+	applyAll := func(record *record.Record) bool {
+		apply(record)
+		return false
+	}
 
-	for position.LogIndex <= wal.lastLogIndex {
+	err := wal.replayFrom(position, snapshot.end, &fragmentBuffer, applyAll)
+	if err != nil {
+		return err
+	}
+
+	if snapshot.pending != nil {
+		position.LogIndex = snapshot.end.LogIndex
+		position.Offset = crc.CRC_SIZE
+		_, err = wal.processBlockForRecovery(snapshot.pending, &fragmentBuffer, applyAll, position)
+		if err != nil {
+			return fmt.Errorf("failed to process current block: %w", err)
+		}
+	}
+	return nil
+}
+
+// replayFrom reads the written blocks from the given position up to end, passing each reassembled
+// record to apply until it returns true. Updates the position as it processes records.
+func (wal *WAL) replayFrom(position *WalPosition, end WalPosition, fragmentBuffer *[]byte, apply func(record *record.Record) bool) error {
+	blockManager := bm.GetBlockManager()
+
+	for position.LogIndex <= end.LogIndex {
 		endBlockIndex := wal.logSize
-		if position.LogIndex == wal.lastLogIndex {
-			endBlockIndex = wal.blocksWrittenInLastLog
+		if position.LogIndex == end.LogIndex {
+			endBlockIndex = end.BlockIndex
 		}
 
 		for position.BlockIndex < endBlockIndex {
 			location := block_location.BlockLocation{
-				FilePath:   fmt.Sprintf("%s/wal_%d.log", wal.logsPath, position.LogIndex),
+				FilePath:   wal.logPath(position.LogIndex),
 				BlockIndex: position.BlockIndex,
 			}
 
@@ -385,14 +562,18 @@ func (wal *WAL) recoverMemtable(memtable *memtable.MemTable, position *WalPositi
 				return fmt.Errorf("CRC failed %s:%d: %w", location.FilePath, location.BlockIndex, err)
 			}
 
-			memtableFull, err := wal.processBlockForRecovery(block, &fragmentBuffer, memtable, position)
+			stop, err := wal.processBlockForRecovery(block, fragmentBuffer, apply, position)
+			if errors.Is(err, errStaleBlock) {
+				// The rest of this segment predates its reuse - nothing more to replay from it
+				break
+			}
 			if err != nil {
 				return fmt.Errorf("failed to process block %s:%d: %w", location.FilePath, location.BlockIndex, err)
 			}
 			position.BlockIndex++
 			position.Offset = crc.CRC_SIZE
 
-			if memtableFull {
+			if stop {
 				return nil
 			}
 		}
@@ -407,8 +588,9 @@ func (wal *WAL) recoverMemtable(memtable *memtable.MemTable, position *WalPositi
 
 // processBlockForRecovery processes a single WAL block and reconstructs records from it.
 // Updates the position as it processes records within the block.
-// Returns true if the memtable becomes full during processing.
-func (wal *WAL) processBlockForRecovery(block []byte, fragmentBuffer *[]byte, memtable *memtable.MemTable, position *WalPosition) (bool, error) {
+// Returns true if apply asked to stop (e.g. the memtable being recovered became full).
+// Returns errStaleBlock if the block was written for another log number (recycled segment).
+func (wal *WAL) processBlockForRecovery(block []byte, fragmentBuffer *[]byte, apply func(record *record.Record) bool, position *WalPosition) (bool, error) {
 	offset := int(position.Offset)
 
 	for offset < len(block) {
@@ -421,16 +603,21 @@ func (wal *WAL) processBlockForRecovery(block []byte, fragmentBuffer *[]byte, me
 		}
 
 		header := DeserializeWALHeader(block[offset:])
+		if header.LogNumber != position.LogIndex {
+			return false, errStaleBlock
+		}
 		offset += HEADER_TOTAL_SIZE
 		payload := block[offset : offset+int(header.PayloadSize)]
 		offset += int(header.PayloadSize)
 		position.Offset = uint64(offset)
 
-		switch header.Type {
+		switch header.FragmentType() {
 		case FRAGMENT_FULL:
-			record := record.Deserialize(payload)
-			memtable.Put(record)
-			if memtable.IsFull() {
+			data, err := decodePayload(payload, header.IsCompressed())
+			if err != nil {
+				return false, err
+			}
+			if apply(record.Deserialize(data)) {
 				return true, nil
 			}
 
@@ -439,10 +626,13 @@ func (wal *WAL) processBlockForRecovery(block []byte, fragmentBuffer *[]byte, me
 
 		case FRAGMENT_LAST:
 			*fragmentBuffer = append(*fragmentBuffer, payload...)
-			record := record.Deserialize(*fragmentBuffer)
-			*fragmentBuffer = (*fragmentBuffer)[:0]
-			memtable.Put(record)
-			if memtable.IsFull() {
+			data, err := decodePayload(*fragmentBuffer, header.IsCompressed())
+			if err != nil {
+				return false, err
+			}
+			// The record's value points into the buffer, so the next record needs a fresh one
+			*fragmentBuffer = make([]byte, 0, BLOCK_SIZE)
+			if apply(record.Deserialize(data)) {
 				return true, nil
 			}
 
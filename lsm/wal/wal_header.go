@@ -21,6 +21,10 @@ const (
 	FRAGMENT_MIDDLE = 2 // Middle fragment of a multi-block user record
 	FRAGMENT_LAST   = 3 // Last fragment of a multi-block user record
 	FRAGMENT_FULL   = 4 // Whole user record fits in one WAL record
+
+	// Payload flags - stored in the high bits of the type byte, next to the fragment type
+	FRAGMENT_TYPE_MASK = 0x0F // Bits holding the fragment type
+	FLAG_COMPRESSED    = 0x80 // The record payload is zlib-compressed (set on all of its fragments)
 )
 
 /*
@@ -29,7 +33,7 @@ const (
    |    Size (8B)  |   Type (1B)   | LogNumber(8B) |
    +---------------+---------------+---------------+
    Size = Length of the fragment payload in bytes
-   Type = Fragment type: 1=FIRST, 2=MIDDLE, 3=LAST, 4=FULL
+   Type = Fragment type: 1=FIRST, 2=MIDDLE, 3=LAST, 4=FULL (low bits), payload flags (high bits)
    LogNumber = Identifies which WAL log this fragment belongs to
 */
 
@@ -50,6 +54,16 @@ func NewWALHeader(size uint64, typ byte, logNumber uint64) *WALHeader {
 	}
 }
 
+// FragmentType returns the fragment type (FIRST/MIDDLE/LAST/FULL) without the payload flags.
+func (h *WALHeader) FragmentType() byte {
+	return h.Type & FRAGMENT_TYPE_MASK
+}
+
+// IsCompressed reports whether the record this fragment belongs to was compressed before fragmentation.
+func (h *WALHeader) IsCompressed() bool {
+	return h.Type&FLAG_COMPRESSED != 0
+}
+
 // Serialize serializes a WALHeader into a byte array. The byte array contains the following fields:
 // - Size: 2 bytes for the size of the fragment payload
 // - Type: 1 byte for the fragment type (FIRST/MIDDLE/LAST/FULL)
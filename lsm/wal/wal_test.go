@@ -32,7 +32,7 @@ func createTombstoneRecord(key string) *record.Record {
 	return record.NewRecord(key, nil, uint64(time.Now().Unix()), true)
 }
 
-func setupTestWAL(t *testing.T) (*WAL, string) {
+func setupTestWAL(t testing.TB) (*WAL, string) {
 	tmpDir, err := os.MkdirTemp("", "wal_test_")
 	if err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
@@ -184,8 +184,12 @@ func processTestBlock(block []byte, fragmentBuffer *[]byte) ([]*record.Record, e
 		payload := block[offset : offset+int(header.PayloadSize)]
 		offset += int(header.PayloadSize)
 
-		switch header.Type {
+		switch header.FragmentType() {
 		case FRAGMENT_FULL:
+			data, err := decodePayload(payload, header.IsCompressed())
+			if err != nil {
+				return nil, err
+			}
 			// Try to deserialize, but handle potential panics from corruption
 			func() {
 				defer func() {
@@ -194,7 +198,7 @@ func processTestBlock(block []byte, fragmentBuffer *[]byte) ([]*record.Record, e
 						panic(fmt.Errorf("corruption detected during record deserialization: %v", r))
 					}
 				}()
-				rec := record.Deserialize(payload)
+				rec := record.Deserialize(data)
 				records = append(records, rec)
 			}()
 
@@ -203,6 +207,10 @@ func processTestBlock(block []byte, fragmentBuffer *[]byte) ([]*record.Record, e
 
 		case FRAGMENT_LAST:
 			*fragmentBuffer = append(*fragmentBuffer, payload...)
+			data, err := decodePayload(*fragmentBuffer, header.IsCompressed())
+			if err != nil {
+				return nil, err
+			}
 			// Try to deserialize, but handle potential panics from corruption
 			func() {
 				defer func() {
@@ -211,7 +219,7 @@ func processTestBlock(block []byte, fragmentBuffer *[]byte) ([]*record.Record, e
 						panic(fmt.Errorf("corruption detected during fragmented record deserialization: %v", r))
 					}
 				}()
-				rec := record.Deserialize(*fragmentBuffer)
+				rec := record.Deserialize(data)
 				records = append(records, rec)
 			}()
 			*fragmentBuffer = (*fragmentBuffer)[:0]
@@ -406,18 +414,19 @@ func TestWAL_RecordSpansMultipleBlocks(t *testing.T) {
 		t.Fatalf("Failed to write large spanning record: %v", err)
 	}
 
-	// The record should have caused multiple blocks to be written due to fragmentation
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// The record should have caused multiple blocks to be written due to fragmentation,
+	// the last fragment once Close() flushed it
 	blocksUsed := wal.blocksWrittenInLastLog - initialBlocks
 	if blocksUsed < 2 {
 		t.Errorf("Expected at least 2 blocks to be written for fragmented record (payload %d bytes), got %d blocks",
 			payloadSize, blocksUsed)
 	}
 
-	err = wal.Close()
-	if err != nil {
-		t.Fatalf("Failed to close WAL: %v", err)
-	}
-
 	records, err := readAllRecordsFromWAL(wal)
 	if err != nil {
 		t.Fatalf("Failed to read records: %v", err)
@@ -464,17 +473,17 @@ func TestWAL_RecordSpansThreeBlocks(t *testing.T) {
 		t.Fatalf("Failed to write triple-spanning record: %v", err)
 	}
 
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
 	// The record should have caused multiple blocks to be written due to fragmentation
 	blocksUsed := wal.blocksWrittenInLastLog - initialBlocks
 	if blocksUsed < 3 {
 		t.Errorf("Expected at least 3 blocks to be written for triple-spanning record, got %d", blocksUsed)
 	}
 
-	err = wal.Close()
-	if err != nil {
-		t.Fatalf("Failed to close WAL: %v", err)
-	}
-
 	records, err := readAllRecordsFromWAL(wal)
 	if err != nil {
 		t.Fatalf("Failed to read records: %v", err)
@@ -1206,7 +1215,12 @@ func TestWAL_RecordExactlyFillsMultipleBlocks(t *testing.T) {
 		t.Fatalf("Failed to write 3-block exact record: %v", err)
 	}
 
-	// Should use exactly 3 blocks
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// Should use exactly 3 blocks, the last one flushed by Close()
 	blocksUsed := wal.blocksWrittenInLastLog - initialBlocks
 	if blocksUsed != 3 {
 		totalSerializedSize := uint64(len(exactRecord.Serialize()))
@@ -1224,11 +1238,6 @@ func TestWAL_RecordExactlyFillsMultipleBlocks(t *testing.T) {
 			initialBlocks, wal.blocksWrittenInLastLog)
 	}
 
-	err = wal.Close()
-	if err != nil {
-		t.Fatalf("Failed to close WAL: %v", err)
-	}
-
 	records, err := readAllRecordsFromWAL(wal)
 	if err != nil {
 		t.Fatalf("Failed to read records: %v", err)
@@ -1950,7 +1959,7 @@ func TestWAL_CurrentImplementationBehavior(t *testing.T) {
 	gracefulWAL.WriteRecord(createTestRecord("flushed_data", 4000))
 	gracefulWAL.WriteRecord(createTestRecord("unflushed", 200))
 
-	gracefulWAL.Close() // This creates metadata file
+	gracefulWAL.Close() // Flushes the last block
 
 	gracefulRecovery, err := BuildWAL()
 	if err != nil {
@@ -2429,3 +2438,502 @@ func TestWAL_RecoverMemtables(t *testing.T) {
 		t.Fatalf("Failed to close recovery WAL: %v", err)
 	}
 }
+
+// TestWAL_SegmentPreallocation verifies that a new log segment spans LOG_SIZE blocks
+// as soon as its first block is written
+func TestWAL_SegmentPreallocation(t *testing.T) {
+	wal, _ := setupTestWAL(t)
+
+	_, err := wal.WriteRecord(createTestRecord("prealloc", 100))
+	if err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	info, err := os.Stat(wal.logPath(1))
+	if err != nil {
+		t.Fatalf("Failed to stat log file: %v", err)
+	}
+	if uint64(info.Size()) != LOG_SIZE*BLOCK_SIZE {
+		t.Errorf("Expected preallocated log of %d bytes, got %d", LOG_SIZE*BLOCK_SIZE, info.Size())
+	}
+
+	// The preallocated tail must not be mistaken for written blocks
+	reloaded, err := BuildWAL()
+	if err != nil {
+		t.Fatalf("Failed to rebuild WAL: %v", err)
+	}
+	if reloaded.blocksWrittenInLastLog != 1 {
+		t.Errorf("Expected 1 written block after reload, got %d", reloaded.blocksWrittenInLastLog)
+	}
+}
+
+// TestWAL_SegmentRecycling verifies that retired segments are kept for reuse and that
+// stale blocks from a reused segment are not replayed
+func TestWAL_SegmentRecycling(t *testing.T) {
+	testSegmentRecycling(t)
+}
+
+// TestWAL_EncryptedSegmentRecycling verifies that encrypted segments stay readable after being renamed for reuse
+func TestWAL_EncryptedSegmentRecycling(t *testing.T) {
+	keyring, err := bm.NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{0x42}, 32)}, 1)
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	bm.GetBlockManager().SetKeyring(keyring)
+	t.Cleanup(func() { bm.GetBlockManager().SetKeyring(nil) })
+
+	testSegmentRecycling(t)
+}
+
+func testSegmentRecycling(t *testing.T) {
+	wal, _ := setupTestWAL(t)
+
+	// Fill log 1 completely with large records so every block holds a header for log 1,
+	// the last record rolls over into log 2
+	maxPayloadPerBlock := BLOCK_SIZE - crc.CRC_SIZE - HEADER_TOTAL_SIZE - 100
+	for i := 0; i <= int(LOG_SIZE); i++ {
+		_, err := wal.WriteRecord(createTestRecord(fmt.Sprintf("old_%d", i), maxPayloadPerBlock))
+		if err != nil {
+			t.Fatalf("Failed to write record %d: %v", i, err)
+		}
+	}
+	if wal.lastLogIndex != 2 {
+		t.Fatalf("Expected rollover to log 2, still on log %d", wal.lastLogIndex)
+	}
+
+	// Retire log 1 - it should be renamed into the recycle pool, not deleted
+	err := wal.DeleteOldLogs(2)
+	if err != nil {
+		t.Fatalf("Failed to retire old logs: %v", err)
+	}
+	if _, err := os.Stat(wal.logPath(1)); !os.IsNotExist(err) {
+		t.Errorf("Log 1 should no longer exist under its original name")
+	}
+	if len(wal.recycledLogs) != 1 {
+		t.Fatalf("Expected 1 recycled log, got %d", len(wal.recycledLogs))
+	}
+	if wal.firstLogIndex != 2 {
+		t.Errorf("Expected first log index 2 after retirement, got %d", wal.firstLogIndex)
+	}
+
+	// Write a few small records into log 2 - its first block reuses the recycled file
+	for i := 0; i < 3; i++ {
+		_, err := wal.WriteRecord(createTestRecord(fmt.Sprintf("new_%d", i), 100))
+		if err != nil {
+			t.Fatalf("Failed to write record %d: %v", i, err)
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	if len(wal.recycledLogs) != 0 {
+		t.Errorf("Expected the recycled log to be reused, %d still pooled", len(wal.recycledLogs))
+	}
+
+	// Log 2 holds the rollover record in block 0 and the new records in block 1.
+	// The reused file still contains log 1 blocks after those - they must be rejected.
+	reloaded, err := BuildWAL()
+	if err != nil {
+		t.Fatalf("Failed to rebuild WAL: %v", err)
+	}
+	if reloaded.blocksWrittenInLastLog != 2 {
+		t.Errorf("Expected 2 written blocks in reused log, got %d", reloaded.blocksWrittenInLastLog)
+	}
+
+	mt, err := memtable.NewMemtable()
+	if err != nil {
+		t.Fatalf("Failed to create memtable: %v", err)
+	}
+	err = reloaded.RecoverMemtables([]*memtable.MemTable{mt})
+	if err != nil {
+		t.Fatalf("Failed to recover memtables: %v", err)
+	}
+	// The rollover record and the three new ones
+	if mt.TotalEntries() != 4 {
+		t.Errorf("Expected 4 recovered records, got %d", mt.TotalEntries())
+	}
+	if mt.Get("old_2") != nil {
+		t.Errorf("Stale record from recycled segment was replayed")
+	}
+}
+
+// TestWAL_RecoveryRejectsStaleBlock verifies that a block carrying another log number stops replay of that log
+func TestWAL_RecoveryRejectsStaleBlock(t *testing.T) {
+	wal, _ := setupTestWAL(t)
+
+	_, err := wal.WriteRecord(createTestRecord("fresh", 100))
+	if err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// Forge a CRC-valid block for log 7 right after the written one
+	staleBlock := make([]byte, BLOCK_SIZE)
+	payload := createTestRecord("stale", 100).Serialize()
+	copy(staleBlock[crc.CRC_SIZE:], NewWALHeader(uint64(len(payload)), FRAGMENT_FULL, 7).Serialize())
+	copy(staleBlock[crc.CRC_SIZE+HEADER_TOTAL_SIZE:], payload)
+	staleBlock = crc.AddCRCToBlockData(staleBlock)
+	err = bm.GetBlockManager().WriteBlock(block_location.BlockLocation{FilePath: wal.logPath(1), BlockIndex: 1}, staleBlock)
+	if err != nil {
+		t.Fatalf("Failed to write stale block: %v", err)
+	}
+
+	if !isStaleBlock(staleBlock, 1) {
+		t.Errorf("Block with log number 7 should be stale for log 1")
+	}
+
+	reloaded, err := BuildWAL()
+	if err != nil {
+		t.Fatalf("Failed to rebuild WAL: %v", err)
+	}
+	if reloaded.blocksWrittenInLastLog != 1 {
+		t.Errorf("Expected stale block to end the log at 1 block, got %d", reloaded.blocksWrittenInLastLog)
+	}
+}
+
+// TestWAL_ReopenWithoutWrites verifies that opening and closing the WAL without writing leaves the logs alone
+func TestWAL_ReopenWithoutWrites(t *testing.T) {
+	wal, _ := setupTestWAL(t)
+
+	_, err := wal.WriteRecord(createTestRecord("key", 100))
+	if err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := wal.Close(); err != nil {
+			t.Fatalf("Failed to close WAL: %v", err)
+		}
+		if wal, err = BuildWAL(); err != nil {
+			t.Fatalf("Failed to rebuild WAL: %v", err)
+		}
+		if wal.blocksWrittenInLastLog != 1 {
+			t.Errorf("Expected reopening to keep the log at 1 block, got %d", wal.blocksWrittenInLastLog)
+		}
+	}
+
+	records, err := readAllRecordsFromWAL(wal)
+	if err != nil || len(records) != 1 {
+		t.Errorf("Expected the single record to be replayed, got %d records (err=%v)", len(records), err)
+	}
+}
+
+// TestWAL_RecoveryRejectsStaleEmptyBlock verifies that a CRC-valid block without records, left in a segment
+// from before its reuse, ends the log
+func TestWAL_RecoveryRejectsStaleEmptyBlock(t *testing.T) {
+	wal, _ := setupTestWAL(t)
+
+	_, err := wal.WriteRecord(createTestRecord("fresh", 100))
+	if err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	emptyBlock := crc.AddCRCToBlockData(make([]byte, BLOCK_SIZE))
+	err = bm.GetBlockManager().WriteBlock(block_location.BlockLocation{FilePath: wal.logPath(1), BlockIndex: 1}, emptyBlock)
+	if err != nil {
+		t.Fatalf("Failed to write empty block: %v", err)
+	}
+	if !isStaleBlock(emptyBlock, 1) {
+		t.Errorf("Block without a header should be stale")
+	}
+
+	reloaded, err := BuildWAL()
+	if err != nil {
+		t.Fatalf("Failed to rebuild WAL: %v", err)
+	}
+	if reloaded.blocksWrittenInLastLog != 1 {
+		t.Errorf("Expected the empty block to end the log at 1 block, got %d", reloaded.blocksWrittenInLastLog)
+	}
+}
+
+// TestWAL_RecycledLogsLimit verifies that retired segments beyond MAX_RECYCLED_LOGS are deleted
+func TestWAL_RecycledLogsLimit(t *testing.T) {
+	wal, _ := setupTestWAL(t)
+
+	maxPayloadPerBlock := BLOCK_SIZE - crc.CRC_SIZE - HEADER_TOTAL_SIZE - 100
+	logsToFill := int(MAX_RECYCLED_LOGS) + 2
+	for i := 0; wal.lastLogIndex <= uint64(logsToFill); i++ {
+		_, err := wal.WriteRecord(createTestRecord(fmt.Sprintf("key_%d", i), maxPayloadPerBlock))
+		if err != nil {
+			t.Fatalf("Failed to write record %d: %v", i, err)
+		}
+	}
+
+	err := wal.DeleteOldLogs(wal.lastLogIndex)
+	if err != nil {
+		t.Fatalf("Failed to retire old logs: %v", err)
+	}
+	if uint64(len(wal.recycledLogs)) != MAX_RECYCLED_LOGS {
+		t.Errorf("Expected %d recycled logs, got %d", MAX_RECYCLED_LOGS, len(wal.recycledLogs))
+	}
+	for logNum := uint64(1); logNum < wal.lastLogIndex; logNum++ {
+		if _, err := os.Stat(wal.logPath(logNum)); !os.IsNotExist(err) {
+			t.Errorf("Log %d should have been retired", logNum)
+		}
+	}
+
+	// The pool is picked up again on restart
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	reloaded, err := BuildWAL()
+	if err != nil {
+		t.Fatalf("Failed to rebuild WAL: %v", err)
+	}
+	if len(reloaded.recycledLogs) != len(wal.recycledLogs) {
+		t.Errorf("Expected %d recycled logs after reload, got %d", len(wal.recycledLogs), len(reloaded.recycledLogs))
+	}
+}
+
+// benchmarkWALWrites writes records of the given size, retiring old segments as they roll over when recycle is set
+func benchmarkWALWrites(b *testing.B, valueSize uint64, recycle bool) {
+	wal, _ := setupTestWAL(b)
+	rec := createTestRecord("bench_key", valueSize)
+
+	b.SetBytes(int64(rec.Size()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := wal.WriteRecord(rec)
+		if err != nil {
+			b.Fatalf("Failed to write record: %v", err)
+		}
+		if wal.lastLogIndex > wal.firstLogIndex+1 {
+			if recycle {
+				err = wal.DeleteOldLogs(wal.lastLogIndex - 1)
+			} else {
+				// Plain deletion, as before segments were recycled
+				err = os.Remove(wal.logPath(wal.firstLogIndex))
+				wal.firstLogIndex++
+			}
+			if err != nil {
+				b.Fatalf("Failed to retire logs: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkWAL_WriteRecord_Small(b *testing.B) {
+	benchmarkWALWrites(b, 100, true)
+}
+
+func BenchmarkWAL_WriteRecord_Large(b *testing.B) {
+	benchmarkWALWrites(b, 3000, true)
+}
+
+func BenchmarkWAL_WriteRecord_Fragmented(b *testing.B) {
+	benchmarkWALWrites(b, 10000, true)
+}
+
+func BenchmarkWAL_WriteRecord_NoRecycling(b *testing.B) {
+	benchmarkWALWrites(b, 3000, false)
+}
+
+// createJSONRecord creates a record with a verbose, highly compressible JSON value of roughly the given size
+func createJSONRecord(key string, approxSize int) *record.Record {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; buf.Len() < approxSize; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"id":%d,"name":"user_%d","active":true,"roles":["reader","writer"]}`, i, i)
+	}
+	buf.WriteString("]")
+	return createTestRecordWithValue(key, buf.Bytes())
+}
+
+// TestWAL_CompressedRecords verifies that compressed payloads are flagged and transparently recovered
+func TestWAL_CompressedRecords(t *testing.T) {
+	wal, _ := setupTestWAL(t)
+	wal.compressPayloads = true
+
+	testRecords := []*record.Record{
+		createJSONRecord("json_small", 500),
+		createJSONRecord("json_fragmented", 20000), // Still spans several blocks once compressed
+		createTestRecord("random_like", 50),        // Too small to benefit, written raw
+		createTombstoneRecord("deleted"),
+	}
+	for _, rec := range testRecords {
+		_, err := wal.WriteRecord(rec)
+		if err != nil {
+			t.Fatalf("Failed to write record %s: %v", rec.Key, err)
+		}
+	}
+	err := wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// The first record must be flagged as compressed and be smaller than its serialized form
+	block, err := bm.GetBlockManager().ReadBlock(block_location.BlockLocation{FilePath: wal.logPath(1), BlockIndex: 0})
+	if err != nil {
+		t.Fatalf("Failed to read block: %v", err)
+	}
+	header := DeserializeWALHeader(block[crc.CRC_SIZE:])
+	if !header.IsCompressed() || header.FragmentType() != FRAGMENT_FULL {
+		t.Errorf("Expected a compressed FULL fragment, got type byte %#x", header.Type)
+	}
+	if header.PayloadSize >= uint64(testRecords[0].Size()) {
+		t.Errorf("Expected compressed payload smaller than %d bytes, got %d", testRecords[0].Size(), header.PayloadSize)
+	}
+
+	// Records read through the test reader match the originals
+	records, err := readAllRecordsFromWAL(wal)
+	if err != nil {
+		t.Fatalf("Failed to read records: %v", err)
+	}
+	if len(records) != len(testRecords) {
+		t.Fatalf("Expected %d records, got %d", len(testRecords), len(records))
+	}
+	for i, rec := range records {
+		if rec.Key != testRecords[i].Key || !bytes.Equal(rec.Value, testRecords[i].Value) || rec.Tombstone != testRecords[i].Tombstone {
+			t.Errorf("Record %d mismatch: expected key %s, got %s", i, testRecords[i].Key, rec.Key)
+		}
+	}
+
+	// Recovery decompresses transparently
+	recoveryWAL, err := BuildWAL()
+	if err != nil {
+		t.Fatalf("Failed to rebuild WAL: %v", err)
+	}
+	mt, err := memtable.NewMemtable()
+	if err != nil {
+		t.Fatalf("Failed to create memtable: %v", err)
+	}
+	err = recoveryWAL.RecoverMemtables([]*memtable.MemTable{mt})
+	if err != nil {
+		t.Fatalf("Failed to recover memtables: %v", err)
+	}
+	for _, expected := range testRecords[:3] {
+		recovered := mt.Get(expected.Key)
+		if recovered == nil {
+			t.Errorf("Record %s was not recovered", expected.Key)
+			continue
+		}
+		if !bytes.Equal(recovered.Value, expected.Value) {
+			t.Errorf("Value mismatch for %s after recovery", expected.Key)
+		}
+	}
+	if mt.TotalEntries() != len(testRecords) {
+		t.Errorf("Expected %d recovered entries, got %d", len(testRecords), mt.TotalEntries())
+	}
+}
+
+// TestWAL_CompressionReducesBlocks verifies that compressible values take fewer WAL blocks when compressed
+func TestWAL_CompressionReducesBlocks(t *testing.T) {
+	writeBlocks := func(compress bool) uint64 {
+		wal, _ := setupTestWAL(t)
+		wal.compressPayloads = compress
+		for i := 0; i < 20; i++ {
+			_, err := wal.WriteRecord(createJSONRecord(fmt.Sprintf("json_%d", i), 2000))
+			if err != nil {
+				t.Fatalf("Failed to write record %d: %v", i, err)
+			}
+		}
+		return (wal.lastLogIndex-1)*LOG_SIZE + wal.blocksWrittenInLastLog
+	}
+
+	raw := writeBlocks(false)
+	compressed := writeBlocks(true)
+	t.Logf("Blocks written: raw=%d, compressed=%d", raw, compressed)
+	if compressed >= raw {
+		t.Errorf("Expected compression to reduce written blocks, raw=%d compressed=%d", raw, compressed)
+	}
+}
+
+// TestWAL_CompressedPayloadCorruption verifies that a damaged compressed payload is reported instead of replayed
+func TestWAL_CompressedPayloadCorruption(t *testing.T) {
+	_, err := decodePayload([]byte("definitely not zlib"), true)
+	if err == nil {
+		t.Errorf("Expected an error when decompressing garbage")
+	}
+
+	data, err := decodePayload([]byte("raw"), false)
+	if err != nil || string(data) != "raw" {
+		t.Errorf("Expected uncompressed payload to be returned unchanged, got %q (%v)", data, err)
+	}
+}
+
+// TestWAL_EncryptedRecovery verifies that an encrypted WAL keeps no plaintext on disk and still recovers across segments
+func TestWAL_EncryptedRecovery(t *testing.T) {
+	keyring, err := bm.NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{0x42}, 32)}, 1)
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	bm.GetBlockManager().SetKeyring(keyring)
+	t.Cleanup(func() { bm.GetBlockManager().SetKeyring(nil) })
+
+	wal, _ := setupTestWAL(t)
+	recordCount := int(LOG_SIZE) + 2 // Spans at least two segments
+	for i := 0; i < recordCount; i++ {
+		_, err := wal.WriteRecord(createTestRecord(fmt.Sprintf("secret_key_%d", i), 3000))
+		if err != nil {
+			t.Fatalf("Failed to write record %d: %v", i, err)
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	if wal.lastLogIndex < 2 {
+		t.Fatalf("Expected records to span several segments, last log is %d", wal.lastLogIndex)
+	}
+
+	onDisk, err := os.ReadFile(wal.logPath(1))
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if bytes.Contains(onDisk, []byte("secret_key_")) {
+		t.Errorf("Expected no plaintext keys in the encrypted log")
+	}
+
+	// Recovery must not be served from the cache
+	bm.GetBlockManager().ClearCache()
+	recoveryWAL, err := BuildWAL()
+	if err != nil {
+		t.Fatalf("Failed to rebuild WAL: %v", err)
+	}
+	mt, err := memtable.NewMemtable()
+	if err != nil {
+		t.Fatalf("Failed to create memtable: %v", err)
+	}
+	err = recoveryWAL.RecoverMemtables([]*memtable.MemTable{mt})
+	if err != nil {
+		t.Fatalf("Failed to recover memtables: %v", err)
+	}
+	if mt.TotalEntries() != recordCount {
+		t.Errorf("Expected %d recovered entries, got %d", recordCount, mt.TotalEntries())
+	}
+}
+
+func BenchmarkWAL_WriteRecord_CompressedJSON(b *testing.B) {
+	wal, _ := setupTestWAL(b)
+	wal.compressPayloads = true
+	rec := createJSONRecord("bench_json", 3000)
+
+	b.SetBytes(int64(rec.Size()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := wal.WriteRecord(rec)
+		if err != nil {
+			b.Fatalf("Failed to write record: %v", err)
+		}
+		if wal.lastLogIndex > wal.firstLogIndex+1 {
+			if err := wal.DeleteOldLogs(wal.lastLogIndex - 1); err != nil {
+				b.Fatalf("Failed to retire logs: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	memtable "hunddb/lsm/memtable"
+	"hunddb/lsm/sstable"
+	"time"
+)
+
+// Reasons for writes to be slowed down or stopped
+const (
+	StallCauseMemtables         = "memtables"          // The flush queue is full or the write buffer budget is reached
+	StallCauseLevel0            = "level0"             // Too many SSTables in level 0
+	StallCausePendingFlush      = "pending_flush"      // Too many bytes in memtables waiting to be flushed
+	StallCausePendingCompaction = "pending_compaction" // Too many bytes waiting to be compacted
+)
+
+// ErrWritesStopped is returned by writes while a background error is set (see LSM.BackgroundError and LSM.Resume).
+var ErrWritesStopped = errors.New("writes stopped by a background error")
+
+// Write conditions reported by WriteStallStats
+const (
+	WriteConditionNormal  = "normal"
+	WriteConditionDelayed = "delayed"
+	WriteConditionStopped = "stopped"
+)
+
+/*
+WriteStallStats describes the backpressure applied to writes while flushes or compactions fall behind.
+A delayed write sleeps once for WRITE_SLOWDOWN_DELAY, a stopped write waits until background work catches up.
+*/
+type WriteStallStats struct {
+	Condition              string // WriteConditionNormal, WriteConditionDelayed or WriteConditionStopped right now
+	Cause                  string // Why writes are currently delayed or stopped, empty when normal
+	Level0Tables           int
+	PendingFlushBytes      int64 // Approximate bytes held by memtables waiting to be flushed
+	PendingCompactionBytes int64 // Bytes of SSTables in levels over capacity, which compaction has to rewrite
+
+	DelayedWrites  uint64            // Writes that were slowed down
+	DelayTime      time.Duration     // Total time writes were slowed down for
+	StoppedWrites  uint64            // Writes that had to wait for background work
+	StopTime       time.Duration     // Total time writes spent waiting
+	StopsByCause   map[string]uint64 // Stopped writes per cause
+	StalledWriters int               // Writes waiting right now
+}
+
+// pendingFlushBytesUnsafe returns the approximate bytes held by queued memtables; must be called with lsm.mu held.
+func (lsm *LSM) pendingFlushBytesUnsafe() int64 {
+	pending := int64(0)
+	for _, imm := range lsm.immutables {
+		pending += imm.mt.MemoryUsage()
+	}
+	return pending
+}
+
+// exceeds reports whether the value reached a threshold, 0 disables the threshold.
+func exceeds(value uint64, threshold uint64) bool {
+	return threshold > 0 && value >= threshold
+}
+
+// writeStopCauseUnsafe returns why writes must wait for background work, or "" if they may proceed; must be called with lsm.mu held.
+func (lsm *LSM) writeStopCauseUnsafe() string {
+	if lsm.mustStallUnsafe() {
+		return StallCauseMemtables
+	}
+	if exceeds(uint64(len(lsm.levels[0])), LEVEL0_STOP_WRITES_TRIGGER) {
+		return StallCauseLevel0
+	}
+	if exceeds(uint64(lsm.pendingFlushBytesUnsafe()), PENDING_FLUSH_STOP_BYTES) {
+		return StallCausePendingFlush
+	}
+	if exceeds(uint64(lsm.pendingCompactionBytes), PENDING_COMPACTION_STOP_BYTES) {
+		return StallCausePendingCompaction
+	}
+	return ""
+}
+
+// writeSlowdownCauseUnsafe returns why writes should be slowed down, or "" if they run at full speed; must be called with lsm.mu held.
+func (lsm *LSM) writeSlowdownCauseUnsafe() string {
+	if exceeds(uint64(len(lsm.levels[0])), LEVEL0_SLOWDOWN_WRITES_TRIGGER) {
+		return StallCauseLevel0
+	}
+	if exceeds(uint64(lsm.pendingFlushBytesUnsafe()), PENDING_FLUSH_SLOWDOWN_BYTES) {
+		return StallCausePendingFlush
+	}
+	if exceeds(uint64(lsm.pendingCompactionBytes), PENDING_COMPACTION_SLOWDOWN_BYTES) {
+		return StallCausePendingCompaction
+	}
+	return ""
+}
+
+/*
+makeRoomForWriteUnsafe runs before every write, with lsm.mu held. It switches a full mutable memtable
+for a fresh one and applies backpressure: past a slowdown threshold the write sleeps once, past a stop
+threshold it waits until a flush or compaction commits. lsm.mu is released while sleeping or waiting.
+While a background error is set the write fails instead.
+*/
+func (lsm *LSM) makeRoomForWriteUnsafe() error {
+	delayed := false
+	var stopStart time.Time
+	for {
+		if lsm.backgroundErr != nil {
+			return fmt.Errorf("%w: %w", ErrWritesStopped, lsm.backgroundErr)
+		}
+		if lsm.memtable == nil {
+			fresh, err := memtable.NewMemtable()
+			if err != nil {
+				return err
+			}
+			lsm.setMemtableUnsafe(fresh)
+		}
+		if lsm.shouldRotateUnsafe() && len(lsm.immutables) < maxImmutableMemtables() {
+			if err := lsm.rotateMemtableUnsafe(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if cause := lsm.writeStopCauseUnsafe(); cause != "" {
+			if stopStart.IsZero() {
+				stopStart = time.Now()
+				lsm.stallStats.StoppedWrites++
+				lsm.stallStats.StopsByCause[cause]++
+				// Compactions only start after flushes, make sure one is running to lift the stop
+				if cause == StallCauseLevel0 || cause == StallCausePendingCompaction {
+					lsm.maybeStartCompactions()
+				}
+			}
+			lsm.stallStats.StalledWriters++
+			lsm.backgroundWork.Wait()
+			lsm.stallStats.StalledWriters--
+			continue
+		}
+
+		if !delayed && WRITE_SLOWDOWN_DELAY > 0 && lsm.writeSlowdownCauseUnsafe() != "" {
+			// Give up the lock while sleeping so reads and background work are not held up
+			delayed = true
+			lsm.stallStats.DelayedWrites++
+			lsm.stallStats.DelayTime += WRITE_SLOWDOWN_DELAY
+			lsm.mu.Unlock()
+			time.Sleep(WRITE_SLOWDOWN_DELAY)
+			lsm.mu.Lock()
+			continue
+		}
+		break
+	}
+	if !stopStart.IsZero() {
+		lsm.stallStats.StopTime += time.Since(stopStart)
+	}
+	return nil
+}
+
+// tableSizeUnsafe returns the size of an SSTable on disk, remembering it since tables never change; must be called with lsm.mu held.
+func (lsm *LSM) tableSizeUnsafe(index uint64) int64 {
+	if size, ok := lsm.tableSizes[index]; ok {
+		return size
+	}
+	size, err := sstable.Size(int(index))
+	if err != nil {
+		// Leave it out of the estimate and try again on the next refresh
+		return 0
+	}
+	lsm.tableSizes[index] = size
+	return size
+}
+
+/*
+refreshPendingCompactionBytesUnsafe re-estimates how many bytes compaction has to rewrite: the sizes of all
+tables in the levels that exceed MAX_TABLES_PER_LEVEL and that the configured compaction works on.
+Called whenever the levels change, must be called with lsm.mu held.
+*/
+func (lsm *LSM) refreshPendingCompactionBytesUnsafe() {
+	compactedLevels := len(lsm.levels)
+	switch COMPACTION_TYPE {
+	case "size":
+	case "level", "leveled":
+		// Leveled compaction never compacts the last level
+		compactedLevels--
+	default:
+		compactedLevels = 0
+	}
+
+	pending := int64(0)
+	for lvl := 0; lvl < compactedLevels; lvl++ {
+		if uint64(len(lsm.levels[lvl])) <= MAX_TABLES_PER_LEVEL {
+			continue
+		}
+		for _, index := range lsm.levels[lvl] {
+			pending += lsm.tableSizeUnsafe(index)
+		}
+	}
+	lsm.pendingCompactionBytes = pending
+}
+
+// compactionCommittedUnsafe updates the stall state after a compaction replaced the given tables; must be called with lsm.mu held.
+func (lsm *LSM) compactionCommittedUnsafe(replaced []int) {
+	for _, index := range replaced {
+		delete(lsm.tableSizes, uint64(index))
+	}
+	lsm.refreshPendingCompactionBytesUnsafe()
+	// Wake writers stopped on level 0 or on pending compaction bytes
+	lsm.backgroundWork.Broadcast()
+}
+
+// WriteStallStats returns the current write backpressure and its history.
+func (lsm *LSM) WriteStallStats() WriteStallStats {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	stats := lsm.stallStats
+	stats.StopsByCause = make(map[string]uint64, len(lsm.stallStats.StopsByCause))
+	for cause, count := range lsm.stallStats.StopsByCause {
+		stats.StopsByCause[cause] = count
+	}
+	stats.Level0Tables = len(lsm.levels[0])
+	stats.PendingFlushBytes = lsm.pendingFlushBytesUnsafe()
+	stats.PendingCompactionBytes = lsm.pendingCompactionBytes
+
+	stats.Condition = WriteConditionNormal
+	if lsm.memtable != nil {
+		if cause := lsm.writeStopCauseUnsafe(); cause != "" {
+			stats.Condition, stats.Cause = WriteConditionStopped, cause
+		} else if cause := lsm.writeSlowdownCauseUnsafe(); cause != "" && WRITE_SLOWDOWN_DELAY > 0 {
+			stats.Condition, stats.Cause = WriteConditionDelayed, cause
+		}
+	}
+	return stats
+}
@@ -14,7 +14,10 @@ var assets embed.FS
 
 func main() {
 	// Create the application (this will handle LSM loading internally)
-	app := NewApp()
+	app, err := NewApp()
+	if err != nil {
+		log.Fatal("Failed to load LSM:", err)
+	}
 
 	// Log data loss status
 	if app.IsDataLost() {
@@ -24,7 +27,7 @@ func main() {
 	}
 
 	// Run the Wails applicationl
-	err := wails.Run(&options.App{
+	err = wails.Run(&options.App{
 		Title:     "HundDB",
 		Width:     800,
 		Height:    600,
@@ -4,6 +4,9 @@ import (
 	"encoding/binary"
 	"hunddb/lsm/block_manager"
 	"hunddb/utils/config"
+	crc_util "hunddb/utils/crc"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -76,8 +79,12 @@ func deserialize(data []byte) *TokenBucket {
 }
 
 // Save to disk through BlockManager
+// The data is framed into a CRC-protected block, so it is encrypted at rest like every other block.
 func (tb *TokenBucket) SaveToDisk() error {
-	serializedData := tb.serialize()
+	if err := os.MkdirAll(filepath.Dir(FILEPATH), 0755); err != nil {
+		return err
+	}
+	serializedData := crc_util.AddCRCsToData(tb.serialize())
 	return tb.BlockManager.WriteToDisk(serializedData, FILEPATH, 0)
 }
 
@@ -17,6 +17,22 @@ func createTestTokenBucket(lastReset time.Time, remainingTokens uint16) *TokenBu
 	}
 }
 
+// TestMain runs the tests in a temporary directory, so saved buckets do not end up in the source tree
+func TestMain(m *testing.M) {
+	tmpDir, err := os.MkdirTemp("", "token_bucket_test_")
+	if err != nil {
+		panic(err)
+	}
+	oldDir, _ := os.Getwd()
+	os.Chdir(tmpDir)
+
+	code := m.Run()
+
+	os.Chdir(oldDir)
+	os.RemoveAll(tmpDir)
+	os.Exit(code)
+}
+
 // ==================== SERIALIZE TESTS ====================
 
 func TestSerialize_ValidData(t *testing.T) {
@@ -536,6 +552,24 @@ func TestSaveToDisk_GracefulShutdown(t *testing.T) {
 	t.Log("✅ SaveToDisk completed without error")
 }
 
+// TestSaveToDisk_LoadBack verifies that a saved bucket is restored by NewTokenBucket
+func TestSaveToDisk_LoadBack(t *testing.T) {
+	defer os.Remove("lsm/token_bucket/token_bucket.db")
+	defer block_manager.GetBlockManager().ClearCache()
+
+	tb := createTestTokenBucket(time.Unix(1609459200, 0), 4)
+	if err := tb.SaveToDisk(); err != nil {
+		t.Fatalf("SaveToDisk failed: %v", err)
+	}
+
+	// Read from disk rather than the cache
+	block_manager.GetBlockManager().ClearCache()
+	loaded := NewTokenBucket()
+	if !loaded.LastReset.Equal(tb.LastReset) || loaded.RemainingTokens != 4 {
+		t.Errorf("Expected bucket (%v, 4), got (%v, %d)", tb.LastReset, loaded.LastReset, loaded.RemainingTokens)
+	}
+}
+
 func TestDiskPersistence_FullCycle(t *testing.T) {
 	// Test serialization/deserialization cycle which is the core of disk persistence
 	originalTime := time.Unix(1609459200, 0) // Use Unix precision
@@ -652,6 +686,7 @@ func TestDiskIO_ErrorHandling(t *testing.T) {
 
 	// Test recovery from no file
 	os.Remove("lsm/token_bucket/token_bucket.db")
+	block_manager.GetBlockManager().ClearCache()
 	tb2 := NewTokenBucket()
 
 	// Should create default instance
@@ -1,11 +1,13 @@
 package config
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
 )
 
@@ -14,33 +16,85 @@ type DBConfig struct {
 	LSM struct {
 		MaxLevels         uint64 `json:"max_levels"`
 		MaxTablesPerLevel uint64 `json:"max_tables_per_level"`
-		MaxMemtables      uint64 `json:"max_memtables"`
-		CompactionType    string `json:"compaction_type"`
-		LSMPath           string `json:"lsm_path"`
+		// Memtables held in memory, the one taking writes included. Writes stall once the rest are all waiting to be flushed
+		MaxMemtables   uint64 `json:"max_memtables"`
+		CompactionType string `json:"compaction_type"`
+		LSMPath        string `json:"lsm_path"`
+		// Changes a subscriber may fall behind by before its subscription is dropped
+		SubscriptionBufferSize uint64 `json:"subscription_buffer_size"`
+		// Approximate memory budget across all memtables, reaching it flushes early and stalls writes until a flush frees memory. 0 disables it
+		WriteBufferSize uint64 `json:"write_buffer_size"`
+		// Write stalls: past a slowdown threshold each write is delayed by write_slowdown_delay_micros,
+		// past a stop threshold writes wait for flushes and compactions to catch up. 0 disables a threshold
+		Level0SlowdownWritesTrigger    uint64 `json:"level0_slowdown_writes_trigger"`
+		Level0StopWritesTrigger        uint64 `json:"level0_stop_writes_trigger"`
+		PendingFlushSlowdownBytes      uint64 `json:"pending_flush_slowdown_bytes"`
+		PendingFlushStopBytes          uint64 `json:"pending_flush_stop_bytes"`
+		PendingCompactionSlowdownBytes uint64 `json:"pending_compaction_slowdown_bytes"`
+		PendingCompactionStopBytes     uint64 `json:"pending_compaction_stop_bytes"`
+		WriteSlowdownDelayMicros       uint64 `json:"write_slowdown_delay_micros"`
+		// Goroutines flushing memtables to SSTables concurrently
+		FlushWorkers uint64 `json:"flush_workers"`
+		// A failed flush is retried this many times, waiting flush_retry_backoff_millis and doubling it after every attempt.
+		// Once retries run out writes fail until the error is resolved
+		FlushMaxRetries         uint64 `json:"flush_max_retries"`
+		FlushRetryBackoffMillis uint64 `json:"flush_retry_backoff_millis"`
 	} `json:"lsm"`
 
 	Cache struct {
 		ReadPathCapacity uint64 `json:"read_path_capacity"`
+		// SSTables whose parsed config, Bloom filter and key bounds are kept in memory, 0 disables the table cache
+		TableCacheCapacity uint64 `json:"table_cache_capacity"`
 	} `json:"cache"`
 
 	WAL struct {
-		BlockSize uint64 `json:"block_size"`
-		LogSize   uint64 `json:"log_size"`
+		BlockSize          uint64 `json:"block_size"`
+		LogSize            uint64 `json:"log_size"`
+		MaxRecycledLogs    uint64 `json:"max_recycled_logs"`
+		CompressionEnabled bool   `json:"compression_enabled"`
 	} `json:"wal"`
 
 	SSTable struct {
 		CompressionEnabled bool   `json:"compression_enabled"`
 		UseSeparateFiles   bool   `json:"use_separate_files"`
 		SparseStepIndex    uint64 `json:"sparse_step_index"`
+		// Format new SSTables are written in: 1 stores every record on its own, 2 groups them into
+		// prefix-compressed data blocks of data_block_size bytes, storing every block_restart_interval-th key whole
+		FormatVersion        uint8  `json:"format_version"`
+		DataBlockSize        uint64 `json:"data_block_size"`
+		BlockRestartInterval uint64 `json:"block_restart_interval"`
+		// Codec compressing each data block of format 2 tables: "none", "deflate", "gzip" or any codec registered
+		// with block_codec.Register. Unknown names are reported when a table is written
+		BlockCompression string `json:"block_compression"`
+		// Serve reads of finished tables from read-only memory mappings instead of the block cache (Linux only,
+		// other platforms keep reading through the block manager)
+		MmapReads bool `json:"mmap_reads"`
+		// Split the block index and filter of format 2 bottom level tables into partitions of about this many bytes
+		// of index, so a lookup reads only one of each. 0 keeps them whole
+		IndexPartitionSize uint64 `json:"index_partition_size"`
 	} `json:"sstable"`
 
 	Memtable struct {
 		Capacity     uint64 `json:"capacity"`
-		MemtableType string `json:"memtable_type"` // "btree", "skiplist", "hashmap"
+		MemtableType string `json:"memtable_type"`  // "btree", "skiplist", "hashmap", "concurrent_skiplist", "art" or a name passed to memtable.Register
+		MaxSizeBytes uint64 `json:"max_size_bytes"` // Approximate memory budget per memtable, 0 = only capacity counts
+		// Slab size of the per-memtable arena the btree and skiplist copy records into, 0 disables the arena
+		ArenaSlabSize uint64 `json:"arena_slab_size"`
 	} `json:"memtable"`
 
 	BloomFilter struct {
+		// SSTable filters of every level but the bottom one: "bloom", "blocked_bloom", "xor" or a policy registered
+		// with filter_policy.Register. Unknown names are reported when a table is written
+		Policy            string  `json:"policy"`
 		FalsePositiveRate float64 `json:"false_positive_rate"`
+		// SSTable filters of the bottom level, which holds most of the data and is probed by every lookup that misses
+		BottomLevelPolicy            string  `json:"bottom_level_policy"`
+		BottomLevelFalsePositiveRate float64 `json:"bottom_level_false_positive_rate"`
+		// Key prefixes the filters of new tables hold for prefix scans: "fixed" (the first prefix_length bytes),
+		// "delimiter" (up to and including prefix_delimiter) or "none"
+		PrefixExtractor string `json:"prefix_extractor"`
+		PrefixLength    uint64 `json:"prefix_length"`
+		PrefixDelimiter string `json:"prefix_delimiter"`
 	} `json:"bloom_filter"`
 
 	BlockManager struct {
@@ -52,6 +106,12 @@ type DBConfig struct {
 		Size uint64 `json:"size"`
 	} `json:"crc"`
 
+	Encryption struct {
+		Enabled     bool              `json:"enabled"`
+		ActiveKeyID uint32            `json:"active_key_id"` // Key used for new writes
+		Keys        map[string]string `json:"keys"`          // Key ID -> hex-encoded AES key (16, 24 or 32 bytes)
+	} `json:"encryption"`
+
 	TokenBucket struct {
 		Capacity       uint16 `json:"capacity"`
 		RefillInterval uint   `json:"refill_interval"`
@@ -94,14 +154,14 @@ func loadConfig() *DBConfig {
 		return getDefaultConfig()
 	}
 
-	// Parse JSON
-	var config DBConfig
-	if err := json.Unmarshal(data, &config); err != nil {
+	// Parse JSON on top of the defaults, so settings missing from an older file keep their default values
+	config := getDefaultConfig()
+	if err := json.Unmarshal(data, config); err != nil {
 		fmt.Printf("Warning: Failed to parse config file, using defaults: %v\n", err)
 		return getDefaultConfig()
 	}
 
-	return &config
+	return config
 }
 
 // getDefaultConfig returns default configuration values
@@ -114,24 +174,53 @@ func getDefaultConfig() *DBConfig {
 	config.LSM.MaxMemtables = 4
 	config.LSM.CompactionType = "size"
 	config.LSM.LSMPath = "lsm.db"
+	config.LSM.SubscriptionBufferSize = 1024
+	config.LSM.WriteBufferSize = 16 * 1024 * 1024
+	config.LSM.Level0SlowdownWritesTrigger = 8
+	config.LSM.Level0StopWritesTrigger = 12
+	config.LSM.PendingFlushSlowdownBytes = 0
+	config.LSM.PendingFlushStopBytes = 0
+	config.LSM.PendingCompactionSlowdownBytes = 1024 * 1024 * 1024
+	config.LSM.PendingCompactionStopBytes = 4 * 1024 * 1024 * 1024
+	config.LSM.WriteSlowdownDelayMicros = 1000
+	config.LSM.FlushWorkers = 4
+	config.LSM.FlushMaxRetries = 3
+	config.LSM.FlushRetryBackoffMillis = 100
 
 	// Cache defaults
 	config.Cache.ReadPathCapacity = 1000
+	config.Cache.TableCacheCapacity = 256
 
 	// WAL defaults
 	config.WAL.LogSize = 16
+	config.WAL.MaxRecycledLogs = 4
+	config.WAL.CompressionEnabled = false
 
 	// SSTable defaults
 	config.SSTable.CompressionEnabled = true
 	config.SSTable.UseSeparateFiles = true
 	config.SSTable.SparseStepIndex = 10
+	config.SSTable.FormatVersion = 2
+	config.SSTable.DataBlockSize = 4096
+	config.SSTable.BlockRestartInterval = 16
+	config.SSTable.BlockCompression = "none"
+	config.SSTable.MmapReads = false
+	config.SSTable.IndexPartitionSize = 0
 
 	// Memtable defaults
 	config.Memtable.Capacity = 1000
-	config.Memtable.MemtableType = "btree" // btree, skiplist, hashmap
+	config.Memtable.MemtableType = "btree" // btree, skiplist, hashmap, concurrent_skiplist, art
+	config.Memtable.MaxSizeBytes = 4 * 1024 * 1024
+	config.Memtable.ArenaSlabSize = 256 * 1024
 
 	// BloomFilter defaults
+	config.BloomFilter.Policy = "blocked_bloom"
 	config.BloomFilter.FalsePositiveRate = 0.01 // 1%
+	config.BloomFilter.BottomLevelPolicy = "xor"
+	config.BloomFilter.BottomLevelFalsePositiveRate = 0.001
+	config.BloomFilter.PrefixExtractor = "delimiter" // One prefix per key, "user:" for "user:42:name"
+	config.BloomFilter.PrefixLength = 10
+	config.BloomFilter.PrefixDelimiter = ":"
 
 	// BlockManager defaults
 	config.BlockManager.BlockSize = 4096 // 4KB
@@ -140,6 +229,11 @@ func getDefaultConfig() *DBConfig {
 	// CRC defaults
 	config.CRC.Size = 4
 
+	// Encryption defaults - disabled, keys have to be supplied by the user
+	config.Encryption.Enabled = false
+	config.Encryption.ActiveKeyID = 1
+	config.Encryption.Keys = map[string]string{}
+
 	// TokenBucket defaults
 	config.TokenBucket.Capacity = 10
 	config.TokenBucket.RefillInterval = 20
@@ -207,6 +301,28 @@ func validateConfig(config *DBConfig) error {
 	if config.LSM.LSMPath == "" {
 		return fmt.Errorf("lsm_path cannot be empty")
 	}
+	if config.LSM.SubscriptionBufferSize < 1 {
+		return fmt.Errorf("subscription_buffer_size must be at least 1")
+	}
+	// A stop that compaction can't lift would block writes for good
+	if config.LSM.Level0StopWritesTrigger > 0 && config.LSM.Level0StopWritesTrigger <= config.LSM.MaxTablesPerLevel {
+		return fmt.Errorf("level0_stop_writes_trigger must be greater than max_tables_per_level")
+	}
+	if config.LSM.Level0SlowdownWritesTrigger > 0 && config.LSM.Level0StopWritesTrigger > 0 &&
+		config.LSM.Level0SlowdownWritesTrigger > config.LSM.Level0StopWritesTrigger {
+		return fmt.Errorf("level0_slowdown_writes_trigger must not exceed level0_stop_writes_trigger")
+	}
+	if config.LSM.PendingFlushSlowdownBytes > 0 && config.LSM.PendingFlushStopBytes > 0 &&
+		config.LSM.PendingFlushSlowdownBytes > config.LSM.PendingFlushStopBytes {
+		return fmt.Errorf("pending_flush_slowdown_bytes must not exceed pending_flush_stop_bytes")
+	}
+	if config.LSM.PendingCompactionSlowdownBytes > 0 && config.LSM.PendingCompactionStopBytes > 0 &&
+		config.LSM.PendingCompactionSlowdownBytes > config.LSM.PendingCompactionStopBytes {
+		return fmt.Errorf("pending_compaction_slowdown_bytes must not exceed pending_compaction_stop_bytes")
+	}
+	if config.LSM.FlushWorkers < 1 {
+		return fmt.Errorf("flush_workers must be at least 1")
+	}
 	if config.WAL.LogSize < 1 {
 		return fmt.Errorf("wal_log_size must be at least 1")
 	}
@@ -215,27 +331,57 @@ func validateConfig(config *DBConfig) error {
 	if config.SSTable.SparseStepIndex < 1 {
 		return fmt.Errorf("sparse_step_index must be at least 1")
 	}
+	if config.SSTable.FormatVersion < 1 || config.SSTable.FormatVersion > 2 {
+		return fmt.Errorf("format_version must be 1 or 2")
+	}
+	if config.SSTable.DataBlockSize < 64 {
+		return fmt.Errorf("data_block_size must be at least 64")
+	}
+	if config.SSTable.BlockRestartInterval < 1 {
+		return fmt.Errorf("block_restart_interval must be at least 1")
+	}
+	if config.SSTable.IndexPartitionSize > 0 && config.SSTable.IndexPartitionSize < 64 {
+		return fmt.Errorf("index_partition_size must be 0 or at least 64")
+	}
+	if config.SSTable.BlockCompression == "" {
+		return fmt.Errorf("block_compression must be set, use \"none\" to store blocks uncompressed")
+	}
+	if config.SSTable.BlockCompression != "none" && config.SSTable.FormatVersion < 2 {
+		return fmt.Errorf("block_compression requires format_version 2")
+	}
 
 	// Memtable validation
 	if config.Memtable.Capacity < 1 {
 		return fmt.Errorf("memtable_capacity must be at least 1")
 	}
-	memtableTypes := []string{"btree", "skiplist", "hashmap"}
-	validType := false
-	for _, t := range memtableTypes {
-		if config.Memtable.MemtableType == t {
-			validType = true
-			break
-		}
-	}
-	if !validType {
-		return fmt.Errorf("memtable_type must be one of: btree, skiplist, hashmap")
+	// Any name registered with memtable.Register is accepted, LoadLSM reports names no implementation registered
+	if config.Memtable.MemtableType == "" {
+		return fmt.Errorf("memtable_type must not be empty")
 	}
 
 	// BloomFilter validation
 	if config.BloomFilter.FalsePositiveRate <= 0 || config.BloomFilter.FalsePositiveRate >= 1 {
 		return fmt.Errorf("false_positive_rate must be between 0 and 1")
 	}
+	if config.BloomFilter.BottomLevelFalsePositiveRate <= 0 || config.BloomFilter.BottomLevelFalsePositiveRate >= 1 {
+		return fmt.Errorf("bottom_level_false_positive_rate must be between 0 and 1")
+	}
+	if config.BloomFilter.Policy == "" || config.BloomFilter.BottomLevelPolicy == "" {
+		return fmt.Errorf("policy and bottom_level_policy must not be empty")
+	}
+	switch config.BloomFilter.PrefixExtractor {
+	case "fixed":
+		if config.BloomFilter.PrefixLength < 1 {
+			return fmt.Errorf("prefix_length must be at least 1")
+		}
+	case "delimiter":
+		if len(config.BloomFilter.PrefixDelimiter) != 1 {
+			return fmt.Errorf("prefix_delimiter must be a single byte")
+		}
+	case "none":
+	default:
+		return fmt.Errorf("prefix_extractor must be fixed, delimiter or none")
+	}
 
 	// BlockManager validation
 	if config.BlockManager.BlockSize < 1024 {
@@ -247,5 +393,24 @@ func validateConfig(config *DBConfig) error {
 		return fmt.Errorf("crc_size must be at least 1")
 	}
 
+	// Encryption validation
+	if config.Encryption.Enabled {
+		if _, exists := config.Encryption.Keys[fmt.Sprintf("%d", config.Encryption.ActiveKeyID)]; config.Encryption.ActiveKeyID == 0 || !exists {
+			return fmt.Errorf("active_key_id must be a non-zero ID present in keys")
+		}
+		for id, hexKey := range config.Encryption.Keys {
+			if keyID, err := strconv.ParseUint(id, 10, 32); err != nil || keyID == 0 {
+				return fmt.Errorf("encryption key ID %q must be a non-zero 32-bit number", id)
+			}
+			key, err := hex.DecodeString(hexKey)
+			if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+				return fmt.Errorf("encryption key %s must be 16, 24 or 32 bytes, hex-encoded", id)
+			}
+		}
+		if config.SSTable.MmapReads {
+			return fmt.Errorf("mmap_reads can't be used with encryption, mapped blocks would still be encrypted")
+		}
+	}
+
 	return nil
 }
@@ -69,6 +69,93 @@ func TestValidateConfig(t *testing.T) {
 		t.Error("Expected validation error for MaxLevels = 0")
 	}
 
+	noFlushWorkers := getDefaultConfig()
+	noFlushWorkers.LSM.FlushWorkers = 0
+	if err := validateConfig(noFlushWorkers); err == nil {
+		t.Error("Expected validation error for FlushWorkers = 0")
+	}
+
+	unknownFormat := getDefaultConfig()
+	unknownFormat.SSTable.FormatVersion = 3
+	if err := validateConfig(unknownFormat); err == nil {
+		t.Error("Expected validation error for FormatVersion = 3")
+	}
+
+	compressedRecords := getDefaultConfig()
+	compressedRecords.SSTable.FormatVersion = 1
+	compressedRecords.SSTable.BlockCompression = "deflate"
+	if err := validateConfig(compressedRecords); err == nil {
+		t.Error("Expected validation error for block compression without data blocks")
+	}
+
+	tinyPartitions := getDefaultConfig()
+	tinyPartitions.SSTable.IndexPartitionSize = 16
+	if err := validateConfig(tinyPartitions); err == nil {
+		t.Error("Expected validation error for index partitions smaller than 64 bytes")
+	}
+
+	mappedEncrypted := getDefaultConfig()
+	mappedEncrypted.SSTable.MmapReads = true
+	mappedEncrypted.Encryption.Enabled = true
+	mappedEncrypted.Encryption.Keys = map[string]string{"1": "000102030405060708090a0b0c0d0e0f"}
+	if err := validateConfig(mappedEncrypted); err == nil {
+		t.Error("Expected validation error for mmap reads with encryption")
+	}
+
+	badKeys := []map[string]string{
+		{"1": "000102030405060708090a0b0c0d0e0f", "2": "not hex"},
+		{"1": "000102030405060708090a0b0c0d0e0f", "2": "0001020304"},
+		{"1": "000102030405060708090a0b0c0d0e0f", "old": "000102030405060708090a0b0c0d0e0f"},
+		{"1": "000102030405060708090a0b0c0d0e0f", "0": "000102030405060708090a0b0c0d0e0f"},
+	}
+	for _, keys := range badKeys {
+		invalidKeys := getDefaultConfig()
+		invalidKeys.Encryption.Enabled = true
+		invalidKeys.Encryption.Keys = keys
+		if err := validateConfig(invalidKeys); err == nil {
+			t.Errorf("Expected validation error for encryption keys %v", keys)
+		}
+	}
+
+	validKeys := getDefaultConfig()
+	validKeys.Encryption.Enabled = true
+	validKeys.Encryption.Keys = map[string]string{"1": "000102030405060708090a0b0c0d0e0f", "2": "000102030405060708090a0b0c0d0e0f1011121314151617"}
+	if err := validateConfig(validKeys); err != nil {
+		t.Errorf("Expected valid encryption keys to pass validation, got %v", err)
+	}
+
+	noBottomFilter := getDefaultConfig()
+	noBottomFilter.BloomFilter.BottomLevelPolicy = ""
+	if err := validateConfig(noBottomFilter); err == nil {
+		t.Error("Expected validation error for an empty bottom level filter policy")
+	}
+
+	looseBottomFilter := getDefaultConfig()
+	looseBottomFilter.BloomFilter.BottomLevelFalsePositiveRate = 1
+	if err := validateConfig(looseBottomFilter); err == nil {
+		t.Error("Expected validation error for a bottom level false positive rate of 1")
+	}
+
+	cappedPrefixes := getDefaultConfig()
+	cappedPrefixes.BloomFilter.PrefixExtractor = "capped"
+	if err := validateConfig(cappedPrefixes); err == nil {
+		t.Error("Expected validation error for the capped prefix extractor only legacy tables use")
+	}
+
+	longDelimiter := getDefaultConfig()
+	longDelimiter.BloomFilter.PrefixExtractor = "delimiter"
+	longDelimiter.BloomFilter.PrefixDelimiter = "::"
+	if err := validateConfig(longDelimiter); err == nil {
+		t.Error("Expected validation error for a prefix delimiter longer than a byte")
+	}
+
+	noPrefixLength := getDefaultConfig()
+	noPrefixLength.BloomFilter.PrefixExtractor = "fixed"
+	noPrefixLength.BloomFilter.PrefixLength = 0
+	if err := validateConfig(noPrefixLength); err == nil {
+		t.Error("Expected validation error for a fixed prefix of length 0")
+	}
+
 	// Test valid config
 	validConfig := getDefaultConfig()
 	err = validateConfig(validConfig)
@@ -76,3 +163,27 @@ func TestValidateConfig(t *testing.T) {
 		t.Errorf("Expected valid config to pass validation, got error: %v", err)
 	}
 }
+
+func TestValidateConfig_WriteStallTriggers(t *testing.T) {
+	// A level 0 stop that compaction never lifts would block writes for good
+	unreachable := getDefaultConfig()
+	unreachable.LSM.Level0StopWritesTrigger = unreachable.LSM.MaxTablesPerLevel
+	if err := validateConfig(unreachable); err == nil {
+		t.Error("Expected validation error for level0_stop_writes_trigger <= max_tables_per_level")
+	}
+
+	inverted := getDefaultConfig()
+	inverted.LSM.PendingFlushSlowdownBytes = 2048
+	inverted.LSM.PendingFlushStopBytes = 1024
+	if err := validateConfig(inverted); err == nil {
+		t.Error("Expected validation error for a slowdown threshold above the stop threshold")
+	}
+
+	disabled := getDefaultConfig()
+	disabled.LSM.Level0SlowdownWritesTrigger = 0
+	disabled.LSM.Level0StopWritesTrigger = 0
+	disabled.LSM.PendingCompactionStopBytes = 0
+	if err := validateConfig(disabled); err != nil {
+		t.Errorf("Expected disabled thresholds to pass validation, got error: %v", err)
+	}
+}
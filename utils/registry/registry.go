@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Entry is an implementation selectable by name in the config and identified by its ID on disk.
+type Entry interface {
+	ID() uint8
+	Name() string
+}
+
+/*
+Registry holds the implementations of a pluggable SSTable component by ID and by name.
+It is safe for concurrent use, create it with New.
+*/
+type Registry[T Entry] struct {
+	pkg    string // Package owning the registry, prefixes panics
+	kind   string // What the entries are, used in errors
+	mu     sync.RWMutex
+	byID   map[uint8]T
+	byName map[string]T
+}
+
+// New creates an empty registry for the given package, kind names the entries in errors (e.g. "filter policy").
+func New[T Entry](pkg string, kind string) *Registry[T] {
+	return &Registry[T]{
+		pkg:    pkg,
+		kind:   kind,
+		byID:   make(map[uint8]T),
+		byName: make(map[string]T),
+	}
+}
+
+// Register adds the entry, and panics if it is nil, its name is empty, or its ID or name are already registered.
+func (registry *Registry[T]) Register(entry T) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if any(entry) == nil {
+		panic(fmt.Sprintf("%s: Register %s is nil", registry.pkg, registry.kind))
+	}
+	if entry.Name() == "" {
+		panic(registry.pkg + ": Register with empty name")
+	}
+	if _, exists := registry.byID[entry.ID()]; exists {
+		panic(fmt.Sprintf("%s: Register called twice for ID %d", registry.pkg, entry.ID()))
+	}
+	if _, exists := registry.byName[entry.Name()]; exists {
+		panic(registry.pkg + ": Register called twice for " + entry.Name())
+	}
+	registry.byID[entry.ID()] = entry
+	registry.byName[entry.Name()] = entry
+}
+
+// Unregister removes the entry again, so tests can clean up what they registered.
+func (registry *Registry[T]) Unregister(entry T) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.byID, entry.ID())
+	delete(registry.byName, entry.Name())
+}
+
+// ByID returns the entry with the given ID.
+func (registry *Registry[T]) ByID(id uint8) (T, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	entry, ok := registry.byID[id]
+	if !ok {
+		return entry, fmt.Errorf("unknown %s ID %d", registry.kind, id)
+	}
+	return entry, nil
+}
+
+// ByName returns the entry with the given name, the error lists the registered names.
+func (registry *Registry[T]) ByName(name string) (T, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	entry, ok := registry.byName[name]
+	if !ok {
+		return entry, fmt.Errorf("unknown %s %q, registered: %v", registry.kind, name, registry.namesUnsafe())
+	}
+	return entry, nil
+}
+
+// Names returns the names of all registered entries, sorted.
+func (registry *Registry[T]) Names() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return registry.namesUnsafe()
+}
+
+func (registry *Registry[T]) namesUnsafe() []string {
+	names := make([]string, 0, len(registry.byName))
+	for name := range registry.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,58 @@
+package registry
+
+import "testing"
+
+type testEntry struct {
+	id   uint8
+	name string
+}
+
+func (entry *testEntry) ID() uint8    { return entry.id }
+func (entry *testEntry) Name() string { return entry.name }
+
+func TestRegistry_RegisterPanics(t *testing.T) {
+	registry := New[Entry]("test", "test entry")
+	registry.Register(&testEntry{1, "one"})
+
+	cases := map[string]Entry{
+		"nil":            nil,
+		"empty name":     &testEntry{2, ""},
+		"duplicate ID":   &testEntry{1, "other"},
+		"duplicate name": &testEntry{2, "one"},
+	}
+	for name, entry := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if message, ok := recover().(string); !ok || message == "" {
+					t.Errorf("expected Register to panic with a message, got %v", message)
+				}
+			}()
+			registry.Register(entry)
+		})
+	}
+	if names := registry.Names(); len(names) != 1 || names[0] != "one" {
+		t.Errorf("Names() = %v, want [one]", names)
+	}
+}
+
+func TestRegistry_Lookup(t *testing.T) {
+	registry := New[Entry]("test", "test entry")
+	one := &testEntry{1, "one"}
+	registry.Register(one)
+
+	if entry, err := registry.ByID(1); err != nil || entry != one {
+		t.Errorf("ByID(1) = %v, %v", entry, err)
+	}
+	if entry, err := registry.ByName("one"); err != nil || entry != one {
+		t.Errorf("ByName(one) = %v, %v", entry, err)
+	}
+	if _, err := registry.ByName("two"); err == nil || err.Error() != `unknown test entry "two", registered: [one]` {
+		t.Errorf("ByName(two) error = %v", err)
+	}
+
+	registry.Unregister(one)
+	if _, err := registry.ByID(1); err == nil {
+		t.Error("expected an unregistered ID to be reported")
+	}
+	registry.Register(one)
+}